@@ -577,13 +577,14 @@ func (md *BareRootMetadataV2) IsValidAndSigned(
 	// Make sure the last writer is valid.
 	writer := md.LastModifyingWriter()
 	if !handle.IsWriter(writer) {
-		return fmt.Errorf("Invalid modifying writer %s", writer)
+		return InvalidLastModifyingWriterError{writer}
 	}
 
-	// Make sure the last modifier is valid.
+	// Make sure the last modifier is valid. IsReader is true for
+	// writers too.
 	user := md.LastModifyingUser
 	if !handle.IsReader(user) {
-		return fmt.Errorf("Invalid modifying user %s", user)
+		return InvalidLastModifyingUserError{user}
 	}
 
 	// Verify signature. We have to re-marshal the WriterMetadata,
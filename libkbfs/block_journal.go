@@ -382,6 +382,17 @@ func (j *blockJournal) getDataWithContext(
 	return j.getData(id)
 }
 
+// getContexts returns the contexts of all the references to the
+// given block, live or archived.
+func (j *blockJournal) getContexts(id BlockID) []BlockContext {
+	refs := j.refs[id]
+	contexts := make([]BlockContext, 0, len(refs))
+	for _, refEntry := range refs {
+		contexts = append(contexts, refEntry.Context)
+	}
+	return contexts
+}
+
 func (j *blockJournal) getAll() (
 	map[BlockID]map[BlockRefNonce]blockRefLocalStatus, error) {
 	if j.isShutdown {
@@ -35,12 +35,22 @@ func (b *BlockOpsStandard) Get(ctx context.Context, kmd KeyMetadata,
 		return err
 	}
 
-	crypto := b.config.Crypto()
+	return assembleBlock(
+		ctx, b.config, kmd, blockPtr, block, buf, blockServerHalf)
+}
+
+// assembleBlock checks that buf, which was fetched for blockPtr along
+// with blockServerHalf, matches blockPtr's ID, and then decrypts and
+// decodes it into block.
+func assembleBlock(ctx context.Context, config Config, kmd KeyMetadata,
+	blockPtr BlockPointer, block Block, buf []byte,
+	blockServerHalf BlockCryptKeyServerHalf) error {
+	crypto := config.Crypto()
 	if err := crypto.VerifyBlockID(buf, blockPtr.ID); err != nil {
 		return err
 	}
 
-	tlfCryptKey, err := b.config.KeyManager().
+	tlfCryptKey, err := config.KeyManager().
 		GetTLFCryptKeyForBlockDecryption(ctx, kmd, blockPtr)
 	if err != nil {
 		return err
@@ -54,7 +64,7 @@ func (b *BlockOpsStandard) Get(ctx context.Context, kmd KeyMetadata,
 	}
 
 	var encryptedBlock EncryptedBlock
-	err = b.config.Codec().Decode(buf, &encryptedBlock)
+	err = config.Codec().Decode(buf, &encryptedBlock)
 	if err != nil {
 		return err
 	}
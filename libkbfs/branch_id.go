@@ -5,9 +5,11 @@
 package libkbfs
 
 import (
+	"bytes"
 	"encoding"
 	"encoding/hex"
 	"errors"
+	"sort"
 )
 
 const (
@@ -71,3 +73,17 @@ func ParseBranchID(s string) (BranchID, error) {
 	}
 	return id, nil
 }
+
+type branchIDSlice []BranchID
+
+func (s branchIDSlice) Len() int { return len(s) }
+func (s branchIDSlice) Less(i, j int) bool {
+	return bytes.Compare(s[i].id[:], s[j].id[:]) < 0
+}
+func (s branchIDSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// sortBranchIDs sorts the given branch IDs by their bytes, so that
+// lists of branches can be compared.
+func sortBranchIDs(bids []BranchID) {
+	sort.Sort(branchIDSlice(bids))
+}
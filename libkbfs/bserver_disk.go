@@ -8,10 +8,12 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"sync"
 
+	"github.com/hashicorp/golang-lru/simplelru"
 	"github.com/keybase/client/go/logger"
 	"golang.org/x/net/context"
 )
@@ -21,6 +23,12 @@ type blockServerDiskTlfStorage struct {
 	journal *blockJournal
 }
 
+// blockServerDiskKey identifies a block stored by a BlockServerDisk.
+type blockServerDiskKey struct {
+	tlfID TlfID
+	id    BlockID
+}
+
 // BlockServerDisk implements the BlockServer interface by just
 // storing blocks in a local leveldb instance.
 type BlockServerDisk struct {
@@ -33,22 +41,46 @@ type BlockServerDisk struct {
 	tlfStorageLock sync.RWMutex
 	// tlfStorage is nil after Shutdown() is called.
 	tlfStorage map[TlfID]*blockServerDiskTlfStorage
+
+	// maxBytes is the total size of block data above which the
+	// least-recently-accessed unpinned blocks are evicted. It is
+	// 0 if there is no limit.
+	maxBytes uint64
+
+	// evictLock protects the fields below. It must be taken
+	// before any tlfStorage lock.
+	evictLock sync.Mutex
+	// lru maps a blockServerDiskKey to the size of its data, for
+	// all blocks put through this server, ordered by access.
+	lru        *simplelru.LRU
+	totalBytes uint64
+	pins       map[blockServerDiskKey]int
 }
 
 var _ blockServerLocal = (*BlockServerDisk)(nil)
 
 // newBlockServerDisk constructs a new BlockServerDisk that stores
-// its data in the given directory.
+// its data in the given directory, evicting blocks once their total
+// size exceeds maxBytes (if non-zero).
 func newBlockServerDisk(
-	config Config, dirPath string, shutdownFunc func(logger.Logger)) *BlockServerDisk {
+	config Config, dirPath string, shutdownFunc func(logger.Logger),
+	maxBytes uint64) *BlockServerDisk {
+	// The LRU is bounded by bytes, not by entry count.
+	lru, err := simplelru.NewLRU(math.MaxInt32, nil)
+	if err != nil {
+		// This should never happen.
+		panic(err)
+	}
 	bserv := &BlockServerDisk{
-		config.Codec(),
-		config.Crypto(),
-		config.MakeLogger("BSD"),
-		dirPath,
-		shutdownFunc,
-		sync.RWMutex{},
-		make(map[TlfID]*blockServerDiskTlfStorage),
+		codec:        config.Codec(),
+		crypto:       config.Crypto(),
+		log:          config.MakeLogger("BSD"),
+		dirPath:      dirPath,
+		shutdownFunc: shutdownFunc,
+		tlfStorage:   make(map[TlfID]*blockServerDiskTlfStorage),
+		maxBytes:     maxBytes,
+		lru:          lru,
+		pins:         make(map[blockServerDiskKey]int),
 	}
 	return bserv
 }
@@ -56,12 +88,21 @@ func newBlockServerDisk(
 // NewBlockServerDir constructs a new BlockServerDisk that stores
 // its data in the given directory.
 func NewBlockServerDir(config Config, dirPath string) *BlockServerDisk {
-	return newBlockServerDisk(config, dirPath, nil)
+	return newBlockServerDisk(config, dirPath, nil, 0)
 }
 
 // NewBlockServerTempDir constructs a new BlockServerDisk that stores its
 // data in a temp directory which is cleaned up on shutdown.
 func NewBlockServerTempDir(config Config) (*BlockServerDisk, error) {
+	return NewBlockServerTempDirWithMaxBytes(config, 0)
+}
+
+// NewBlockServerTempDirWithMaxBytes is like NewBlockServerTempDir,
+// except that once the blocks it stores take up more than maxBytes
+// in total, it evicts the least-recently-accessed ones that aren't
+// pinned (see Pin). A maxBytes of 0 means there is no limit.
+func NewBlockServerTempDirWithMaxBytes(
+	config Config, maxBytes uint64) (*BlockServerDisk, error) {
 	tempdir, err := ioutil.TempDir(os.TempDir(), "kbfs_bserver_tmp")
 	if err != nil {
 		return nil, err
@@ -71,7 +112,7 @@ func NewBlockServerTempDir(config Config) (*BlockServerDisk, error) {
 		if err != nil {
 			log.Warning("error removing %s: %s", tempdir, err)
 		}
-	}), nil
+	}, maxBytes), nil
 }
 
 var errBlockServerDiskShutdown = errors.New("BlockServerDisk is shutdown")
@@ -130,13 +171,16 @@ func (b *BlockServerDisk) Get(ctx context.Context, tlfID TlfID, id BlockID,
 		return nil, BlockCryptKeyServerHalf{}, err
 	}
 
-	tlfStorage.lock.RLock()
-	defer tlfStorage.lock.RUnlock()
-	data, keyServerHalf, err := tlfStorage.journal.getDataWithContext(
-		id, context)
+	data, keyServerHalf, err := func() (
+		[]byte, BlockCryptKeyServerHalf, error) {
+		tlfStorage.lock.RLock()
+		defer tlfStorage.lock.RUnlock()
+		return tlfStorage.journal.getDataWithContext(id, context)
+	}()
 	if err != nil {
 		return nil, BlockCryptKeyServerHalf{}, err
 	}
+	b.touch(tlfID, id)
 	return data, keyServerHalf, nil
 }
 
@@ -156,9 +200,17 @@ func (b *BlockServerDisk) Put(ctx context.Context, tlfID TlfID, id BlockID,
 		return err
 	}
 
-	tlfStorage.lock.Lock()
-	defer tlfStorage.lock.Unlock()
-	return tlfStorage.journal.putData(ctx, id, context, buf, serverHalf)
+	err = func() error {
+		tlfStorage.lock.Lock()
+		defer tlfStorage.lock.Unlock()
+		return tlfStorage.journal.putData(
+			ctx, id, context, buf, serverHalf)
+	}()
+	if err != nil {
+		return err
+	}
+	b.added(ctx, tlfID, id, uint64(len(buf)))
+	return nil
 }
 
 // AddBlockReference implements the BlockServer interface for BlockServerDisk.
@@ -171,9 +223,16 @@ func (b *BlockServerDisk) AddBlockReference(ctx context.Context, tlfID TlfID,
 		return err
 	}
 
-	tlfStorage.lock.Lock()
-	defer tlfStorage.lock.Unlock()
-	return tlfStorage.journal.addReference(ctx, id, context)
+	err = func() error {
+		tlfStorage.lock.Lock()
+		defer tlfStorage.lock.Unlock()
+		return tlfStorage.journal.addReference(ctx, id, context)
+	}()
+	if err != nil {
+		return err
+	}
+	b.touch(tlfID, id)
+	return nil
 }
 
 // RemoveBlockReferences implements the BlockServer interface for
@@ -188,9 +247,20 @@ func (b *BlockServerDisk) RemoveBlockReferences(ctx context.Context,
 		return nil, err
 	}
 
-	tlfStorage.lock.Lock()
-	defer tlfStorage.lock.Unlock()
-	return tlfStorage.journal.removeReferences(ctx, contexts, true)
+	liveCounts, err = func() (map[BlockID]int, error) {
+		tlfStorage.lock.Lock()
+		defer tlfStorage.lock.Unlock()
+		return tlfStorage.journal.removeReferences(ctx, contexts, true)
+	}()
+	if err != nil {
+		return nil, err
+	}
+	for id, count := range liveCounts {
+		if count == 0 {
+			b.removed(tlfID, id)
+		}
+	}
+	return liveCounts, nil
 }
 
 // ArchiveBlockReferences implements the BlockServer interface for
@@ -209,6 +279,118 @@ func (b *BlockServerDisk) ArchiveBlockReferences(ctx context.Context,
 	return tlfStorage.journal.archiveReferences(ctx, contexts)
 }
 
+// Pin prevents the given block from being evicted, even if it's the
+// least-recently-accessed one, until a matching call to Unpin. Pins
+// are counted, and a block may be pinned before it's put.
+func (b *BlockServerDisk) Pin(tlfID TlfID, id BlockID) {
+	b.evictLock.Lock()
+	defer b.evictLock.Unlock()
+	b.pins[blockServerDiskKey{tlfID, id}]++
+}
+
+// Unpin undoes a previous call to Pin. The block becomes eligible
+// for eviction again once all its pins have been undone.
+func (b *BlockServerDisk) Unpin(tlfID TlfID, id BlockID) {
+	b.evictLock.Lock()
+	defer b.evictLock.Unlock()
+	key := blockServerDiskKey{tlfID, id}
+	if b.pins[key] <= 1 {
+		delete(b.pins, key)
+		return
+	}
+	b.pins[key]--
+}
+
+// touch marks the given block as the most recently accessed one.
+func (b *BlockServerDisk) touch(tlfID TlfID, id BlockID) {
+	b.evictLock.Lock()
+	defer b.evictLock.Unlock()
+	b.lru.Get(blockServerDiskKey{tlfID, id})
+}
+
+// removed stops tracking the size of the given block, once all its
+// references are gone.
+func (b *BlockServerDisk) removed(tlfID TlfID, id BlockID) {
+	b.evictLock.Lock()
+	defer b.evictLock.Unlock()
+	key := blockServerDiskKey{tlfID, id}
+	if size, ok := b.lru.Peek(key); ok {
+		b.totalBytes -= size.(uint64)
+		b.lru.Remove(key)
+	}
+}
+
+// added records that the given block, with size bytes of data, has
+// been put, and evicts other blocks if that puts the total size over
+// b.maxBytes.
+func (b *BlockServerDisk) added(
+	ctx context.Context, tlfID TlfID, id BlockID, size uint64) {
+	b.evictLock.Lock()
+	defer b.evictLock.Unlock()
+	key := blockServerDiskKey{tlfID, id}
+	if _, ok := b.lru.Get(key); !ok {
+		b.lru.Add(key, size)
+		b.totalBytes += size
+	}
+
+	if b.maxBytes == 0 {
+		return
+	}
+
+	// Keys are ordered from least to most recently accessed.
+	for _, k := range b.lru.Keys() {
+		if b.totalBytes <= b.maxBytes {
+			return
+		}
+		evictKey := k.(blockServerDiskKey)
+		// Never evict the block that was just put, or a
+		// pinned one.
+		if evictKey == key || b.pins[evictKey] > 0 {
+			continue
+		}
+		err := b.evictLocked(ctx, evictKey)
+		if err != nil {
+			b.log.CWarningf(ctx, "Couldn't evict block %s: %v",
+				evictKey.id, err)
+			return
+		}
+	}
+
+	if b.totalBytes > b.maxBytes {
+		b.log.CDebugf(ctx, "Total block size %d still exceeds %d "+
+			"after eviction", b.totalBytes, b.maxBytes)
+	}
+}
+
+// evictLocked removes all references to the given block, along with
+// its data. b.evictLock must be held.
+func (b *BlockServerDisk) evictLocked(
+	ctx context.Context, key blockServerDiskKey) error {
+	b.log.CDebugf(ctx, "Evicting block %s from %s", key.id, key.tlfID)
+	tlfStorage, err := b.getStorage(ctx, key.tlfID)
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		tlfStorage.lock.Lock()
+		defer tlfStorage.lock.Unlock()
+		contexts := tlfStorage.journal.getContexts(key.id)
+		_, err := tlfStorage.journal.removeReferences(
+			ctx, map[BlockID][]BlockContext{key.id: contexts}, true)
+		return err
+	}()
+	if err != nil {
+		return err
+	}
+
+	if size, ok := b.lru.Peek(key); ok {
+		b.totalBytes -= size.(uint64)
+		b.lru.Remove(key)
+	}
+	return nil
+}
+
 // getAll returns all the known block references, and should only be
 // used during testing.
 func (b *BlockServerDisk) getAll(ctx context.Context, tlfID TlfID) (
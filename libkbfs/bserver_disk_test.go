@@ -0,0 +1,114 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/protocol"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestBlockServerDiskMaxBytes(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	crypto := config.Crypto()
+
+	// Allow room for only two 4-byte blocks.
+	b, err := NewBlockServerTempDirWithMaxBytes(config, 10)
+	require.NoError(t, err)
+	defer b.Shutdown()
+
+	ctx := context.Background()
+	tlfID := FakeTlfID(1, false)
+	bCtx := BlockContext{keybase1.MakeTestUID(1), "", zeroBlockRefNonce}
+
+	var ids []BlockID
+	put := func(i byte) {
+		data := []byte{i, i, i, i}
+		id, err := crypto.MakePermanentBlockID(data)
+		require.NoError(t, err)
+		serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+		require.NoError(t, err)
+		err = b.Put(ctx, tlfID, id, bCtx, data, serverHalf)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	requireExists := func(i int, exists bool) {
+		_, _, err := b.Get(ctx, tlfID, ids[i], bCtx)
+		if exists {
+			require.NoError(t, err, "block %d", i)
+		} else {
+			require.IsType(t, BServerErrorBlockNonExistent{}, err,
+				"block %d", i)
+		}
+	}
+
+	// The third block pushes out the first one.
+	put(0)
+	put(1)
+	put(2)
+	requireExists(0, false)
+	requireExists(1, true)
+	requireExists(2, true)
+
+	// A pinned block is skipped over, even if it's the least
+	// recently accessed one.
+	b.Pin(tlfID, ids[1])
+	put(3)
+	requireExists(2, false)
+	requireExists(1, true)
+	requireExists(3, true)
+
+	// Once unpinned, it can be evicted again.
+	b.Unpin(tlfID, ids[1])
+	requireExists(3, true)
+	put(4)
+	requireExists(1, false)
+	requireExists(3, true)
+	requireExists(4, true)
+
+	// Removed blocks no longer count towards the limit.
+	liveCounts, err := b.RemoveBlockReferences(
+		ctx, tlfID, map[BlockID][]BlockContext{ids[3]: {bCtx}})
+	require.NoError(t, err)
+	require.Equal(t, map[BlockID]int{ids[3]: 0}, liveCounts)
+	put(5)
+	requireExists(4, true)
+	requireExists(5, true)
+}
+
+func TestBlockServerDiskUnlimited(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	crypto := config.Crypto()
+
+	b, err := NewBlockServerTempDir(config)
+	require.NoError(t, err)
+	defer b.Shutdown()
+
+	ctx := context.Background()
+	tlfID := FakeTlfID(1, false)
+	bCtx := BlockContext{keybase1.MakeTestUID(1), "", zeroBlockRefNonce}
+
+	var ids []BlockID
+	for i := 0; i < 100; i++ {
+		data := make([]byte, 1024)
+		data[0] = byte(i)
+		id, err := crypto.MakePermanentBlockID(data)
+		require.NoError(t, err)
+		serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+		require.NoError(t, err)
+		err = b.Put(ctx, tlfID, id, bCtx, data, serverHalf)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	for _, id := range ids {
+		_, _, err := b.Get(ctx, tlfID, id, bCtx)
+		require.NoError(t, err)
+	}
+}
@@ -281,6 +281,20 @@ func (e BServerErrorThrottle) ToStatus() (s keybase1.Status) {
 	return
 }
 
+// BServerErrorDisconnected is returned by BlockServerRemote when an
+// RPC fails because the connection to the block server went down,
+// and it either was cut off or timed out waiting for the connection
+// to come back. Unlike most errors, retrying the RPC later may
+// succeed. It's generated locally, so it has no status code.
+type BServerErrorDisconnected struct {
+	Err error
+}
+
+// Error implements the Error interface for BServerErrorDisconnected.
+func (e BServerErrorDisconnected) Error() string {
+	return "BServerErrorDisconnected{" + e.Err.Error() + "}"
+}
+
 type bServerErrorUnwrapper struct{}
 
 var _ rpc.ErrorUnwrapper = bServerErrorUnwrapper{}
@@ -7,6 +7,8 @@ package libkbfs
 import (
 	"encoding/hex"
 	"errors"
+	"io"
+	"net"
 	"time"
 
 	"github.com/cenkalti/backoff"
@@ -29,6 +31,8 @@ const (
 type BlockServerRemote struct {
 	config     Config
 	shutdownFn func()
+	conn       *rpc.Connection
+	transport  *bserverTransport
 	client     keybase1.BlockInterface
 	log        logger.Logger
 	deferLog   logger.Logger
@@ -57,10 +61,14 @@ func NewBlockServerRemote(config Config, blkSrvAddr string, ctx Context) *BlockS
 	bs.authToken = NewAuthToken(config,
 		BServerTokenServer, BServerTokenExpireIn,
 		"libkbfs_bserver_remote", bs)
-	// This will connect only on-demand due to the last argument.
-	conn := rpc.NewTLSConnection(blkSrvAddr, GetRootCerts(blkSrvAddr),
-		bServerErrorUnwrapper{}, bs, false, ctx.NewRPCLogFactory(),
-		libkb.WrapError, config.MakeLogger(""), LogTagsFromContext)
+	bs.transport = newBServerTransport(
+		blkSrvAddr, ctx.NewRPCLogFactory(), bs.OnConnectError)
+	// This will connect only on-demand due to the connectNow
+	// argument.
+	conn := rpc.NewConnectionWithTransport(bs, bs.transport,
+		bServerErrorUnwrapper{}, false, libkb.WrapError,
+		config.MakeLogger(""), LogTagsFromContext)
+	bs.conn = conn
 	bs.client = keybase1.BlockClient{Cli: conn.GetClient()}
 	bs.shutdownFn = conn.Shutdown
 	return bs
@@ -85,6 +93,42 @@ func (b *BlockServerRemote) RemoteAddress() string {
 	return b.blkSrvAddr
 }
 
+// IsConnected returns whether the connection to the block server is
+// currently up. The connection reconnects on its own, with randomized
+// exponential backoff, the next time it's used after going down.
+func (b *BlockServerRemote) IsConnected() bool {
+	return b.conn != nil && b.conn.IsConnected()
+}
+
+// SetMaxReconnectBackoff sets the longest that the connection waits
+// between attempts to reconnect to the block server, which defaults
+// to a minute. It applies from the next time the connection goes
+// down.
+func (b *BlockServerRemote) SetMaxReconnectBackoff(
+	maxBackoff time.Duration) {
+	if b.transport != nil {
+		b.transport.setMaxBackoff(maxBackoff)
+	}
+}
+
+// checkDisconnected turns err, if it's from an RPC that was cut off
+// or timed out while the connection to the block server was down,
+// into a BServerErrorDisconnected, so that callers can tell it apart
+// from a permanent failure.
+func (b *BlockServerRemote) checkDisconnected(err error) error {
+	if err == nil || b.conn == nil || b.conn.IsConnected() {
+		return err
+	}
+	switch err {
+	case context.DeadlineExceeded, io.EOF, io.ErrUnexpectedEOF:
+		return BServerErrorDisconnected{err}
+	}
+	if _, ok := err.(net.Error); ok {
+		return BServerErrorDisconnected{err}
+	}
+	return err
+}
+
 // HandlerName implements the ConnectionHandler interface.
 func (*BlockServerRemote) HandlerName() string {
 	return "BlockServerRemote"
@@ -229,6 +273,7 @@ func (b *BlockServerRemote) Get(ctx context.Context, tlfID TlfID, id BlockID,
 	}
 
 	res, err := b.client.GetBlock(ctx, arg)
+	err = b.checkDisconnected(err)
 	if err != nil {
 		return nil, BlockCryptKeyServerHalf{}, err
 	}
@@ -271,7 +316,8 @@ func (b *BlockServerRemote) Put(ctx context.Context, tlfID TlfID, id BlockID,
 	}
 
 	// Handle OverQuota errors at the caller
-	return b.client.PutBlock(ctx, arg)
+	err = b.checkDisconnected(b.client.PutBlock(ctx, arg))
+	return err
 }
 
 // AddBlockReference implements the BlockServer interface for BlockServerRemote
@@ -291,10 +337,12 @@ func (b *BlockServerRemote) AddBlockReference(ctx context.Context, tlfID TlfID,
 	}()
 
 	// Handle OverQuota errors at the caller
-	return b.client.AddReference(ctx, keybase1.AddReferenceArg{
-		Ref:    makeBlockReference(id, context),
-		Folder: tlfID.String(),
-	})
+	err = b.checkDisconnected(b.client.AddReference(ctx,
+		keybase1.AddReferenceArg{
+			Ref:    makeBlockReference(id, context),
+			Folder: tlfID.String(),
+		}))
+	return err
 }
 
 // RemoveBlockReferences implements the BlockServer interface for
@@ -398,7 +446,7 @@ func (b *BlockServerRemote) batchDowngradeReferences(ctx context.Context,
 				return err
 			}
 			// non-throttle error, do not retry here
-			finalError = err
+			finalError = b.checkDisconnected(err)
 		}
 		return nil
 	}, backoff.NewExponentialBackOff())
@@ -437,6 +485,7 @@ func (b *BlockServerRemote) getNotDone(all map[BlockID][]BlockContext, doneRefs
 // GetUserQuotaInfo implements the BlockServer interface for BlockServerRemote
 func (b *BlockServerRemote) GetUserQuotaInfo(ctx context.Context) (info *UserQuotaInfo, err error) {
 	res, err := b.client.GetUserQuotaInfo(ctx)
+	err = b.checkDisconnected(err)
 	if err != nil {
 		return nil, err
 	}
@@ -7,7 +7,9 @@ package libkbfs
 import (
 	"bytes"
 	"errors"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	keybase1 "github.com/keybase/client/go/protocol"
@@ -275,3 +277,110 @@ func TestBServerRemotePutCanceled(t *testing.T) {
 	}
 	testRPCWithCanceledContext(t, serverConn, f)
 }
+
+// unreachableTransport is an rpc.ConnectionTransport that never
+// manages to connect.
+type unreachableTransport struct{}
+
+func (unreachableTransport) Dial(ctx context.Context) (rpc.Transporter, error) {
+	return nil, errors.New("unreachable")
+}
+
+func (unreachableTransport) IsConnected() bool { return false }
+
+func (unreachableTransport) Finalize() {}
+
+func (unreachableTransport) Close() {}
+
+// An RPC that times out while the server is unreachable should
+// return a BServerErrorDisconnected.
+func TestBServerRemoteDisconnected(t *testing.T) {
+	codec := NewCodecMsgpack()
+	localUsers := MakeLocalUsers([]libkb.NormalizedUsername{"testuser"})
+	currentUID := localUsers[0].UID
+	crypto := &CryptoLocal{CryptoCommon: MakeCryptoCommon(codec)}
+	config := &ConfigLocal{codec: codec, crypto: crypto}
+	setTestLogger(config, t)
+
+	b := newBlockServerRemoteWithClient(config, nil)
+	conn := rpc.NewConnectionWithTransport(b, unreachableTransport{},
+		bServerErrorUnwrapper{}, false, libkb.WrapError,
+		config.MakeLogger(""), LogTagsFromContext)
+	b.conn = conn
+	b.client = keybase1.BlockClient{Cli: conn.GetClient()}
+	b.shutdownFn = conn.Shutdown
+	defer b.Shutdown()
+
+	if b.IsConnected() {
+		t.Fatal("Unexpectedly connected")
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, _, err := b.Get(ctx, FakeTlfID(2, false), fakeBlockID(1),
+		BlockContext{currentUID, "", zeroBlockRefNonce})
+	if _, ok := err.(BServerErrorDisconnected); !ok {
+		t.Errorf("Expected BServerErrorDisconnected, got %v", err)
+	}
+}
+
+// Dialing the block server should retry failed dials, waiting no
+// longer than the configured maximum between them.
+func TestBServerTransportDialBackoff(t *testing.T) {
+	const failures = 10
+	maxBackoff := 20 * time.Millisecond
+	dials := 0
+	var waits []time.Duration
+	transport := &bserverTransport{
+		dial: func(ctx context.Context) (net.Conn, error) {
+			dials++
+			if dials <= failures {
+				return nil, errors.New("unreachable")
+			}
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		},
+		onDialError: func(err error, wait time.Duration) {
+			waits = append(waits, wait)
+		},
+	}
+	transport.setMaxBackoff(maxBackoff)
+
+	_, err := transport.Dial(context.Background())
+	if err != nil {
+		t.Fatalf("Couldn't dial: %v", err)
+	}
+	defer transport.Close()
+	if dials != failures+1 {
+		t.Errorf("Expected %d dials, got %d", failures+1, dials)
+	}
+	if len(waits) != failures {
+		t.Fatalf("Expected %d waits, got %d", failures, len(waits))
+	}
+	for i, wait := range waits {
+		if wait > maxBackoff {
+			t.Errorf("Wait %d is %s, more than %s", i, wait, maxBackoff)
+		}
+	}
+}
+
+// Canceling the context should stop a dial that keeps failing.
+func TestBServerTransportDialCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	transport := &bserverTransport{
+		dial: func(ctx context.Context) (net.Conn, error) {
+			return nil, errors.New("unreachable")
+		},
+		onDialError: func(err error, wait time.Duration) {
+			cancel()
+		},
+	}
+	transport.setMaxBackoff(time.Hour)
+
+	_, err := transport.Dial(ctx)
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
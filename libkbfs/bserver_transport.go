@@ -0,0 +1,152 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/keybase/client/go/libkb"
+	rpc "github.com/keybase/go-framed-msgpack-rpc"
+	"golang.org/x/net/context"
+)
+
+// bserverMaxReconnectBackoffDefault is the default maximum wait
+// between attempts to reconnect to the block server. It's the same
+// as the rpc.Connection default.
+const bserverMaxReconnectBackoffDefault = backoff.DefaultMaxInterval
+
+// bserverTransport is a ConnectionTransport implementation that
+// connects to a block server over TLS. The transport that
+// rpc.NewTLSConnection makes leaves retrying failed dials to the
+// rpc.Connection, whose backoff can't be configured, so instead
+// Dial itself retries until it succeeds or ctx is canceled, with
+// randomized exponential backoff capped at a settable maximum.
+type bserverTransport struct {
+	dial        func(ctx context.Context) (net.Conn, error)
+	logFactory  rpc.LogFactory
+	onDialError func(err error, wait time.Duration)
+
+	// Protects everything below.
+	mutex           sync.Mutex
+	maxBackoff      time.Duration
+	conn            net.Conn
+	transport       rpc.Transporter
+	stagedTransport rpc.Transporter
+}
+
+// Test that bserverTransport fully implements the
+// ConnectionTransport interface.
+var _ rpc.ConnectionTransport = (*bserverTransport)(nil)
+
+// newBServerTransport returns a bserverTransport that connects to
+// the given block server address, and calls onDialError before
+// waiting to retry a failed dial.
+func newBServerTransport(blkSrvAddr string, logFactory rpc.LogFactory,
+	onDialError func(err error, wait time.Duration)) *bserverTransport {
+	rootCerts := GetRootCerts(blkSrvAddr)
+	dial := func(ctx context.Context) (net.Conn, error) {
+		var config *tls.Config
+		if rootCerts != nil {
+			certs := x509.NewCertPool()
+			if !certs.AppendCertsFromPEM(rootCerts) {
+				return nil, errors.New("Unable to load root certificates")
+			}
+			config = &tls.Config{RootCAs: certs}
+		}
+		return tls.DialWithDialer(&net.Dialer{
+			KeepAlive: 10 * time.Second,
+		}, "tcp", blkSrvAddr, config)
+	}
+	return &bserverTransport{
+		dial:        dial,
+		logFactory:  logFactory,
+		onDialError: onDialError,
+		maxBackoff:  bserverMaxReconnectBackoffDefault,
+	}
+}
+
+func (t *bserverTransport) setMaxBackoff(maxBackoff time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.maxBackoff = maxBackoff
+}
+
+// newBackoff returns the backoff to use for one round of dialing.
+// Its interval is capped so that, even with randomization, no wait
+// is longer than t.maxBackoff.
+func (t *bserverTransport) newBackoff() *backoff.ExponentialBackOff {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	b := backoff.NewExponentialBackOff()
+	// Never give up; the caller cancels ctx to stop.
+	b.MaxElapsedTime = 0
+	b.MaxInterval = time.Duration(
+		float64(t.maxBackoff) / (1 + b.RandomizationFactor))
+	if b.InitialInterval > b.MaxInterval {
+		b.InitialInterval = b.MaxInterval
+	}
+	b.Reset()
+	return b
+}
+
+// Dial is an implementation of the ConnectionTransport interface.
+func (t *bserverTransport) Dial(ctx context.Context) (
+	rpc.Transporter, error) {
+	b := t.newBackoff()
+	var conn net.Conn
+	for {
+		var err error
+		conn, err = t.dial(ctx)
+		if err == nil {
+			break
+		}
+		wait := b.NextBackOff()
+		if t.onDialError != nil {
+			t.onDialError(err, wait)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	transport := rpc.NewTransport(conn, t.logFactory, libkb.WrapError)
+	t.conn = conn
+	t.stagedTransport = transport
+	return transport, nil
+}
+
+// IsConnected is an implementation of the ConnectionTransport interface.
+func (t *bserverTransport) IsConnected() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.transport != nil && t.transport.IsConnected()
+}
+
+// Finalize is an implementation of the ConnectionTransport interface.
+func (t *bserverTransport) Finalize() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.transport = t.stagedTransport
+	t.stagedTransport = nil
+}
+
+// Close is an implementation of the ConnectionTransport interface.
+func (t *bserverTransport) Close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.conn != nil {
+		t.conn.Close()
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "fmt"
+
+const (
+	// rabinWindowSize is the number of bytes the rolling hash of
+	// RabinBlockSplitter covers.
+	rabinWindowSize = 48
+	// rabinPrime is the base of the rolling hash polynomial.
+	rabinPrime uint64 = 1099511628211
+	// rabinMix is multiplied into the rolling hash before its top
+	// bits are checked, so that they depend on all of its bits.
+	rabinMix uint64 = 0x9e3779b97f4a7c15
+)
+
+// rabinPrimeToWindow is rabinPrime^rabinWindowSize, i.e. the factor
+// of the byte leaving the window when the hash is rolled.
+var rabinPrimeToWindow = func() uint64 {
+	p := uint64(1)
+	for i := 0; i < rabinWindowSize; i++ {
+		p *= rabinPrime
+	}
+	return p
+}()
+
+// RabinBlockSplitter implements the BlockSplitter interface by
+// splitting file blocks at content-defined boundaries, found with a
+// Rabin-Karp rolling hash over the last rabinWindowSize bytes. Since
+// a boundary depends only on the bytes just before it, an insertion
+// into a file only changes the blocks around it, and the blocks
+// after it keep the same contents (and so the same IDs), unlike with
+// BlockSplitterSimple. Use NewRabinBlockSplitter to make one, and
+// Config.SetBlockSplitter to use it.
+type RabinBlockSplitter struct {
+	minSize int64
+	maxSize int64
+	// A boundary is found when the top hashBits bits of the mixed
+	// hash are all zero.
+	hashBits                uint
+	blockChangeEmbedMaxSize uint64
+}
+
+var _ BlockSplitter = (*RabinBlockSplitter)(nil)
+
+// NewRabinBlockSplitter creates a new RabinBlockSplitter whose blocks
+// have contents of at least minSize bytes (except for the last block
+// of a file) and at most maxSize bytes, and about avgSize bytes on
+// average. minSize must be at least rabinWindowSize, and
+// minSize < avgSize < maxSize. Like with NewBlockSplitterSimpleExact,
+// the sizes don't account for encoding overhead.
+func NewRabinBlockSplitter(minSize, avgSize, maxSize int64,
+	blockChangeEmbedMaxSize uint64) (*RabinBlockSplitter, error) {
+	if minSize < rabinWindowSize {
+		return nil, fmt.Errorf("Min block size %d is less than the "+
+			"hash window size %d", minSize, rabinWindowSize)
+	}
+	if avgSize <= minSize || maxSize <= avgSize {
+		return nil, fmt.Errorf("Block sizes must satisfy min < avg < max, "+
+			"but got min=%d avg=%d max=%d", minSize, avgSize, maxSize)
+	}
+	if blockChangeEmbedMaxSize == 0 {
+		return nil, fmt.Errorf("Max block change embed size is zero")
+	}
+
+	// Past minSize, a boundary is expected every 2^hashBits
+	// bytes, so pick the largest 2^hashBits that doesn't make the
+	// average bigger than avgSize.
+	var hashBits uint
+	for int64(1)<<(hashBits+1) <= avgSize-minSize {
+		hashBits++
+	}
+
+	return &RabinBlockSplitter{
+		minSize:                 minSize,
+		maxSize:                 maxSize,
+		hashBits:                hashBits,
+		blockChangeEmbedMaxSize: blockChangeEmbedMaxSize,
+	}, nil
+}
+
+// rabinHash returns the rolling hash of the rabinWindowSize bytes of
+// the given sequence ending just before end, which must be at least
+// rabinWindowSize.
+func rabinHash(byteAt func(int64) byte, end int64) uint64 {
+	var h uint64
+	for i := end - rabinWindowSize; i < end; i++ {
+		h = h*rabinPrime + uint64(byteAt(i)) + 1
+	}
+	return h
+}
+
+// rabinRoll returns the rolling hash h after in is shifted into the
+// window and out is shifted out of it.
+func rabinRoll(h uint64, in, out byte) uint64 {
+	return h*rabinPrime + uint64(in) + 1 - (uint64(out)+1)*rabinPrimeToWindow
+}
+
+func (b *RabinBlockSplitter) isBoundary(h uint64) bool {
+	return (h*rabinMix)>>(64-b.hashBits) == 0
+}
+
+// findBoundary returns the length of the first block that can be cut
+// from the start of the given sequence of n bytes, considering only
+// lengths of at least from. If there's no such boundary within the
+// sequence, it returns -1.
+func (b *RabinBlockSplitter) findBoundary(
+	byteAt func(int64) byte, from, n int64) int64 {
+	if from < b.minSize {
+		from = b.minSize
+	}
+	var h uint64
+	for end := from; end <= n; end++ {
+		if end == from {
+			h = rabinHash(byteAt, end)
+		} else {
+			h = rabinRoll(h, byteAt(end-1), byteAt(end-1-rabinWindowSize))
+		}
+		if end >= b.maxSize || b.isBoundary(h) {
+			return end
+		}
+	}
+	return -1
+}
+
+// CopyUntilSplit implements the BlockSplitter interface for
+// RabinBlockSplitter.
+func (b *RabinBlockSplitter) CopyUntilSplit(
+	block *FileBlock, lastBlock bool, data []byte, off int64) int64 {
+	currLen := int64(len(block.Contents))
+	if off < currLen {
+		// Overwriting the middle of the block; CheckSplit will
+		// fix up the boundaries later.
+		return copyUntilMaxSize(block, data, off, b.maxSize)
+	}
+
+	if currLen >= b.maxSize {
+		return 0
+	}
+
+	if off > currLen {
+		// Fill in the hole, so the new data is appended.
+		if off > b.maxSize {
+			return 0
+		}
+		block.Contents = append(block.Contents, make([]byte, off-currLen)...)
+		currLen = off
+	}
+
+	byteAt := func(i int64) byte {
+		if i < currLen {
+			return block.Contents[i]
+		}
+		return data[i-currLen]
+	}
+	end := b.findBoundary(byteAt, currLen, currLen+int64(len(data)))
+	if end < 0 {
+		end = currLen + int64(len(data))
+	}
+
+	toCopy := end - currLen
+	block.Contents = append(block.Contents, data[:toCopy]...)
+	return toCopy
+}
+
+// CheckSplit implements the BlockSplitter interface for
+// RabinBlockSplitter.
+func (b *RabinBlockSplitter) CheckSplit(block *FileBlock) int64 {
+	n := int64(len(block.Contents))
+	byteAt := func(i int64) byte {
+		return block.Contents[i]
+	}
+	end := b.findBoundary(byteAt, 0, n)
+	switch {
+	case end == n:
+		return 0
+	case end > 0:
+		return end
+	default:
+		return -1
+	}
+}
+
+// ShouldEmbedBlockChanges implements the BlockSplitter interface for
+// RabinBlockSplitter.
+func (b *RabinBlockSplitter) ShouldEmbedBlockChanges(
+	bc *BlockChanges) bool {
+	return bc.SizeEstimate() <= b.blockChangeEmbedMaxSize
+}
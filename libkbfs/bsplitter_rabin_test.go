@@ -0,0 +1,243 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func makeRabinBlockSplitterForTest(t *testing.T) *RabinBlockSplitter {
+	bsplit, err := NewRabinBlockSplitter(256, 1024, 4096, 8*1024)
+	if err != nil {
+		t.Fatalf("Got error making Rabin block splitter: %v", err)
+	}
+	return bsplit
+}
+
+func makeRandomDataForTest(seed int64, n int) []byte {
+	data := make([]byte, n)
+	r := rand.New(rand.NewSource(seed))
+	for i := range data {
+		data[i] = byte(r.Intn(256))
+	}
+	return data
+}
+
+// splitForTest writes data sequentially to a new file in writes of
+// writeSize bytes, the way folderBlockOps does, and returns the
+// contents of the resulting blocks.
+func splitForTest(
+	bsplit BlockSplitter, data []byte, writeSize int) [][]byte {
+	blocks := []*FileBlock{NewFileBlock().(*FileBlock)}
+	for written := 0; written < len(data); {
+		end := written + writeSize
+		if end > len(data) {
+			end = len(data)
+		}
+		for written < end {
+			block := blocks[len(blocks)-1]
+			n := bsplit.CopyUntilSplit(block, true, data[written:end],
+				int64(len(block.Contents)))
+			written += int(n)
+			if written < end {
+				blocks = append(blocks, NewFileBlock().(*FileBlock))
+			}
+		}
+	}
+	var contents [][]byte
+	for _, block := range blocks {
+		contents = append(contents, block.Contents)
+	}
+	return contents
+}
+
+func countSharedBlocks(a, b [][]byte) int {
+	seen := make(map[string]bool)
+	for _, block := range a {
+		seen[string(block)] = true
+	}
+	shared := 0
+	for _, block := range b {
+		if seen[string(block)] {
+			shared++
+		}
+	}
+	return shared
+}
+
+func TestRabinBlockSplitterSizes(t *testing.T) {
+	bsplit := makeRabinBlockSplitterForTest(t)
+	data := makeRandomDataForTest(1, 256*1024)
+	blocks := splitForTest(bsplit, data, 8*1024)
+
+	if !bytes.Equal(bytes.Join(blocks, nil), data) {
+		t.Fatalf("Blocks don't add up to the data")
+	}
+	for i, block := range blocks {
+		if len(block) > 4096 {
+			t.Errorf("Block %d is too big: %d", i, len(block))
+		}
+		if i < len(blocks)-1 && len(block) < 256 {
+			t.Errorf("Block %d is too small: %d", i, len(block))
+		}
+	}
+	avg := len(data) / len(blocks)
+	if avg < 512 || avg > 2048 {
+		t.Errorf("Unexpected average block size %d", avg)
+	}
+}
+
+func TestRabinBlockSplitterWriteSizeIndependent(t *testing.T) {
+	bsplit := makeRabinBlockSplitterForTest(t)
+	data := makeRandomDataForTest(1, 64*1024)
+	expected := splitForTest(bsplit, data, len(data))
+	for _, writeSize := range []int{1, 100, 1000, 5000} {
+		blocks := splitForTest(bsplit, data, writeSize)
+		if len(blocks) != len(expected) {
+			t.Fatalf("Got %d blocks with write size %d, expected %d",
+				len(blocks), writeSize, len(expected))
+		}
+		for i := range blocks {
+			if !bytes.Equal(blocks[i], expected[i]) {
+				t.Errorf("Block %d differs with write size %d", i, writeSize)
+			}
+		}
+	}
+}
+
+func TestRabinBlockSplitterPrefixInsert(t *testing.T) {
+	bsplit := makeRabinBlockSplitterForTest(t)
+	data := makeRandomDataForTest(1, 256*1024)
+	inserted := append([]byte{0x42}, data...)
+
+	blocks := splitForTest(bsplit, data, 8*1024)
+	newBlocks := splitForTest(bsplit, inserted, 8*1024)
+
+	// All but the first block or so should be unchanged.
+	shared := countSharedBlocks(blocks, newBlocks)
+	if shared < len(blocks)-2 {
+		t.Errorf("Only %d of %d blocks are unchanged after an insert",
+			shared, len(blocks))
+	}
+
+	// Whereas with fixed-size blocks, nothing is.
+	simple, err := NewBlockSplitterSimpleExact(1024, 512)
+	if err != nil {
+		t.Fatalf("Got error making block splitter: %v", err)
+	}
+	shared = countSharedBlocks(splitForTest(simple, data, 8*1024),
+		splitForTest(simple, inserted, 8*1024))
+	if shared != 0 {
+		t.Errorf("%d fixed-size blocks are unchanged after an insert", shared)
+	}
+}
+
+func TestRabinBlockSplitterCheckSplit(t *testing.T) {
+	bsplit := makeRabinBlockSplitterForTest(t)
+	data := makeRandomDataForTest(1, 64*1024)
+	blocks := splitForTest(bsplit, data, len(data))
+	if len(blocks) < 3 {
+		t.Fatalf("Too few blocks: %d", len(blocks))
+	}
+
+	// A block that ends at a boundary is fine.
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = blocks[0]
+	if splitAt := bsplit.CheckSplit(block); splitAt != 0 {
+		t.Errorf("Unexpected split of a whole block at %d", splitAt)
+	}
+
+	// A block holding two blocks' worth should be split between
+	// them.
+	block.Contents = append(append([]byte(nil), blocks[0]...), blocks[1]...)
+	if splitAt := bsplit.CheckSplit(block); splitAt != int64(len(blocks[0])) {
+		t.Errorf("Split at %d, expected %d", splitAt, len(blocks[0]))
+	}
+
+	// A block that ends before its boundary needs more bytes.
+	block.Contents = blocks[1][:len(blocks[1])-1]
+	if splitAt := bsplit.CheckSplit(block); splitAt != -1 {
+		t.Errorf("Split at %d, expected -1", splitAt)
+	}
+
+	// A block that's too big gets split at the max size.
+	block.Contents = make([]byte, 5000)
+	for i := range block.Contents {
+		block.Contents[i] = 0x1
+	}
+	splitAt := bsplit.CheckSplit(block)
+	if splitAt <= 0 || splitAt > 4096 {
+		t.Errorf("Unexpected split of a big block at %d", splitAt)
+	}
+}
+
+func TestRabinBlockSplitterWithKBFSOps(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer config.Shutdown()
+	config.SetBlockSplitter(makeRabinBlockSplitterForTest(t))
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	data := makeRandomDataForTest(1, 64*1024)
+	for off := 0; off < len(data); off += 1000 {
+		end := off + 1000
+		if end > len(data) {
+			end = len(data)
+		}
+		err = kbfsOps.Write(ctx, fileNode, data[off:end], int64(off))
+		if err != nil {
+			t.Fatalf("Couldn't write to file: %v", err)
+		}
+	}
+	err = kbfsOps.Sync(ctx, fileNode)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	// Overwrite part of the middle, which needs the block
+	// boundaries to be fixed up on sync.
+	copy(data[30000:], makeRandomDataForTest(2, 5000))
+	err = kbfsOps.Write(ctx, fileNode, data[30000:35000], 30000)
+	if err != nil {
+		t.Fatalf("Couldn't write to file: %v", err)
+	}
+	err = kbfsOps.Sync(ctx, fileNode)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	if err != nil {
+		t.Fatalf("Couldn't read file: %v", err)
+	}
+	if !bytes.Equal(buf[:n], data) {
+		t.Errorf("Read back different data")
+	}
+}
+
+func TestRabinBlockSplitterBadSizes(t *testing.T) {
+	for _, sizes := range []struct {
+		minSize, avgSize, maxSize int64
+	}{
+		{rabinWindowSize - 1, 1024, 4096},
+		{256, 256, 4096},
+		{256, 1024, 1024},
+		{1024, 256, 4096},
+	} {
+		_, err := NewRabinBlockSplitter(
+			sizes.minSize, sizes.avgSize, sizes.maxSize, 8*1024)
+		if err == nil {
+			t.Errorf("No error for sizes %v", sizes)
+		}
+	}
+}
@@ -7,7 +7,10 @@ package libkbfs
 import "fmt"
 
 // BlockSplitterSimple implements the BlockSplitter interface by using
-// a simple max-size algorithm to determine when to split blocks.
+// a simple max-size algorithm to determine when to split blocks. New
+// code should construct one with NewBlockSplitterSimple or
+// NewBlockSplitterSimpleExact, which validate their parameters,
+// rather than with a struct literal.
 type BlockSplitterSimple struct {
 	maxSize                 int64
 	blockChangeEmbedMaxSize uint64
@@ -19,6 +22,11 @@ type BlockSplitterSimple struct {
 // round-up padding we do.
 func NewBlockSplitterSimple(desiredBlockSize int64,
 	blockChangeEmbedMaxSize uint64, codec Codec) (*BlockSplitterSimple, error) {
+	if desiredBlockSize <= 0 {
+		return nil, fmt.Errorf("Desired block size %d is not positive",
+			desiredBlockSize)
+	}
+
 	// If the desired block size is exactly a power of 2, subtract one
 	// from it to account for the padding we will do, which rounds up
 	// when the encoded size is exactly a power of 2.
@@ -74,28 +82,60 @@ func NewBlockSplitterSimple(desiredBlockSize int64,
 	}, nil
 }
 
+// NewBlockSplitterSimpleExact creates a new BlockSplitterSimple that
+// splits file blocks at exactly maxSize bytes of contents, without
+// accounting for encoding overhead like NewBlockSplitterSimple
+// does. Both sizes must be positive, and blockChangeEmbedMaxSize
+// must be smaller than maxSize.
+func NewBlockSplitterSimpleExact(maxSize int64,
+	blockChangeEmbedMaxSize uint64) (*BlockSplitterSimple, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("Max block size %d is not positive", maxSize)
+	}
+	if blockChangeEmbedMaxSize == 0 {
+		return nil, fmt.Errorf("Max block change embed size is zero")
+	}
+	if blockChangeEmbedMaxSize >= uint64(maxSize) {
+		return nil, fmt.Errorf("Max block change embed size %d is not "+
+			"smaller than the max block size %d",
+			blockChangeEmbedMaxSize, maxSize)
+	}
+	return &BlockSplitterSimple{
+		maxSize:                 maxSize,
+		blockChangeEmbedMaxSize: blockChangeEmbedMaxSize,
+	}, nil
+}
+
 // CopyUntilSplit implements the BlockSplitter interface for
 // BlockSplitterSimple.
 func (b *BlockSplitterSimple) CopyUntilSplit(
 	block *FileBlock, lastBlock bool, data []byte, off int64) int64 {
+	// lastBlock is irrelevant since we only copy fixed sizes
+	return copyUntilMaxSize(block, data, off, b.maxSize)
+}
+
+// copyUntilMaxSize copies as much of data into block at off as will
+// fit without making the block's contents longer than maxSize, and
+// returns how much was copied.
+func copyUntilMaxSize(
+	block *FileBlock, data []byte, off int64, maxSize int64) int64 {
 	n := int64(len(data))
 	currLen := int64(len(block.Contents))
-	// lastBlock is irrelevant since we only copy fixed sizes
 
 	toCopy := n
 	if currLen < (off + n) {
 		moreNeeded := (n + off) - currLen
 		// Reduce the number of additional bytes if it will take this block
 		// over maxSize.
-		if moreNeeded+currLen > b.maxSize {
-			moreNeeded = b.maxSize - currLen
+		if moreNeeded+currLen > maxSize {
+			moreNeeded = maxSize - currLen
 			if moreNeeded < 0 {
 				// If it is already over maxSize w/o any added bytes,
 				// just give up.
 				return 0
 			}
 			// only copy to the end of the block
-			toCopy = b.maxSize - off
+			toCopy = maxSize - off
 		}
 
 		if moreNeeded > 0 {
@@ -166,3 +166,40 @@ func TestBsplitterOverhead(t *testing.T) {
 			g, e)
 	}
 }
+
+func TestBsplitterExact(t *testing.T) {
+	bsplit, err := NewBlockSplitterSimpleExact(10, 5)
+	if err != nil {
+		t.Fatalf("Got error making exact block splitter: %v", err)
+	}
+	if bsplit.maxSize != 10 {
+		t.Errorf("Unexpected max size: %d", bsplit.maxSize)
+	}
+	if bsplit.blockChangeEmbedMaxSize != 5 {
+		t.Errorf("Unexpected max embed size: %d",
+			bsplit.blockChangeEmbedMaxSize)
+	}
+
+	for _, sizes := range []struct {
+		maxSize                 int64
+		blockChangeEmbedMaxSize uint64
+	}{
+		{0, 5},
+		{-10, 5},
+		{10, 0},
+		{10, 10},
+		{10, 20},
+	} {
+		_, err := NewBlockSplitterSimpleExact(
+			sizes.maxSize, sizes.blockChangeEmbedMaxSize)
+		if err == nil {
+			t.Errorf("No error for max size %d and max embed size %d",
+				sizes.maxSize, sizes.blockChangeEmbedMaxSize)
+		}
+	}
+
+	_, err = NewBlockSplitterSimple(0, 5, NewCodecMsgpack())
+	if err == nil {
+		t.Errorf("No error for a zero desired block size")
+	}
+}
@@ -26,6 +26,10 @@ const (
 	// increase this once we support levels of indirection for
 	// directories.
 	maxDirBytesDefault = MaxBlockSizeBytesDefault
+	// Maximum supported serialized size of a single MD object. This
+	// is well above the size of any reasonable MD; it's only meant
+	// to catch pathological MDs before they're written.
+	maxMDBytesDefault = 16 * 1024 * 1024
 	// Default time after setting the rekey bit before prompting for a
 	// paper key.
 	rekeyWithPromptWaitTimeDefault = 10 * time.Minute
@@ -62,19 +66,25 @@ type ConfigLocal struct {
 	clock       Clock
 	kbpki       KBPKI
 	renamer     ConflictRenamer
+	merger      MergeStrategy
 	registry    metrics.Registry
 	loggerFn    func(prefix string) logger.Logger
 	noBGFlush   bool // logic opposite so the default value is the common setting
 	rwpWaitTime time.Duration
 
+	allowUnverifiedKeys bool
+
 	maxFileBytes uint64
 	maxNameBytes uint32
 	maxDirBytes  uint64
+	maxMDBytes   uint64
 	rekeyQueue   RekeyQueue
 
 	qrPeriod   time.Duration
 	qrUnrefAge time.Duration
 
+	writerInfoCacheTTL time.Duration
+
 	// allKnownConfigsForTesting is used for testing, and contains all created
 	// Config objects in this test.
 	allKnownConfigsForTesting *[]Config
@@ -192,7 +202,8 @@ func NewConfigLocal() *ConfigLocal {
 	config := &ConfigLocal{}
 	config.SetClock(wallClock{})
 	config.SetReporter(NewReporterSimple(config.Clock(), 10))
-	config.SetConflictRenamer(WriterDeviceDateConflictRenamer{config})
+	config.SetConflictRenamer(WriterDeviceDateConflictRenamer{config: config})
+	config.SetMergeStrategy(RenameMergeStrategy{})
 	config.ResetCaches()
 	config.SetCodec(NewCodecMsgpack())
 	config.SetBlockOps(&BlockOpsStandard{config})
@@ -202,11 +213,14 @@ func NewConfigLocal() *ConfigLocal {
 	config.maxFileBytes = maxFileBytesDefault
 	config.maxNameBytes = maxNameBytesDefault
 	config.maxDirBytes = maxDirBytesDefault
+	config.maxMDBytes = maxMDBytesDefault
 	config.rwpWaitTime = rekeyWithPromptWaitTimeDefault
 
 	config.qrPeriod = qrPeriodDefault
 	config.qrUnrefAge = qrUnrefAgeDefault
 
+	config.writerInfoCacheTTL = writerInfoCacheTTLDefault
+
 	// Don't bother creating the registry if UseNilMetrics is set.
 	if !metrics.UseNilMetrics {
 		registry := metrics.NewRegistry()
@@ -513,6 +527,20 @@ func (c *ConfigLocal) SetConflictRenamer(cr ConflictRenamer) {
 	c.renamer = cr
 }
 
+// MergeStrategy implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MergeStrategy() MergeStrategy {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.merger
+}
+
+// SetMergeStrategy implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetMergeStrategy(ms MergeStrategy) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.merger = ms
+}
+
 // MetadataVersion implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) MetadataVersion() MetadataVer {
 	return InitialExtraMetadataVer
@@ -537,6 +565,20 @@ func (c *ConfigLocal) SetDoBackgroundFlushes(doBGFlush bool) {
 	c.noBGFlush = !doBGFlush
 }
 
+// AllowUnverifiedKeys implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) AllowUnverifiedKeys() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.allowUnverifiedKeys
+}
+
+// SetAllowUnverifiedKeys implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetAllowUnverifiedKeys(allow bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.allowUnverifiedKeys = allow
+}
+
 // RekeyWithPromptWaitTime implements the Config interface for
 // ConfigLocal.
 func (c *ConfigLocal) RekeyWithPromptWaitTime() time.Duration {
@@ -553,6 +595,21 @@ func (c *ConfigLocal) QuotaReclamationMinUnrefAge() time.Duration {
 	return c.qrUnrefAge
 }
 
+// WriterInfoCacheTTL implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) WriterInfoCacheTTL() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.writerInfoCacheTTL
+}
+
+// SetWriterInfoCacheTTL implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetWriterInfoCacheTTL(ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writerInfoCacheTTL = ttl
+}
+
 // ReqsBufSize implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) ReqsBufSize() int {
 	return 20
@@ -573,6 +630,11 @@ func (c *ConfigLocal) MaxDirBytes() uint64 {
 	return c.maxDirBytes
 }
 
+// MaxMDBytes implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MaxMDBytes() uint64 {
+	return c.maxMDBytes
+}
+
 func (c *ConfigLocal) resetCachesWithoutShutdown() DirtyBlockCache {
 	c.lock.Lock()
 	defer c.lock.Unlock()
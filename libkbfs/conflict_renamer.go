@@ -6,36 +6,427 @@ package libkbfs
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/keybase/client/go/libkb"
 	keybase1 "github.com/keybase/client/go/protocol"
 	"golang.org/x/net/context"
 )
 
+// ConflictTimestampGranularity is how precisely
+// WriterDeviceDateConflictRenamer records the time of a conflict in
+// the names it generates.
+type ConflictTimestampGranularity int
+
+const (
+	// ConflictTimestampDate records just the date, e.g.
+	// "2016-01-02".
+	ConflictTimestampDate ConflictTimestampGranularity = iota
+	// ConflictTimestampMinute also records the hour and minute,
+	// e.g. "2016-01-02 15h04".
+	ConflictTimestampMinute
+	// ConflictTimestampSecond also records the second, e.g.
+	// "2016-01-02 15h04m05s".
+	ConflictTimestampSecond
+)
+
+// format returns t formatted with granularity g. The formats avoid
+// characters that aren't allowed in file names on some platforms, and
+// dots, which would be mistaken for an extension.
+func (g ConflictTimestampGranularity) format(t time.Time) string {
+	switch g {
+	case ConflictTimestampMinute:
+		return t.Format("2006-01-02 15h04")
+	case ConflictTimestampSecond:
+		return t.Format("2006-01-02 15h04m05s")
+	default:
+		return t.Format("2006-01-02")
+	}
+}
+
 // WriterDeviceDateConflictRenamer renames a file using
 // a username, device name, and date.
 type WriterDeviceDateConflictRenamer struct {
 	config Config
+	// MaxConflictDepth, if positive, is the maximum number of
+	// conflict markers that a renamed file may have. If the
+	// original name already has that many markers, the oldest
+	// ones are dropped to make room for the new one. If zero,
+	// markers are nested without limit.
+	MaxConflictDepth int
+	// MaxInvolvedWriters, if positive, makes the renamer name all
+	// the writers involved in a conflict, in sorted order, instead
+	// of just the writer and device of the renamed entry. At most
+	// MaxInvolvedWriters names are listed, followed by a count of
+	// the remaining ones.
+	MaxInvolvedWriters int
+	// TimestampGranularity is how precisely the time of the
+	// conflict is recorded. The default is just the date; a finer
+	// granularity makes collisions between conflicts on the same
+	// day less likely.
+	TimestampGranularity ConflictTimestampGranularity
+	// UnknownDeviceName is used in place of the name of a device
+	// that doesn't have one. If empty, "unknown" is used.
+	UnknownDeviceName string
+	// UnknownDeviceKIDSuffix, if true, makes the renamer follow
+	// UnknownDeviceName with a short prefix of the device's KID,
+	// so that conflicts from different unnamed devices get
+	// different names.
+	UnknownDeviceKIDSuffix bool
+	// DateFormat, if non-empty, is the time.Time.Format layout
+	// used to record the time of the conflict, in place of
+	// TimestampGranularity. Use NewWriterDeviceDateConflictRenamer
+	// to make sure it's valid.
+	DateFormat string
+}
+
+// conflictDateFormatSample is the time that validateConflictDateFormat
+// formats; every element is distinct from the reference time's.
+var conflictDateFormatSample = time.Date(
+	2017, 11, 28, 21, 38, 49, 0, time.UTC)
+
+// validateConflictDateFormat returns an error if the given layout
+// wouldn't produce dates that are usable in conflict names.
+func validateConflictDateFormat(layout string) error {
+	date := conflictDateFormatSample.Format(layout)
+	if date == layout {
+		return InvalidConflictDateFormatError{
+			layout, "it has no date or time elements"}
+	}
+	// Slashes and backslashes would make paths, parentheses
+	// would end the conflict marker, dots would be mistaken for
+	// an extension, and colons aren't allowed on some platforms.
+	if i := strings.IndexAny(date, `/\().:`); i >= 0 {
+		return InvalidConflictDateFormatError{
+			layout, fmt.Sprintf("its dates contain %q", date[i])}
+	}
+	return nil
+}
+
+// NewWriterDeviceDateConflictRenamer returns a
+// WriterDeviceDateConflictRenamer that gets the time of each
+// conflict from config's clock and records it with the given
+// time.Time.Format layout, or with the default one if dateFormat is
+// empty. It returns an InvalidConflictDateFormatError if the layout
+// would produce unusable names. Use Config.SetConflictRenamer to
+// select it.
+func NewWriterDeviceDateConflictRenamer(config Config, dateFormat string) (
+	WriterDeviceDateConflictRenamer, error) {
+	if dateFormat != "" {
+		err := validateConflictDateFormat(dateFormat)
+		if err != nil {
+			return WriterDeviceDateConflictRenamer{}, err
+		}
+	}
+	return WriterDeviceDateConflictRenamer{
+		config:     config,
+		DateFormat: dateFormat,
+	}, nil
+}
+
+// formatTime returns t formatted with cr.DateFormat, if set, or
+// else with cr.TimestampGranularity.
+func (cr WriterDeviceDateConflictRenamer) formatTime(t time.Time) string {
+	if cr.DateFormat != "" {
+		return t.Format(cr.DateFormat)
+	}
+	return cr.TimestampGranularity.format(t)
+}
+
+// unknownDeviceKIDHexLen is the number of hex digits of the KID that
+// WriterDeviceDateConflictRenamer.UnknownDeviceKIDSuffix adds.
+const unknownDeviceKIDHexLen = 8
+
+// unknownDeviceName returns the name to use for a device without
+// one, whose KID is kid (which may be empty).
+func (cr WriterDeviceDateConflictRenamer) unknownDeviceName(
+	kid keybase1.KID) string {
+	name := cr.UnknownDeviceName
+	if name == "" {
+		name = "unknown"
+	}
+	// Skip the version and key type bytes at the start of the
+	// KID, which are the same for all device keys.
+	kidStr := kid.String()
+	if cr.UnknownDeviceKIDSuffix && len(kidStr) >= 4+unknownDeviceKIDHexLen {
+		name += " " + kidStr[4:4+unknownDeviceKIDHexLen]
+	}
+	return name
 }
 
 // ConflictRename implements the ConflictRename interface for
 // TimeAndWriterConflictRenamer.
-func (cr WriterDeviceDateConflictRenamer) ConflictRename(op op, original string) string {
+func (cr WriterDeviceDateConflictRenamer) ConflictRename(op op, original string,
+	involvedWriters []libkb.NormalizedUsername,
+	exists func(name string) bool) string {
 	now := cr.config.Clock().Now()
+	if cr.MaxInvolvedWriters > 0 && len(involvedWriters) > 0 {
+		return uniqueConflictName(exists, func(n int) string {
+			return cr.conflictRenameWritersHelper(
+				now, involvedWriters, original, n)
+		})
+	}
 	winfo := op.getWriterInfo()
-	return cr.ConflictRenameHelper(now, string(winfo.name), winfo.deviceName, original)
+	device := winfo.deviceName
+	if device == "" {
+		device = cr.unknownDeviceName(winfo.kid)
+	}
+	return uniqueConflictName(exists, func(n int) string {
+		return cr.conflictRenameHelper(
+			now, string(winfo.name), device, original, n)
+	})
+}
+
+// conflictRenamePattern matches any name produced by
+// WriterDeviceDateConflictRenamer: a base name, one or more conflict
+// markers, and an optional extension.
+var conflictRenamePattern = regexp.MustCompile(
+	`^.*(\.conflicted \([^()]* [0-9]{4}-[0-9]{2}-[0-9]{2}` +
+		`( [0-9]{2}h[0-9]{2}(m[0-9]{2}s)?)?( #[0-9]+)?\))+` +
+		`(\.[^ /\\]*)?$`)
+
+// conflictRenameCustomDatePattern is like conflictRenamePattern, but
+// matches any date, as produced with a custom DateFormat.
+var conflictRenameCustomDatePattern = regexp.MustCompile(
+	`^.*(\.conflicted \([^()]*\))+(\.[^ /\\]*)?$`)
+
+// Pattern implements the ConflictRenamer interface for
+// WriterDeviceDateConflictRenamer.
+func (cr WriterDeviceDateConflictRenamer) Pattern() *regexp.Regexp {
+	if cr.DateFormat != "" {
+		return conflictRenameCustomDatePattern
+	}
+	return conflictRenamePattern
+}
+
+// maxConflictNameCounter is the highest counter that
+// uniqueConflictName tries before giving up and returning a name that
+// may already exist. Conflict resolution makes the names it creates
+// unique anyway, so this just keeps a pathological directory from
+// making it loop for too long.
+const maxConflictNameCounter = 100
+
+// uniqueConflictName returns name(1), or, if that already exists,
+// name(n) for the first n > 1 for which it doesn't.
+func uniqueConflictName(
+	exists func(name string) bool, name func(n int) string) string {
+	for n := 1; ; n++ {
+		candidate := name(n)
+		if n >= maxConflictNameCounter || !exists(candidate) {
+			return candidate
+		}
+	}
+}
+
+// conflictCounter returns the suffix to add to the n-th conflict
+// marker for the same name, i.e. nothing for the first one and " #n"
+// for the rest.
+func conflictCounter(n int) string {
+	if n <= 1 {
+		return ""
+	}
+	return fmt.Sprintf(" #%d", n)
+}
+
+// noExistingNames is an exists predicate for ConflictRename that
+// reports every name as free, for callers that don't know which
+// names are taken.
+func noExistingNames(string) bool {
+	return false
+}
+
+// crMergedNames holds exists predicates for ConflictRename that
+// report whether a name is already taken in the merged branch, either
+// in the directory that a conflicting chain applies to, or in that
+// directory's parent. For the chain of a file, only parent is used.
+type crMergedNames struct {
+	dir    func(name string) bool
+	parent func(name string) bool
+}
+
+// noMergedNames is a crMergedNames that reports every name as free.
+var noMergedNames = crMergedNames{noExistingNames, noExistingNames}
+
+// involvedWriters returns the writers of the given ops.
+func involvedWriters(ops ...op) []libkb.NormalizedUsername {
+	writers := make([]libkb.NormalizedUsername, 0, len(ops))
+	for _, op := range ops {
+		writers = append(writers, op.getWriterInfo().name)
+	}
+	return writers
 }
 
 // ConflictRenameHelper is a helper for ConflictRename especially useful from
 // tests.
-func (WriterDeviceDateConflictRenamer) ConflictRenameHelper(t time.Time, user, device, original string) string {
+func (cr WriterDeviceDateConflictRenamer) ConflictRenameHelper(t time.Time, user, device, original string) string {
+	return cr.conflictRenameHelper(t, user, device, original, 1)
+}
+
+// conflictRenameHelper is like ConflictRenameHelper, but generates
+// the n-th name for the conflict.
+func (cr WriterDeviceDateConflictRenamer) conflictRenameHelper(
+	t time.Time, user, device, original string, n int) string {
+	if device == "" {
+		device = cr.unknownDeviceName("")
+	}
+	base, ext := splitExtension(original)
+	if cr.MaxConflictDepth > 0 {
+		base = trimConflictMarkers(base, cr.MaxConflictDepth-1)
+	}
+	date := cr.formatTime(t)
+	return fmt.Sprintf("%s.conflicted (%s's %s copy %s%s)%s",
+		base, user, device, date, conflictCounter(n), ext)
+}
+
+// ConflictRenameWritersHelper is a helper for ConflictRename that
+// names the given writers, in sorted order and without duplicates,
+// instead of a single writer and device. It is especially useful
+// from tests.
+func (cr WriterDeviceDateConflictRenamer) ConflictRenameWritersHelper(
+	t time.Time, writers []libkb.NormalizedUsername,
+	original string) string {
+	return cr.conflictRenameWritersHelper(t, writers, original, 1)
+}
+
+// conflictRenameWritersHelper is like ConflictRenameWritersHelper,
+// but generates the n-th name for the conflict.
+func (cr WriterDeviceDateConflictRenamer) conflictRenameWritersHelper(
+	t time.Time, writers []libkb.NormalizedUsername,
+	original string, n int) string {
+	seen := make(map[libkb.NormalizedUsername]bool, len(writers))
+	var names []string
+	for _, w := range writers {
+		if seen[w] {
+			continue
+		}
+		seen[w] = true
+		names = append(names, string(w))
+	}
+	sort.Strings(names)
+
+	var more string
+	if cr.MaxInvolvedWriters > 0 && len(names) > cr.MaxInvolvedWriters {
+		more = fmt.Sprintf(" +%d more", len(names)-cr.MaxInvolvedWriters)
+		names = names[:cr.MaxInvolvedWriters]
+	}
+
+	base, ext := splitExtension(original)
+	if cr.MaxConflictDepth > 0 {
+		base = trimConflictMarkers(base, cr.MaxConflictDepth-1)
+	}
+	date := cr.formatTime(t)
+	return fmt.Sprintf("%s.conflicted (%s%s %s%s)%s",
+		base, strings.Join(names, ","), more, date, conflictCounter(n), ext)
+}
+
+// conflictMarkerRegexp matches a single conflict marker, as generated
+// by ConflictRenameHelper, at the end of a base name.
+var conflictMarkerRegexp = regexp.MustCompile(
+	`^(.*)(\.conflicted \([^()]*\))$`)
+
+// trimConflictMarkers removes the oldest conflict markers from the
+// end of base, so that at most keep markers are left.
+func trimConflictMarkers(base string, keep int) string {
+	var markers []string
+	for {
+		m := conflictMarkerRegexp.FindStringSubmatch(base)
+		if m == nil {
+			break
+		}
+		base = m[1]
+		// Markers are found newest first.
+		markers = append([]string{m[2]}, markers...)
+	}
+	if len(markers) > keep {
+		markers = markers[len(markers)-keep:]
+	}
+	return base + strings.Join(markers, "")
+}
+
+// DatePrefixConflictRenamer renames a file by inserting the date,
+// username, and device name between its base name and its extension,
+// e.g. "report (conflicted 2016-01-02 alice's laptop).pdf". Unlike
+// WriterDeviceDateConflictRenamer, the marker starts with a space
+// rather than a dot, so conflicted copies sort right after their
+// originals in file managers that order names naturally.
+type DatePrefixConflictRenamer struct {
+	config Config
+	// TimestampGranularity is how precisely the time of the
+	// conflict is recorded, as for
+	// WriterDeviceDateConflictRenamer.
+	TimestampGranularity ConflictTimestampGranularity
+}
+
+// NewDatePrefixConflictRenamer returns a DatePrefixConflictRenamer
+// that gets the time of each conflict from config's clock. Use
+// Config.SetConflictRenamer to select it.
+func NewDatePrefixConflictRenamer(config Config) DatePrefixConflictRenamer {
+	return DatePrefixConflictRenamer{config: config}
+}
+
+// ConflictRename implements the ConflictRenamer interface for
+// DatePrefixConflictRenamer.
+func (cr DatePrefixConflictRenamer) ConflictRename(op op, original string,
+	involvedWriters []libkb.NormalizedUsername,
+	exists func(name string) bool) string {
+	now := cr.config.Clock().Now()
+	winfo := op.getWriterInfo()
+	return uniqueConflictName(exists, func(n int) string {
+		return cr.conflictRenameHelper(
+			now, string(winfo.name), winfo.deviceName, original, n)
+	})
+}
+
+// datePrefixConflictRenamePattern matches any name produced by
+// DatePrefixConflictRenamer: a base name, one or more conflict
+// markers, and an optional extension.
+var datePrefixConflictRenamePattern = regexp.MustCompile(
+	`^.*( \(conflicted [0-9]{4}-[0-9]{2}-[0-9]{2}` +
+		`( [0-9]{2}h[0-9]{2}(m[0-9]{2}s)?)? [^()]*\))+` +
+		`(\.[^ /\\]*)?$`)
+
+// Pattern implements the ConflictRenamer interface for
+// DatePrefixConflictRenamer.
+func (cr DatePrefixConflictRenamer) Pattern() *regexp.Regexp {
+	return datePrefixConflictRenamePattern
+}
+
+// ConflictRenameHelper is a helper for ConflictRename especially
+// useful from tests.
+func (cr DatePrefixConflictRenamer) ConflictRenameHelper(
+	t time.Time, user, device, original string) string {
+	return cr.conflictRenameHelper(t, user, device, original, 1)
+}
+
+// conflictRenameHelper is like ConflictRenameHelper, but generates
+// the n-th name for the conflict.
+func (cr DatePrefixConflictRenamer) conflictRenameHelper(
+	t time.Time, user, device, original string, n int) string {
 	if device == "" {
 		device = "unknown"
 	}
 	base, ext := splitExtension(original)
-	date := t.Format("2006-01-02")
-	return fmt.Sprintf("%s.conflicted (%s's %s copy %s)%s",
-		base, user, device, date, ext)
+	date := cr.TimestampGranularity.format(t)
+	return fmt.Sprintf("%s (conflicted %s %s's %s%s)%s",
+		base, date, user, device, conflictCounter(n), ext)
+}
+
+// compoundExtensions lists the extensions that splitExtension keeps
+// together with the final extension after them, e.g. so that
+// "foo.tar.gz" splits into "foo" and ".tar.gz" rather than "foo.tar"
+// and ".gz". An entry with an empty ext applies whatever the final
+// extension is; otherwise it applies only when the final extension
+// is exactly ext.
+var compoundExtensions = []struct {
+	prefix, ext string
+}{
+	{".tar", ""},
+	{".user", ".js"},
+	{".user", ".css"},
+	{".d", ".ts"},
 }
 
 // splitExtension splits filename into a base name and the extension.
@@ -44,8 +435,12 @@ func splitExtension(path string) (string, string) {
 		switch path[i] {
 		case '.':
 			// Handle some multipart extensions
-			if i >= 4 && path[i-4:i] == ".tar" {
-				i -= 4
+			for _, ce := range compoundExtensions {
+				if (ce.ext == "" || ce.ext == path[i:]) &&
+					strings.HasSuffix(path[:i], ce.prefix) {
+					i -= len(ce.prefix)
+					break
+				}
 			}
 			// A leading dot is not an extension
 			if i == 0 || path[i-1] == '/' || path[i-1] == '\\' {
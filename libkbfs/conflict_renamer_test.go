@@ -6,6 +6,12 @@ package libkbfs
 
 import (
 	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/keybase/client/go/libkb"
+	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/stretchr/testify/require"
 )
 
 func testSplitExtension(t *testing.T, s, base, ext string) {
@@ -30,3 +36,337 @@ func TestSplitExtension(t *testing.T) {
 	testSplitExtension(t, "weird. is this?", "weird. is this?", "")
 	testSplitExtension(t, "", "", "")
 }
+
+func TestSplitExtensionCompound(t *testing.T) {
+	tests := []struct {
+		path, base, ext string
+	}{
+		{"archive.tar.gz", "archive", ".tar.gz"},
+		{"archive.tar.zst", "archive", ".tar.zst"},
+		{"archive.tar", "archive", ".tar"},
+		{"archive.gz", "archive", ".gz"},
+		{"x/archive.tar.xz", "x/archive", ".tar.xz"},
+		{"script.user.js", "script", ".user.js"},
+		{"script.user.txt", "script.user", ".txt"},
+		{"types.d.ts", "types", ".d.ts"},
+		{".bashrc", ".bashrc", ""},
+		{".tar.zst", ".tar.zst", ""},
+		{"x/.user.js", "x/.user.js", ""},
+	}
+	for _, test := range tests {
+		testSplitExtension(t, test.path, test.base, test.ext)
+	}
+
+	cr := WriterDeviceDateConflictRenamer{}
+	now := time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)
+	require.Equal(t,
+		"archive.conflicted (alice's laptop copy 2016-01-02).tar.zst",
+		cr.ConflictRenameHelper(now, "alice", "laptop", "archive.tar.zst"))
+}
+
+func TestConflictRenameMaxDepth(t *testing.T) {
+	t1 := time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)
+	t2 := time.Date(2016, 1, 3, 0, 0, 0, 0, time.UTC)
+	t3 := time.Date(2016, 1, 4, 0, 0, 0, 0, time.UTC)
+
+	// By default, markers nest without limit.
+	cr := WriterDeviceDateConflictRenamer{}
+	name := cr.ConflictRenameHelper(t1, "alice", "laptop", "x.txt")
+	require.Equal(t,
+		"x.conflicted (alice's laptop copy 2016-01-02).txt", name)
+	name = cr.ConflictRenameHelper(t2, "bob", "phone", name)
+	require.Equal(t,
+		"x.conflicted (alice's laptop copy 2016-01-02)"+
+			".conflicted (bob's phone copy 2016-01-03).txt", name)
+
+	// With a depth of 1, only the latest marker is kept.
+	cr = WriterDeviceDateConflictRenamer{MaxConflictDepth: 1}
+	name1 := cr.ConflictRenameHelper(t3, "carol", "desktop", name)
+	require.Equal(t,
+		"x.conflicted (carol's desktop copy 2016-01-04).txt", name1)
+
+	// With a depth of 2, the oldest marker is dropped.
+	cr = WriterDeviceDateConflictRenamer{MaxConflictDepth: 2}
+	name2 := cr.ConflictRenameHelper(t3, "carol", "desktop", name)
+	require.Equal(t,
+		"x.conflicted (bob's phone copy 2016-01-03)"+
+			".conflicted (carol's desktop copy 2016-01-04).txt", name2)
+
+	// Names without an extension work too.
+	cr = WriterDeviceDateConflictRenamer{MaxConflictDepth: 1}
+	name = cr.ConflictRenameHelper(t1, "alice", "laptop", "x")
+	name = cr.ConflictRenameHelper(t2, "bob", "phone", name)
+	require.Equal(t, "x.conflicted (bob's phone copy 2016-01-03)", name)
+}
+
+func TestConflictRenameInvolvedWriters(t *testing.T) {
+	now := time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)
+	writers := []libkb.NormalizedUsername{"carol", "alice", "bob", "alice"}
+
+	cr := WriterDeviceDateConflictRenamer{MaxInvolvedWriters: 2}
+	name := cr.ConflictRenameWritersHelper(now, writers, "report.txt")
+	require.Equal(t,
+		"report.conflicted (alice,bob +1 more 2016-01-02).txt", name)
+
+	cr = WriterDeviceDateConflictRenamer{MaxInvolvedWriters: 3}
+	name = cr.ConflictRenameWritersHelper(now, writers, "report.txt")
+	require.Equal(t,
+		"report.conflicted (alice,bob,carol 2016-01-02).txt", name)
+
+	// The writer-list markers are subject to the depth limit too.
+	cr = WriterDeviceDateConflictRenamer{
+		MaxConflictDepth:   1,
+		MaxInvolvedWriters: 2,
+	}
+	name = cr.ConflictRenameWritersHelper(now, writers, name)
+	require.Equal(t,
+		"report.conflicted (alice,bob +1 more 2016-01-02).txt", name)
+}
+
+func TestConflictRenamePattern(t *testing.T) {
+	now := time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)
+	cr := WriterDeviceDateConflictRenamer{MaxInvolvedWriters: 2}
+	pattern := cr.Pattern()
+
+	for _, original := range []string{
+		"x", "x.txt", "x.tar.gz", ".hidden", "with space.txt",
+	} {
+		name := cr.ConflictRenameHelper(now, "alice", "laptop", original)
+		require.True(t, pattern.MatchString(name), name)
+		name = cr.ConflictRenameHelper(now, "bob", "", name)
+		require.True(t, pattern.MatchString(name), name)
+		name = cr.ConflictRenameWritersHelper(now,
+			[]libkb.NormalizedUsername{"carol", "alice", "bob"}, original)
+		require.True(t, pattern.MatchString(name), name)
+	}
+
+	for _, name := range []string{
+		"x", "x.txt", "report (final).txt", "x.conflicted.txt",
+		"x.conflicted (alice's laptop copy).txt",
+	} {
+		require.False(t, pattern.MatchString(name), name)
+	}
+}
+
+func TestConflictRenameTimestampGranularity(t *testing.T) {
+	t1 := time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)
+	t2 := time.Date(2016, 1, 2, 15, 4, 59, 0, time.UTC)
+	t3 := time.Date(2016, 1, 2, 15, 5, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		granularity ConflictTimestampGranularity
+		expected    string
+		// Which of t2 and t3 should collide with t1.
+		collidesT2, collidesT3 bool
+	}{
+		{ConflictTimestampDate, "2016-01-02", true, true},
+		{ConflictTimestampMinute, "2016-01-02 15h04", true, false},
+		{ConflictTimestampSecond, "2016-01-02 15h04m05s", false, false},
+	} {
+		cr := WriterDeviceDateConflictRenamer{
+			TimestampGranularity: test.granularity,
+		}
+		name1 := cr.ConflictRenameHelper(t1, "alice", "laptop", "x.txt")
+		require.Equal(t,
+			"x.conflicted (alice's laptop copy "+test.expected+").txt",
+			name1)
+		require.True(t, cr.Pattern().MatchString(name1), name1)
+
+		name2 := cr.ConflictRenameHelper(t2, "alice", "laptop", "x.txt")
+		require.Equal(t, test.collidesT2, name1 == name2, name2)
+		name3 := cr.ConflictRenameHelper(t3, "alice", "laptop", "x.txt")
+		require.Equal(t, test.collidesT3, name1 == name3, name3)
+
+		// Nested markers and names without an extension still
+		// work.
+		name := cr.ConflictRenameHelper(t1, "alice", "laptop", "x")
+		name = cr.ConflictRenameHelper(t3, "bob", "phone", name)
+		require.True(t, cr.Pattern().MatchString(name), name)
+		base, ext := splitExtension(name)
+		require.Equal(t, name, base)
+		require.Equal(t, "", ext)
+	}
+}
+
+func TestDatePrefixConflictRename(t *testing.T) {
+	now := time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)
+	cr := DatePrefixConflictRenamer{}
+	pattern := cr.Pattern()
+
+	for _, test := range []struct {
+		original, expected string
+	}{
+		{"report.pdf", "report (conflicted 2016-01-02 alice's laptop).pdf"},
+		{"report-v2.pdf",
+			"report-v2 (conflicted 2016-01-02 alice's laptop).pdf"},
+		{"archive.tar.gz",
+			"archive (conflicted 2016-01-02 alice's laptop).tar.gz"},
+		{"x", "x (conflicted 2016-01-02 alice's laptop)"},
+		{".hidden", ".hidden (conflicted 2016-01-02 alice's laptop)"},
+	} {
+		name := cr.ConflictRenameHelper(now, "alice", "laptop", test.original)
+		require.Equal(t, test.expected, name)
+		require.True(t, pattern.MatchString(name), name)
+	}
+
+	// Markers nest, and an unknown device is named as such.
+	cr.TimestampGranularity = ConflictTimestampMinute
+	name := cr.ConflictRenameHelper(now, "bob", "",
+		"report (conflicted 2016-01-02 alice's laptop).pdf")
+	require.Equal(t, "report (conflicted 2016-01-02 alice's laptop) "+
+		"(conflicted 2016-01-02 15h04 bob's unknown).pdf", name)
+	require.True(t, pattern.MatchString(name), name)
+
+	for _, name := range []string{
+		"report.pdf", "report (final).pdf", "report (conflicted).pdf",
+		"report.conflicted (alice's laptop copy 2016-01-02).pdf",
+	} {
+		require.False(t, pattern.MatchString(name), name)
+	}
+}
+
+func TestConflictRenameCounter(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	config := NewConfigMock(mockCtrl, NewSafeTestReporter(t))
+	now := time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)
+	config.mockClock.EXPECT().Now().AnyTimes().Return(now)
+
+	co, err := newCreateOp("foo.txt", BlockPointer{ID: fakeBlockID(1)}, File)
+	require.NoError(t, err)
+	co.setWriterInfo(writerInfo{name: "alice", deviceName: "laptop"})
+
+	taken := map[string]bool{}
+	exists := func(name string) bool { return taken[name] }
+
+	for _, test := range []struct {
+		cr       ConflictRenamer
+		expected []string
+	}{
+		{WriterDeviceDateConflictRenamer{config: config}, []string{
+			"foo.conflicted (alice's laptop copy 2016-01-02).txt",
+			"foo.conflicted (alice's laptop copy 2016-01-02 #2).txt",
+			"foo.conflicted (alice's laptop copy 2016-01-02 #3).txt",
+		}},
+		{NewDatePrefixConflictRenamer(config), []string{
+			"foo (conflicted 2016-01-02 alice's laptop).txt",
+			"foo (conflicted 2016-01-02 alice's laptop #2).txt",
+			"foo (conflicted 2016-01-02 alice's laptop #3).txt",
+		}},
+	} {
+		// Each name should be taken in turn once the previous
+		// ones exist.
+		for _, expected := range test.expected {
+			name := test.cr.ConflictRename(co, "foo.txt", nil, exists)
+			require.Equal(t, expected, name)
+			require.True(t, test.cr.Pattern().MatchString(name), name)
+			taken[name] = true
+		}
+
+		// Without an exists predicate, the first name is always
+		// used.
+		name := test.cr.ConflictRename(co, "foo.txt", nil, noExistingNames)
+		require.Equal(t, test.expected[0], name)
+	}
+}
+
+func TestConflictRenameUnknownDevice(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	config := NewConfigMock(mockCtrl, NewSafeTestReporter(t))
+	now := time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)
+	config.mockClock.EXPECT().Now().AnyTimes().Return(now)
+
+	kid1 := keybase1.KID("0120aaaaaaaabbbbbbbb0a")
+	kid2 := keybase1.KID("0120ccccccccdddddddd0a")
+	makeOp := func(kid keybase1.KID) op {
+		co, err := newCreateOp(
+			"foo.txt", BlockPointer{ID: fakeBlockID(1)}, File)
+		require.NoError(t, err)
+		co.setWriterInfo(writerInfo{name: "alice", kid: kid})
+		return co
+	}
+
+	for _, test := range []struct {
+		cr           WriterDeviceDateConflictRenamer
+		name1, name2 string
+	}{
+		// By default, unnamed devices are all "unknown".
+		{WriterDeviceDateConflictRenamer{config: config},
+			"foo.conflicted (alice's unknown copy 2016-01-02).txt",
+			"foo.conflicted (alice's unknown copy 2016-01-02).txt"},
+		{WriterDeviceDateConflictRenamer{
+			config: config, UnknownDeviceName: "unbekannt"},
+			"foo.conflicted (alice's unbekannt copy 2016-01-02).txt",
+			"foo.conflicted (alice's unbekannt copy 2016-01-02).txt"},
+		// With the KID suffix, they're told apart.
+		{WriterDeviceDateConflictRenamer{
+			config: config, UnknownDeviceKIDSuffix: true},
+			"foo.conflicted (alice's unknown aaaaaaaa copy 2016-01-02).txt",
+			"foo.conflicted (alice's unknown cccccccc copy 2016-01-02).txt"},
+		{WriterDeviceDateConflictRenamer{config: config,
+			UnknownDeviceName: "unbekannt", UnknownDeviceKIDSuffix: true},
+			"foo.conflicted (alice's unbekannt aaaaaaaa copy 2016-01-02).txt",
+			"foo.conflicted (alice's unbekannt cccccccc copy 2016-01-02).txt"},
+	} {
+		name := test.cr.ConflictRename(
+			makeOp(kid1), "foo.txt", nil, noExistingNames)
+		require.Equal(t, test.name1, name)
+		require.True(t, test.cr.Pattern().MatchString(name), name)
+		name = test.cr.ConflictRename(
+			makeOp(kid2), "foo.txt", nil, noExistingNames)
+		require.Equal(t, test.name2, name)
+	}
+
+	// Without a KID, there's nothing to add.
+	cr := WriterDeviceDateConflictRenamer{
+		config: config, UnknownDeviceKIDSuffix: true}
+	require.Equal(t, "foo.conflicted (alice's unknown copy 2016-01-02).txt",
+		cr.ConflictRename(makeOp(""), "foo.txt", nil, noExistingNames))
+	require.Equal(t, "foo.conflicted (alice's unknown copy 2016-01-02).txt",
+		cr.ConflictRenameHelper(now, "alice", "", "foo.txt"))
+
+	// A named device is unaffected.
+	co := makeOp(kid1)
+	co.setWriterInfo(writerInfo{name: "alice", kid: kid1, deviceName: "laptop"})
+	require.Equal(t, "foo.conflicted (alice's laptop copy 2016-01-02).txt",
+		cr.ConflictRename(co, "foo.txt", nil, noExistingNames))
+}
+
+func TestConflictRenameDateFormat(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	config := NewConfigMock(mockCtrl, NewSafeTestReporter(t))
+	now := time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)
+	config.mockClock.EXPECT().Now().AnyTimes().Return(now)
+
+	co, err := newCreateOp("foo.txt", BlockPointer{ID: fakeBlockID(1)}, File)
+	require.NoError(t, err)
+	co.setWriterInfo(writerInfo{name: "alice", deviceName: "laptop"})
+
+	for _, test := range []struct {
+		format, expected string
+	}{
+		// The default.
+		{"", "foo.conflicted (alice's laptop copy 2016-01-02).txt"},
+		{"2006-01-02 15h04m", "foo.conflicted " +
+			"(alice's laptop copy 2016-01-02 15h04m).txt"},
+		{"02 Jan 2006", "foo.conflicted (alice's laptop copy 02 Jan 2016).txt"},
+	} {
+		cr, err := NewWriterDeviceDateConflictRenamer(config, test.format)
+		require.NoError(t, err)
+		name := cr.ConflictRename(co, "foo.txt", nil, noExistingNames)
+		require.Equal(t, test.expected, name)
+		require.True(t, cr.Pattern().MatchString(name), name)
+		require.Equal(t, test.expected,
+			cr.ConflictRenameHelper(now, "alice", "laptop", "foo.txt"))
+	}
+
+	for _, format := range []string{
+		"no date here", "2006/01/02", "01-02 (2006)", "2006-01-02 15:04",
+		"2006.01.02", `2006\01\02`,
+	} {
+		_, err := NewWriterDeviceDateConflictRenamer(config, format)
+		require.IsType(t, InvalidConflictDateFormatError{}, err, format)
+	}
+}
@@ -54,6 +54,9 @@ type ConflictResolver struct {
 	fbo              *folderBranchOps
 	log              logger.Logger
 	maxRevsThreshold int
+	// writerInfos caches the writer infos looked up while
+	// resolving, since many ops usually share a writer.
+	writerInfos *writerInfoCache
 
 	inputChanLock sync.RWMutex
 	inputChan     chan conflictInput
@@ -64,6 +67,11 @@ type ConflictResolver struct {
 	inputLock    sync.Mutex
 	currInput    conflictInput
 	lockNextTime bool
+
+	// completionListeners are notified, and then removed, the next
+	// time a resolution completes successfully.
+	completionLock      sync.Mutex
+	completionListeners []chan<- MetadataRevision
 }
 
 // NewConflictResolver constructs a new ConflictResolver (and launches
@@ -84,6 +92,8 @@ func NewConflictResolver(
 		fbo:              fbo,
 		log:              log,
 		maxRevsThreshold: crMaxRevsThresholdDefault,
+		writerInfos: newWriterInfoCache(config,
+			writerInfoCacheCapacityDefault, config.WriterInfoCacheTTL()),
 		currInput: conflictInput{
 			unmerged: MetadataRevisionUninitialized,
 			merged:   MetadataRevisionUninitialized,
@@ -195,6 +205,23 @@ func (cr *ConflictResolver) Resolve(unmerged MetadataRevision,
 	cr.inputChan <- conflictInput{unmerged, merged}
 }
 
+// forceResolve is like Resolve, but starts a new resolution of the
+// unmerged branch even if one has already been tried for the same
+// revisions, and has it block unmerged writes so that it can't be
+// canceled by them. It's used when the unmerged branch can't grow
+// any more, so only a successful resolution can unblock writes.
+func (cr *ConflictResolver) forceResolve(unmerged MetadataRevision) {
+	func() {
+		cr.inputLock.Lock()
+		defer cr.inputLock.Unlock()
+		cr.lockNextTime = true
+		if cr.currInput.unmerged >= unmerged {
+			cr.currInput.unmerged = unmerged - 1
+		}
+	}()
+	cr.Resolve(unmerged, MetadataRevisionUninitialized)
+}
+
 // Wait blocks until the current set of submitted resolutions are
 // complete (though not necessarily successful), or until the given
 // context is canceled.
@@ -220,6 +247,26 @@ func (cr *ConflictResolver) Restart(baseCtx context.Context) {
 	cr.startProcessing(baseCtx)
 }
 
+// notifyOnCompletion returns a channel that will receive the
+// resolved revision the next time a resolution completes
+// successfully. Each returned channel receives at most one value.
+func (cr *ConflictResolver) notifyOnCompletion() <-chan MetadataRevision {
+	cr.completionLock.Lock()
+	defer cr.completionLock.Unlock()
+	c := make(chan MetadataRevision, 1)
+	cr.completionListeners = append(cr.completionListeners, c)
+	return c
+}
+
+func (cr *ConflictResolver) signalCompletion(resolvedRev MetadataRevision) {
+	cr.completionLock.Lock()
+	defer cr.completionLock.Unlock()
+	for _, c := range cr.completionListeners {
+		c <- resolvedRev
+	}
+	cr.completionListeners = nil
+}
+
 func (cr *ConflictResolver) checkDone(ctx context.Context) error {
 	select {
 	case <-ctx.Done():
@@ -301,13 +348,15 @@ func (cr *ConflictResolver) makeChains(ctx context.Context,
 	unmerged, merged []ImmutableRootMetadata) (
 	unmergedChains *crChains, mergedChains *crChains, err error) {
 	unmergedChains, err =
-		newCRChains(ctx, cr.config, unmerged, &cr.fbo.blocks, true)
+		newCRChains(ctx, cr.config, unmerged, &cr.fbo.blocks, true,
+			cr.writerInfos)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	mergedChains, err =
-		newCRChains(ctx, cr.config, merged, &cr.fbo.blocks, true)
+		newCRChains(ctx, cr.config, merged, &cr.fbo.blocks, true,
+			cr.writerInfos)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1057,7 +1106,8 @@ func (cr *ConflictResolver) addRecreateOpsToUnmergedChains(ctx context.Context,
 	if err != nil {
 		return nil, err
 	}
-	winfo, err := newWriterInfo(ctx, cr.config, uid, unmergedChains.mostRecentMD.LastModifyingWriterKID())
+	winfo, err := cr.writerInfos.get(
+		ctx, uid, unmergedChains.mostRecentMD.LastModifyingWriterKID())
 	if err != nil {
 		return nil, err
 	}
@@ -1598,7 +1648,7 @@ func (cr *ConflictResolver) addMergedRecreates(ctx context.Context,
 						return err
 					}
 					co.AddRefBlock(c.mostRecent)
-					winfo, err := newWriterInfo(ctx, cr.config,
+					winfo, err := cr.writerInfos.get(ctx,
 						mergedChains.mostRecentMD.LastModifyingWriter(),
 						mergedChains.mostRecentMD.LastModifyingWriterKID())
 					if err != nil {
@@ -1617,11 +1667,41 @@ func (cr *ConflictResolver) addMergedRecreates(ctx context.Context,
 	return nil
 }
 
+// mergedNameExists returns an exists predicate for ConflictRename
+// that reports whether a name is taken in the merged directory at
+// dir. The directory is only fetched the first time the predicate is
+// called, and if it can't be fetched, every name is reported as free.
+func (cr *ConflictResolver) mergedNameExists(ctx context.Context,
+	lState *lockState, mergedChains *crChains, dir path) func(string) bool {
+	var children map[string]DirEntry
+	fetched := false
+	return func(name string) bool {
+		if !fetched {
+			fetched = true
+			ptr := dir.tailPointer()
+			if !mergedChains.isDeleted(ptr) {
+				dblock, err := cr.fbo.blocks.GetDirBlockForReading(
+					ctx, lState, mergedChains.mostRecentMD.ReadOnly(),
+					ptr, dir.Branch, dir)
+				if err != nil {
+					cr.log.CDebugf(ctx, "Couldn't get merged dir %v "+
+						"to check for conflict names: %v", dir, err)
+				} else {
+					children = dblock.Children
+				}
+			}
+		}
+		_, ok := children[name]
+		return ok
+	}
+}
+
 // getActionsToMerge returns the set of actions needed to merge each
 // unmerged chain of operations, in a map keyed by the tail pointer of
 // the corresponding merged path.
-func (cr *ConflictResolver) getActionsToMerge(unmergedChains *crChains,
-	mergedChains *crChains, mergedPaths map[BlockPointer]path) (
+func (cr *ConflictResolver) getActionsToMerge(ctx context.Context,
+	lState *lockState, unmergedChains *crChains, mergedChains *crChains,
+	mergedPaths map[BlockPointer]path) (
 	map[BlockPointer]crActionList, error) {
 	actionMap := make(map[BlockPointer]crActionList)
 	for unmergedMostRecent, unmergedChain := range unmergedChains.byMostRecent {
@@ -1641,8 +1721,21 @@ func (cr *ConflictResolver) getActionsToMerge(unmergedChains *crChains,
 			continue
 		}
 
+		// Conflict renames shouldn't collide with names already
+		// in the merged branch.
+		mergedNames := noMergedNames
+		if !unmergedChain.isFile() {
+			mergedNames.dir = cr.mergedNameExists(
+				ctx, lState, mergedChains, mergedPath)
+		}
+		if mergedPath.hasValidParent() {
+			mergedNames.parent = cr.mergedNameExists(
+				ctx, lState, mergedChains, *mergedPath.parentPath())
+		}
+
 		actions, err := unmergedChain.getActionsToMerge(
-			cr.config.ConflictRenamer(), mergedPath, mergedChain)
+			cr.config.ConflictRenamer(), cr.config.MergeStrategy(),
+			mergedPath, mergedChain, mergedNames)
 		if err != nil {
 			return nil, err
 		}
@@ -1756,8 +1849,9 @@ func collapseActions(unmergedChains *crChains, unmergedPaths []path,
 }
 
 func (cr *ConflictResolver) computeActions(ctx context.Context,
-	unmergedChains *crChains, mergedChains *crChains, unmergedPaths []path,
-	mergedPaths map[BlockPointer]path, recreateOps []*createOp) (
+	lState *lockState, unmergedChains *crChains, mergedChains *crChains,
+	unmergedPaths []path, mergedPaths map[BlockPointer]path,
+	recreateOps []*createOp) (
 	map[BlockPointer]crActionList, []path, error) {
 	// Process all the recreateOps, adding them to the appropriate
 	// unmerged chains.
@@ -1783,8 +1877,8 @@ func (cr *ConflictResolver) computeActions(ctx context.Context,
 		return nil, nil, err
 	}
 
-	actionMap, err :=
-		cr.getActionsToMerge(unmergedChains, mergedChains, mergedPaths)
+	actionMap, err := cr.getActionsToMerge(
+		ctx, lState, unmergedChains, mergedChains, mergedPaths)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -2491,7 +2585,7 @@ func (cr *ConflictResolver) makePostResolutionPaths(ctx context.Context,
 	resolvedChains, err := newCRChains(ctx, cr.config,
 		[]ImmutableRootMetadata{MakeImmutableRootMetadata(md, fakeMdID(1),
 			cr.config.Clock().Now())},
-		&cr.fbo.blocks, false)
+		&cr.fbo.blocks, false, cr.writerInfos)
 	if err != nil {
 		return nil, err
 	}
@@ -3280,6 +3374,9 @@ func (e CRWrapError) Error() string {
 func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	cr.log.CDebugf(ctx, "Starting conflict resolution with input %v", ci)
 	var err error
+	// Set if the resolution failed, but the branch was unstaged
+	// instead, in which case err is cleared.
+	var unstaged bool
 	lState := makeFBOLockState()
 	defer func() {
 		cr.log.CDebugf(ctx, "Finished conflict resolution: %v", err)
@@ -3290,9 +3387,15 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 				WriteMode, CRWrapError{err})
 		} else {
 			// We finished successfully, so no need to lock next time.
-			cr.inputLock.Lock()
-			defer cr.inputLock.Unlock()
-			cr.lockNextTime = false
+			func() {
+				cr.inputLock.Lock()
+				defer cr.inputLock.Unlock()
+				cr.lockNextTime = false
+			}()
+			// Only a real resolution counts as a completion.
+			if !unstaged {
+				cr.signalCompletion(cr.fbo.getCurrMDRevision(lState))
+			}
 		}
 	}()
 
@@ -3307,6 +3410,7 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 		if err != nil {
 			// writerLock is definitely unlocked by here.
 			err = cr.maybeUnstageAfterFailure(ctx, lState, mergedMDs, err)
+			unstaged = err == nil
 		}
 	}()
 
@@ -3385,8 +3489,8 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	// actions contains the logic needed to manipulate the data into
 	// the final merged state, including the resolution of any
 	// conflicts that occurred between the two branches.
-	actionMap, newUnmergedPaths, err := cr.computeActions(ctx, unmergedChains,
-		mergedChains, unmergedPaths, mergedPaths, recOps)
+	actionMap, newUnmergedPaths, err := cr.computeActions(ctx, lState,
+		unmergedChains, mergedChains, unmergedPaths, mergedPaths, recOps)
 	if err != nil {
 		return
 	}
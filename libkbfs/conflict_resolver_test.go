@@ -32,6 +32,8 @@ func crTestInit(t *testing.T) (mockCtrl *gomock.Controller, config *ConfigMock,
 	mockDaemon := NewMockKeybaseService(mockCtrl)
 	mockDaemon.EXPECT().LoadUserPlusKeys(gomock.Any(), gomock.Any()).AnyTimes().Return(UserInfo{Name: "mockUser"}, nil)
 	config.SetKeybaseService(mockDaemon)
+	// The writer info cache checks its entries against the clock.
+	config.mockClock.EXPECT().Now().AnyTimes().Return(time.Now())
 	return mockCtrl, config, fbo.cr
 }
 
@@ -132,6 +134,18 @@ func TestCRInput(t *testing.T) {
 	cr.Wait(ctx)
 }
 
+func TestCRWriterInfoCacheTTL(t *testing.T) {
+	mockCtrl, config, cr := crTestInit(t)
+	defer crTestShutdown(mockCtrl, config, cr)
+	require.Equal(t, writerInfoCacheTTLDefault, cr.writerInfos.ttl)
+
+	// A new resolver should use the configured TTL.
+	config.SetWriterInfoCacheTTL(time.Minute)
+	cr2 := NewConflictResolver(config, cr.fbo)
+	defer cr2.Shutdown()
+	require.Equal(t, time.Minute, cr2.writerInfos.ttl)
+}
+
 func TestCRInputFracturedRange(t *testing.T) {
 	mockCtrl, config, cr := crTestInit(t)
 	defer crTestShutdown(mockCtrl, config, cr)
@@ -328,8 +342,8 @@ func testCRCheckPathsAndActions(t *testing.T, cr *ConflictResolver,
 	}
 
 	// Now for step 2 -- check the actions
-	actionMap, _, err := cr.computeActions(ctx, unmergedChains, mergedChains,
-		unmergedPaths, mergedPaths, recreateOps)
+	actionMap, _, err := cr.computeActions(ctx, lState, unmergedChains,
+		mergedChains, unmergedPaths, mergedPaths, recreateOps)
 	if err != nil {
 		t.Fatalf("Couldn't compute actions: %v", err)
 	}
@@ -961,7 +975,8 @@ func TestCRMergedChainsConflictSimple(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	clock, now := newTestClockAndTimeNow()
+	// Noon on 2016-01-02, UTC.
+	clock := NewTestClockAtUnix(1451736000)
 	config2.SetClock(clock)
 
 	name := userName1.String() + "," + userName2.String()
@@ -1004,11 +1019,10 @@ func TestCRMergedChainsConflictSimple(t *testing.T) {
 	mergedPathRoot := cr1.fbo.nodeCache.PathFromNode(dirRoot1)
 	mergedPaths[unmergedPathRoot.tailPointer()] = mergedPathRoot
 
-	cre := WriterDeviceDateConflictRenamer{}
 	expectedActions := map[BlockPointer]crActionList{
 		mergedPathRoot.tailPointer(): {&renameUnmergedAction{
 			"file1",
-			cre.ConflictRenameHelper(now, "u2", "dev1", "file1"),
+			"file1.conflicted (u2's dev1 copy 2016-01-02)",
 			"", 0, false, zeroPtr, zeroPtr}},
 	}
 
@@ -1029,7 +1043,8 @@ func TestCRMergedChainsConflictFileCollapse(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	clock, now := newTestClockAndTimeNow()
+	// Noon on 2016-01-02, UTC.
+	clock := NewTestClockAtUnix(1451736000)
 	config2.SetClock(clock)
 
 	name := userName1.String() + "," + userName2.String()
@@ -1110,13 +1125,12 @@ func TestCRMergedChainsConflictFileCollapse(t *testing.T) {
 	coFile, err := newCreateOp("file", dirRootPtr, Exec)
 	require.NoError(t, err)
 
-	cre := WriterDeviceDateConflictRenamer{}
 	mergedPathRoot := cr1.fbo.nodeCache.PathFromNode(dirRoot1)
 	// Both unmerged actions should collapse into just one rename operation
 	expectedActions := map[BlockPointer]crActionList{
 		mergedPathRoot.tailPointer(): {&renameUnmergedAction{
 			"file",
-			cre.ConflictRenameHelper(now, "u2", "dev1", "file"),
+			"file.conflicted (u2's dev1 copy 2016-01-02)",
 			"", 0, false, zeroPtr, zeroPtr}},
 	}
 
@@ -1179,8 +1193,8 @@ func TestCRDoActionsSimple(t *testing.T) {
 		t.Fatalf("Couldn't build chains and paths: %v", err)
 	}
 
-	actionMap, _, err := cr2.computeActions(ctx, unmergedChains, mergedChains,
-		unmergedPaths, mergedPaths, recreateOps)
+	actionMap, _, err := cr2.computeActions(ctx, lState, unmergedChains,
+		mergedChains, unmergedPaths, mergedPaths, recreateOps)
 	if err != nil {
 		t.Fatalf("Couldn't compute actions: %v", err)
 	}
@@ -1226,7 +1240,8 @@ func TestCRDoActionsWriteConflict(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	clock, now := newTestClockAndTimeNow()
+	// Noon on 2016-01-02, UTC.
+	clock := NewTestClockAtUnix(1451736000)
 	config2.SetClock(clock)
 
 	name := userName1.String() + "," + userName2.String()
@@ -1295,8 +1310,8 @@ func TestCRDoActionsWriteConflict(t *testing.T) {
 		t.Fatalf("Couldn't build chains and paths: %v", err)
 	}
 
-	actionMap, _, err := cr2.computeActions(ctx, unmergedChains, mergedChains,
-		unmergedPaths, mergedPaths, recreateOps)
+	actionMap, _, err := cr2.computeActions(ctx, lState, unmergedChains,
+		mergedChains, unmergedPaths, mergedPaths, recreateOps)
 	if err != nil {
 		t.Fatalf("Couldn't compute actions: %v", err)
 	}
@@ -1311,8 +1326,7 @@ func TestCRDoActionsWriteConflict(t *testing.T) {
 
 	// Does the merged block contain the two files?
 	mergedRootPath := cr1.fbo.nodeCache.PathFromNode(dir1)
-	cre := WriterDeviceDateConflictRenamer{}
-	mergedName := cre.ConflictRenameHelper(now, "u2", "dev1", "file")
+	mergedName := "file.conflicted (u2's dev1 copy 2016-01-02)"
 	if len(newFileBlocks) != 1 {
 		t.Errorf("Unexpected new file blocks!")
 	}
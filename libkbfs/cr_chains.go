@@ -81,8 +81,9 @@ func (cc *crChain) getCollapsedWriteRange() []WriteRange {
 	return wr
 }
 
-func (cc *crChain) getActionsToMerge(renamer ConflictRenamer, mergedPath path,
-	mergedChain *crChain) (crActionList, error) {
+func (cc *crChain) getActionsToMerge(renamer ConflictRenamer,
+	strategy MergeStrategy, mergedPath path, mergedChain *crChain,
+	mergedNames crMergedNames) (crActionList, error) {
 	var actions crActionList
 
 	// If this is a file, determine whether the unmerged chain
@@ -127,14 +128,28 @@ func (cc *crChain) getActionsToMerge(renamer ConflictRenamer, mergedPath path,
 		if mergedChain != nil {
 			for _, mergedOp := range mergedChain.ops {
 				action, err :=
-					unmergedOp.CheckConflict(renamer, mergedOp, cc.isFile())
+					unmergedOp.CheckConflict(renamer, mergedOp, cc.isFile(),
+						mergedNames)
 				if err != nil {
 					return nil, err
 				}
-				if action != nil {
-					conflict = true
-					actions = append(actions, action)
+				if action == nil {
+					continue
 				}
+				conflict = true
+
+				// A conflicting file would normally be renamed,
+				// but the merge strategy may prefer to drop the
+				// unmerged op altogether.
+				if _, ok := action.(*renameUnmergedAction); ok &&
+					cc.isFile() && strategy != nil &&
+					strategy.ResolveFileConflict(unmergedOp, mergedOp) ==
+						MergeKeepMerged {
+					actions = append(actions,
+						&dropUnmergedAction{unmergedOp})
+					break
+				}
+				actions = append(actions, action)
 			}
 		}
 		// no conflicts!
@@ -626,7 +641,7 @@ func newCRChainsEmpty() *crChains {
 }
 
 func newCRChains(ctx context.Context, cfg Config, rmds []ImmutableRootMetadata,
-	fbo *folderBlockOps, identifyTypes bool) (
+	fbo *folderBlockOps, identifyTypes bool, winfos *writerInfoCache) (
 	ccs *crChains, err error) {
 	ccs = newCRChainsEmpty()
 
@@ -639,7 +654,7 @@ func newCRChains(ctx context.Context, cfg Config, rmds []ImmutableRootMetadata,
 			continue
 		}
 
-		winfo, err := newWriterInfo(ctx, cfg, rmd.LastModifyingWriter(),
+		winfo, err := winfos.get(ctx, rmd.LastModifyingWriter(),
 			rmd.LastModifyingWriterKID())
 		if err != nil {
 			return nil, err
@@ -178,7 +178,9 @@ func TestCRChainsSingleOp(t *testing.T) {
 	rmds := []*RootMetadata{rmd}
 	config, irmds := testCRChainsFillInWriter(t, rmds)
 	defer config.Shutdown()
-	cc, err := newCRChains(context.Background(), config, irmds, nil, true)
+	cc, err := newCRChains(context.Background(), config, irmds, nil, true,
+		newWriterInfoCache(config, writerInfoCacheCapacityDefault,
+			writerInfoCacheTTLDefault))
 	if err != nil {
 		t.Fatalf("Error making chains: %v", err)
 	}
@@ -213,7 +215,9 @@ func TestCRChainsRenameOp(t *testing.T) {
 	rmds := []*RootMetadata{rmd}
 	config, irmds := testCRChainsFillInWriter(t, rmds)
 	defer config.Shutdown()
-	cc, err := newCRChains(context.Background(), config, irmds, nil, true)
+	cc, err := newCRChains(context.Background(), config, irmds, nil, true,
+		newWriterInfoCache(config, writerInfoCacheCapacityDefault,
+			writerInfoCacheTTLDefault))
 	if err != nil {
 		t.Fatalf("Error making chains: %v", err)
 	}
@@ -323,7 +327,9 @@ func TestCRChainsMultiOps(t *testing.T) {
 	rmds := []*RootMetadata{bigRmd}
 	config, irmds := testCRChainsFillInWriter(t, rmds)
 	defer config.Shutdown()
-	cc, err := newCRChains(context.Background(), config, irmds, nil, true)
+	cc, err := newCRChains(context.Background(), config, irmds, nil, true,
+		newWriterInfoCache(config, writerInfoCacheCapacityDefault,
+			writerInfoCacheTTLDefault))
 	if err != nil {
 		t.Fatalf("Error making chains for big RMD: %v", err)
 	}
@@ -355,7 +361,9 @@ func TestCRChainsMultiOps(t *testing.T) {
 	// now make sure the chain of MDs gets the same answers
 	config, multiIrmds := testCRChainsFillInWriter(t, multiRmds)
 	defer config.Shutdown()
-	mcc, err := newCRChains(context.Background(), config, multiIrmds, nil, true)
+	mcc, err := newCRChains(context.Background(), config, multiIrmds, nil, true,
+		newWriterInfoCache(config, writerInfoCacheCapacityDefault,
+			writerInfoCacheTTLDefault))
 	if err != nil {
 		t.Fatalf("Error making chains for multi RMDs: %v", err)
 	}
@@ -481,7 +489,9 @@ func TestCRChainsCollapse(t *testing.T) {
 	rmds := []*RootMetadata{rmd}
 	config, irmds := testCRChainsFillInWriter(t, rmds)
 	defer config.Shutdown()
-	cc, err := newCRChains(context.Background(), config, irmds, nil, true)
+	cc, err := newCRChains(context.Background(), config, irmds, nil, true,
+		newWriterInfoCache(config, writerInfoCacheCapacityDefault,
+			writerInfoCacheTTLDefault))
 	if err != nil {
 		t.Fatalf("Error making chains: %v", err)
 	}
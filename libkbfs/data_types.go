@@ -45,6 +45,10 @@ type UserInfo struct {
 	// Revoked keys, and the time at which they were revoked.
 	RevokedVerifyingKeys   map[VerifyingKey]keybase1.KeybaseTime
 	RevokedCryptPublicKeys map[CryptPublicKey]keybase1.KeybaseTime
+
+	// The times at which the (non-revoked) verifying keys were
+	// provisioned, if known.
+	VerifyingKeyProvisionTimes map[VerifyingKey]keybase1.Time
 }
 
 // SessionInfo contains all the info about the keybase session that
@@ -914,7 +918,8 @@ const (
 
 // UserInfoFromProtocol returns UserInfo from UserPlusKeys
 func UserInfoFromProtocol(upk keybase1.UserPlusKeys) (UserInfo, error) {
-	verifyingKeys, cryptPublicKeys, kidNames, err := filterKeys(upk.DeviceKeys)
+	verifyingKeys, cryptPublicKeys, kidNames, provisionTimes, err :=
+		filterKeys(upk.DeviceKeys)
 	if err != nil {
 		return UserInfo{}, err
 	}
@@ -936,6 +941,8 @@ func UserInfoFromProtocol(upk keybase1.UserPlusKeys) (UserInfo, error) {
 		KIDNames:               kidNames,
 		RevokedVerifyingKeys:   revokedVerifyingKeys,
 		RevokedCryptPublicKeys: revokedCryptPublicKeys,
+
+		VerifyingKeyProvisionTimes: provisionTimes,
 	}, nil
 }
 
@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"strconv"
+	"time"
 )
 
 // diskJournal stores an ordered list of entries.
@@ -155,10 +156,16 @@ func (j diskJournal) removeEarliest() (empty bool, err error) {
 
 // The functions below are for reading and writing journal entries.
 
+// readJournalEntryBytes returns the encoded entry with the given
+// ordinal, for callers that need to decode it themselves.
+func (j diskJournal) readJournalEntryBytes(o journalOrdinal) (
+	[]byte, error) {
+	return ioutil.ReadFile(j.journalEntryPath(o))
+}
+
 func (j diskJournal) readJournalEntry(o journalOrdinal) (
 	interface{}, error) {
-	p := j.journalEntryPath(o)
-	buf, err := ioutil.ReadFile(p)
+	buf, err := j.readJournalEntryBytes(o)
 	if err != nil {
 		return bserverJournalEntry{}, err
 	}
@@ -245,6 +252,106 @@ func (j diskJournal) appendJournalEntry(
 	return j.writeLatestOrdinal(next)
 }
 
+// appendJournalEntries appends the given entries to the journal,
+// with the first one getting ordinal first, which must be the
+// successor of the latest ordinal if the journal isn't empty. All the
+// entries are written before the latest ordinal is updated, so a
+// failure partway through leaves the journal as it was.
+func (j diskJournal) appendJournalEntries(
+	first journalOrdinal, entries []interface{}) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	lo, err := j.readLatestOrdinal()
+	if os.IsNotExist(err) {
+		// Continue on.
+	} else if err != nil {
+		return err
+	} else if first != lo+1 {
+		return fmt.Errorf(
+			"%v unexpectedly does not follow %v", first, lo)
+	}
+
+	last := first + journalOrdinal(len(entries)-1)
+	if last < first {
+		// Rollover is almost certainly a bug.
+		return fmt.Errorf("Ordinal rollover for %d entries after %v",
+			len(entries), first)
+	}
+
+	for i, entry := range entries {
+		err := j.writeJournalEntry(first+journalOrdinal(i), entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = j.readEarliestOrdinal()
+	if os.IsNotExist(err) {
+		err := j.writeEarliestOrdinal(first)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return j.writeLatestOrdinal(last)
+}
+
+// readHighestOnDiskOrdinal scans the journal directory for entry
+// files and returns the highest ordinal among them, regardless of
+// what the latest ordinal file says. ok is false if there are no
+// entry files.
+func (j diskJournal) readHighestOnDiskOrdinal() (
+	o journalOrdinal, ok bool, err error) {
+	fileInfos, err := ioutil.ReadDir(j.dir)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	for _, fi := range fileInfos {
+		if fi.IsDir() {
+			continue
+		}
+		fileO, err := makeJournalOrdinal(fi.Name())
+		if err != nil {
+			// Not an entry file, e.g. EARLIEST or LATEST.
+			continue
+		}
+		if !ok || fileO > o {
+			o = fileO
+			ok = true
+		}
+	}
+	return o, ok, nil
+}
+
+// moveJournalEntry moves the entry file for the given ordinal, if
+// there is one, into destDir, which is created if necessary. The
+// moved file's modification time is set to mtime, to record when it
+// was moved, and its name is the ordinal followed by mtime, so that
+// moving an entry with the same ordinal later on doesn't overwrite
+// it.
+func (j diskJournal) moveJournalEntry(
+	o journalOrdinal, destDir string, mtime time.Time) error {
+	err := os.MkdirAll(destDir, 0700)
+	if err != nil {
+		return err
+	}
+	destPath := filepath.Join(
+		destDir, fmt.Sprintf("%s-%d", o, mtime.UnixNano()))
+	err = os.Rename(j.journalEntryPath(o), destPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return os.Chtimes(destPath, mtime, mtime)
+}
+
 func (j *diskJournal) move(newDir string) (oldDir string, err error) {
 	err = os.Rename(j.dir, newDir)
 	if err != nil {
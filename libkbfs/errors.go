@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	keybase1 "github.com/keybase/client/go/protocol"
@@ -536,6 +537,38 @@ func (e KeyNotFoundError) Error() string {
 	return fmt.Sprintf("Could not find key with kid=%s", e.kid)
 }
 
+// KeyTooNewError indicates that a verifying key was used to sign
+// something too soon after it was provisioned.
+type KeyTooNewError struct {
+	kid           keybase1.KID
+	provisionTime time.Time
+	atTime        time.Time
+	minAge        time.Duration
+}
+
+// Error implements the error interface for KeyTooNewError.
+func (e KeyTooNewError) Error() string {
+	return fmt.Sprintf("Key with kid=%s was provisioned at %s, which is "+
+		"less than %s before %s", e.kid, e.provisionTime, e.minAge,
+		e.atTime)
+}
+
+// KeyRevocationAmbiguousError indicates that a revoked verifying key
+// was checked at a time too close to its revocation time to tell,
+// given possible clock skew, whether it was still valid.
+type KeyRevocationAmbiguousError struct {
+	kid         keybase1.KID
+	revokedTime time.Time
+	atTime      time.Time
+	window      time.Duration
+}
+
+// Error implements the error interface for KeyRevocationAmbiguousError.
+func (e KeyRevocationAmbiguousError) Error() string {
+	return fmt.Sprintf("Key with kid=%s was revoked at %s, which is "+
+		"within %s of %s", e.kid, e.revokedTime, e.window, e.atTime)
+}
+
 // UnverifiableTlfUpdateError indicates that a MD update could not be
 // verified.
 type UnverifiableTlfUpdateError struct {
@@ -720,6 +753,16 @@ func (e InvalidHashError) Error() string {
 	return fmt.Sprintf("Invalid hash %s", e.H)
 }
 
+// InvalidMdIDError is returned whenever an MdID that isn't
+// well-formed for its hash type is detected.
+type InvalidMdIDError struct {
+	ID MdID
+}
+
+func (e InvalidMdIDError) Error() string {
+	return fmt.Sprintf("Invalid MdID %s", e.ID)
+}
+
 // InvalidTlfID indicates whether the TLF ID string is not parseable
 // or invalid.
 type InvalidTlfID struct {
@@ -808,6 +851,19 @@ func (e MDPrevRootMismatch) Error() string {
 		e.prevRoot, e.expectedPrevRoot)
 }
 
+// RMDSChainBrokenError indicates that the RootMetadataSigned at the
+// given index of a chain passed to VerifyRMDSChain failed
+// verification, either on its own or as a successor of the previous
+// one.
+type RMDSChainBrokenError struct {
+	Index int
+	Err   error
+}
+
+func (e RMDSChainBrokenError) Error() string {
+	return fmt.Sprintf("MD chain broken at index %d: %v", e.Index, e.Err)
+}
+
 // MDDiskUsageMismatch indicates an inconsistency in the DiskUsage
 // field of a RootMetadata object.
 type MDDiskUsageMismatch struct {
@@ -1193,3 +1249,61 @@ type MutableBareRootMetadataNoImplError struct {
 func (e MutableBareRootMetadataNoImplError) Error() string {
 	return "Does not implement MutableBareRootMetadata"
 }
+
+// InvalidLastModifyingWriterError indicates that the last modifying
+// writer of an MD isn't a writer of its folder.
+type InvalidLastModifyingWriterError struct {
+	Writer keybase1.UID
+}
+
+// Error implements the error interface for InvalidLastModifyingWriterError.
+func (e InvalidLastModifyingWriterError) Error() string {
+	return fmt.Sprintf("Invalid modifying writer %s", e.Writer)
+}
+
+// InvalidLastModifyingUserError indicates that the last modifying
+// user of an MD is neither a writer nor a reader of its folder.
+type InvalidLastModifyingUserError struct {
+	User keybase1.UID
+}
+
+// Error implements the error interface for InvalidLastModifyingUserError.
+func (e InvalidLastModifyingUserError) Error() string {
+	return fmt.Sprintf("Invalid modifying user %s", e.User)
+}
+
+// InvalidMDRangeTokenError indicates that an MDRangeToken passed to
+// GetRangePagedFromToken wasn't one returned by GetRangePaged.
+type InvalidMDRangeTokenError struct {
+	Token MDRangeToken
+}
+
+// Error implements the error interface for InvalidMDRangeTokenError.
+func (e InvalidMDRangeTokenError) Error() string {
+	return fmt.Sprintf("Invalid MD range token %q", string(e.Token))
+}
+
+// InvalidConflictDateFormatError indicates that a date format given
+// for conflict renaming would produce unusable conflict names.
+type InvalidConflictDateFormatError struct {
+	Format string
+	Reason string
+}
+
+// Error implements the error interface for InvalidConflictDateFormatError.
+func (e InvalidConflictDateFormatError) Error() string {
+	return fmt.Sprintf("Invalid conflict date format %q: %s",
+		e.Format, e.Reason)
+}
+
+// MDServerUnsupportedError indicates that an MDServer implementation
+// doesn't support the given method, e.g. because the remote server
+// has no RPC for it yet.
+type MDServerUnsupportedError struct {
+	Method string
+}
+
+// Error implements the error interface for MDServerUnsupportedError.
+func (e MDServerUnsupportedError) Error() string {
+	return fmt.Sprintf("%s not supported by this MD server", e.Method)
+}
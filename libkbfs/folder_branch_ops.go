@@ -417,6 +417,12 @@ func (fbo *folderBranchOps) GetFavorites(ctx context.Context) (
 	return nil, errors.New("GetFavorites is not supported by folderBranchOps")
 }
 
+func (fbo *folderBranchOps) ListAllConflicts(ctx context.Context) (
+	[]ConflictInfo, error) {
+	return nil, errors.New(
+		"ListAllConflicts is not supported by folderBranchOps")
+}
+
 func (fbo *folderBranchOps) RefreshCachedFavorites(ctx context.Context) {
 	// no-op
 }
@@ -1804,8 +1810,9 @@ func isRecoverableBlockErrorForRemoval(err error) bool {
 func isRetriableError(err error, retries int) bool {
 	_, isExclOnUnmergedError := err.(ExclOnUnmergedError)
 	_, isUnmergedSelfConflictError := err.(UnmergedSelfConflictError)
+	_, isTooManyRevisions := err.(MDServerErrorTooManyRevisions)
 	recoverable := isExclOnUnmergedError || isUnmergedSelfConflictError ||
-		isRecoverableBlockError(err)
+		isTooManyRevisions || isRecoverableBlockError(err)
 	return recoverable && retries < maxRetriesOnRecoverableErrors
 }
 
@@ -1942,10 +1949,13 @@ func isRevisionConflict(err error) bool {
 	_, isConflictDiskUsage := err.(MDServerErrorConflictDiskUsage)
 	_, isConditionFailed := err.(MDServerErrorConditionFailed)
 	_, isConflictFolderMapping := err.(MDServerErrorConflictFolderMapping)
+	// A branch that's grown too long needs conflict resolution to
+	// merge it back in.
+	_, isTooManyRevisions := err.(MDServerErrorTooManyRevisions)
 	_, isJournal := err.(MDJournalConflictError)
 	return isConflictRevision || isConflictPrevRoot ||
 		isConflictDiskUsage || isConditionFailed ||
-		isConflictFolderMapping || isJournal
+		isConflictFolderMapping || isTooManyRevisions || isJournal
 }
 
 func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
@@ -1990,6 +2000,15 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 		// We're out of date, and this is not an exclusive write, so put it as an
 		// unmerged MD.
 		mdID, err = mdops.PutUnmerged(ctx, md)
+		if _, ok := err.(MDServerErrorTooManyRevisions); ok {
+			// The branch is too long to grow any more, so it has
+			// to be merged back in by conflict resolution before
+			// this write is retried in `doMDWriteWithRetry`.  CR
+			// may have already given up on the current head, so
+			// force it to run again.
+			fbo.cr.forceResolve(md.Revision() - 1)
+			return err
+		}
 		if isRevisionConflict(err) {
 			// Self-conflicts are retried in `doMDWriteWithRetry`.
 			err = UnmergedSelfConflictError{err}
@@ -2308,6 +2327,12 @@ func (fbo *folderBranchOps) doMDWriteWithRetry(ctx context.Context,
 				if err = fbo.cr.Wait(ctx); err != nil {
 					return err
 				}
+			} else if _, ok := err.(MDServerErrorTooManyRevisions); ok {
+				// CR was forced to merge the too-long branch back
+				// in, so wait for it before retrying.
+				if err = fbo.cr.Wait(ctx); err != nil {
+					return err
+				}
 			} else if _, ok := err.(UnmergedSelfConflictError); ok {
 				// We can only get here if we are already on an
 				// unmerged branch and an errored PutUnmerged did make
@@ -48,6 +48,35 @@ type KBFSStatus struct {
 	JournalServer   *JournalServerStatus `json:",omitempty"`
 }
 
+// ConflictInfo describes an outstanding conflict in a folder, i.e.
+// an unmerged branch that hasn't been resolved yet.
+type ConflictInfo struct {
+	Tlf TlfID
+	BID BranchID
+	// The merged revision that the branch diverged from.
+	MergedRevision MetadataRevision
+	// The range of unmerged revisions on the branch, including
+	// any that are still only in the local journal.
+	RevisionStart MetadataRevision
+	RevisionEnd   MetadataRevision
+	// True if none of the branch has been flushed to the server
+	// yet.
+	JournalOnly bool
+}
+
+type conflictInfosByID []ConflictInfo
+
+func (c conflictInfosByID) Len() int { return len(c) }
+
+func (c conflictInfosByID) Less(i, j int) bool {
+	if c[i].Tlf != c[j].Tlf {
+		return c[i].Tlf.String() < c[j].Tlf.String()
+	}
+	return c[i].BID.String() < c[j].BID.String()
+}
+
+func (c conflictInfosByID) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+
 // StatusUpdate is a dummy type used to indicate status has been updated.
 type StatusUpdate struct{}
 
@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"reflect"
+	"regexp"
 	"time"
 
 	"github.com/keybase/client/go/libkb"
@@ -267,6 +268,11 @@ type KBFSOps interface {
 	// for the folder.
 	GetEditHistory(ctx context.Context, folderBranch FolderBranch) (
 		edits TlfWriterEdits, err error)
+	// ListAllConflicts returns the outstanding conflicts, i.e. the
+	// unmerged branches, of every folder known to this KBFSOps
+	// instance or its write journals, sorted by folder and branch
+	// ID.  This is a remote-access operation.
+	ListAllConflicts(ctx context.Context) ([]ConflictInfo, error)
 
 	// Shutdown is called to clean up any resources associated with
 	// this KBFSOps instance.
@@ -975,7 +981,10 @@ type MDServer interface {
 	// object corresponding to the given top-level folder's handle, if
 	// the logged-in user has read permission on the folder.  It
 	// creates the folder if one doesn't exist yet, and the logged-in
-	// user has permission to do so.
+	// user has permission to do so.  If mStatus is Unmerged, it
+	// returns the head of the current device's unmerged branch
+	// (whose branch ID is in the returned metadata), or nil if
+	// the device has no unmerged branch.
 	GetForHandle(ctx context.Context, handle BareTlfHandle,
 		mStatus MergeStatus) (TlfID, *RootMetadataSigned, error)
 
@@ -986,19 +995,56 @@ type MDServer interface {
 		*RootMetadataSigned, error)
 
 	// GetRange returns a range of (signed/encrypted) metadata objects
-	// corresponding to the passed revision numbers (inclusive).
+	// corresponding to the passed revision numbers (inclusive).  Both
+	// start and stop must be at least MetadataRevisionInitial, and
+	// stop must not be less than start, or else an
+	// MDServerErrorBadRequest is returned.  Revisions in the range
+	// that the server doesn't have are omitted from the result.
 	GetRange(ctx context.Context, id TlfID, bid BranchID, mStatus MergeStatus,
 		start, stop MetadataRevision) ([]*RootMetadataSigned, error)
 
+	// GetRangeByWriter is like GetRange, except that it returns
+	// only the metadata objects in the range whose last modifying
+	// writer is the given user.
+	GetRangeByWriter(ctx context.Context, id TlfID, bid BranchID,
+		mStatus MergeStatus, start, stop MetadataRevision,
+		writer keybase1.UID) ([]*RootMetadataSigned, error)
+
+	// HasRevision returns whether the server has a metadata object
+	// with the given revision on the given branch and, if so, its
+	// ID, e.g. for skipping a put of a revision that's already on
+	// the server.  It may cost as much as a GetRange of that
+	// revision, so it should only be used when there's reason to
+	// believe the revision is there.  rev must be at least
+	// MetadataRevisionInitial.
+	HasRevision(ctx context.Context, id TlfID, bid BranchID,
+		mStatus MergeStatus, rev MetadataRevision) (bool, MdID, error)
+
 	// Put stores the (signed/encrypted) metadata object for the given
 	// top-level folder. Note: If the unmerged bit is set in the metadata
 	// block's flags bitmask it will be appended to the unmerged per-device
 	// history.
 	Put(ctx context.Context, rmds *RootMetadataSigned) error
 
+	// TrialPut performs the same validation that Put would for
+	// the given metadata object, and returns the error that Put
+	// would return, but doesn't store anything.
+	TrialPut(ctx context.Context, rmds *RootMetadataSigned) error
+
 	// PruneBranch prunes all unmerged history for the given TLF branch.
 	PruneBranch(ctx context.Context, id TlfID, bid BranchID) error
 
+	// GetBranches returns the IDs of all the unmerged branches of
+	// the given TLF that haven't been pruned, across all devices,
+	// if the logged-in user has read permission on the folder.
+	GetBranches(ctx context.Context, id TlfID) ([]BranchID, error)
+
+	// GetQuotaInfo returns the number of bytes of metadata the
+	// logged-in user has put, along with the user's limit. A limit
+	// of 0 means there is none. Servers that don't track metadata
+	// usage return MDServerUnsupportedError.
+	GetQuotaInfo(ctx context.Context) (used, limit uint64, err error)
+
 	// RegisterForUpdate tells the MD server to inform the caller when
 	// there is a merged update with a revision number greater than
 	// currHead, which did NOT originate from this same MD server
@@ -1013,6 +1059,18 @@ type MDServer interface {
 	RegisterForUpdate(ctx context.Context, id TlfID,
 		currHead MetadataRevision) (<-chan error, error)
 
+	// RegisterForHandleChange tells the MD server to inform the
+	// caller when the latest handle for the given TLF changes, e.g.
+	// because one of its social assertions was resolved to a user.
+	// The caller must be a reader of the TLF.  This method returns a
+	// chan which receives only the new handle before it's closed, so
+	// the caller must re-register to get future handle changes. The
+	// chan is closed without receiving anything if the server is
+	// shut down first. Servers that don't support handle change
+	// notifications return MDServerUnsupportedError.
+	RegisterForHandleChange(ctx context.Context, id TlfID) (
+		<-chan BareTlfHandle, error)
+
 	// CheckForRekeys initiates the rekey checking process on the
 	// server.  The server is allowed to delay this request, and so it
 	// returns a channel for returning the error. Actual rekey
@@ -1186,6 +1244,15 @@ type KeyServer interface {
 		serverHalfID TLFCryptKeyServerHalfID,
 		cryptPublicKey CryptPublicKey) (TLFCryptKeyServerHalf, error)
 
+	// GetKeyHalves gets the server-side key halves for the given
+	// requests, returning one result per request, in the same
+	// order.  A key half that doesn't exist, or that the current
+	// user isn't authorized to get, gets a result with an
+	// MDServerErrorUnauthorized error; any other failure fails the
+	// whole call.
+	GetKeyHalves(ctx context.Context, requests []KeyHalfRequest) (
+		[]KeyHalfResult, error)
+
 	// PutTLFCryptKeyServerHalves stores a server-side key halves for a
 	// set of users and devices.
 	PutTLFCryptKeyServerHalves(ctx context.Context,
@@ -1254,7 +1321,28 @@ type Clock interface {
 // ConflictRenamer deals with names for conflicting directory entries.
 type ConflictRenamer interface {
 	// ConflictRename returns the appropriately modified filename.
-	ConflictRename(op op, original string) string
+	// involvedWriters is the set of writers involved in the
+	// conflict, which the renamer may or may not use. If exists
+	// returns true for the name the renamer would otherwise
+	// pick, it adds a counter to the name to make it unique. An
+	// exists that always returns false means no counter is
+	// ever added.
+	ConflictRename(op op, original string,
+		involvedWriters []libkb.NormalizedUsername,
+		exists func(name string) bool) string
+	// Pattern returns a regexp that matches any name produced by
+	// ConflictRename, and no name it wouldn't produce, so that
+	// external tooling can identify conflict files.
+	Pattern() *regexp.Regexp
+}
+
+// MergeStrategy decides how conflict resolution settles conflicting
+// changes to the same file made on the unmerged and merged branches.
+type MergeStrategy interface {
+	// ResolveFileConflict is called with the conflicting unmerged
+	// and merged ops, and returns whether to keep both versions
+	// (renaming the unmerged one), or just the merged one.
+	ResolveFileConflict(unmergedOp, mergedOp op) MergeDecision
 }
 
 // Config collects all the singleton instance instantiations needed to
@@ -1303,6 +1391,8 @@ type Config interface {
 	SetClock(Clock)
 	ConflictRenamer() ConflictRenamer
 	SetConflictRenamer(ConflictRenamer)
+	MergeStrategy() MergeStrategy
+	SetMergeStrategy(MergeStrategy)
 	MetadataVersion() MetadataVer
 	DataVersion() DataVer
 	RekeyQueue() RekeyQueue
@@ -1319,11 +1409,22 @@ type Config interface {
 	// MaxDirBytes indicates the maximum supported plaintext size of a
 	// directory in bytes.
 	MaxDirBytes() uint64
+	// MaxMDBytes indicates the maximum supported serialized size of
+	// a single MD object in bytes. Larger MDs are rejected when
+	// they're put. 0 means there's no limit.
+	MaxMDBytes() uint64
 	// DoBackgroundFlushes says whether we should periodically try to
 	// flush dirty files, even without a sync from the user.  Should
 	// be true except for during some testing.
 	DoBackgroundFlushes() bool
 	SetDoBackgroundFlushes(bool)
+	// AllowUnverifiedKeys says whether MD signed by a key that
+	// fails full verification should still be accepted, as long as
+	// the key is known (possibly revoked) for the signing user.
+	// Should be false except when reading folders of users whose
+	// keys are not yet fully verified.
+	AllowUnverifiedKeys() bool
+	SetAllowUnverifiedKeys(bool)
 	// RekeyWithPromptWaitTime indicates how long to wait, after
 	// setting the rekey bit, before prompting for a paper key.
 	RekeyWithPromptWaitTime() time.Duration
@@ -1336,6 +1437,13 @@ type Config interface {
 	// must have been unreferenced before it can be reclaimed.
 	QuotaReclamationMinUnrefAge() time.Duration
 
+	// WriterInfoCacheTTL indicates how long a writer's info, as
+	// looked up during conflict resolution and for edit
+	// histories, is cached before being looked up again, e.g. to
+	// pick up a changed device name.
+	WriterInfoCacheTTL() time.Duration
+	SetWriterInfoCacheTTL(time.Duration)
+
 	// ResetCaches clears and re-initializes all data and key caches.
 	ResetCaches()
 
@@ -10,8 +10,10 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol"
 
 	"golang.org/x/net/context"
 )
@@ -41,7 +43,10 @@ type JournalServerStatus struct {
 type TLFJournalStatus struct {
 	RevisionStart MetadataRevision
 	RevisionEnd   MetadataRevision
-	BlockOpCount  uint64
+	// The number of bytes on disk used by the MDs between
+	// RevisionStart and RevisionEnd.
+	MDDiskUsage  uint64
+	BlockOpCount uint64
 }
 
 // JournalServer is the server that handles write journals. It
@@ -49,7 +54,8 @@ type TLFJournalStatus struct {
 // instead of MDServer because it has to potentially modify the
 // RootMetadata passed in, and by the time it hits MDServer it's
 // already too late. However, this assumes that all MD ops go through
-// MDOps.
+// MDOps. Its Set* methods aren't goroutine-safe, and so must be
+// called before it's used.
 type JournalServer struct {
 	config Config
 
@@ -62,6 +68,26 @@ type JournalServer struct {
 	delegateBlockServer BlockServer
 	delegateMDOps       MDOps
 
+	// prefetchNextRevision, if set, makes MD flushes prefetch the
+	// blocks referenced by the next revision in the journal while
+	// the current one is being put.
+	prefetchNextRevision bool
+
+	// mdFlushConflictRetries is how many times a flush retries
+	// putting a merged MD after a transient revision conflict,
+	// before converting the journal to a branch.
+	mdFlushConflictRetries int
+
+	// mdFlushRetryBackoff is how long a flush waits before retrying
+	// an MD whose put failed, when its error sink says to
+	// continue. The wait doubles with each consecutive failure of
+	// the same revision, up to mdFlushRetryBackoffMax.
+	mdFlushRetryBackoff time.Duration
+
+	// mdQuarantineRetention is how long each MD journal keeps the
+	// entries that a repair has quarantined. Zero means forever.
+	mdQuarantineRetention time.Duration
+
 	lock       sync.RWMutex
 	tlfBundles map[TlfID]*tlfJournalBundle
 }
@@ -70,18 +96,61 @@ func makeJournalServer(
 	config Config, log logger.Logger, dir string,
 	bcache BlockCache, bserver BlockServer, mdOps MDOps) *JournalServer {
 	jServer := JournalServer{
-		config:              config,
-		log:                 log,
-		deferLog:            log.CloneWithAddedDepth(1),
-		dir:                 dir,
-		delegateBlockCache:  bcache,
-		delegateBlockServer: bserver,
-		delegateMDOps:       mdOps,
-		tlfBundles:          make(map[TlfID]*tlfJournalBundle),
+		config:                 config,
+		log:                    log,
+		deferLog:               log.CloneWithAddedDepth(1),
+		dir:                    dir,
+		delegateBlockCache:     bcache,
+		delegateBlockServer:    bserver,
+		delegateMDOps:          mdOps,
+		mdFlushConflictRetries: mdFlushConflictRetriesDefault,
+		mdFlushRetryBackoff:    mdFlushRetryBackoffDefault,
+		tlfBundles:             make(map[TlfID]*tlfJournalBundle),
 	}
 	return &jServer
 }
 
+// SetNextRevisionPrefetch sets whether flushing an MD revision also
+// starts a best-effort background prefetch, from the delegate block
+// server, of the blocks referenced by the following revision in the
+// journal.
+func (j *JournalServer) SetNextRevisionPrefetch(enabled bool) {
+	j.prefetchNextRevision = enabled
+}
+
+// SetMDFlushConflictRetries sets how many times a flush retries
+// putting a merged MD after a revision conflict, if the MD is still a
+// valid successor of the server's refetched merged head, before
+// converting the journal to a branch.
+func (j *JournalServer) SetMDFlushConflictRetries(retries int) {
+	j.mdFlushConflictRetries = retries
+}
+
+// SetMDFlushRetryBackoff sets how long a flush initially waits
+// before retrying an MD whose put failed, when its error sink says
+// to continue.
+func (j *JournalServer) SetMDFlushRetryBackoff(backoff time.Duration) {
+	j.mdFlushRetryBackoff = backoff
+}
+
+// SetMDQuarantineRetention sets how long the MD journals enabled
+// from then on keep entries quarantined by a repair, or forever if
+// retention is 0.
+func (j *JournalServer) SetMDQuarantineRetention(retention time.Duration) {
+	j.mdQuarantineRetention = retention
+}
+
+// tlfIDs returns the IDs of all TLFs with an enabled journal.
+func (j *JournalServer) tlfIDs() []TlfID {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	tlfIDs := make([]TlfID, 0, len(j.tlfBundles))
+	for tlfID := range j.tlfBundles {
+		tlfIDs = append(tlfIDs, tlfID)
+	}
+	return tlfIDs
+}
+
 func (j *JournalServer) getBundle(tlfID TlfID) (*tlfJournalBundle, bool) {
 	j.lock.RLock()
 	defer j.lock.RUnlock()
@@ -89,6 +158,19 @@ func (j *JournalServer) getBundle(tlfID TlfID) (*tlfJournalBundle, bool) {
 	return bundle, ok
 }
 
+// mdJournalLength returns the number of MDs in the journal for the
+// given TLF.
+func (j *JournalServer) mdJournalLength(tlfID TlfID) (uint64, error) {
+	bundle, ok := j.getBundle(tlfID)
+	if !ok {
+		return 0, fmt.Errorf("Journal not enabled for %s", tlfID)
+	}
+
+	bundle.lock.RLock()
+	defer bundle.lock.RUnlock()
+	return bundle.mdJournal.length()
+}
+
 // EnableExistingJournals turns on the write journal for all TLFs with
 // an existing journal. This must be the first thing done to a
 // JournalServer. Any returned error is fatal, and means that the
@@ -167,8 +249,13 @@ func (j *JournalServer) Enable(ctx context.Context, tlfID TlfID) (err error) {
 	}
 
 	bundle.blockJournal = blockJournal
-	mdJournal, err := makeMDJournal(
-		j.config.Codec(), j.config.Crypto(), tlfDir, log)
+	mdJournal, err := makeMDJournalWithOptions(
+		j.config.Codec(), j.config.Crypto(), tlfDir, log,
+		mdJournalOptions{
+			quarantineRetention: j.mdQuarantineRetention,
+			maxMDBytes:          j.config.MaxMDBytes(),
+			clock:               j.config.Clock(),
+		})
 	if err != nil {
 		return err
 	}
@@ -178,8 +265,74 @@ func (j *JournalServer) Enable(ctx context.Context, tlfID TlfID) (err error) {
 	return nil
 }
 
+// mdFlushConflictRetriesDefault is the default for
+// JournalServer.mdFlushConflictRetries.
+const mdFlushConflictRetriesDefault = 0
+
+const (
+	// mdFlushRetryBackoffDefault is the default for
+	// JournalServer.mdFlushRetryBackoff.
+	mdFlushRetryBackoffDefault = 100 * time.Millisecond
+	// mdFlushRetryBackoffMax caps the wait between retries of
+	// the same MD revision.
+	mdFlushRetryBackoffMax = 30 * time.Second
+)
+
+// journalFlushErrorAction says what a flush loop should do after
+// a failed flush attempt.
+type journalFlushErrorAction int
+
+const (
+	// journalFlushAbort stops the flush and returns the error.
+	journalFlushAbort journalFlushErrorAction = iota
+	// journalFlushContinue retries the failed entry and keeps
+	// draining the journal.
+	journalFlushContinue
+)
+
+// journalFlushErrorSink is called once per failed attempt to flush
+// an MD, with the revision of the MD being flushed and the error
+// encountered. Its return value decides whether the flush keeps
+// going.
+type journalFlushErrorSink func(
+	rev MetadataRevision, err error) journalFlushErrorAction
+
 // Flush flushes the write journal for the given TLF.
 func (j *JournalServer) Flush(ctx context.Context, tlfID TlfID) (err error) {
+	return j.flushWithErrorSink(ctx, tlfID, nil)
+}
+
+// flushWithErrorSink flushes the write journal for the given TLF
+// like Flush, except that each failed MD flush attempt is reported
+// to errSink (if non-nil), which may choose to have the flush retry
+// the MD and continue instead of aborting. Retries back off
+// exponentially while the same MD keeps failing. Block flush errors
+// always abort.
+func (j *JournalServer) flushWithErrorSink(ctx context.Context,
+	tlfID TlfID, errSink journalFlushErrorSink) (err error) {
+	_, err = j.flushHelper(ctx, tlfID, errSink, time.Time{})
+	return err
+}
+
+// flushWithBudget flushes the write journal for the given TLF like
+// Flush, but stops once budget has elapsed, and returns the number
+// of block and MD entries it managed to flush. The budget is only
+// checked between entries, so an entry is never abandoned partway
+// through. If ctx is canceled between entries, the flush stops and
+// ctx.Err() is returned.
+func (j *JournalServer) flushWithBudget(ctx context.Context,
+	tlfID TlfID, budget time.Duration) (flushed int, err error) {
+	deadline := j.config.Clock().Now().Add(budget)
+	return j.flushHelper(ctx, tlfID, nil, deadline)
+}
+
+// flushHelper does the work for flushWithErrorSink and
+// flushWithBudget. The flush stops with ctx.Err() before starting
+// any entry once ctx has been canceled, and, if deadline is
+// non-zero, stops early once the deadline has passed.
+func (j *JournalServer) flushHelper(ctx context.Context,
+	tlfID TlfID, errSink journalFlushErrorSink, deadline time.Time) (
+	flushed int, err error) {
 	j.log.CDebugf(ctx, "Flushing journal for %s", tlfID)
 	flushedBlockEntries := 0
 	flushedMDEntries := 0
@@ -195,7 +348,19 @@ func (j *JournalServer) Flush(ctx context.Context, tlfID TlfID) (err error) {
 	bundle, ok := j.getBundle(tlfID)
 	if !ok {
 		j.log.CDebugf(ctx, "Journal not enabled for %s", tlfID)
-		return nil
+		return 0, nil
+	}
+
+	outOfBudget := func() (bool, error) {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		default:
+		}
+		if deadline.IsZero() {
+			return false, nil
+		}
+		return !j.config.Clock().Now().Before(deadline), nil
 	}
 
 	// TODO: Interleave block flushes with their related MD
@@ -204,6 +369,15 @@ func (j *JournalServer) Flush(ctx context.Context, tlfID TlfID) (err error) {
 	// TODO: Parallelize block puts.
 
 	for {
+		stop, err := outOfBudget()
+		if err != nil {
+			return flushedBlockEntries, err
+		}
+		if stop {
+			j.log.CDebugf(ctx, "Ran out of budget for %s after "+
+				"flushing %d block entries", tlfID, flushedBlockEntries)
+			return flushedBlockEntries, nil
+		}
 		flushed, err := func() (bool, error) {
 			bundle.lock.Lock()
 			defer bundle.lock.Unlock()
@@ -211,7 +385,7 @@ func (j *JournalServer) Flush(ctx context.Context, tlfID TlfID) (err error) {
 				ctx, j.delegateBlockServer, tlfID)
 		}()
 		if err != nil {
-			return err
+			return flushedBlockEntries, err
 		}
 		if !flushed {
 			break
@@ -221,35 +395,223 @@ func (j *JournalServer) Flush(ctx context.Context, tlfID TlfID) (err error) {
 
 	_, uid, err := j.config.KBPKI().GetCurrentUserInfo(ctx)
 	if err != nil {
-		return err
+		return flushedBlockEntries, err
 	}
 
 	key, err := j.config.KBPKI().GetCurrentVerifyingKey(ctx)
 	if err != nil {
-		return err
+		return flushedBlockEntries, err
 	}
 
+	// Any prefetches still running once the flush is over are no
+	// longer useful.
+	prefetchCtx, cancelPrefetch := context.WithCancel(ctx)
+	defer cancelPrefetch()
+	prefetchedRev := MetadataRevisionUninitialized
+
+	retryRev := MetadataRevisionUninitialized
+	var retryBackoff time.Duration
+
 	for {
-		flushed, err := func() (bool, error) {
+		stop, err := outOfBudget()
+		if err != nil {
+			return flushedBlockEntries + flushedMDEntries, err
+		}
+		if stop {
+			j.log.CDebugf(ctx, "Ran out of budget for %s after "+
+				"flushing %d block entries and %d MD entries",
+				tlfID, flushedBlockEntries, flushedMDEntries)
+			return flushedBlockEntries + flushedMDEntries, nil
+		}
+		flushed, rev, err := func() (bool, MetadataRevision, error) {
 			bundle.lock.Lock()
 			defer bundle.lock.Unlock()
-			return bundle.mdJournal.flushOne(
+			rev, err := bundle.mdJournal.j.readEarliestRevision()
+			if err != nil {
+				return false, MetadataRevisionUninitialized, err
+			}
+			if j.prefetchNextRevision && rev != MetadataRevisionUninitialized &&
+				prefetchedRev != rev+1 {
+				prefetchedRev = rev + 1
+				j.startNextRevisionPrefetch(
+					prefetchCtx, tlfID, uid, bundle, rev+1)
+			}
+			flushed, err := bundle.mdJournal.flushOne(
 				ctx, j.config.Crypto(), uid, key,
-				j.config.MDServer())
+				j.config.MDServer(), j.mdFlushConflictRetries)
+			return flushed, rev, err
 		}()
 		if err != nil {
-			return err
+			if errSink == nil ||
+				errSink(rev, err) != journalFlushContinue {
+				return flushedBlockEntries + flushedMDEntries, err
+			}
+			if rev == retryRev {
+				retryBackoff *= 2
+				if retryBackoff > mdFlushRetryBackoffMax {
+					retryBackoff = mdFlushRetryBackoffMax
+				}
+			} else {
+				retryRev = rev
+				retryBackoff = j.mdFlushRetryBackoff
+			}
+			j.log.CDebugf(ctx, "Continuing flush for %s in %s after "+
+				"error on revision %s: %v", tlfID, retryBackoff, rev, err)
+			select {
+			case <-time.After(retryBackoff):
+			case <-ctx.Done():
+				return flushedBlockEntries + flushedMDEntries, ctx.Err()
+			}
+			continue
 		}
 		if !flushed {
 			break
 		}
+		retryRev = MetadataRevisionUninitialized
 		flushedMDEntries++
 	}
 
 	j.log.CDebugf(ctx, "Flushed %d block entries and %d MD entries for %s",
 		flushedBlockEntries, flushedMDEntries, tlfID)
 
-	return nil
+	return flushedBlockEntries + flushedMDEntries, nil
+}
+
+// startNextRevisionPrefetch starts a background prefetch of the
+// blocks referenced by revision rev in the given bundle's MD
+// journal, if there is such a revision. bundle.lock must be held.
+// Errors are only logged, since the prefetch is purely an
+// optimization.
+func (j *JournalServer) startNextRevisionPrefetch(ctx context.Context,
+	tlfID TlfID, uid keybase1.UID, bundle *tlfJournalBundle,
+	rev MetadataRevision) {
+	ibrmds, err := bundle.mdJournal.getRange(uid, rev, rev)
+	if err != nil {
+		j.log.CDebugf(ctx, "Couldn't get revision %s for prefetch: %v",
+			rev, err)
+		return
+	}
+	if len(ibrmds) == 0 {
+		return
+	}
+	go j.prefetchBlocksForMD(ctx, j.delegateBlockServer, tlfID, ibrmds[0])
+}
+
+// prefetchBlocksForMD fetches the blocks referenced by the given MD
+// whose types are known (see getTypedBlockPointers) from bserver and
+// puts them into the block cache, so that they're warm by the time
+// the MD is flushed. It gives up as soon as ctx is
+// canceled.
+func (j *JournalServer) prefetchBlocksForMD(ctx context.Context,
+	bserver BlockServer, tlfID TlfID, ibrmd ImmutableBareRootMetadata) {
+	rev := ibrmd.RevisionNumber()
+	err := func() error {
+		bareHandle, err := ibrmd.MakeBareTlfHandle()
+		if err != nil {
+			return err
+		}
+		handle, err := MakeTlfHandle(ctx, bareHandle, j.config.KBPKI())
+		if err != nil {
+			return err
+		}
+		brmd, ok := ibrmd.BareRootMetadata.(MutableBareRootMetadata)
+		if !ok {
+			return MutableBareRootMetadataNoImplError{}
+		}
+		rmd := RootMetadata{
+			bareMd:    brmd,
+			tlfHandle: handle,
+		}
+		err = decryptMDPrivateData(ctx, j.config, &rmd, rmd.ReadOnly())
+		if err != nil {
+			return err
+		}
+
+		irmd := MakeImmutableRootMetadata(
+			&rmd, ibrmd.mdID, ibrmd.localTimestamp)
+		for _, tptr := range getTypedBlockPointers(irmd) {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			err := j.prefetchBlock(
+				ctx, bserver, irmd, tptr.ptr, tptr.newBlock)
+			if err != nil {
+				j.log.CDebugf(ctx, "Prefetch of block %v for "+
+					"revision %s failed: %v", tptr.ptr, rev, err)
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		j.log.CDebugf(ctx, "Prefetch for revision %s failed: %v",
+			rev, err)
+	}
+}
+
+// prefetchBlock fetches the block for ptr from bserver, assembles it
+// into a block made by newBlock, and puts it into the block cache.
+func (j *JournalServer) prefetchBlock(ctx context.Context,
+	bserver BlockServer, kmd KeyMetadata, ptr BlockPointer,
+	newBlock makeNewBlock) error {
+	buf, serverHalf, err := bserver.Get(
+		ctx, kmd.TlfID(), ptr.ID, ptr.BlockContext)
+	if err != nil {
+		return err
+	}
+
+	block := newBlock()
+	err = assembleBlock(ctx, j.config, kmd, ptr, block, buf, serverHalf)
+	if err != nil {
+		return err
+	}
+
+	return j.config.BlockCache().Put(ptr, kmd.TlfID(), block, TransientEntry)
+}
+
+// flushAllJournals flushes the write journals for all TLFs, using at
+// most concurrency goroutines at a time. Each journal is still
+// flushed in order; only flushes of different journals happen in
+// parallel. An error flushing one journal doesn't stop the others
+// from being flushed; all such errors are returned, keyed by TLF.
+func (j *JournalServer) flushAllJournals(
+	ctx context.Context, concurrency int) map[TlfID]error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	tlfIDs := j.tlfIDs()
+
+	j.log.CDebugf(ctx, "Flushing %d journals with concurrency %d",
+		len(tlfIDs), concurrency)
+
+	tlfIDCh := make(chan TlfID, len(tlfIDs))
+	for _, tlfID := range tlfIDs {
+		tlfIDCh <- tlfID
+	}
+	close(tlfIDCh)
+
+	var errLock sync.Mutex
+	errs := make(map[TlfID]error)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tlfID := range tlfIDCh {
+				err := j.Flush(ctx, tlfID)
+				if err != nil {
+					errLock.Lock()
+					errs[tlfID] = err
+					errLock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errs
 }
 
 // Disable turns off the write journal for the given TLF.
@@ -323,6 +685,45 @@ func (j *JournalServer) Status() JournalServerStatus {
 	}
 }
 
+// journalConflict returns a ConflictInfo describing the unmerged
+// MDs in the journal for the given TLF, along with true, if the
+// journal has been converted to a branch. The returned info has
+// JournalOnly set, since the journal can't tell which of the
+// branch's MDs have already been flushed.
+func (j *JournalServer) journalConflict(
+	ctx context.Context, tlfID TlfID) (ConflictInfo, bool, error) {
+	bundle, ok := j.getBundle(tlfID)
+	if !ok {
+		return ConflictInfo{}, false, nil
+	}
+
+	_, uid, err := j.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return ConflictInfo{}, false, err
+	}
+
+	// Take the write lock, since getStatus may update the MD
+	// journal's cached disk usage.
+	bundle.lock.Lock()
+	defer bundle.lock.Unlock()
+	status, err := bundle.mdJournal.getStatus(uid)
+	if err != nil {
+		return ConflictInfo{}, false, err
+	}
+	if status.MergedStatus != Unmerged ||
+		status.RevisionStart == MetadataRevisionUninitialized {
+		return ConflictInfo{}, false, nil
+	}
+	return ConflictInfo{
+		Tlf:            tlfID,
+		BID:            bundle.mdJournal.branchID,
+		MergedRevision: status.RevisionStart - 1,
+		RevisionStart:  status.RevisionStart,
+		RevisionEnd:    status.RevisionEnd,
+		JournalOnly:    true,
+	}, true, nil
+}
+
 // JournalStatus returns a TLFServerStatus object for the given TLF
 // suitable for diagnostics.
 func (j *JournalServer) JournalStatus(tlfID TlfID) (TLFJournalStatus, error) {
@@ -331,8 +732,10 @@ func (j *JournalServer) JournalStatus(tlfID TlfID) (TLFJournalStatus, error) {
 		return TLFJournalStatus{}, fmt.Errorf("Journal not enabled for %s", tlfID)
 	}
 
-	bundle.lock.RLock()
-	defer bundle.lock.RUnlock()
+	// Take the write lock, since diskUsage may update the MD
+	// journal's cached total.
+	bundle.lock.Lock()
+	defer bundle.lock.Unlock()
 	earliestRevision, err := bundle.mdJournal.readEarliestRevision()
 	if err != nil {
 		return TLFJournalStatus{}, err
@@ -341,6 +744,10 @@ func (j *JournalServer) JournalStatus(tlfID TlfID) (TLFJournalStatus, error) {
 	if err != nil {
 		return TLFJournalStatus{}, err
 	}
+	mdDiskUsage, err := bundle.mdJournal.diskUsage()
+	if err != nil {
+		return TLFJournalStatus{}, err
+	}
 	blockOpCount, err := bundle.blockJournal.length()
 	if err != nil {
 		return TLFJournalStatus{}, err
@@ -348,6 +755,23 @@ func (j *JournalServer) JournalStatus(tlfID TlfID) (TLFJournalStatus, error) {
 	return TLFJournalStatus{
 		RevisionStart: earliestRevision,
 		RevisionEnd:   latestRevision,
+		MDDiskUsage:   mdDiskUsage,
 		BlockOpCount:  blockOpCount,
 	}, nil
 }
+
+// FlushStats returns statistics on the MDs flushed from the journal
+// for the given TLF at or after the given time. Only flushes since
+// the journal was enabled in this process, and within the last day,
+// are counted.
+func (j *JournalServer) FlushStats(
+	tlfID TlfID, since time.Time) (FlushStats, error) {
+	bundle, ok := j.getBundle(tlfID)
+	if !ok {
+		return FlushStats{}, fmt.Errorf("Journal not enabled for %s", tlfID)
+	}
+
+	bundle.lock.RLock()
+	defer bundle.lock.RUnlock()
+	return bundle.mdJournal.flushStats(since), nil
+}
@@ -5,9 +5,13 @@
 package libkbfs
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/keybase/client/go/protocol"
 	"github.com/stretchr/testify/require"
@@ -114,3 +118,734 @@ func TestJournalServerRestart(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, rmd.Revision(), head.Revision())
 }
+
+func TestScanJournalDirs(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+
+	jServer.delegateBlockServer = shutdownOnlyBlockServer{}
+
+	ctx := context.Background()
+
+	blockTlfID := FakeTlfID(2, false)
+	mdTlfID := FakeTlfID(3, false)
+	emptyTlfID := FakeTlfID(4, false)
+	for _, tlfID := range []TlfID{blockTlfID, mdTlfID} {
+		err := jServer.Enable(ctx, tlfID)
+		require.NoError(t, err)
+	}
+
+	// Simulate a journal dir left behind after all its entries
+	// were flushed.
+	err := os.Mkdir(filepath.Join(tempdir, emptyTlfID.String()), 0700)
+	require.NoError(t, err)
+
+	// Non-TLF dirs should be skipped.
+	err = os.Mkdir(filepath.Join(tempdir, "not_a_tlf"), 0700)
+	require.NoError(t, err)
+
+	// A journal dir that can't be read shouldn't stop the others
+	// from being scanned.
+	corruptTlfID := FakeTlfID(5, false)
+	corruptDir := filepath.Join(tempdir, corruptTlfID.String())
+	err = os.Mkdir(corruptDir, 0700)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(
+		corruptDir, "md_journal_format_version"), []byte("bad"), 0600)
+	require.NoError(t, err)
+
+	blockServer := config.BlockServer()
+	mdOps := config.MDOps()
+	crypto := config.Crypto()
+
+	uid := keybase1.MakeTestUID(1)
+	bCtx := BlockContext{uid, "", zeroBlockRefNonce}
+	data := []byte{1, 2, 3, 4}
+	bID, err := crypto.MakePermanentBlockID(data)
+	require.NoError(t, err)
+	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	err = blockServer.Put(ctx, blockTlfID, bID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+
+	bh, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	h, err := MakeTlfHandle(ctx, bh, config.KBPKI())
+	require.NoError(t, err)
+
+	rmd := NewRootMetadata()
+	err = rmd.Update(mdTlfID, bh)
+	require.NoError(t, err)
+	rmd.tlfHandle = h
+	rmd.SetRevision(MetadataRevision(1))
+	rekeyDone, _, err := config.KeyManager().Rekey(ctx, rmd, false)
+	require.NoError(t, err)
+	require.True(t, rekeyDone)
+	_, err = mdOps.Put(ctx, rmd)
+	require.NoError(t, err)
+
+	infos, err := ScanJournalDirs(tempdir)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(infos))
+
+	infoMap := make(map[TlfID]JournalDirInfo)
+	for _, info := range infos {
+		require.Equal(t, filepath.Join(tempdir, info.TlfID.String()),
+			info.Dir)
+		infoMap[info.TlfID] = info
+	}
+
+	blockInfo := infoMap[blockTlfID]
+	require.Equal(t, uint64(1), blockInfo.BlockEntryCount)
+	require.Equal(t, uint64(0), blockInfo.MDEntryCount)
+	require.False(t, blockInfo.Abandoned)
+
+	mdInfo := infoMap[mdTlfID]
+	require.Equal(t, uint64(0), mdInfo.BlockEntryCount)
+	require.Equal(t, uint64(1), mdInfo.MDEntryCount)
+	require.Equal(t, NullBranchID, mdInfo.BranchID)
+	require.False(t, mdInfo.Abandoned)
+
+	emptyInfo := infoMap[emptyTlfID]
+	require.Equal(t, uint64(0), emptyInfo.BlockEntryCount)
+	require.Equal(t, uint64(0), emptyInfo.MDEntryCount)
+	require.True(t, emptyInfo.Abandoned)
+
+	for _, tlfID := range []TlfID{blockTlfID, mdTlfID, emptyTlfID} {
+		require.NoError(t, infoMap[tlfID].Err)
+	}
+
+	corruptInfo := infoMap[corruptTlfID]
+	require.Error(t, corruptInfo.Err)
+	require.False(t, corruptInfo.Abandoned)
+}
+
+// failingBlockServer fails all puts for a single TLF.
+type failingBlockServer struct {
+	BlockServer
+	failTlfID TlfID
+}
+
+var errFailingBlockServer = errors.New("failing block server")
+
+func (s failingBlockServer) Put(
+	ctx context.Context, tlfID TlfID, id BlockID, context BlockContext,
+	buf []byte, serverHalf BlockCryptKeyServerHalf) error {
+	if tlfID == s.failTlfID {
+		return errFailingBlockServer
+	}
+	return s.BlockServer.Put(ctx, tlfID, id, context, buf, serverHalf)
+}
+
+func TestJournalServerFlushAllJournals(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+
+	failTlfID := FakeTlfID(4, false)
+	jServer.delegateBlockServer = failingBlockServer{
+		jServer.delegateBlockServer, failTlfID}
+
+	ctx := context.Background()
+	blockServer := config.BlockServer()
+	crypto := config.Crypto()
+	uid := keybase1.MakeTestUID(1)
+	bCtx := BlockContext{uid, "", zeroBlockRefNonce}
+
+	tlfIDs := []TlfID{FakeTlfID(2, false), FakeTlfID(3, false), failTlfID}
+	for i, tlfID := range tlfIDs {
+		err := jServer.Enable(ctx, tlfID)
+		require.NoError(t, err)
+
+		data := []byte{1, 2, 3, byte(i)}
+		bID, err := crypto.MakePermanentBlockID(data)
+		require.NoError(t, err)
+		serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+		require.NoError(t, err)
+		err = blockServer.Put(ctx, tlfID, bID, bCtx, data, serverHalf)
+		require.NoError(t, err)
+	}
+
+	errs := jServer.flushAllJournals(ctx, 2)
+	require.Equal(t, map[TlfID]error{failTlfID: errFailingBlockServer}, errs)
+
+	for _, tlfID := range tlfIDs {
+		status, err := jServer.JournalStatus(tlfID)
+		require.NoError(t, err)
+		if tlfID == failTlfID {
+			require.Equal(t, uint64(1), status.BlockOpCount)
+		} else {
+			require.Equal(t, uint64(0), status.BlockOpCount)
+		}
+	}
+}
+
+// intermittentMDServer fails every other put with a fixed error.
+type intermittentMDServer struct {
+	MDServer
+	lock  sync.Mutex
+	puts  int
+	fails int
+}
+
+var errIntermittentMDServer = errors.New("intermittent MD server")
+
+func (s *intermittentMDServer) Put(
+	ctx context.Context, rmds *RootMetadataSigned) error {
+	s.lock.Lock()
+	s.puts++
+	fail := s.puts%2 == 1
+	if fail {
+		s.fails++
+	}
+	s.lock.Unlock()
+	if fail {
+		return errIntermittentMDServer
+	}
+	return s.MDServer.Put(ctx, rmds)
+}
+
+func TestJournalServerFlushWithErrorSink(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+
+	ctx := context.Background()
+
+	tlfID := FakeTlfID(2, false)
+	err := jServer.Enable(ctx, tlfID)
+	require.NoError(t, err)
+
+	mdOps := config.MDOps()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	bh, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	h, err := MakeTlfHandle(ctx, bh, config.KBPKI())
+	require.NoError(t, err)
+
+	// Put a few MDs into the journal.
+
+	rmd := NewRootMetadata()
+	err = rmd.Update(tlfID, bh)
+	require.NoError(t, err)
+	rmd.tlfHandle = h
+	rmd.SetRevision(MetadataRevision(1))
+	rekeyDone, _, err := config.KeyManager().Rekey(ctx, rmd, false)
+	require.NoError(t, err)
+	require.True(t, rekeyDone)
+
+	const mdCount = 4
+	for i := 0; i < mdCount; i++ {
+		mdID, err := mdOps.Put(ctx, rmd)
+		require.NoError(t, err)
+		if i < mdCount-1 {
+			rmd, err = rmd.MakeSuccessor(config, mdID, true)
+			require.NoError(t, err)
+		}
+	}
+
+	mdServer := &intermittentMDServer{MDServer: config.MDServer()}
+	config.SetMDServer(mdServer)
+	defer config.SetMDServer(mdServer.MDServer)
+
+	// Without a sink, the first error aborts the flush.
+	err = jServer.Flush(ctx, tlfID)
+	require.Equal(t, errIntermittentMDServer, err)
+	status, err := jServer.JournalStatus(tlfID)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(1), status.RevisionStart)
+	require.Equal(t, MetadataRevision(mdCount), status.RevisionEnd)
+
+	// Even if the sink continues, a canceled context stops the
+	// flush.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var failedRevs []MetadataRevision
+	err = jServer.flushWithErrorSink(cancelCtx, tlfID,
+		func(rev MetadataRevision, err error) journalFlushErrorAction {
+			failedRevs = append(failedRevs, rev)
+			cancel()
+			return journalFlushContinue
+		})
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, []MetadataRevision{2}, failedRevs)
+
+	// With a sink that continues, every failure is reported and
+	// the journal is drained.
+	failedRevs = nil
+	err = jServer.flushWithErrorSink(ctx, tlfID,
+		func(rev MetadataRevision, err error) journalFlushErrorAction {
+			require.Equal(t, errIntermittentMDServer, err)
+			failedRevs = append(failedRevs, rev)
+			return journalFlushContinue
+		})
+	require.NoError(t, err)
+	require.Equal(t, []MetadataRevision{3, 4}, failedRevs)
+	require.Equal(t, 4, mdServer.fails)
+
+	status, err = jServer.JournalStatus(tlfID)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevisionUninitialized, status.RevisionStart)
+
+	head, err := mdServer.MDServer.GetForTLF(
+		ctx, tlfID, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(mdCount), head.MD.RevisionNumber())
+}
+
+// failingMDServer fails every put with a fixed error.
+type failingMDServer struct {
+	MDServer
+}
+
+func (s failingMDServer) Put(
+	ctx context.Context, rmds *RootMetadataSigned) error {
+	return errIntermittentMDServer
+}
+
+func TestJournalServerFlushWithErrorSinkBackoff(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+
+	ctx := context.Background()
+
+	tlfID := FakeTlfID(2, false)
+	err := jServer.Enable(ctx, tlfID)
+	require.NoError(t, err)
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	bh, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	h, err := MakeTlfHandle(ctx, bh, config.KBPKI())
+	require.NoError(t, err)
+
+	rmd := NewRootMetadata()
+	err = rmd.Update(tlfID, bh)
+	require.NoError(t, err)
+	rmd.tlfHandle = h
+	rmd.SetRevision(MetadataRevision(1))
+	rekeyDone, _, err := config.KeyManager().Rekey(ctx, rmd, false)
+	require.NoError(t, err)
+	require.True(t, rekeyDone)
+	_, err = config.MDOps().Put(ctx, rmd)
+	require.NoError(t, err)
+
+	mdServer := failingMDServer{config.MDServer()}
+	config.SetMDServer(mdServer)
+	defer config.SetMDServer(mdServer.MDServer)
+
+	// With retries backing off from 10ms, only a handful of
+	// attempts (10ms, 20ms, 40ms, 80ms, ...) fit before the
+	// timeout, instead of a busy loop.
+	jServer.SetMDFlushRetryBackoff(10 * time.Millisecond)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	failures := 0
+	err = jServer.flushWithErrorSink(timeoutCtx, tlfID,
+		func(rev MetadataRevision, err error) journalFlushErrorAction {
+			require.Equal(t, MetadataRevision(1), rev)
+			require.Equal(t, errIntermittentMDServer, err)
+			failures++
+			return journalFlushContinue
+		})
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.True(t, failures >= 2, "failures=%d", failures)
+	require.True(t, failures <= 6, "failures=%d", failures)
+}
+
+// slowMDServer delays every put by a fixed amount.
+type slowMDServer struct {
+	MDServer
+	delay time.Duration
+}
+
+func (s *slowMDServer) Put(
+	ctx context.Context, rmds *RootMetadataSigned) error {
+	time.Sleep(s.delay)
+	return s.MDServer.Put(ctx, rmds)
+}
+
+func TestJournalServerEnableMDJournalOptions(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+
+	clock, _ := newTestClockAndTimeNow()
+	config.SetClock(clock)
+	jServer.SetMDQuarantineRetention(7 * 24 * time.Hour)
+
+	ctx := context.Background()
+	tlfID := FakeTlfID(2, false)
+	err := jServer.Enable(ctx, tlfID)
+	require.NoError(t, err)
+
+	// The MD journal should use the config's clock and the
+	// configured retention.
+	bundle, ok := jServer.getBundle(tlfID)
+	require.True(t, ok)
+	require.Equal(t, clock, bundle.mdJournal.clock)
+	require.Equal(t, 7*24*time.Hour, bundle.mdJournal.quarantineRetention)
+	require.Equal(t, config.MaxMDBytes(), bundle.mdJournal.maxMDBytes)
+}
+
+func TestJournalServerFlushWithBudget(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+
+	ctx := context.Background()
+
+	tlfID := FakeTlfID(2, false)
+	err := jServer.Enable(ctx, tlfID)
+	require.NoError(t, err)
+
+	mdOps := config.MDOps()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	bh, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	h, err := MakeTlfHandle(ctx, bh, config.KBPKI())
+	require.NoError(t, err)
+
+	// Put some MDs into the journal.
+
+	rmd := NewRootMetadata()
+	err = rmd.Update(tlfID, bh)
+	require.NoError(t, err)
+	rmd.tlfHandle = h
+	rmd.SetRevision(MetadataRevision(1))
+	rekeyDone, _, err := config.KeyManager().Rekey(ctx, rmd, false)
+	require.NoError(t, err)
+	require.True(t, rekeyDone)
+
+	const mdCount = 10
+	for i := 0; i < mdCount; i++ {
+		mdID, err := mdOps.Put(ctx, rmd)
+		require.NoError(t, err)
+		if i < mdCount-1 {
+			rmd, err = rmd.MakeSuccessor(config, mdID, true)
+			require.NoError(t, err)
+		}
+	}
+
+	const delay = 20 * time.Millisecond
+	mdServer := &slowMDServer{MDServer: config.MDServer(), delay: delay}
+	config.SetMDServer(mdServer)
+	defer config.SetMDServer(mdServer.MDServer)
+
+	// A canceled context should stop the flush before it starts.
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	flushed, err := jServer.flushWithBudget(canceledCtx, tlfID, time.Hour)
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, 0, flushed)
+
+	// A budget covering only a few puts should stop partway
+	// through, between entries.
+	const budget = 3 * delay
+	start := time.Now()
+	flushed, err = jServer.flushWithBudget(ctx, tlfID, budget)
+	elapsed := time.Since(start)
+	require.NoError(t, err)
+	require.True(t, flushed > 0, "flushed=%d", flushed)
+	require.True(t, flushed < mdCount, "flushed=%d", flushed)
+	require.True(t, elapsed >= budget, "elapsed=%s", elapsed)
+
+	status, err := jServer.JournalStatus(tlfID)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(flushed+1), status.RevisionStart)
+	require.Equal(t, MetadataRevision(mdCount), status.RevisionEnd)
+
+	head, err := mdServer.MDServer.GetForTLF(
+		ctx, tlfID, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(flushed), head.MD.RevisionNumber())
+
+	// An ample budget should drain the rest of the journal.
+	flushedRest, err := jServer.flushWithBudget(ctx, tlfID, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, mdCount-flushed, flushedRest)
+}
+
+func TestJournalServerWaitForJournalLength(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+
+	ctx := context.Background()
+
+	tlfID := FakeTlfID(2, false)
+	err := jServer.Enable(ctx, tlfID)
+	require.NoError(t, err)
+
+	mdOps := config.MDOps()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	bh, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	h, err := MakeTlfHandle(ctx, bh, config.KBPKI())
+	require.NoError(t, err)
+
+	// Put some MDs into the journal.
+
+	rmd := NewRootMetadata()
+	err = rmd.Update(tlfID, bh)
+	require.NoError(t, err)
+	rmd.tlfHandle = h
+	rmd.SetRevision(MetadataRevision(1))
+	rekeyDone, _, err := config.KeyManager().Rekey(ctx, rmd, false)
+	require.NoError(t, err)
+	require.True(t, rekeyDone)
+
+	const mdCount = 5
+	for i := 0; i < mdCount; i++ {
+		mdID, err := mdOps.Put(ctx, rmd)
+		require.NoError(t, err)
+		if i < mdCount-1 {
+			rmd, err = rmd.MakeSuccessor(config, mdID, true)
+			require.NoError(t, err)
+		}
+	}
+
+	// Waiting for a length the journal never reaches should time
+	// out.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err = WaitForJournalLength(timeoutCtx, jServer, tlfID, 0)
+	require.Error(t, err)
+
+	// Flush slowly in the background, so that the wait polls
+	// while the journal is being flushed.
+	mdServer := &slowMDServer{
+		MDServer: config.MDServer(), delay: 5 * time.Millisecond}
+	config.SetMDServer(mdServer)
+	defer config.SetMDServer(mdServer.MDServer)
+
+	flushErrCh := make(chan error, 1)
+	go func() {
+		flushErrCh <- jServer.Flush(ctx, tlfID)
+	}()
+
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	err = WaitForJournalLength(waitCtx, jServer, tlfID, 0)
+	require.NoError(t, err)
+	require.NoError(t, <-flushErrCh)
+
+	status, err := jServer.JournalStatus(tlfID)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevisionUninitialized, status.RevisionStart)
+}
+
+// prefetchRecordingBlockServer records the IDs of the blocks fetched
+// through it.
+type prefetchRecordingBlockServer struct {
+	BlockServer
+
+	lock    sync.Mutex
+	fetched map[BlockID]bool
+	fetchCh chan BlockID
+}
+
+func (b *prefetchRecordingBlockServer) Get(
+	ctx context.Context, tlfID TlfID, id BlockID, context BlockContext) (
+	[]byte, BlockCryptKeyServerHalf, error) {
+	b.lock.Lock()
+	b.fetched[id] = true
+	b.lock.Unlock()
+	select {
+	case b.fetchCh <- id:
+	default:
+	}
+	return b.BlockServer.Get(ctx, tlfID, id, context)
+}
+
+func (b *prefetchRecordingBlockServer) wasFetched(id BlockID) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.fetched[id]
+}
+
+// waitingMDServer holds up the put of a given revision until it is
+// told to continue.
+type waitingMDServer struct {
+	MDServer
+	rev      MetadataRevision
+	putCh    chan struct{}
+	resumeCh chan struct{}
+}
+
+func (s *waitingMDServer) Put(
+	ctx context.Context, rmds *RootMetadataSigned) error {
+	if rmds.MD.RevisionNumber() == s.rev {
+		s.putCh <- struct{}{}
+		<-s.resumeCh
+	}
+	return s.MDServer.Put(ctx, rmds)
+}
+
+func TestJournalServerFlushPrefetchesNextRevision(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+
+	ctx := context.Background()
+
+	tlfID := FakeTlfID(2, false)
+	err := jServer.Enable(ctx, tlfID)
+	require.NoError(t, err)
+
+	mdOps := config.MDOps()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	bh, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	h, err := MakeTlfHandle(ctx, bh, config.KBPKI())
+	require.NoError(t, err)
+
+	// Put some MDs into the journal, each referencing a new root
+	// block and a new file block. Only the blocks for revision 2
+	// actually exist on the server.
+
+	rmd := NewRootMetadata()
+	err = rmd.Update(tlfID, bh)
+	require.NoError(t, err)
+	rmd.tlfHandle = h
+	rmd.SetRevision(MetadataRevision(1))
+	rekeyDone, _, err := config.KeyManager().Rekey(ctx, rmd, false)
+	require.NoError(t, err)
+	require.True(t, rekeyDone)
+
+	putBlock := func(block Block) BlockPointer {
+		id, _, readyBlockData, err := config.BlockOps().Ready(
+			ctx, rmd, block)
+		require.NoError(t, err)
+		ptr := BlockPointer{
+			ID:           id,
+			KeyGen:       rmd.LatestKeyGeneration(),
+			DataVer:      FirstValidDataVer,
+			BlockContext: BlockContext{Creator: uid},
+		}
+		err = jServer.delegateBlockServer.Put(ctx, tlfID, id,
+			ptr.BlockContext, readyBlockData.buf,
+			readyBlockData.serverHalf)
+		require.NoError(t, err)
+		return ptr
+	}
+
+	const mdCount = 3
+	var rootIDs, fileIDs []BlockID
+	var rootPtr2, filePtr2 BlockPointer
+	for i := 0; i < mdCount; i++ {
+		rootPtr := BlockPointer{ID: fakeBlockID(byte(2 * i))}
+		filePtr := BlockPointer{ID: fakeBlockID(byte(2*i + 1))}
+		if i == 1 {
+			// Empty blocks decode as either type, so the
+			// prefetch has to go by how they're referenced.
+			rootPtr = putBlock(NewDirBlock())
+			filePtr = putBlock(NewFileBlock())
+			rootPtr2, filePtr2 = rootPtr, filePtr
+		}
+		rootIDs = append(rootIDs, rootPtr.ID)
+		fileIDs = append(fileIDs, filePtr.ID)
+		rmd.data.Dir.BlockPointer = rootPtr
+		co, err := newCreateOp("file", rootPtr, File)
+		require.NoError(t, err)
+		err = co.Dir.setRef(rootPtr)
+		require.NoError(t, err)
+		co.AddRefBlock(filePtr)
+		rmd.AddOp(co)
+
+		mdID, err := mdOps.Put(ctx, rmd)
+		require.NoError(t, err)
+		if i < mdCount-1 {
+			rmd, err = rmd.MakeSuccessor(config, mdID, true)
+			require.NoError(t, err)
+		}
+	}
+
+	bServer := &prefetchRecordingBlockServer{
+		BlockServer: jServer.delegateBlockServer,
+		fetched:     make(map[BlockID]bool),
+		fetchCh:     make(chan BlockID, 100),
+	}
+	jServer.delegateBlockServer = bServer
+	defer func() { jServer.delegateBlockServer = bServer.BlockServer }()
+
+	mdServer := &waitingMDServer{
+		MDServer: config.MDServer(),
+		rev:      MetadataRevision(1),
+		putCh:    make(chan struct{}),
+		resumeCh: make(chan struct{}),
+	}
+	config.SetMDServer(mdServer)
+	defer config.SetMDServer(mdServer.MDServer)
+
+	jServer.SetNextRevisionPrefetch(true)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- jServer.Flush(ctx, tlfID)
+	}()
+
+	// While revision 1 is being put, the blocks for revision 2
+	// should get prefetched.
+	select {
+	case <-mdServer.putCh:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for put of revision 1")
+	}
+	timeout := time.After(10 * time.Second)
+	for !bServer.wasFetched(rootIDs[1]) ||
+		!bServer.wasFetched(fileIDs[1]) {
+		select {
+		case <-bServer.fetchCh:
+		case <-timeout:
+			t.Fatal("Timed out waiting for prefetch of revision 2")
+		}
+	}
+	close(mdServer.resumeCh)
+
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for flush")
+	}
+
+	// The prefetched blocks should have been cached.
+	for _, ptr := range []BlockPointer{rootPtr2, filePtr2} {
+		for {
+			_, err := config.BlockCache().Get(ptr)
+			if err == nil {
+				break
+			}
+			select {
+			case <-time.After(time.Millisecond):
+			case <-timeout:
+				t.Fatalf("Timed out waiting for %v to be cached", ptr)
+			}
+		}
+	}
+	block, err := config.BlockCache().Get(rootPtr2)
+	require.NoError(t, err)
+	require.IsType(t, &DirBlock{}, block)
+	block, err = config.BlockCache().Get(filePtr2)
+	require.NoError(t, err)
+	require.IsType(t, &FileBlock{}, block)
+
+	// Revision 1 was never the next revision, so its blocks
+	// shouldn't have been prefetched.
+	require.False(t, bServer.wasFetched(rootIDs[0]))
+	require.False(t, bServer.wasFetched(fileIDs[0]))
+
+	head, err := mdServer.MDServer.GetForTLF(
+		ctx, tlfID, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(mdCount), head.MD.RevisionNumber())
+}
@@ -4,7 +4,16 @@
 
 package libkbfs
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
 
 // GetJournalServer returns the JournalServer tied to a particular
 // config.
@@ -16,3 +25,95 @@ func GetJournalServer(config Config) (*JournalServer, error) {
 	}
 	return jbserver.jServer, nil
 }
+
+// JournalDirInfo describes a single TLF journal directory found by
+// ScanJournalDirs.
+type JournalDirInfo struct {
+	Dir             string
+	TlfID           TlfID
+	BlockEntryCount uint64
+	MDEntryCount    uint64
+	// BranchID is the branch of the MD journal's entries, if
+	// any.
+	BranchID BranchID
+	// Abandoned is set if the journal has no entries and isn't
+	// on a branch, and so can be safely removed.
+	Abandoned bool
+	// Err is set if the journals in Dir couldn't be read, in which
+	// case the fields above other than Dir and TlfID are unset.
+	Err error
+}
+
+// scanJournalDir reads the block and MD journals in the given TLF
+// journal directory, and fills in the counts of info.
+func scanJournalDir(ctx context.Context, codec Codec,
+	crypto CryptoCommon, log logger.Logger, info *JournalDirInfo) error {
+	blockJournal, err := makeBlockJournal(
+		ctx, codec, crypto, info.Dir, log)
+	if err != nil {
+		return fmt.Errorf(
+			"Error reading block journal in %s: %v", info.Dir, err)
+	}
+	blockCount, err := blockJournal.length()
+	if err != nil {
+		return err
+	}
+
+	mdJournal, err := makeMDJournal(codec, crypto, info.Dir, log)
+	if err != nil {
+		return fmt.Errorf(
+			"Error reading MD journal in %s: %v", info.Dir, err)
+	}
+	mdCount, err := mdJournal.length()
+	if err != nil {
+		return err
+	}
+
+	info.BlockEntryCount = blockCount
+	info.MDEntryCount = mdCount
+	info.BranchID = mdJournal.branchID
+	info.Abandoned = blockCount == 0 && mdCount == 0 &&
+		mdJournal.branchID == NullBranchID
+	return nil
+}
+
+// ScanJournalDirs lists all the TLF journal directories under root,
+// which is laid out like the directory of a JournalServer. It can be
+// used to find journals left behind by a process that didn't clean
+// up after itself. Subdirectories that aren't named after a TLF ID
+// are skipped. If the journals in a directory can't be read, the
+// error is recorded in its JournalDirInfo, and the scan carries on
+// with the rest; only a failure to list root itself is returned.
+func ScanJournalDirs(root string) ([]JournalDirInfo, error) {
+	fileInfos, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	codec := NewCodecMsgpack()
+	crypto := MakeCryptoCommon(codec)
+	log := logger.NewNull()
+	ctx := context.Background()
+
+	var infos []JournalDirInfo
+	for _, fi := range fileInfos {
+		if !fi.IsDir() {
+			continue
+		}
+		tlfID, err := ParseTlfID(fi.Name())
+		if err != nil {
+			continue
+		}
+
+		info := JournalDirInfo{
+			Dir:   filepath.Join(root, fi.Name()),
+			TlfID: tlfID,
+		}
+		info.Err = scanJournalDir(ctx, codec, crypto, log, &info)
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
 
@@ -811,6 +812,468 @@ func TestBasicCRFileConflict(t *testing.T) {
 	}
 }
 
+// Tests that a conflict rename doesn't collide with a name that
+// already exists in the merged directory.
+func TestCRFileConflictNameCollision(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	clock, now := newTestClockAndTimeNow()
+	config2.SetClock(clock)
+
+	name := userName1.String() + "," + userName2.String()
+
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, dirA1, "b", false, NoExcl)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fileB2, _, err := kbfsOps2.Lookup(ctx, dirA2, "b")
+	require.NoError(t, err)
+
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 1 writes the file, and also takes the name that user
+	// 2's conflicting copy would get.
+	cre := WriterDeviceDateConflictRenamer{}
+	takenName := cre.ConflictRenameHelper(now, "u2", "dev1", "b")
+	err = kbfsOps1.Write(ctx, fileB1, []byte{1, 2, 3, 4, 5}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileB1)
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateFile(ctx, dirA1, takenName, false, NoExcl)
+	require.NoError(t, err)
+
+	// User 2 writes the file too.
+	err = kbfsOps2.Write(ctx, fileB2, []byte{5, 4, 3, 2, 1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.Sync(ctx, fileB2)
+	require.NoError(t, err)
+
+	c <- struct{}{}
+	err = RestartCRForTesting(context.Background(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	children1, err := kbfsOps1.GetDirChildren(ctx, dirA1)
+	require.NoError(t, err)
+	children2, err := kbfsOps2.GetDirChildren(ctx, dirA2)
+	require.NoError(t, err)
+	require.Equal(t, children1, children2)
+
+	expectedChildren := []string{
+		"b",
+		takenName,
+		cre.conflictRenameHelper(now, "u2", "dev1", "b", 2),
+	}
+	require.Len(t, children1, len(expectedChildren))
+	for _, child := range expectedChildren {
+		_, ok := children1[child]
+		require.True(t, ok, "Couldn't find child %s", child)
+	}
+}
+
+func testCRFileConflictPreferNewest(t *testing.T, unmergedNewer bool) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetMergeStrategy(PreferNewestMergeStrategy{})
+
+	// Keep user 2's clock in the past, so that its unmerged write
+	// looks older than user 1's merged write, or move it into the
+	// future to make it look newer.
+	clock, _ := newTestClockAndTimeNow()
+	if unmergedNewer {
+		clock.Add(1 * time.Hour)
+	}
+	config2.SetClock(clock)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file in a shared dir
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, dirA1, "b", false, NoExcl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileB2, _, err := kbfsOps2.Lookup(ctx, dirA2, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// disable updates and CR on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// User 1 writes the file
+	data1 := []byte{1, 2, 3, 4, 5}
+	err = kbfsOps1.Write(ctx, fileB1, data1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kbfsOps1.Sync(ctx, fileB1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// User 2 makes a conflicting write
+	data2 := []byte{5, 4, 3, 2, 1}
+	err = kbfsOps2.Write(ctx, fileB2, data2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kbfsOps2.Sync(ctx, fileB2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(context.Background(), config2,
+		rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// If user 1's version is newer, it should be the only one
+	// left. Otherwise, user 2's version is kept as a conflict
+	// copy, since conflict resolution can't replace a merged file
+	// with an unmerged one.
+	expectedChildren := 1
+	if unmergedNewer {
+		expectedChildren = 2
+	}
+	children1, err := kbfsOps1.GetDirChildren(ctx, dirA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	children2, err := kbfsOps2.GetDirChildren(ctx, dirA2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children1) != expectedChildren {
+		t.Fatalf("Unexpected children: %v", children1)
+	}
+	if _, ok := children1["b"]; !ok {
+		t.Fatalf("Couldn't find b: %v", children1)
+	}
+	if !reflect.DeepEqual(children1, children2) {
+		t.Fatalf("Users 1 and 2 see different children: %v vs %v",
+			children1, children2)
+	}
+
+	for kbfsOps, dirA := range map[KBFSOps]Node{
+		kbfsOps1: dirA1,
+		kbfsOps2: dirA2,
+	} {
+		fileB, _, err := kbfsOps.Lookup(ctx, dirA, "b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(data1))
+		n, err := kbfsOps.Read(ctx, fileB, buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(data1)) || !reflect.DeepEqual(data1, buf) {
+			t.Fatalf("Unexpected data: %v", buf[:n])
+		}
+	}
+}
+
+// Tests that a merge strategy preferring the newest change discards
+// the older, unmerged version of a conflicting file, instead of
+// renaming it.
+func TestCRFileConflictPreferNewestMerged(t *testing.T) {
+	testCRFileConflictPreferNewest(t, false)
+}
+
+// Tests that a merge strategy preferring the newest change still
+// keeps both versions of a conflicting file when the unmerged one
+// is newer.
+func TestCRFileConflictPreferNewestUnmerged(t *testing.T) {
+	testCRFileConflictPreferNewest(t, true)
+}
+
+// Tests that a caller can wait for conflict resolution to complete
+// via CRCompletionChanForTesting, without having to poll.
+func TestCRCompletionChan(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	clock, now := newTestClockAndTimeNow()
+	config2.SetClock(clock)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file in a shared dir
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, dirA1, "b", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't lookup dir: %v", err)
+	}
+	fileB2, _, err := kbfsOps2.Lookup(ctx, dirA2, "b")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %v", err)
+	}
+
+	// disable updates and CR on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't disable CR: %v", err)
+	}
+
+	// User 1 writes the file
+	data1 := []byte{1, 2, 3, 4, 5}
+	err = kbfsOps1.Write(ctx, fileB1, data1, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps1.Sync(ctx, fileB1)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	// User 2 writes the file too, causing a conflict
+	data2 := []byte{5, 4, 3, 2, 1}
+	err = kbfsOps2.Write(ctx, fileB2, data2, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	err = kbfsOps2.Sync(ctx, fileB2)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	mergedRev := getOps(config1, rootNode1.GetFolderBranch().Tlf).
+		getCurrMDRevision(makeFBOLockState())
+
+	crDone, err := CRCompletionChanForTesting(
+		config2, rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't get CR completion chan: %v", err)
+	}
+
+	// re-enable updates and CR, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(context.Background(), config2,
+		rootNode2.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't restart CR: %v", err)
+	}
+
+	var resolvedRev MetadataRevision
+	select {
+	case resolvedRev = <-crDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for CR")
+	}
+
+	if g, e := resolvedRev, mergedRev+1; g != e {
+		t.Errorf("Unexpected resolved revision: %d vs %d", g, e)
+	}
+	ops2 := getOps(config2, rootNode2.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	if !ops2.isMasterBranch(lState) {
+		t.Errorf("User 2 is still on a branch after CR")
+	}
+	if g, e := ops2.getCurrMDRevision(lState), resolvedRev; g != e {
+		t.Errorf("Unexpected head revision for user 2: %d vs %d", g, e)
+	}
+
+	cre := WriterDeviceDateConflictRenamer{}
+	expectedChildren := []string{
+		"b",
+		cre.ConflictRenameHelper(now, "u2", "dev1", "b"),
+	}
+	children2, err := kbfsOps2.GetDirChildren(ctx, dirA2)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	if g, e := len(children2), len(expectedChildren); g != e {
+		t.Errorf("Wrong number of children: %d vs %d", g, e)
+	}
+	for _, child := range expectedChildren {
+		if _, ok := children2[child]; !ok {
+			t.Errorf("Couldn't find child %s", child)
+		}
+	}
+}
+
+// Tests that an unmerged write that would make the branch too long
+// forces conflict resolution, even if CR already failed for the
+// current unmerged head, and is then retried on the merged branch.
+func TestUnmergedPutTooManyRevisions(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	clock, _ := newTestClockAndTimeNow()
+	config2.SetClock(clock)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file in a shared dir
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileA1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	_, _, err = kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+
+	// disable updates and CR on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 1 writes the file, and user 2 creates a new one, starting
+	// an unmerged branch.
+	err = kbfsOps1.Write(ctx, fileA1, []byte{1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileA1)
+	require.NoError(t, err)
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "b", false, NoExcl)
+	require.NoError(t, err)
+	ops2 := getOps(config2, rootNode2.GetFolderBranch().Tlf)
+	require.False(t, ops2.isMasterBranch(makeFBOLockState()))
+
+	// Let CR start on the unmerged head, but cancel it before it
+	// can finish, so that asking for it again is a no-op.
+	onPutStalledCh, putUnstallCh, putCtx :=
+		StallMDOp(ctx, config2, StallableMDPut)
+	putCtx, cancel := context.WithCancel(putCtx)
+	err = RestartCRForTesting(putCtx, config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	<-onPutStalledCh
+	cancel()
+	close(putUnstallCh)
+	err = ops2.cr.Wait(ctx)
+	require.NoError(t, err)
+	require.False(t, ops2.isMasterBranch(makeFBOLockState()))
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = RestartCRForTesting(
+		context.Background(), config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = ops2.cr.Wait(ctx)
+	require.NoError(t, err)
+	require.False(t, ops2.isMasterBranch(makeFBOLockState()))
+
+	mdServer, ok := config2.MDServer().(*MDServerMemory)
+	require.True(t, ok)
+	mdServer.SetMaxBranchRevisions(1)
+	defer mdServer.SetMaxBranchRevisions(0)
+
+	// Another write can't grow the branch, so it has to wait for CR
+	// to merge the branch back in, and then gets written to the
+	// merged branch.
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "c", false, NoExcl)
+	require.NoError(t, err)
+	require.True(t, ops2.isMasterBranch(makeFBOLockState()))
+
+	c <- struct{}{}
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+	for _, kbfsOps := range []KBFSOps{kbfsOps1, kbfsOps2} {
+		root := rootNode1
+		if kbfsOps == kbfsOps2 {
+			root = rootNode2
+		}
+		children, err := kbfsOps.GetDirChildren(ctx, root)
+		require.NoError(t, err)
+		require.Len(t, children, 3)
+		for _, child := range []string{"a", "b", "c"} {
+			require.Contains(t, children, child)
+		}
+	}
+
+	// Don't make shutdown wait for the failed put's revision to
+	// show up on the unmerged branch.
+	clock.Add(deleteBlockMaxRetryTime)
+}
+
 // Tests that two users can create the same file simultaneously, and
 // the unmerged user can write to it, and they will be merged into a
 // single file.
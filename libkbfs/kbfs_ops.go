@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -582,6 +583,65 @@ func (fs *KBFSOpsStandard) GetEditHistory(ctx context.Context,
 	return ops.GetEditHistory(ctx, folderBranch)
 }
 
+// ListAllConflicts implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) ListAllConflicts(ctx context.Context) (
+	[]ConflictInfo, error) {
+	tlfIDs := make(map[TlfID]bool)
+	func() {
+		fs.opsLock.RLock()
+		defer fs.opsLock.RUnlock()
+		for fb := range fs.ops {
+			tlfIDs[fb.Tlf] = true
+		}
+	}()
+	jServer, jServerErr := GetJournalServer(fs.config)
+	if jServerErr == nil {
+		for _, tlfID := range jServer.tlfIDs() {
+			tlfIDs[tlfID] = true
+		}
+	}
+
+	var conflicts []ConflictInfo
+	for tlfID := range tlfIDs {
+		tlfConflicts, err := getServerConflicts(
+			ctx, fs.config.MDServer(), tlfID)
+		if err != nil {
+			return nil, err
+		}
+
+		if jServerErr == nil {
+			jConflict, ok, err := jServer.journalConflict(ctx, tlfID)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				// The journal may hold the latest part of a
+				// branch that's partially on the server.
+				found := false
+				for i, c := range tlfConflicts {
+					if c.BID != jConflict.BID {
+						continue
+					}
+					found = true
+					if jConflict.RevisionEnd > c.RevisionEnd {
+						tlfConflicts[i].RevisionEnd =
+							jConflict.RevisionEnd
+					}
+				}
+				if !found {
+					tlfConflicts = append(tlfConflicts, jConflict)
+				}
+			}
+		}
+
+		conflicts = append(conflicts, tlfConflicts...)
+	}
+
+	sort.Sort(conflictInfosByID(conflicts))
+	return conflicts, nil
+}
+
 // Notifier:
 var _ Notifier = (*KBFSOpsStandard)(nil)
 
@@ -5464,3 +5464,203 @@ func TestKBFSOpsMaliciousMDServerRange(t *testing.T) {
 	// have MDOps do the handle check, that'll trigger first.
 	require.IsType(t, MDPrevRootMismatch{}, err)
 }
+
+func getFileBlockIDsOrBust(
+	t *testing.T, config Config, fileNode Node) []BlockID {
+	ctx := context.Background()
+	ops := getOps(config, fileNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	file, err := ops.pathFromNodeForRead(fileNode)
+	require.NoError(t, err)
+	infos, err := ops.blocks.GetIndirectFileBlockInfos(
+		ctx, lState, ops.getHead(lState), file)
+	require.NoError(t, err)
+	ids := make([]BlockID, 0, len(infos))
+	for _, info := range infos {
+		ids = append(ids, info.ID)
+	}
+	return ids
+}
+
+func TestKBFSOpsDeterministicBlockIDsReuse(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	crypto := installDeterministicBlockIDsForTesting(config)
+
+	// Make blocks small.
+	blockSize := int64(5)
+	config.BlockSplitter().(*BlockSplitterSimple).maxSize = blockSize
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	data := make([]byte, 4*blockSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	ids1 := getFileBlockIDsOrBust(t, config, fileNode)
+	require.Equal(t, 4, len(ids1))
+	assigned := crypto.assignedCount()
+	for _, id := range ids1 {
+		found := false
+		for i := uint64(1); i <= assigned; i++ {
+			if id == crypto.blockIDForTesting(i) {
+				found = true
+				break
+			}
+		}
+		require.True(t, found, "Unexpected block ID %s", id)
+	}
+
+	// Edit a single byte in the second block.
+	err = kbfsOps.Write(ctx, fileNode, []byte{0xff}, blockSize+1)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	// Only the edited block should have gotten a new ID, which
+	// must come after all the previously-assigned ones.
+	ids2 := getFileBlockIDsOrBust(t, config, fileNode)
+	require.Equal(t, len(ids1), len(ids2))
+	for i := range ids1 {
+		if i == 1 {
+			continue
+		}
+		require.Equal(t, ids1[i], ids2[i])
+	}
+	newAssigned := crypto.assignedCount()
+	require.True(t, newAssigned > assigned)
+	found := false
+	for i := assigned + 1; i <= newAssigned; i++ {
+		if ids2[1] == crypto.blockIDForTesting(i) {
+			found = true
+			break
+		}
+	}
+	require.True(t, found, "Unexpected block ID %s", ids2[1])
+}
+
+func TestKBFSOpsListAllConflicts(t *testing.T) {
+	var u1, u2, u3 libkb.NormalizedUsername = "u1", "u2", "u3"
+	config1, _, ctx := kbfsOpsInitNoMocks(t, u1, u2, u3)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1, u2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	// makeConflict leaves user 2 with an unresolved conflict in
+	// the given folder.
+	makeConflict := func(name string) FolderBranch {
+		rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+		rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+		fb := rootNode1.GetFolderBranch()
+
+		_, err := DisableUpdatesForTesting(config2, fb)
+		require.NoError(t, err)
+		err = DisableCRForTesting(config2, fb)
+		require.NoError(t, err)
+
+		_, _, err = config1.KBFSOps().CreateFile(
+			ctx, rootNode1, "a", false, NoExcl)
+		require.NoError(t, err)
+		_, _, err = config2.KBFSOps().CreateFile(
+			ctx, rootNode2, "b", false, NoExcl)
+		require.NoError(t, err)
+		return fb
+	}
+
+	conflicts, err := config2.KBFSOps().ListAllConflicts(ctx)
+	require.NoError(t, err)
+	require.Len(t, conflicts, 0)
+
+	fbA := makeConflict("u1,u2")
+	fbB := makeConflict("u1,u2,u3")
+
+	conflicts, err = config2.KBFSOps().ListAllConflicts(ctx)
+	require.NoError(t, err)
+	require.Len(t, conflicts, 2)
+
+	byTlf := make(map[TlfID]ConflictInfo)
+	for _, c := range conflicts {
+		byTlf[c.Tlf] = c
+	}
+	for _, fb := range []FolderBranch{fbA, fbB} {
+		c, ok := byTlf[fb.Tlf]
+		require.True(t, ok, "No conflict listed for %s", fb.Tlf)
+		require.NotEqual(t, NullBranchID, c.BID)
+		require.Equal(t, MetadataRevision(1), c.MergedRevision)
+		require.Equal(t, MetadataRevision(2), c.RevisionStart)
+		require.Equal(t, MetadataRevision(2), c.RevisionEnd)
+		require.False(t, c.JournalOnly)
+	}
+
+	// The branches are on the server, so user 1 sees them too.
+	conflicts1, err := config1.KBFSOps().ListAllConflicts(ctx)
+	require.NoError(t, err)
+	require.Equal(t, conflicts, conflicts1)
+}
+
+// noBranchesMDServer behaves like MDServerRemote, which can't list
+// branches.
+type noBranchesMDServer struct {
+	MDServer
+}
+
+func (md noBranchesMDServer) GetBranches(ctx context.Context, id TlfID) (
+	[]BranchID, error) {
+	return nil, MDServerUnsupportedError{"GetBranches"}
+}
+
+func TestKBFSOpsListAllConflictsNoGetBranches(t *testing.T) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsInitNoMocks(t, u1, u2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1, u2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	rootNode1 := GetRootNodeOrBust(t, config1, "u1,u2", false)
+	rootNode2 := GetRootNodeOrBust(t, config2, "u1,u2", false)
+	fb := rootNode1.GetFolderBranch()
+
+	_, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb)
+	require.NoError(t, err)
+
+	_, _, err = config1.KBFSOps().CreateFile(
+		ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	_, _, err = config2.KBFSOps().CreateFile(
+		ctx, rootNode2, "b", false, NoExcl)
+	require.NoError(t, err)
+
+	mdserver1 := config1.MDServer()
+	mdserver2 := config2.MDServer()
+	config1.SetMDServer(noBranchesMDServer{mdserver1})
+	config2.SetMDServer(noBranchesMDServer{mdserver2})
+	defer config1.SetMDServer(mdserver1)
+	defer config2.SetMDServer(mdserver2)
+
+	// Without GetBranches, each user sees only their own
+	// branch.
+	conflicts, err := config2.KBFSOps().ListAllConflicts(ctx)
+	require.NoError(t, err)
+	require.Len(t, conflicts, 1)
+	require.Equal(t, fb.Tlf, conflicts[0].Tlf)
+	require.NotEqual(t, NullBranchID, conflicts[0].BID)
+	require.Equal(t, MetadataRevision(1), conflicts[0].MergedRevision)
+	require.Equal(t, MetadataRevision(2), conflicts[0].RevisionEnd)
+
+	conflicts1, err := config1.KBFSOps().ListAllConflicts(ctx)
+	require.NoError(t, err)
+	require.Len(t, conflicts1, 0)
+}
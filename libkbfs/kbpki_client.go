@@ -6,6 +6,8 @@ package libkbfs
 
 import (
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/keybase/client/go/libkb"
@@ -14,17 +16,261 @@ import (
 	"golang.org/x/net/context"
 )
 
-// KBPKIClient uses a config's KeybaseService.
+// KBPKIClient uses a config's KeybaseService. Its key-checking and
+// rate-limiting settings are read without locking, so they should
+// all be set up before the client is handed to anyone else.
 type KBPKIClient struct {
 	config Config
 	log    logger.Logger
+
+	identifyLatencies         *latencyTracker
+	loadUserPlusKeysLatencies *latencyTracker
+
+	// If non-zero, HasVerifyingKey rejects keys that were
+	// provisioned less than minKeyAge before the time they're
+	// being checked at.
+	minKeyAge time.Duration
+
+	// If non-nil, outbound identity calls to the KeybaseService
+	// wait for a token from identifyLimiter first.
+	identifyLimiter *tokenBucket
+
+	// The number of times HasVerifyingKey flushes a user from the
+	// local cache and reloads it when a key isn't found, and how
+	// long it waits before the second such retry, doubling for
+	// each one after that.
+	staleCacheRetries      int
+	staleCacheRetryBackoff time.Duration
+
+	// If non-zero, HasVerifyingKey returns a
+	// KeyRevocationAmbiguousError for revoked keys checked at a
+	// time within revocationSkewWindow of their revocation time.
+	revocationSkewWindow time.Duration
+
+	inflightLock      sync.Mutex
+	inflightLoadUPKs  map[keybase1.UID]*inflightUserInfoCall
+	inflightRefreshes map[keybase1.UID]*inflightUserInfoCall
+}
+
+// inflightUserInfoCall is an outstanding LoadUserPlusKeys call (or
+// RefreshUser call) that concurrent callers for the same UID can
+// wait on instead of making their own call. userInfo and err may
+// only be read after done is closed.
+type inflightUserInfoCall struct {
+	done     chan struct{}
+	userInfo UserInfo
+	err      error
 }
 
 var _ KBPKI = (*KBPKIClient)(nil)
 
 // NewKBPKIClient returns a new KBPKIClient with the given Config.
 func NewKBPKIClient(config Config) *KBPKIClient {
-	return &KBPKIClient{config, config.MakeLogger("")}
+	return &KBPKIClient{
+		config:                    config,
+		log:                       config.MakeLogger(""),
+		identifyLatencies:         newLatencyTracker(latencyTrackerWindow),
+		loadUserPlusKeysLatencies: newLatencyTracker(latencyTrackerWindow),
+		staleCacheRetries:         1,
+		inflightLoadUPKs:          make(map[keybase1.UID]*inflightUserInfoCall),
+		inflightRefreshes:         make(map[keybase1.UID]*inflightUserInfoCall),
+	}
+}
+
+// tokenBucket is a goroutine-safe token bucket rate limiter. Tokens
+// are added at rate per second, up to burst. Each wait takes one
+// token, waiting for it if necessary; the balance goes negative
+// while there are waiters, so that they're spaced out evenly.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait takes a token, blocking until it's available or ctx is
+// done. If ctx is done first, the token is returned to the bucket.
+func (tb *tokenBucket) wait(ctx context.Context) error {
+	delay := func() time.Duration {
+		tb.lock.Lock()
+		defer tb.lock.Unlock()
+		now := time.Now()
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+		tb.last = now
+		tb.tokens--
+		if tb.tokens >= 0 {
+			return 0
+		}
+		return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	}()
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		tb.lock.Lock()
+		defer tb.lock.Unlock()
+		tb.tokens++
+		return ctx.Err()
+	}
+}
+
+// latencyTrackerWindow is the number of most recent calls over which
+// latency percentiles are computed.
+const latencyTrackerWindow = 1000
+
+// LatencySummary summarizes the latencies of a single kind of call.
+type LatencySummary struct {
+	// Count is the total number of calls made.
+	Count int
+	// P50 and P99 are the median and 99th-percentile latencies
+	// over the most recent calls.
+	P50 time.Duration
+	P99 time.Duration
+}
+
+// ResolutionStats summarizes the latencies of identity resolution
+// calls made by a KBPKIClient.
+type ResolutionStats struct {
+	Identify         LatencySummary
+	LoadUserPlusKeys LatencySummary
+}
+
+// latencyTracker records the latencies of the most recent calls in a
+// fixed-size ring buffer. It is goroutine-safe.
+type latencyTracker struct {
+	lock      sync.Mutex
+	count     int
+	latencies []time.Duration
+}
+
+func newLatencyTracker(window int) *latencyTracker {
+	return &latencyTracker{latencies: make([]time.Duration, 0, window)}
+}
+
+func (lt *latencyTracker) record(d time.Duration) {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	if len(lt.latencies) < cap(lt.latencies) {
+		lt.latencies = append(lt.latencies, d)
+	} else {
+		lt.latencies[lt.count%cap(lt.latencies)] = d
+	}
+	lt.count++
+}
+
+func (lt *latencyTracker) summary() LatencySummary {
+	lt.lock.Lock()
+	count := lt.count
+	latencies := make([]time.Duration, len(lt.latencies))
+	copy(latencies, lt.latencies)
+	lt.lock.Unlock()
+
+	if len(latencies) == 0 {
+		return LatencySummary{}
+	}
+	sort.Sort(durationSlice(latencies))
+	// Use the nearest-rank method.
+	percentile := func(p int) time.Duration {
+		i := (p*len(latencies)+99)/100 - 1
+		return latencies[i]
+	}
+	return LatencySummary{
+		Count: count,
+		P50:   percentile(50),
+		P99:   percentile(99),
+	}
+}
+
+type durationSlice []time.Duration
+
+func (d durationSlice) Len() int           { return len(d) }
+func (d durationSlice) Less(i, j int) bool { return d[i] < d[j] }
+func (d durationSlice) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// SetMinKeyAge makes HasVerifyingKey reject verifying keys that
+// were provisioned less than the given duration before the time at
+// which they're being checked, with a KeyTooNewError. This guards
+// against signatures from freshly-provisioned, and possibly
+// compromised, devices. Keys with an unknown provisioning time are
+// not rejected. A zero duration disables the check.
+func (k *KBPKIClient) SetMinKeyAge(minKeyAge time.Duration) {
+	k.minKeyAge = minKeyAge
+}
+
+// SetIdentifyRateLimit limits outbound Identify and
+// LoadUserPlusKeys calls to the KeybaseService to rate per second,
+// with bursts of up to burst calls. Calls over the limit wait, or
+// fail if their context is done first. Concurrent LoadUserPlusKeys
+// calls for the same UID share a single outbound call, and so only
+// count once against the limit. A non-positive rate disables the
+// limit.
+func (k *KBPKIClient) SetIdentifyRateLimit(rate float64, burst int) {
+	if rate <= 0 {
+		k.identifyLimiter = nil
+		return
+	}
+	k.identifyLimiter = newTokenBucket(rate, burst)
+}
+
+// SetStaleCacheRetries sets how many times HasVerifyingKey flushes a
+// user from the local cache and reloads it, when the key it's looking
+// for isn't found, before giving up. The first retry happens right
+// away, and later ones wait for backoff, doubling each time. The
+// default is a single retry.
+func (k *KBPKIClient) SetStaleCacheRetries(
+	retries int, backoff time.Duration) {
+	k.staleCacheRetries = retries
+	k.staleCacheRetryBackoff = backoff
+}
+
+// SetRevocationSkewWindow makes HasVerifyingKey return a
+// KeyRevocationAmbiguousError, instead of accepting or rejecting the
+// key, when a revoked key is checked at a time within the given
+// window of its revocation time.  Since server and device clocks can
+// disagree, such a result can't be trusted either way, and
+// security-sensitive callers may want to treat it conservatively.  A
+// zero window disables the check.
+func (k *KBPKIClient) SetRevocationSkewWindow(window time.Duration) {
+	k.revocationSkewWindow = window
+}
+
+func (k *KBPKIClient) waitForIdentifyLimit(ctx context.Context) error {
+	if k.identifyLimiter == nil {
+		return nil
+	}
+	return k.identifyLimiter.wait(ctx)
+}
+
+// ResolutionStats returns a summary of the latencies of the identity
+// resolution calls made by this KBPKIClient so far.
+func (k *KBPKIClient) ResolutionStats() ResolutionStats {
+	return ResolutionStats{
+		Identify:         k.identifyLatencies.summary(),
+		LoadUserPlusKeys: k.loadUserPlusKeysLatencies.summary(),
+	}
 }
 
 // GetCurrentToken implements the KBPKI interface for KBPKIClient.
@@ -79,6 +325,12 @@ func (k *KBPKIClient) Resolve(ctx context.Context, assertion string) (
 // Identify implements the KBPKI interface for KBPKIClient.
 func (k *KBPKIClient) Identify(ctx context.Context, assertion, reason string) (
 	UserInfo, error) {
+	err := k.waitForIdentifyLimit(ctx)
+	if err != nil {
+		return UserInfo{}, err
+	}
+	start := time.Now()
+	defer func() { k.identifyLatencies.record(time.Since(start)) }()
 	return k.config.KeybaseService().Identify(ctx, assertion, reason)
 }
 
@@ -93,17 +345,35 @@ func (k *KBPKIClient) GetNormalizedUsername(ctx context.Context, uid keybase1.UI
 	return username, nil
 }
 
+// hasVerifyingKey returns whether the given key was valid for uid at
+// atServerTime. If trustAtRevokeTime is set, a key revoked at
+// atServerTime, to the precision of the revoke time, is considered
+// still valid.
 func (k *KBPKIClient) hasVerifyingKey(ctx context.Context, uid keybase1.UID,
-	verifyingKey VerifyingKey, atServerTime time.Time) (bool, error) {
+	verifyingKey VerifyingKey, atServerTime time.Time,
+	trustAtRevokeTime bool) (bool, error) {
 	userInfo, err := k.loadUserPlusKeys(ctx, uid)
 	if err != nil {
 		return false, err
 	}
 
 	for _, key := range userInfo.VerifyingKeys {
-		if verifyingKey.kid.Equal(key.kid) {
-			return true, nil
+		if !verifyingKey.kid.Equal(key.kid) {
+			continue
 		}
+		t, ok := userInfo.VerifyingKeyProvisionTimes[key]
+		if k.minKeyAge > 0 && ok {
+			provisionTime := keybase1.FromTime(t)
+			if atServerTime.Sub(provisionTime) < k.minKeyAge {
+				return false, KeyTooNewError{
+					kid:           verifyingKey.kid,
+					provisionTime: provisionTime,
+					atTime:        atServerTime,
+					minAge:        k.minKeyAge,
+				}
+			}
+		}
+		return true, nil
 	}
 
 	for key, t := range userInfo.RevokedVerifyingKeys {
@@ -114,7 +384,28 @@ func (k *KBPKIClient) hasVerifyingKey(ctx context.Context, uid keybase1.UID,
 		// Trust the server times -- if the key was valid at the given
 		// time, we are good to go.  TODO: use Merkle data to check
 		// the server timestamps, to prove the server isn't lying.
-		if atServerTime.Before(revokedTime) {
+		validAtTime := atServerTime.Before(revokedTime)
+		atRevokeTime := false
+		if !validAtTime && trustAtRevokeTime {
+			// Revoke times only have millisecond precision.
+			atRevokeTime = keybase1.ToTime(atServerTime) == t.Unix
+			validAtTime = atRevokeTime
+		}
+		if k.revocationSkewWindow > 0 && !atRevokeTime {
+			skew := atServerTime.Sub(revokedTime)
+			if skew < 0 {
+				skew = -skew
+			}
+			if skew < k.revocationSkewWindow {
+				return false, KeyRevocationAmbiguousError{
+					kid:         verifyingKey.kid,
+					revokedTime: revokedTime,
+					atTime:      atServerTime,
+					window:      k.revocationSkewWindow,
+				}
+			}
+		}
+		if validAtTime {
 			k.log.CDebugf(ctx, "Trusting revoked verifying key %s for user %s "+
 				"(revoked time: %v vs. server time %v)", verifyingKey.kid, uid,
 				revokedTime, atServerTime)
@@ -151,22 +442,54 @@ func (k *KBPKIClient) hasUnverifiedVerifyingKey(ctx context.Context, uid keybase
 // HasVerifyingKey implements the KBPKI interface for KBPKIClient.
 func (k *KBPKIClient) HasVerifyingKey(ctx context.Context, uid keybase1.UID,
 	verifyingKey VerifyingKey, atServerTime time.Time) error {
-	ok, err := k.hasVerifyingKey(ctx, uid, verifyingKey, atServerTime)
+	return k.checkVerifyingKey(ctx, uid, verifyingKey, atServerTime, false)
+}
+
+// HasVerifyingKeyAtRevision returns nil if the key that signed the
+// writer metadata of the given journal revision was valid for its
+// writer at the time the revision was recorded in the journal. Unlike
+// HasVerifyingKey, a key revoked at exactly that time is still
+// considered valid. When replaying or flushing an MD journal, this
+// should be used instead of checking the key against the wall clock,
+// since the key may have been revoked since the revision was signed.
+func (k *KBPKIClient) HasVerifyingKeyAtRevision(
+	ctx context.Context, rmd ImmutableBareRootMetadata) error {
+	return k.checkVerifyingKey(ctx, rmd.LastModifyingWriter(),
+		rmd.GetWriterMetadataSigInfo().VerifyingKey,
+		rmd.localTimestamp, true)
+}
+
+func (k *KBPKIClient) checkVerifyingKey(ctx context.Context,
+	uid keybase1.UID, verifyingKey VerifyingKey, atServerTime time.Time,
+	trustAtRevokeTime bool) error {
+	ok, err := k.hasVerifyingKey(
+		ctx, uid, verifyingKey, atServerTime, trustAtRevokeTime)
 	if err != nil {
 		return err
 	}
-	if ok {
-		return nil
-	}
 
-	// If the first attempt couldn't find the key, try again after
-	// clearing our local cache.  We might have stale info if the
-	// service hasn't learned of the users' new key yet.
-	k.config.KeybaseService().FlushUserFromLocalCache(ctx, uid)
+	backoff := k.staleCacheRetryBackoff
+	for retry := 0; !ok && retry < k.staleCacheRetries; retry++ {
+		if retry > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff *= 2
+		}
 
-	ok, err = k.hasVerifyingKey(ctx, uid, verifyingKey, atServerTime)
-	if err != nil {
-		return err
+		// If the key couldn't be found, try again after
+		// clearing our local cache.  We might have stale info
+		// if the service hasn't learned of the users' new key
+		// yet.
+		k.config.KeybaseService().FlushUserFromLocalCache(ctx, uid)
+
+		ok, err = k.hasVerifyingKey(
+			ctx, uid, verifyingKey, atServerTime, trustAtRevokeTime)
+		if err != nil {
+			return err
+		}
 	}
 	if !ok {
 		return KeyNotFoundError{verifyingKey.kid}
@@ -205,9 +528,161 @@ func (k *KBPKIClient) GetCryptPublicKeys(ctx context.Context,
 	return userInfo.CryptPublicKeys, nil
 }
 
+// maxParallelCryptPublicKeyLoads is the maximum number of users whose
+// keys GetCryptPublicKeysForUsers loads at once.
+const maxParallelCryptPublicKeyLoads = 10
+
+// GetCryptPublicKeysForUsers returns the crypt public keys of each of
+// the given users, loading them concurrently and each distinct user
+// only once. If a user is loaded with no crypt keys, the local cache
+// may be stale, so it's flushed and the user is loaded again, like
+// HasVerifyingKey does for a missing verifying key. If any user can't
+// be loaded, the whole call fails.
+func (k *KBPKIClient) GetCryptPublicKeysForUsers(ctx context.Context,
+	uids []keybase1.UID) (map[keybase1.UID][]CryptPublicKey, error) {
+	uidCh := make(chan keybase1.UID, len(uids))
+	seen := make(map[keybase1.UID]bool, len(uids))
+	for _, uid := range uids {
+		if seen[uid] {
+			continue
+		}
+		seen[uid] = true
+		uidCh <- uid
+	}
+	close(uidCh)
+
+	workers := maxParallelCryptPublicKeyLoads
+	if len(seen) < workers {
+		workers = len(seen)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var lock sync.Mutex
+	keys := make(map[keybase1.UID][]CryptPublicKey, len(seen))
+	var firstErr error
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for uid := range uidCh {
+				userKeys, err := k.getCryptPublicKeysWithRetry(ctx, uid)
+				lock.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+						// No point in loading the rest.
+						cancel()
+					}
+				} else {
+					keys[uid] = userKeys
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return keys, nil
+}
+
+func (k *KBPKIClient) getCryptPublicKeysWithRetry(
+	ctx context.Context, uid keybase1.UID) ([]CryptPublicKey, error) {
+	keys, err := k.GetCryptPublicKeys(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		return keys, nil
+	}
+
+	k.config.KeybaseService().FlushUserFromLocalCache(ctx, uid)
+	return k.GetCryptPublicKeys(ctx, uid)
+}
+
+// coalesceUserInfoCall calls fn for uid, unless there's already a
+// call for uid in inflight, in which case it waits for that call's
+// result instead. If that call failed only because its caller's ctx
+// was canceled, the waiter retries, so that one caller's
+// cancellation isn't passed on to the others.
+func (k *KBPKIClient) coalesceUserInfoCall(ctx context.Context,
+	inflight map[keybase1.UID]*inflightUserInfoCall, uid keybase1.UID,
+	fn func() (UserInfo, error)) (UserInfo, error) {
+	for {
+		k.inflightLock.Lock()
+		call, ok := inflight[uid]
+		if !ok {
+			break
+		}
+		k.inflightLock.Unlock()
+		select {
+		case <-call.done:
+			if call.err == context.Canceled ||
+				call.err == context.DeadlineExceeded {
+				if ctx.Err() != nil {
+					return UserInfo{}, ctx.Err()
+				}
+				continue
+			}
+			return call.userInfo, call.err
+		case <-ctx.Done():
+			return UserInfo{}, ctx.Err()
+		}
+	}
+	call := &inflightUserInfoCall{done: make(chan struct{})}
+	inflight[uid] = call
+	k.inflightLock.Unlock()
+
+	defer func() {
+		k.inflightLock.Lock()
+		defer k.inflightLock.Unlock()
+		delete(inflight, uid)
+		close(call.done)
+	}()
+
+	call.userInfo, call.err = fn()
+	return call.userInfo, call.err
+}
+
+func (k *KBPKIClient) loadUserPlusKeysUncoalesced(
+	ctx context.Context, uid keybase1.UID) (UserInfo, error) {
+	err := k.waitForIdentifyLimit(ctx)
+	if err != nil {
+		return UserInfo{}, err
+	}
+
+	start := time.Now()
+	defer func() { k.loadUserPlusKeysLatencies.record(time.Since(start)) }()
+	return k.config.KeybaseService().LoadUserPlusKeys(ctx, uid)
+}
+
 func (k *KBPKIClient) loadUserPlusKeys(ctx context.Context, uid keybase1.UID) (
 	UserInfo, error) {
-	return k.config.KeybaseService().LoadUserPlusKeys(ctx, uid)
+	return k.coalesceUserInfoCall(ctx, k.inflightLoadUPKs, uid,
+		func() (UserInfo, error) {
+			return k.loadUserPlusKeysUncoalesced(ctx, uid)
+		})
+}
+
+// RefreshUser flushes the given user from the KeybaseService's local
+// cache and reloads it, so that changes such as newly-added devices
+// are picked up right away, rather than only after a key lookup
+// fails.  It returns the reloaded UserInfo.  Concurrent calls for
+// the same user share a single flush and reload.
+func (k *KBPKIClient) RefreshUser(ctx context.Context, uid keybase1.UID) (
+	UserInfo, error) {
+	return k.coalesceUserInfoCall(ctx, k.inflightRefreshes, uid,
+		func() (UserInfo, error) {
+			k.config.KeybaseService().FlushUserFromLocalCache(ctx, uid)
+			// Don't join an in-flight load, since it may have
+			// started before the flush.
+			return k.loadUserPlusKeysUncoalesced(ctx, uid)
+		})
 }
 
 func (k *KBPKIClient) session(ctx context.Context) (SessionInfo, error) {
@@ -5,12 +5,15 @@
 package libkbfs
 
 import (
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/keybase/client/go/libkb"
 	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
 
@@ -48,6 +51,54 @@ func makeTestKBPKIClientWithRevokedKey(t *testing.T, revokeTime time.Time) (
 	return NewKBPKIClient(config), currentUID, users
 }
 
+func makeTestKBPKIClientWithProvisionTime(
+	t *testing.T, provisionTime time.Time) (
+	client *KBPKIClient, currentUID keybase1.UID, users []LocalUser) {
+	currentUID = keybase1.MakeTestUID(1)
+	names := []libkb.NormalizedUsername{"test_name1", "test_name2"}
+	users = MakeLocalUsers(names)
+	// Give each user's key a provisioning time.
+	for i, user := range users {
+		user.VerifyingKeyProvisionTimes = map[VerifyingKey]keybase1.Time{
+			user.VerifyingKeys[0]: keybase1.ToTime(provisionTime),
+		}
+		users[i] = user
+	}
+	codec := NewCodecMsgpack()
+	daemon := NewKeybaseDaemonMemory(currentUID, users, codec)
+	config := &ConfigLocal{codec: codec, service: daemon}
+	setTestLogger(config, t)
+	return NewKBPKIClient(config), currentUID, users
+}
+
+// waitingContext is a context.Context that signals on waiting the
+// first time its Done channel is requested, i.e. once its caller
+// starts waiting on something.
+type waitingContext struct {
+	context.Context
+	once    sync.Once
+	waiting chan<- struct{}
+}
+
+func (c *waitingContext) Done() <-chan struct{} {
+	c.once.Do(func() { c.waiting <- struct{}{} })
+	return c.Context.Done()
+}
+
+// waitForWaitingContexts waits until count waitingContexts have
+// signaled on waiting.
+func waitForWaitingContexts(
+	t *testing.T, waiting <-chan struct{}, count int) {
+	for i := 0; i < count; i++ {
+		select {
+		case <-waiting:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %d callers; got %d",
+				count, i)
+		}
+	}
+}
+
 func TestKBPKIClientIdentify(t *testing.T) {
 	c, _, _ := makeTestKBPKIClient(t)
 
@@ -113,6 +164,110 @@ func TestKBPKIClientHasRevokedVerifyingKey(t *testing.T) {
 	}
 }
 
+func TestKBPKIClientHasRevokedVerifyingKeyAmbiguous(t *testing.T) {
+	revokeTime := time.Now()
+	c, _, localUsers := makeTestKBPKIClientWithRevokedKey(t, revokeTime)
+	c.SetRevocationSkewWindow(time.Minute)
+
+	var revokedKey VerifyingKey
+	for k := range localUsers[0].RevokedVerifyingKeys {
+		revokedKey = k
+		break
+	}
+
+	// Something verified just before or just after the key was
+	// revoked is ambiguous.
+	err := c.HasVerifyingKey(context.Background(), keybase1.MakeTestUID(1),
+		revokedKey, revokeTime.Add(-10*time.Second))
+	require.IsType(t, KeyRevocationAmbiguousError{}, err)
+	err = c.HasVerifyingKey(context.Background(), keybase1.MakeTestUID(1),
+		revokedKey, revokeTime.Add(10*time.Second))
+	require.IsType(t, KeyRevocationAmbiguousError{}, err)
+
+	// Outside the window, the result is clear-cut again.
+	err = c.HasVerifyingKey(context.Background(), keybase1.MakeTestUID(1),
+		revokedKey, revokeTime.Add(-2*time.Minute))
+	require.NoError(t, err)
+	err = c.HasVerifyingKey(context.Background(), keybase1.MakeTestUID(1),
+		revokedKey, revokeTime.Add(2*time.Minute))
+	require.IsType(t, KeyNotFoundError{}, err)
+}
+
+func TestKBPKIClientHasVerifyingKeyAtRevision(t *testing.T) {
+	// Revoke times have millisecond precision, so use one that's
+	// exactly representable.
+	revokeTime := keybase1.FromTime(keybase1.ToTime(time.Now()))
+	c, _, localUsers := makeTestKBPKIClientWithRevokedKey(t, revokeTime)
+
+	var revokedKey VerifyingKey
+	for k := range localUsers[0].RevokedVerifyingKeys {
+		revokedKey = k
+		break
+	}
+
+	makeRevision := func(localTimestamp time.Time) ImmutableBareRootMetadata {
+		brmd := &BareRootMetadataV2{}
+		brmd.SetLastModifyingWriter(keybase1.MakeTestUID(1))
+		brmd.SetWriterMetadataSigInfo(SignatureInfo{
+			VerifyingKey: revokedKey,
+		})
+		return MakeImmutableBareRootMetadata(
+			brmd, fakeMdID(1), localTimestamp)
+	}
+
+	// Something recorded before the key was revoked
+	err := c.HasVerifyingKeyAtRevision(context.Background(),
+		makeRevision(revokeTime.Add(-10*time.Second)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Something recorded at the instant the key was revoked,
+	// which HasVerifyingKey rejects.
+	err = c.HasVerifyingKeyAtRevision(context.Background(),
+		makeRevision(revokeTime))
+	if err != nil {
+		t.Error(err)
+	}
+	err = c.HasVerifyingKey(context.Background(), keybase1.MakeTestUID(1),
+		revokedKey, revokeTime)
+	if err == nil {
+		t.Error("HasVerifyingKey unexpectedly succeeded")
+	}
+
+	// Something recorded after the key was revoked
+	err = c.HasVerifyingKeyAtRevision(context.Background(),
+		makeRevision(revokeTime.Add(10*time.Second)))
+	if err == nil {
+		t.Error("HasVerifyingKeyAtRevision unexpectedly succeeded")
+	}
+}
+
+func TestKBPKIClientHasVerifyingKeyMinKeyAge(t *testing.T) {
+	provisionTime := time.Now()
+	c, _, localUsers := makeTestKBPKIClientWithProvisionTime(
+		t, provisionTime)
+	c.SetMinKeyAge(time.Hour)
+
+	key := localUsers[0].VerifyingKeys[0]
+
+	// Something signed within the window should be rejected.
+	err := c.HasVerifyingKey(context.Background(), keybase1.MakeTestUID(1),
+		key, provisionTime.Add(10*time.Minute))
+	require.IsType(t, KeyTooNewError{}, err)
+
+	// Something signed outside the window should be accepted.
+	err = c.HasVerifyingKey(context.Background(), keybase1.MakeTestUID(1),
+		key, provisionTime.Add(2*time.Hour))
+	require.NoError(t, err)
+
+	// Without a minimum age, anything goes.
+	c.SetMinKeyAge(0)
+	err = c.HasVerifyingKey(context.Background(), keybase1.MakeTestUID(1),
+		key, provisionTime.Add(10*time.Minute))
+	require.NoError(t, err)
+}
+
 // Test that KBPKI forces a cache flush one time if it can't find a
 // given verifying key.
 func TestKBPKIClientHasVerifyingKeyStaleCache(t *testing.T) {
@@ -148,6 +303,88 @@ func TestKBPKIClientHasVerifyingKeyStaleCache(t *testing.T) {
 	}
 }
 
+func TestKBPKIClientHasVerifyingKeyStaleCacheRetries(t *testing.T) {
+	ctr := NewSafeTestReporter(t)
+	mockCtrl := gomock.NewController(ctr)
+	config := NewConfigMock(mockCtrl, ctr)
+	c := NewKBPKIClient(config)
+	c.SetStaleCacheRetries(3, time.Millisecond)
+	config.SetKBPKI(c)
+	defer func() {
+		config.ctr.CheckForFailures()
+		mockCtrl.Finish()
+	}()
+
+	u := keybase1.MakeTestUID(1)
+	key1 := MakeLocalUserVerifyingKeyOrBust("u_1")
+	key2 := MakeLocalUserVerifyingKeyOrBust("u_2")
+	info1 := UserInfo{
+		VerifyingKeys: []VerifyingKey{key1},
+	}
+	info2 := UserInfo{
+		VerifyingKeys: []VerifyingKey{key1, key2},
+	}
+
+	// The key only shows up on the last retry, and every retry
+	// must flush first.
+	gomock.InOrder(
+		config.mockKbs.EXPECT().LoadUserPlusKeys(gomock.Any(), u).
+			Return(info1, nil),
+		config.mockKbs.EXPECT().FlushUserFromLocalCache(gomock.Any(), u),
+		config.mockKbs.EXPECT().LoadUserPlusKeys(gomock.Any(), u).
+			Return(info1, nil),
+		config.mockKbs.EXPECT().FlushUserFromLocalCache(gomock.Any(), u),
+		config.mockKbs.EXPECT().LoadUserPlusKeys(gomock.Any(), u).
+			Return(info1, nil),
+		config.mockKbs.EXPECT().FlushUserFromLocalCache(gomock.Any(), u),
+		config.mockKbs.EXPECT().LoadUserPlusKeys(gomock.Any(), u).
+			Return(info2, nil),
+	)
+
+	err := c.HasVerifyingKey(context.Background(), u, key2, time.Now())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKBPKIClientHasVerifyingKeyStaleCacheRetriesCanceled(t *testing.T) {
+	ctr := NewSafeTestReporter(t)
+	mockCtrl := gomock.NewController(ctr)
+	config := NewConfigMock(mockCtrl, ctr)
+	c := NewKBPKIClient(config)
+	c.SetStaleCacheRetries(3, time.Hour)
+	config.SetKBPKI(c)
+	defer func() {
+		config.ctr.CheckForFailures()
+		mockCtrl.Finish()
+	}()
+
+	u := keybase1.MakeTestUID(1)
+	key1 := MakeLocalUserVerifyingKeyOrBust("u_1")
+	key2 := MakeLocalUserVerifyingKeyOrBust("u_2")
+	info1 := UserInfo{
+		VerifyingKeys: []VerifyingKey{key1},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// The first retry happens right away, but the context is
+	// canceled before the second one.
+	gomock.InOrder(
+		config.mockKbs.EXPECT().LoadUserPlusKeys(gomock.Any(), u).
+			Return(info1, nil),
+		config.mockKbs.EXPECT().FlushUserFromLocalCache(gomock.Any(), u),
+		config.mockKbs.EXPECT().LoadUserPlusKeys(gomock.Any(), u).
+			Do(func(context.Context, keybase1.UID) { cancel() }).
+			Return(info1, nil),
+	)
+
+	err := c.HasVerifyingKey(ctx, u, key2, time.Now())
+	if err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+}
+
 func TestKBPKIClientGetCryptPublicKeys(t *testing.T) {
 	c, _, localUsers := makeTestKBPKIClient(t)
 
@@ -168,6 +405,67 @@ func TestKBPKIClientGetCryptPublicKeys(t *testing.T) {
 	}
 }
 
+func TestKBPKIClientGetCryptPublicKeysForUsers(t *testing.T) {
+	c, _, localUsers := makeTestKBPKIClient(t)
+
+	uid1 := keybase1.MakeTestUID(1)
+	uid2 := keybase1.MakeTestUID(2)
+	keys, err := c.GetCryptPublicKeysForUsers(context.Background(),
+		[]keybase1.UID{uid1, uid2, uid1})
+	require.NoError(t, err)
+	require.Equal(t, map[keybase1.UID][]CryptPublicKey{
+		uid1: localUsers[0].CryptPublicKeys,
+		uid2: localUsers[1].CryptPublicKeys,
+	}, keys)
+
+	// If any user can't be loaded, the whole call fails.
+	keys, err = c.GetCryptPublicKeysForUsers(context.Background(),
+		[]keybase1.UID{uid1, keybase1.MakeTestUID(3), uid2})
+	require.Error(t, err)
+	require.Nil(t, keys)
+}
+
+func TestKBPKIClientGetCryptPublicKeysForUsersStaleCache(t *testing.T) {
+	ctr := NewSafeTestReporter(t)
+	mockCtrl := gomock.NewController(ctr)
+	config := NewConfigMock(mockCtrl, ctr)
+	c := NewKBPKIClient(config)
+	config.SetKBPKI(c)
+	defer func() {
+		config.ctr.CheckForFailures()
+		mockCtrl.Finish()
+	}()
+
+	u1 := keybase1.MakeTestUID(1)
+	u2 := keybase1.MakeTestUID(2)
+	key1 := MakeLocalUserCryptPublicKeyOrBust("u_1")
+	key2 := MakeLocalUserCryptPublicKeyOrBust("u_2")
+
+	// u1's cached info has no crypt keys, so it should be flushed
+	// and loaded again, but only once.
+	gomock.InOrder(
+		config.mockKbs.EXPECT().LoadUserPlusKeys(gomock.Any(), u1).
+			Return(UserInfo{}, nil),
+		config.mockKbs.EXPECT().FlushUserFromLocalCache(gomock.Any(), u1),
+		config.mockKbs.EXPECT().LoadUserPlusKeys(gomock.Any(), u1).
+			Return(UserInfo{
+				CryptPublicKeys: []CryptPublicKey{key1},
+			}, nil),
+	)
+
+	// u2 is requested twice, but should only be loaded once.
+	config.mockKbs.EXPECT().LoadUserPlusKeys(gomock.Any(), u2).
+		Return(UserInfo{CryptPublicKeys: []CryptPublicKey{key2}}, nil)
+
+	keys, err := c.GetCryptPublicKeysForUsers(context.Background(),
+		[]keybase1.UID{u1, u2, u2})
+	require.NoError(t, err)
+	require.Equal(t, map[keybase1.UID][]CryptPublicKey{
+		u1: {key1},
+		u2: {key2},
+	}, keys)
+}
+
 func TestKBPKIClientGetCurrentCryptPublicKey(t *testing.T) {
 	c, _, localUsers := makeTestKBPKIClient(t)
 
@@ -225,3 +523,344 @@ func TestKBPKIClientHasUnverifiedVerifyingKey(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// slowKeybaseService sleeps for the next of the given delays before
+// each Identify and LoadUserPlusKeys call.
+type slowKeybaseService struct {
+	KeybaseService
+	delays []time.Duration
+}
+
+func (s *slowKeybaseService) sleep() {
+	time.Sleep(s.delays[0])
+	s.delays = s.delays[1:]
+}
+
+func (s *slowKeybaseService) Identify(
+	ctx context.Context, assertion, reason string) (UserInfo, error) {
+	s.sleep()
+	return s.KeybaseService.Identify(ctx, assertion, reason)
+}
+
+func (s *slowKeybaseService) LoadUserPlusKeys(
+	ctx context.Context, uid keybase1.UID) (UserInfo, error) {
+	s.sleep()
+	return s.KeybaseService.LoadUserPlusKeys(ctx, uid)
+}
+
+func TestKBPKIClientResolutionStats(t *testing.T) {
+	c, currentUID, _ := makeTestKBPKIClient(t)
+	config := c.config.(*ConfigLocal)
+
+	fast := 5 * time.Millisecond
+	slow := 50 * time.Millisecond
+	service := &slowKeybaseService{
+		KeybaseService: config.KeybaseService(),
+		delays: []time.Duration{
+			fast, fast, fast, slow,
+			slow, slow,
+		},
+	}
+	config.SetKeybaseService(service)
+
+	require.Equal(t, ResolutionStats{}, c.ResolutionStats())
+
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		_, err := c.Identify(ctx, "test_name1", "")
+		require.NoError(t, err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err := c.GetCryptPublicKeys(ctx, currentUID)
+		require.NoError(t, err)
+	}
+
+	stats := c.ResolutionStats()
+
+	require.Equal(t, 4, stats.Identify.Count)
+	require.True(t, stats.Identify.P50 >= fast, "%v", stats.Identify.P50)
+	require.True(t, stats.Identify.P50 < slow, "%v", stats.Identify.P50)
+	require.True(t, stats.Identify.P99 >= slow, "%v", stats.Identify.P99)
+
+	require.Equal(t, 2, stats.LoadUserPlusKeys.Count)
+	require.True(t, stats.LoadUserPlusKeys.P50 >= slow,
+		"%v", stats.LoadUserPlusKeys.P50)
+	require.True(t, stats.LoadUserPlusKeys.P99 >= slow,
+		"%v", stats.LoadUserPlusKeys.P99)
+}
+
+func TestLatencyTrackerWindow(t *testing.T) {
+	lt := newLatencyTracker(2)
+	lt.record(3 * time.Second)
+	lt.record(1 * time.Second)
+	lt.record(2 * time.Second)
+
+	// Only the two most recent latencies should be summarized.
+	summary := lt.summary()
+	require.Equal(t, LatencySummary{
+		Count: 3,
+		P50:   1 * time.Second,
+		P99:   2 * time.Second,
+	}, summary)
+}
+
+// recordingKeybaseService records the time of each LoadUserPlusKeys
+// call, optionally waiting on a channel before returning.
+type recordingKeybaseService struct {
+	KeybaseService
+	release chan struct{}
+
+	lock      sync.Mutex
+	callTimes []time.Time
+}
+
+func (s *recordingKeybaseService) LoadUserPlusKeys(
+	ctx context.Context, uid keybase1.UID) (UserInfo, error) {
+	s.lock.Lock()
+	s.callTimes = append(s.callTimes, time.Now())
+	s.lock.Unlock()
+	if s.release != nil {
+		<-s.release
+	}
+	return s.KeybaseService.LoadUserPlusKeys(ctx, uid)
+}
+
+func (s *recordingKeybaseService) getCallTimes() []time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]time.Time(nil), s.callTimes...)
+}
+
+func TestKBPKIClientIdentifyRateLimit(t *testing.T) {
+	c, _, _ := makeTestKBPKIClient(t)
+	config := c.config.(*ConfigLocal)
+	service := &recordingKeybaseService{
+		KeybaseService: config.KeybaseService(),
+	}
+	config.SetKeybaseService(service)
+
+	const rate = 20
+	interval := time.Second / rate
+	c.SetIdentifyRateLimit(rate, 1)
+
+	// Resolve many distinct UIDs at once; the unknown ones will
+	// fail, but every call still goes out to the service.
+	const callCount = 6
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < callCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _ = c.GetCryptPublicKeys(ctx, keybase1.MakeTestUID(uint32(i+1)))
+		}(i)
+	}
+	wg.Wait()
+
+	callTimes := service.getCallTimes()
+	require.Equal(t, callCount, len(callTimes))
+	sort.Sort(timeSlice(callTimes))
+	// Allow a little slack for timer granularity.
+	minGap := interval * 4 / 5
+	for i := 1; i < len(callTimes); i++ {
+		gap := callTimes[i].Sub(callTimes[i-1])
+		require.True(t, gap >= minGap, "gap %d is %v", i, gap)
+	}
+}
+
+func TestKBPKIClientIdentifyRateLimitDedup(t *testing.T) {
+	c, currentUID, _ := makeTestKBPKIClient(t)
+	config := c.config.(*ConfigLocal)
+	service := &recordingKeybaseService{
+		KeybaseService: config.KeybaseService(),
+		release:        make(chan struct{}),
+	}
+	config.SetKeybaseService(service)
+
+	// Only allow one call for a long time.
+	c.SetIdentifyRateLimit(0.01, 1)
+
+	ctx := context.Background()
+	const callCount = 5
+	errCh := make(chan error, callCount)
+	go func() {
+		_, err := c.GetCryptPublicKeys(ctx, currentUID)
+		errCh <- err
+	}()
+	// Wait for the first call to reach the service before
+	// starting the rest, so that they're deduped against it.
+	for len(service.getCallTimes()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	waiting := make(chan struct{}, callCount)
+	for i := 1; i < callCount; i++ {
+		go func() {
+			_, err := c.GetCryptPublicKeys(
+				&waitingContext{Context: ctx, waiting: waiting},
+				currentUID)
+			errCh <- err
+		}()
+	}
+	// Wait for the followers to start waiting on the call that's
+	// blocked in the service.
+	waitForWaitingContexts(t, waiting, callCount-1)
+	close(service.release)
+
+	for i := 0; i < callCount; i++ {
+		select {
+		case err := <-errCh:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for deduped calls")
+		}
+	}
+	require.Equal(t, 1, len(service.getCallTimes()))
+
+	// The bucket is now empty, so a new call must wait, and
+	// gives up when its context is canceled.
+	ctx2, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err := c.GetCryptPublicKeys(ctx2, currentUID)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Equal(t, 1, len(service.getCallTimes()))
+}
+
+func TestKBPKIClientRefreshUser(t *testing.T) {
+	ctr := NewSafeTestReporter(t)
+	mockCtrl := gomock.NewController(ctr)
+	config := NewConfigMock(mockCtrl, ctr)
+	c := NewKBPKIClient(config)
+	config.SetKBPKI(c)
+	defer func() {
+		config.ctr.CheckForFailures()
+		mockCtrl.Finish()
+	}()
+
+	u := keybase1.MakeTestUID(1)
+	key1 := MakeLocalUserVerifyingKeyOrBust("u_1")
+	key2 := MakeLocalUserVerifyingKeyOrBust("u_2")
+	info := UserInfo{
+		VerifyingKeys: []VerifyingKey{key1, key2},
+	}
+
+	// The refresh flushes first, and the reload happens only
+	// once for all the concurrent callers.
+	release := make(chan struct{})
+	loadStarted := make(chan struct{})
+	gomock.InOrder(
+		config.mockKbs.EXPECT().FlushUserFromLocalCache(gomock.Any(), u),
+		config.mockKbs.EXPECT().LoadUserPlusKeys(gomock.Any(), u).
+			Do(func(context.Context, keybase1.UID) {
+				close(loadStarted)
+				<-release
+			}).Return(info, nil),
+	)
+
+	ctx := context.Background()
+	const callCount = 5
+	type result struct {
+		info UserInfo
+		err  error
+	}
+	resultCh := make(chan result, callCount)
+	go func() {
+		info, err := c.RefreshUser(ctx, u)
+		resultCh <- result{info, err}
+	}()
+	<-loadStarted
+	waiting := make(chan struct{}, callCount)
+	for i := 1; i < callCount; i++ {
+		go func() {
+			info, err := c.RefreshUser(
+				&waitingContext{Context: ctx, waiting: waiting}, u)
+			resultCh <- result{info, err}
+		}()
+	}
+	waitForWaitingContexts(t, waiting, callCount-1)
+	close(release)
+
+	for i := 0; i < callCount; i++ {
+		select {
+		case r := <-resultCh:
+			require.NoError(t, r.err)
+			require.Equal(t, info, r.info)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for coalesced refreshes")
+		}
+	}
+
+	// A later refresh flushes and reloads again.
+	config.mockKbs.EXPECT().FlushUserFromLocalCache(gomock.Any(), u)
+	config.mockKbs.EXPECT().LoadUserPlusKeys(gomock.Any(), u).
+		Return(info, nil)
+	info2, err := c.RefreshUser(ctx, u)
+	require.NoError(t, err)
+	require.Equal(t, info, info2)
+}
+
+func TestKBPKIClientLoadUserPlusKeysLeaderCanceled(t *testing.T) {
+	ctr := NewSafeTestReporter(t)
+	mockCtrl := gomock.NewController(ctr)
+	config := NewConfigMock(mockCtrl, ctr)
+	c := NewKBPKIClient(config)
+	config.SetKBPKI(c)
+	defer func() {
+		config.ctr.CheckForFailures()
+		mockCtrl.Finish()
+	}()
+
+	u := keybase1.MakeTestUID(1)
+	info := UserInfo{
+		VerifyingKeys: []VerifyingKey{MakeLocalUserVerifyingKeyOrBust("u_1")},
+	}
+
+	// The first load fails because its caller is canceled, which
+	// shouldn't fail the waiting caller, who retries.
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	loadStarted := make(chan struct{})
+	gomock.InOrder(
+		config.mockKbs.EXPECT().LoadUserPlusKeys(gomock.Any(), u).
+			Do(func(ctx context.Context, _ keybase1.UID) {
+				close(loadStarted)
+				<-ctx.Done()
+			}).Return(UserInfo{}, context.Canceled),
+		config.mockKbs.EXPECT().LoadUserPlusKeys(gomock.Any(), u).
+			Return(info, nil),
+	)
+
+	leaderErrCh := make(chan error, 1)
+	go func() {
+		_, err := c.loadUserPlusKeys(leaderCtx, u)
+		leaderErrCh <- err
+	}()
+	<-loadStarted
+
+	type result struct {
+		info UserInfo
+		err  error
+	}
+	resultCh := make(chan result, 1)
+	waiting := make(chan struct{}, 1)
+	go func() {
+		info, err := c.loadUserPlusKeys(&waitingContext{
+			Context: context.Background(), waiting: waiting}, u)
+		resultCh <- result{info, err}
+	}()
+	waitForWaitingContexts(t, waiting, 1)
+	cancel()
+
+	require.Equal(t, context.Canceled, <-leaderErrCh)
+	select {
+	case r := <-resultCh:
+		require.NoError(t, r.err)
+		require.Equal(t, info, r.info)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the retried load")
+	}
+}
+
+type timeSlice []time.Time
+
+func (s timeSlice) Len() int           { return len(s) }
+func (s timeSlice) Less(i, j int) bool { return s[i].Before(s[j]) }
+func (s timeSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -22,6 +22,21 @@ func (id TLFCryptKeyServerHalfID) String() string {
 	return id.ID.String()
 }
 
+// KeyHalfRequest identifies a server-side key half to get with
+// KeyServer.GetKeyHalves: the ID of the half, and the crypt public
+// key of the device it's for.
+type KeyHalfRequest struct {
+	ServerHalfID   TLFCryptKeyServerHalfID
+	CryptPublicKey CryptPublicKey
+}
+
+// KeyHalfResult is the result of a KeyHalfRequest. If Err is non-nil,
+// ServerHalf is unset.
+type KeyHalfResult struct {
+	ServerHalf TLFCryptKeyServerHalf
+	Err        error
+}
+
 // TLFCryptKeyInfo is a per-device key half entry in the
 // TLFWriterKeyBundle/TLFReaderKeyBundle.
 type TLFCryptKeyInfo struct {
@@ -81,6 +81,31 @@ func NewKeyServerTempDir(config Config) (*KeyServerLocal, error) {
 	})
 }
 
+// getServerHalfLocked gets the server half with the given ID for
+// the given user and device key. ks.shutdownLock must be held for
+// reading.
+func (ks *KeyServerLocal) getServerHalfLocked(ctx context.Context,
+	uid keybase1.UID, serverHalfID TLFCryptKeyServerHalfID,
+	key CryptPublicKey) (serverHalf TLFCryptKeyServerHalf, err error) {
+	buf, err := ks.db.Get(serverHalfID.ID.Bytes(), nil)
+	if err != nil {
+		return TLFCryptKeyServerHalf{}, err
+	}
+
+	err = ks.config.Codec().Decode(buf, &serverHalf)
+	if err != nil {
+		return TLFCryptKeyServerHalf{}, err
+	}
+
+	err = ks.config.Crypto().VerifyTLFCryptKeyServerHalfID(
+		serverHalfID, uid, key.kid, serverHalf)
+	if err != nil {
+		ks.log.CDebugf(ctx, "error verifying server half ID: %s", err)
+		return TLFCryptKeyServerHalf{}, MDServerErrorUnauthorized{}
+	}
+	return serverHalf, nil
+}
+
 // GetTLFCryptKeyServerHalf implements the KeyServer interface for
 // KeyServerLocal.
 func (ks *KeyServerLocal) GetTLFCryptKeyServerHalf(ctx context.Context,
@@ -88,31 +113,51 @@ func (ks *KeyServerLocal) GetTLFCryptKeyServerHalf(ctx context.Context,
 	ks.shutdownLock.RLock()
 	defer ks.shutdownLock.RUnlock()
 	if *ks.shutdown {
-		err = errors.New("Key server already shut down")
+		return TLFCryptKeyServerHalf{},
+			errors.New("Key server already shut down")
 	}
 
-	buf, err := ks.db.Get(serverHalfID.ID.Bytes(), nil)
+	_, uid, err := ks.config.KBPKI().GetCurrentUserInfo(ctx)
 	if err != nil {
-		return
+		return TLFCryptKeyServerHalf{}, err
 	}
 
-	err = ks.config.Codec().Decode(buf, &serverHalf)
-	if err != nil {
-		return TLFCryptKeyServerHalf{}, err
+	return ks.getServerHalfLocked(ctx, uid, serverHalfID, key)
+}
+
+// GetKeyHalves implements the KeyServer interface for KeyServerLocal.
+func (ks *KeyServerLocal) GetKeyHalves(ctx context.Context,
+	requests []KeyHalfRequest) ([]KeyHalfResult, error) {
+	ks.shutdownLock.RLock()
+	defer ks.shutdownLock.RUnlock()
+	if *ks.shutdown {
+		return nil, errors.New("Key server already shut down")
 	}
 
 	_, uid, err := ks.config.KBPKI().GetCurrentUserInfo(ctx)
 	if err != nil {
-		return TLFCryptKeyServerHalf{}, err
+		return nil, err
 	}
 
-	err = ks.config.Crypto().VerifyTLFCryptKeyServerHalfID(
-		serverHalfID, uid, key.kid, serverHalf)
-	if err != nil {
-		ks.log.CDebugf(ctx, "error verifying server half ID: %s", err)
-		return TLFCryptKeyServerHalf{}, MDServerErrorUnauthorized{}
+	results := make([]KeyHalfResult, len(requests))
+	for i, req := range requests {
+		serverHalf, err := ks.getServerHalfLocked(
+			ctx, uid, req.ServerHalfID, req.CryptPublicKey)
+		switch err.(type) {
+		case nil:
+			results[i].ServerHalf = serverHalf
+		case MDServerErrorUnauthorized:
+			results[i].Err = err
+		default:
+			if err != leveldb.ErrNotFound {
+				return nil, err
+			}
+			// Like the remote server, don't distinguish a
+			// missing key half from an unauthorized one.
+			results[i].Err = MDServerErrorUnauthorized{}
+		}
 	}
-	return serverHalf, nil
+	return results, nil
 }
 
 // PutTLFCryptKeyServerHalves implements the KeyOps interface for KeyServerLocal.
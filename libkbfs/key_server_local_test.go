@@ -9,6 +9,7 @@ import (
 
 	"github.com/keybase/client/go/libkb"
 	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
 
@@ -153,3 +154,65 @@ func TestKeyServerLocalTLFCryptKeyServerHalves(t *testing.T) {
 		t.Error("GetTLFCryptKeyServerHalf(id2, keyGen2, publicKey2) unexpectedly succeeded")
 	}
 }
+
+// Test that GetKeyHalves returns per-request results.
+func TestKeyServerLocalGetKeyHalves(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, uid1, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	_, uid2, err := config2.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	publicKey1, err := config1.KBPKI().GetCurrentCryptPublicKey(ctx)
+	require.NoError(t, err)
+	publicKey2, err := config2.KBPKI().GetCurrentCryptPublicKey(ctx)
+	require.NoError(t, err)
+
+	serverHalf1 := MakeTLFCryptKeyServerHalf([32]byte{1})
+	serverHalf2 := MakeTLFCryptKeyServerHalf([32]byte{2})
+	serverHalf3 := MakeTLFCryptKeyServerHalf([32]byte{3})
+
+	keyHalves := map[keybase1.UID]map[keybase1.KID]TLFCryptKeyServerHalf{
+		uid1: {publicKey1.kid: serverHalf1},
+		uid2: {publicKey2.kid: serverHalf2},
+	}
+	err = config1.KeyOps().PutTLFCryptKeyServerHalves(ctx, keyHalves)
+	require.NoError(t, err)
+
+	serverHalfID1, err := config1.Crypto().GetTLFCryptKeyServerHalfID(
+		uid1, publicKey1.kid, serverHalf1)
+	require.NoError(t, err)
+	serverHalfID2, err := config1.Crypto().GetTLFCryptKeyServerHalfID(
+		uid2, publicKey2.kid, serverHalf2)
+	require.NoError(t, err)
+	// Never put.
+	serverHalfID3, err := config1.Crypto().GetTLFCryptKeyServerHalfID(
+		uid1, publicKey1.kid, serverHalf3)
+	require.NoError(t, err)
+
+	requests := []KeyHalfRequest{
+		{serverHalfID1, publicKey1},
+		{serverHalfID2, publicKey1},
+		{serverHalfID3, publicKey1},
+	}
+	results, err := config1.KeyServer().GetKeyHalves(ctx, requests)
+	require.NoError(t, err)
+	require.Equal(t, []KeyHalfResult{
+		{ServerHalf: serverHalf1},
+		{Err: MDServerErrorUnauthorized{}},
+		{Err: MDServerErrorUnauthorized{}},
+	}, results)
+
+	// uid2 can get its own half.
+	results, err = config2.KeyServer().GetKeyHalves(
+		ctx, []KeyHalfRequest{{serverHalfID2, publicKey2}})
+	require.NoError(t, err)
+	require.Equal(t, []KeyHalfResult{{ServerHalf: serverHalf2}}, results)
+
+	results, err = config1.KeyServer().GetKeyHalves(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, results, 0)
+}
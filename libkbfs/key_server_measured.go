@@ -13,10 +13,11 @@ import (
 // KeyServerMeasured delegates to another KeyServer instance but
 // also keeps track of stats.
 type KeyServerMeasured struct {
-	delegate    KeyServer
-	getTimer    metrics.Timer
-	putTimer    metrics.Timer
-	deleteTimer metrics.Timer
+	delegate       KeyServer
+	getTimer       metrics.Timer
+	getHalvesTimer metrics.Timer
+	putTimer       metrics.Timer
+	deleteTimer    metrics.Timer
 }
 
 var _ KeyServer = KeyServerMeasured{}
@@ -25,13 +26,15 @@ var _ KeyServer = KeyServerMeasured{}
 // instance with the given delegate and registry.
 func NewKeyServerMeasured(delegate KeyServer, r metrics.Registry) KeyServerMeasured {
 	getTimer := metrics.GetOrRegisterTimer("KeyServer.GetTLFCryptKeyServerHalf", r)
+	getHalvesTimer := metrics.GetOrRegisterTimer("KeyServer.GetKeyHalves", r)
 	putTimer := metrics.GetOrRegisterTimer("KeyServer.PutTLFCryptKeyServerHalves", r)
 	deleteTimer := metrics.GetOrRegisterTimer("KeyServer.DeleteTLFCryptKeyServerHalf", r)
 	return KeyServerMeasured{
-		delegate:    delegate,
-		getTimer:    getTimer,
-		putTimer:    putTimer,
-		deleteTimer: deleteTimer,
+		delegate:       delegate,
+		getTimer:       getTimer,
+		getHalvesTimer: getHalvesTimer,
+		putTimer:       putTimer,
+		deleteTimer:    deleteTimer,
 	}
 }
 
@@ -46,6 +49,16 @@ func (b KeyServerMeasured) GetTLFCryptKeyServerHalf(ctx context.Context,
 	return serverHalf, err
 }
 
+// GetKeyHalves implements the KeyServer interface for
+// KeyServerMeasured.
+func (b KeyServerMeasured) GetKeyHalves(ctx context.Context,
+	requests []KeyHalfRequest) (results []KeyHalfResult, err error) {
+	b.getHalvesTimer.Time(func() {
+		results, err = b.delegate.GetKeyHalves(ctx, requests)
+	})
+	return results, err
+}
+
 // PutTLFCryptKeyServerHalves implements the KeyServer interface for
 // KeyServerMeasured.
 func (b KeyServerMeasured) PutTLFCryptKeyServerHalves(ctx context.Context,
@@ -92,26 +92,31 @@ func processKey(publicKey keybase1.PublicKey,
 }
 
 func filterKeys(keys []keybase1.PublicKey) (
-	[]VerifyingKey, []CryptPublicKey, map[keybase1.KID]string, error) {
+	[]VerifyingKey, []CryptPublicKey, map[keybase1.KID]string,
+	map[VerifyingKey]keybase1.Time, error) {
 	var verifyingKeys []VerifyingKey
 	var cryptPublicKeys []CryptPublicKey
 	var kidNames = map[keybase1.KID]string{}
+	provisionTimes := make(map[VerifyingKey]keybase1.Time)
 
-	addVerifyingKey := func(key VerifyingKey) {
-		verifyingKeys = append(verifyingKeys, key)
-	}
 	addCryptPublicKey := func(key CryptPublicKey) {
 		cryptPublicKeys = append(cryptPublicKeys, key)
 	}
 
 	for _, publicKey := range keys {
+		addVerifyingKey := func(key VerifyingKey) {
+			verifyingKeys = append(verifyingKeys, key)
+			if publicKey.CTime != 0 {
+				provisionTimes[key] = publicKey.CTime
+			}
+		}
 		err := processKey(publicKey, addVerifyingKey, addCryptPublicKey,
 			kidNames)
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, err
 		}
 	}
-	return verifyingKeys, cryptPublicKeys, kidNames, nil
+	return verifyingKeys, cryptPublicKeys, kidNames, provisionTimes, nil
 }
 
 func filterRevokedKeys(keys []keybase1.RevokedKey) (
@@ -318,7 +323,8 @@ func (k *KeybaseServiceBase) LoadUserPlusKeys(ctx context.Context, uid keybase1.
 
 func (k *KeybaseServiceBase) processUserPlusKeys(upk keybase1.UserPlusKeys) (
 	UserInfo, error) {
-	verifyingKeys, cryptPublicKeys, kidNames, err := filterKeys(upk.DeviceKeys)
+	verifyingKeys, cryptPublicKeys, kidNames, provisionTimes, err :=
+		filterKeys(upk.DeviceKeys)
 	if err != nil {
 		return UserInfo{}, err
 	}
@@ -343,6 +349,8 @@ func (k *KeybaseServiceBase) processUserPlusKeys(upk keybase1.UserPlusKeys) (
 		KIDNames:               kidNames,
 		RevokedVerifyingKeys:   revokedVerifyingKeys,
 		RevokedCryptPublicKeys: revokedCryptPublicKeys,
+
+		VerifyingKeyProvisionTimes: provisionTimes,
 	}
 
 	k.setCachedUserInfo(upk.Uid, u)
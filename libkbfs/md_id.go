@@ -24,6 +24,38 @@ func MdIDFromBytes(data []byte) (MdID, error) {
 	return MdID{h}, nil
 }
 
+// mdIDFromString creates a new MdID from the given string, as
+// returned by MdID.String. Unlike MdIDFromBytes, it maps the empty
+// string to the zero MdID.
+func mdIDFromString(dataStr string) (MdID, error) {
+	if dataStr == "" {
+		return MdID{}, nil
+	}
+	h, err := HashFromString(dataStr)
+	if err != nil {
+		return MdID{}, err
+	}
+	return MdID{h}, nil
+}
+
+// IsValid returns nil if id is well-formed for its hash type, i.e. if
+// the type is known and the hash is of the right length for it, and
+// an error describing what's wrong with it otherwise. Note that the
+// zero MdID isn't valid.
+func (id MdID) IsValid() error {
+	if !id.h.IsValid() {
+		return InvalidMdIDError{id}
+	}
+	// Once we have multiple hash types we'll need to expand this.
+	if t := id.h.hashType(); t != DefaultHashType {
+		return UnknownHashTypeError{t}
+	}
+	if len(id.h.h) != DefaultHashByteLength {
+		return InvalidMdIDError{id}
+	}
+	return nil
+}
+
 // Bytes returns the bytes of the MDID.
 func (id MdID) Bytes() []byte {
 	return id.h.Bytes()
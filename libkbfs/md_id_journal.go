@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"time"
 )
 
 // An mdIDJournal wraps a diskJournal to provide a persistent list of
@@ -24,8 +25,46 @@ type mdIDJournal struct {
 	j diskJournal
 }
 
+// An mdIDJournalEntry is an MdID along with any journal-only
+// information about it. Fields are exported only for serialization.
+type mdIDJournalEntry struct {
+	ID MdID
+	// CorrelationID is an opaque, application-defined ID that
+	// can be used to group together revisions that belong to
+	// the same higher-level action. It is stored only in the
+	// journal, and isn't part of the MD itself.
+	CorrelationID string `codec:",omitempty"`
+	// FromServer is set if the MD was received from the
+	// server, and so doesn't need to be flushed.
+	FromServer bool `codec:",omitempty"`
+	// ContentHash is a hash of the plaintext content of the MD
+	// as it was put (see mdJournal.makeContentHash), used to
+	// detect re-puts of identical content. It's empty for
+	// entries that weren't added by put.
+	ContentHash []byte `codec:",omitempty"`
+}
+
+// decodeMdIDJournalEntry decodes an encoded mdIDJournalEntry. Journals
+// written before mdIDJournalEntry existed stored each entry as a
+// bare MdID, so if buf doesn't decode as an mdIDJournalEntry, it's
+// decoded as an MdID instead.
+func decodeMdIDJournalEntry(codec Codec, buf []byte) (
+	mdIDJournalEntry, error) {
+	var entry mdIDJournalEntry
+	err := codec.Decode(buf, &entry)
+	if err == nil {
+		return entry, nil
+	}
+
+	var id MdID
+	if legacyErr := codec.Decode(buf, &id); legacyErr != nil {
+		return mdIDJournalEntry{}, err
+	}
+	return mdIDJournalEntry{ID: id}, nil
+}
+
 func makeMdIDJournal(codec Codec, dir string) mdIDJournal {
-	j := makeDiskJournal(codec, dir, reflect.TypeOf(MdID{}))
+	j := makeDiskJournal(codec, dir, reflect.TypeOf(mdIDJournalEntry{}))
 	return mdIDJournal{j}
 }
 
@@ -87,18 +126,58 @@ func (j mdIDJournal) writeLatestRevision(r MetadataRevision) error {
 	return j.j.writeLatestOrdinal(o)
 }
 
-func (j mdIDJournal) readMdID(r MetadataRevision) (MdID, error) {
+// readHighestOnDiskRevision returns the revision of the highest
+// entry actually present on disk, which may differ from
+// readLatestRevision if the journal was torn. It returns
+// MetadataRevisionUninitialized if there are no entries on disk.
+func (j mdIDJournal) readHighestOnDiskRevision() (MetadataRevision, error) {
+	o, ok, err := j.j.readHighestOnDiskOrdinal()
+	if err != nil {
+		return MetadataRevisionUninitialized, err
+	}
+	if !ok {
+		return MetadataRevisionUninitialized, nil
+	}
+	return ordinalToRevision(o)
+}
+
+func (j mdIDJournal) readJournalEntry(r MetadataRevision) (
+	mdIDJournalEntry, error) {
 	o, err := revisionToOrdinal(r)
 	if err != nil {
-		return MdID{}, err
+		return mdIDJournalEntry{}, err
 	}
-	e, err := j.j.readJournalEntry(o)
+	buf, err := j.j.readJournalEntryBytes(o)
 	if err != nil {
-		return MdID{}, err
+		return mdIDJournalEntry{}, err
 	}
 
-	// TODO: Validate MdID?
-	return e.(MdID), nil
+	entry, err := decodeMdIDJournalEntry(j.j.codec, buf)
+	if err != nil {
+		return mdIDJournalEntry{}, err
+	}
+	if err := entry.ID.IsValid(); err != nil {
+		return mdIDJournalEntry{}, err
+	}
+	return entry, nil
+}
+
+// journalEntryPath returns the path of the file holding the entry
+// for the given revision.
+func (j mdIDJournal) journalEntryPath(r MetadataRevision) (string, error) {
+	o, err := revisionToOrdinal(r)
+	if err != nil {
+		return "", err
+	}
+	return j.j.journalEntryPath(o), nil
+}
+
+func (j mdIDJournal) readMdID(r MetadataRevision) (MdID, error) {
+	e, err := j.readJournalEntry(r)
+	if err != nil {
+		return MdID{}, err
+	}
+	return e.ID, nil
 }
 
 // All functions below are public functions.
@@ -127,20 +206,23 @@ func (j mdIDJournal) getLatest() (MdID, error) {
 	return j.readMdID(latestRevision)
 }
 
-func (j mdIDJournal) getRange(
-	start, stop MetadataRevision) (MetadataRevision, []MdID, error) {
+// iterateEntryRange calls fn with each entry in [start, stop],
+// clamped to the bounds of the journal, in revision order. It stops
+// at, and returns, the first error returned by fn.
+func (j mdIDJournal) iterateEntryRange(start, stop MetadataRevision,
+	fn func(MetadataRevision, mdIDJournalEntry) error) error {
 	earliestRevision, err := j.readEarliestRevision()
 	if err != nil {
-		return MetadataRevisionUninitialized, nil, err
+		return err
 	} else if earliestRevision == MetadataRevisionUninitialized {
-		return MetadataRevisionUninitialized, nil, nil
+		return nil
 	}
 
 	latestRevision, err := j.readLatestRevision()
 	if err != nil {
-		return MetadataRevisionUninitialized, nil, err
+		return err
 	} else if latestRevision == MetadataRevisionUninitialized {
-		return MetadataRevisionUninitialized, nil, nil
+		return nil
 	}
 
 	if start < earliestRevision {
@@ -151,35 +233,115 @@ func (j mdIDJournal) getRange(
 		stop = latestRevision
 	}
 
-	if stop < start {
-		return MetadataRevisionUninitialized, nil, nil
+	for i := start; i <= stop; i++ {
+		entry, err := j.readJournalEntry(i)
+		if err != nil {
+			return err
+		}
+		err = fn(i, entry)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
+func (j mdIDJournal) getEntryRange(
+	start, stop MetadataRevision) (
+	MetadataRevision, []mdIDJournalEntry, error) {
+	realStart := MetadataRevisionUninitialized
+	var entries []mdIDJournalEntry
+	err := j.iterateEntryRange(start, stop,
+		func(r MetadataRevision, entry mdIDJournalEntry) error {
+			if realStart == MetadataRevisionUninitialized {
+				realStart = r
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	if err != nil {
+		return MetadataRevisionUninitialized, nil, err
+	}
+	return realStart, entries, nil
+}
+
+func (j mdIDJournal) getRange(
+	start, stop MetadataRevision) (MetadataRevision, []MdID, error) {
+	realStart, entries, err := j.getEntryRange(start, stop)
+	if err != nil {
+		return MetadataRevisionUninitialized, nil, err
+	}
 	var mdIDs []MdID
-	for i := start; i <= stop; i++ {
-		mdID, err := j.readMdID(i)
+	for _, entry := range entries {
+		mdIDs = append(mdIDs, entry.ID)
+	}
+	return realStart, mdIDs, nil
+}
+
+// rewriteLegacyEntries rewrites each entry on disk, from the earliest
+// one to the highest one, in the current format, so that any stored
+// as bare MdIDs become mdIDJournalEntry objects.
+func (j mdIDJournal) rewriteLegacyEntries() error {
+	earliest, err := j.readEarliestRevision()
+	if err != nil {
+		return err
+	}
+	if earliest == MetadataRevisionUninitialized {
+		return nil
+	}
+	highest, err := j.readHighestOnDiskRevision()
+	if err != nil {
+		return err
+	}
+	for r := earliest; r <= highest; r++ {
+		entry, err := j.readJournalEntry(r)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		o, err := revisionToOrdinal(r)
+		if err != nil {
+			return err
+		}
+		err = j.j.writeJournalEntry(o, entry)
 		if err != nil {
-			return MetadataRevisionUninitialized, nil, err
+			return err
 		}
-		mdIDs = append(mdIDs, mdID)
 	}
-	return start, mdIDs, nil
+	return nil
 }
 
-func (j mdIDJournal) replaceHead(mdID MdID) error {
+func (j mdIDJournal) replaceHead(entry mdIDJournalEntry) error {
 	o, err := j.j.readLatestOrdinal()
 	if err != nil {
 		return err
 	}
-	return j.j.writeJournalEntry(o, mdID)
+	return j.j.writeJournalEntry(o, entry)
 }
 
-func (j mdIDJournal) append(r MetadataRevision, mdID MdID) error {
+func (j mdIDJournal) append(
+	r MetadataRevision, entry mdIDJournalEntry) error {
 	o, err := revisionToOrdinal(r)
 	if err != nil {
 		return err
 	}
-	return j.j.appendJournalEntry(&o, mdID)
+	return j.j.appendJournalEntry(&o, entry)
+}
+
+// appendRange appends the given entries, the first of which has
+// revision start, as a single update to the journal.
+func (j mdIDJournal) appendRange(
+	start MetadataRevision, entries []mdIDJournalEntry) error {
+	o, err := revisionToOrdinal(start)
+	if err != nil {
+		return err
+	}
+	genericEntries := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		genericEntries[i] = entry
+	}
+	return j.j.appendJournalEntries(o, genericEntries)
 }
 
 func (j mdIDJournal) removeEarliest() (empty bool, err error) {
@@ -190,6 +352,40 @@ func (j mdIDJournal) clear() error {
 	return j.j.clearOrdinals()
 }
 
+// removeEntriesFrom removes the entry files for revision r and every
+// later revision still on disk, highest first, so that an
+// interrupted removal leaves no gaps. It doesn't update the earliest
+// or latest revisions.
+func (j mdIDJournal) removeEntriesFrom(r MetadataRevision) error {
+	highest, err := j.readHighestOnDiskRevision()
+	if err != nil {
+		return err
+	}
+	for rev := highest; rev >= r && rev != MetadataRevisionUninitialized; rev-- {
+		path, err := j.journalEntryPath(rev)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveEntry moves the entry for the given revision out of the
+// journal and into destDir, stamping it with the given time. It
+// doesn't update the earliest or latest revisions.
+func (j mdIDJournal) moveEntry(
+	r MetadataRevision, destDir string, mtime time.Time) error {
+	o, err := revisionToOrdinal(r)
+	if err != nil {
+		return err
+	}
+	return j.j.moveJournalEntry(o, destDir, mtime)
+}
+
 func (j *mdIDJournal) move(newDir string) (oldDir string, err error) {
 	return j.j.move(newDir)
 }
@@ -64,3 +64,41 @@ func TestMdIDEncodeDecodeZero(t *testing.T) {
 		t.Errorf("expected empty block ID, got %s", id)
 	}
 }
+
+func TestMdIDIsValid(t *testing.T) {
+	id := fakeMdID(1)
+	if err := id.IsValid(); err != nil {
+		t.Errorf("expected %s to be valid, got %v", id, err)
+	}
+
+	if err := (MdID{}).IsValid(); err == nil {
+		t.Error("expected the zero MdID to be invalid")
+	}
+
+	truncated := MdID{hashFromRawNoCheck(DefaultHashType,
+		id.h.hashData()[:DefaultHashByteLength-2])}
+	if err, ok := truncated.IsValid().(InvalidMdIDError); !ok {
+		t.Errorf("expected InvalidMdIDError, got %v", err)
+	}
+
+	// An extended ID is still a valid hash, but it's too long for
+	// its type.
+	extended := MdID{hashFromRawNoCheck(DefaultHashType,
+		append(id.h.hashData(), 0))}
+	if err, ok := extended.IsValid().(InvalidMdIDError); !ok {
+		t.Errorf("expected InvalidMdIDError, got %v", err)
+	}
+
+	// So is one with an unknown type.
+	unknownType := MdID{hashFromRawNoCheck(
+		DefaultHashType+1, id.h.hashData())}
+	if err, ok := unknownType.IsValid().(UnknownHashTypeError); !ok {
+		t.Errorf("expected UnknownHashTypeError, got %v", err)
+	}
+
+	// One with the invalid type isn't a valid hash at all.
+	invalidType := MdID{hashFromRawNoCheck(InvalidHash, id.h.hashData())}
+	if err, ok := invalidType.IsValid().(InvalidMdIDError); !ok {
+		t.Errorf("expected InvalidMdIDError, got %v", err)
+	}
+}
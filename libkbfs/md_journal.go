@@ -5,11 +5,14 @@
 package libkbfs
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/keybase/client/go/logger"
@@ -60,7 +63,8 @@ func MakeImmutableBareRootMetadata(
 // dir/mds/01ff/f...ff
 //
 // There's a single journal subdirectory; the journal ordinals are
-// just MetadataRevisions, and the journal entries are just MdIDs.
+// just MetadataRevisions, and the journal entries are just MdIDs
+// along with optional correlation IDs (see mdIDJournalEntry).
 //
 // The Metadata objects are stored separately in dir/mds. Each block
 // has its own subdirectory with its ID as a name. The MD
@@ -86,25 +90,205 @@ type mdJournal struct {
 	// becomes empty, since on a restart the branch ID is
 	// retrieved from the server (via GetUnmergedForTLF).
 	branchID BranchID
+	// Why branchID was created, if it was created by
+	// convertToBranch. Unlike branchID itself, this is persisted
+	// (see branchReasonPath), since the server doesn't know it.
+	branchReason MDJournalBranchReason
 
 	// Set only when the journal becomes empty due to
 	// flushing. This doesn't need to be persisted for the same
 	// reason as branchID.
 	lastMdID MdID
+
+	// If staleBranchCheckPeriod is non-zero, then every
+	// staleBranchCheckPeriod-th put onto a branch first checks
+	// with staleBranchMDServer whether the branch still exists.
+	staleBranchCheckPeriod int
+	staleBranchMDServer    MDServer
+	putsSinceBranchCheck   int
+	// Whether branchID is known to exist on the server, i.e. it
+	// has been flushed or reported by the server at least
+	// once. Until then, the server not knowing about branchID
+	// doesn't mean that it's stale.
+	branchOnServer bool
+	// Set to branchID once it's detected to be stale, so that
+	// further puts onto it can be rejected right away.
+	staleBranchID BranchID
+
+	// If non-zero, puts of MDs that serialize to more than
+	// maxMDBytes bytes fail with MDJournalTooLargeError.
+	maxMDBytes uint64
+
+	// If set, the writer signature of each newly-stored MD is
+	// written to a sidecar file next to it (see sigPath), and the
+	// MD is stored without it. MDs are read back the same way
+	// whether or not this is set.
+	detachedSigs bool
+
+	// Entries quarantined by a repair are stamped with the time
+	// from clock, and pruneQuarantine removes those older than
+	// quarantineRetention. A retention of 0 keeps them forever.
+	clock               Clock
+	quarantineRetention time.Duration
+
+	// If diskUsageValid is set, diskUsageBytes is the number of
+	// bytes on disk used by the entries in the journal. Puts,
+	// flushes, and clears keep it up to date; anything else that
+	// changes the journal just resets diskUsageValid, so that the
+	// next call to diskUsage recomputes it.
+	diskUsageBytes uint64
+	diskUsageValid bool
+
+	// If a put of the MD at ambiguousPutRevision failed in a way
+	// that leaves it unknown whether the server stored it, the
+	// next flush of that revision first checks with the server,
+	// so that it isn't sent again. Like branchID, it isn't
+	// persisted.
+	ambiguousPutRevision MetadataRevision
+
+	// flushEvents records the MDs pushed to the server by
+	// flushOne, oldest first, for flushStats. It's trimmed to
+	// the last mdJournalMaxFlushEvents events, none older than
+	// mdJournalFlushEventRetention. Like branchID, it isn't
+	// persisted.
+	flushEvents []mdJournalFlushEvent
+}
+
+const (
+	// mdJournalMaxFlushEvents is the maximum number of flush
+	// events an mdJournal remembers.
+	mdJournalMaxFlushEvents = 10000
+	// mdJournalFlushEventRetention is how long an mdJournal
+	// remembers a flush event.
+	mdJournalFlushEventRetention = 24 * time.Hour
+)
+
+// mdJournalFlushEvent describes a single MD pushed to the server.
+type mdJournalFlushEvent struct {
+	time      time.Time
+	bytes     uint64
+	conflicts int
+}
+
+// mdJournalFormatVer is the version of the on-disk layout of an MD
+// journal, which is recorded in a file in the journal's directory.
+type mdJournalFormatVer int
+
+const (
+	// mdJournalFormatVerUnversioned is the layout of journals
+	// written before the format version was recorded, and is
+	// assumed for any existing journal with no version file. Its
+	// entries may be bare MdIDs rather than mdIDJournalEntry
+	// objects.
+	mdJournalFormatVerUnversioned mdJournalFormatVer = 1
+	// mdJournalFormatVerRecorded records its version, and stores
+	// every entry as an mdIDJournalEntry.
+	mdJournalFormatVerRecorded mdJournalFormatVer = 2
+
+	currentMDJournalFormatVer = mdJournalFormatVerRecorded
+)
+
+// mdJournalMigrations maps each format version below the current one
+// to the function that upgrades a journal from that version to the
+// next one. Until a journal is migrated, it's read as if it had the
+// current layout, so any migration that changes the layout must
+// also make migration mandatory for the versions before it.
+var mdJournalMigrations = map[mdJournalFormatVer]func(j *mdJournal) error{
+	mdJournalFormatVerUnversioned: func(j *mdJournal) error {
+		return j.j.rewriteLegacyEntries()
+	},
+}
+
+// mdJournalOptions holds the options for makeMDJournalWithOptions.
+// The zero value gives a journal that's opened as-is, with inline
+// signatures, quarantined entries kept forever, no MD size limit,
+// and the wall clock.
+type mdJournalOptions struct {
+	// If repair is set, a journal whose recorded head has no entry
+	// on disk (e.g., after a torn write) has its head reset to the
+	// highest entry that forms a valid chain from the earliest
+	// one, and anything beyond it is moved into a quarantine
+	// directory. Otherwise, such a journal is rejected with
+	// MDJournalHeadMismatchError.
+	repair bool
+	// If migrate is set, a journal with an older on-disk format
+	// version is first upgraded to the current one.
+	migrate bool
+	// If detachedSigs is set, newly-stored MDs have their writer
+	// signatures written to sidecar files.
+	detachedSigs bool
+	// If quarantineRetention is non-zero, quarantined entries set
+	// aside longer ago than that are removed.
+	quarantineRetention time.Duration
+	// If clock is set, it's used instead of the wall clock to
+	// stamp quarantined entries and flushes.
+	clock Clock
+	// If maxMDBytes is non-zero, puts of MDs that serialize to
+	// more than that many bytes fail with
+	// MDJournalTooLargeError.
+	maxMDBytes uint64
 }
 
 func makeMDJournal(codec Codec, crypto cryptoPure, dir string,
 	log logger.Logger) (*mdJournal, error) {
+	return makeMDJournalWithOptions(
+		codec, crypto, dir, log, mdJournalOptions{})
+}
+
+// makeMDJournalWithOptions is like makeMDJournal, but with the given
+// options. If options.repair is set and the journal's head had to be
+// repaired, the repaired journal is returned along with an
+// MDJournalRepairedError describing the correction. In any case, a
+// journal with a format version newer than the current one is
+// rejected with MDJournalFormatVersionError.
+func makeMDJournalWithOptions(codec Codec, crypto cryptoPure, dir string,
+	log logger.Logger, options mdJournalOptions) (*mdJournal, error) {
 	journalDir := filepath.Join(dir, "md_journal")
 
+	clock := options.clock
+	if clock == nil {
+		clock = wallClock{}
+	}
+
 	deferLog := log.CloneWithAddedDepth(1)
 	journal := mdJournal{
-		codec:    codec,
-		crypto:   crypto,
-		dir:      dir,
-		log:      log,
-		deferLog: deferLog,
-		j:        makeMdIDJournal(codec, journalDir),
+		codec:      codec,
+		crypto:     crypto,
+		dir:        dir,
+		log:        log,
+		deferLog:   deferLog,
+		j:          makeMdIDJournal(codec, journalDir),
+		maxMDBytes: options.maxMDBytes,
+		clock:      clock,
+
+		detachedSigs:        options.detachedSigs,
+		quarantineRetention: options.quarantineRetention,
+	}
+
+	err := journal.checkFormatVersion(options.migrate)
+	if err != nil {
+		return nil, err
+	}
+
+	// getMD checks each MD's branch ID against the journal's, so
+	// the branch has to be known before any MD is read that way,
+	// or else a journal that was converted to a branch couldn't
+	// be reloaded.
+	earliestID, err := journal.j.getEarliest()
+	if err != nil {
+		return nil, err
+	}
+	if earliestID != (MdID{}) {
+		rmd, err := journal.readMD(earliestID)
+		if err != nil {
+			return nil, err
+		}
+		journal.branchID = rmd.BID()
+	}
+
+	repairErr, err := journal.checkHead(options.repair)
+	if err != nil {
+		return nil, err
 	}
 
 	earliest, err := journal.getEarliest()
@@ -131,13 +315,326 @@ func makeMDJournal(codec Codec, crypto cryptoPure, dir string,
 				earliest.BID(), latest.BID())
 		}
 		journal.branchID = earliest.BID()
+		journal.branchReason, err = journal.readBranchReason()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = journal.pruneQuarantine()
+	if err != nil {
+		return nil, err
 	}
 
+	if repairErr != nil {
+		return &journal, *repairErr
+	}
 	return &journal, nil
 }
 
+// MDJournalBranchReason records why an MD journal was converted to a
+// branch.
+type MDJournalBranchReason int
+
+const (
+	// MDJournalBranchReasonUnknown means the journal isn't on a
+	// branch, or the branch wasn't created by convertToBranch,
+	// e.g. it was put directly onto the journal.
+	MDJournalBranchReasonUnknown MDJournalBranchReason = iota
+	// MDJournalBranchReasonConflict means a merged MD hit a
+	// revision conflict while being flushed.
+	MDJournalBranchReasonConflict
+	// MDJournalBranchReasonExplicitFork means the caller
+	// explicitly asked for the journal to fork.
+	MDJournalBranchReasonExplicitFork
+	// MDJournalBranchReasonReanchor means the journal was forked
+	// so that it could be re-anchored onto a different merged
+	// revision.
+	MDJournalBranchReasonReanchor
+)
+
+func (r MDJournalBranchReason) String() string {
+	switch r {
+	case MDJournalBranchReasonUnknown:
+		return "unknown"
+	case MDJournalBranchReasonConflict:
+		return "conflict"
+	case MDJournalBranchReasonExplicitFork:
+		return "explicit fork"
+	case MDJournalBranchReasonReanchor:
+		return "re-anchor"
+	default:
+		return fmt.Sprintf("MDJournalBranchReason(%d)", int(r))
+	}
+}
+
+// mdJournalBranchReasonInfo is the persisted form of an
+// MDJournalBranchReason. The branch ID is stored along with it, so
+// that a reason left over from an earlier branch is never attributed
+// to a later one.
+type mdJournalBranchReasonInfo struct {
+	BID    BranchID
+	Reason MDJournalBranchReason
+}
+
+func (j mdJournal) branchReasonPath() string {
+	return filepath.Join(j.dir, "md_journal_branch_reason")
+}
+
+// readBranchReason returns the recorded reason for the journal's
+// current branch, or MDJournalBranchReasonUnknown if there isn't
+// one.
+func (j mdJournal) readBranchReason() (MDJournalBranchReason, error) {
+	buf, err := ioutil.ReadFile(j.branchReasonPath())
+	if os.IsNotExist(err) {
+		return MDJournalBranchReasonUnknown, nil
+	} else if err != nil {
+		return MDJournalBranchReasonUnknown, err
+	}
+
+	var info mdJournalBranchReasonInfo
+	err = j.codec.Decode(buf, &info)
+	if err != nil {
+		return MDJournalBranchReasonUnknown, err
+	}
+	if info.BID != j.branchID {
+		return MDJournalBranchReasonUnknown, nil
+	}
+	return info.Reason, nil
+}
+
+func (j mdJournal) writeBranchReason(
+	bid BranchID, reason MDJournalBranchReason) error {
+	buf, err := j.codec.Encode(mdJournalBranchReasonInfo{bid, reason})
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(j.dir, 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(j.branchReasonPath(), buf, 0600)
+}
+
+func (j mdJournal) formatVersionPath() string {
+	return filepath.Join(j.dir, "md_journal_format_version")
+}
+
+// readFormatVersion returns the journal's recorded format version,
+// and whether it was actually recorded. A journal without a version
+// file is either new, in which case the current version is returned,
+// or unversioned. Nothing is written.
+func (j mdJournal) readFormatVersion() (
+	v mdJournalFormatVer, recorded bool, err error) {
+	buf, err := ioutil.ReadFile(j.formatVersionPath())
+	if err == nil {
+		v, err := strconv.Atoi(string(buf))
+		if err != nil {
+			return 0, false, err
+		}
+		return mdJournalFormatVer(v), true, nil
+	} else if !os.IsNotExist(err) {
+		return 0, false, err
+	}
+
+	for _, p := range []string{j.j.j.dir, j.mdsPath()} {
+		_, err := os.Stat(p)
+		if err == nil {
+			return mdJournalFormatVerUnversioned, false, nil
+		} else if !os.IsNotExist(err) {
+			return 0, false, err
+		}
+	}
+
+	return currentMDJournalFormatVer, false, nil
+}
+
+func (j mdJournal) writeFormatVersion(v mdJournalFormatVer) error {
+	err := os.MkdirAll(j.dir, 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(
+		j.formatVersionPath(), []byte(strconv.Itoa(int(v))), 0600)
+}
+
+// checkFormatVersion rejects a journal with a format version newer
+// than the current one, and if migrate is set, runs the migrations
+// needed to bring an older journal up to the current version, and
+// records the version of a new journal. Only migrate causes any
+// writes.
+func (j *mdJournal) checkFormatVersion(migrate bool) error {
+	v, recorded, err := j.readFormatVersion()
+	if err != nil {
+		return err
+	}
+
+	if v > currentMDJournalFormatVer || v < mdJournalFormatVerUnversioned {
+		return MDJournalFormatVersionError{v, currentMDJournalFormatVer}
+	}
+
+	if v == currentMDJournalFormatVer {
+		if migrate && !recorded {
+			return j.writeFormatVersion(v)
+		}
+		return nil
+	}
+
+	if !migrate {
+		j.log.Debug("Leaving MD journal at format version %d "+
+			"(current is %d)", v, currentMDJournalFormatVer)
+		return nil
+	}
+
+	for ; v < currentMDJournalFormatVer; v++ {
+		j.log.Debug("Migrating MD journal from format version %d to %d",
+			v, v+1)
+		err := mdJournalMigrations[v](j)
+		if err != nil {
+			return err
+		}
+		err = j.writeFormatVersion(v + 1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkHead checks whether the journal's recorded head revision has
+// an entry on disk, and if not and repair is set, repairs the
+// journal. If a repair was done, it returns a non-nil
+// MDJournalRepairedError as its first return value.
+//
+// Only a head beyond the highest on-disk entry counts as a mismatch,
+// since entries above the head can legitimately be left behind
+// after the journal is cleared.
+func (j *mdJournal) checkHead(repair bool) (
+	repairErr *MDJournalRepairedError, err error) {
+	earliestRev, err := j.j.readEarliestRevision()
+	if err != nil {
+		return nil, err
+	}
+	latestRev, err := j.j.readLatestRevision()
+	if err != nil {
+		return nil, err
+	}
+	if latestRev == MetadataRevisionUninitialized {
+		return nil, nil
+	}
+	highestRev, err := j.j.readHighestOnDiskRevision()
+	if err != nil {
+		return nil, err
+	}
+	if highestRev >= latestRev {
+		return nil, nil
+	}
+
+	if !repair {
+		return nil, MDJournalHeadMismatchError{latestRev, highestRev}
+	}
+
+	// Find the highest entry that forms a valid chain from the
+	// earliest one.
+	newHeadRev := MetadataRevisionUninitialized
+	var prev BareRootMetadata
+	var prevID MdID
+	for r := earliestRev; r <= highestRev; r++ {
+		entry, err := j.j.readJournalEntry(r)
+		if err != nil {
+			j.log.Warning("Couldn't read MD journal entry "+
+				"for revision %s: %v", r, err)
+			break
+		}
+		rmd, _, err := j.getMD(entry.ID)
+		if err != nil {
+			j.log.Warning("Couldn't read MD %s for "+
+				"revision %s: %v", entry.ID, r, err)
+			break
+		}
+		if prev != nil {
+			err := prev.CheckValidSuccessor(prevID, rmd)
+			if err != nil {
+				j.log.Warning("MD %s for revision %s "+
+					"isn't a valid successor: %v",
+					entry.ID, r, err)
+				break
+			}
+		}
+		newHeadRev = r
+		prev = rmd
+		prevID = entry.ID
+	}
+
+	// Quarantine everything beyond the new head.
+	quarantineDir := j.quarantinePath()
+	quarantineStart := newHeadRev + 1
+	if newHeadRev == MetadataRevisionUninitialized {
+		quarantineStart = earliestRev
+	}
+	now := j.clock.Now()
+	for r := quarantineStart; r <= latestRev; r++ {
+		err := j.j.moveEntry(r, quarantineDir, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if newHeadRev == MetadataRevisionUninitialized {
+		err = j.j.clear()
+	} else {
+		err = j.j.writeLatestRevision(newHeadRev)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	j.log.Warning("Repaired MD journal in %s: head was %s but the "+
+		"highest on-disk entry was %s; head is now %s",
+		j.dir, latestRev, highestRev, newHeadRev)
+	return &MDJournalRepairedError{
+		OldHead:       latestRev,
+		NewHead:       newHeadRev,
+		QuarantineDir: quarantineDir,
+	}, nil
+}
+
+// pruneQuarantine removes the quarantined journal entries that were
+// set aside more than quarantineRetention ago. It does nothing if
+// quarantineRetention is 0.
+func (j mdJournal) pruneQuarantine() error {
+	if j.quarantineRetention == 0 {
+		return nil
+	}
+
+	fileInfos, err := ioutil.ReadDir(j.quarantinePath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	cutoff := j.clock.Now().Add(-j.quarantineRetention)
+	for _, fi := range fileInfos {
+		if fi.IsDir() || !fi.ModTime().Before(cutoff) {
+			continue
+		}
+		j.log.Debug("Removing quarantined MD journal entry %s, "+
+			"set aside at %s", fi.Name(), fi.ModTime())
+		err := os.Remove(filepath.Join(j.quarantinePath(), fi.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // The functions below are for building various paths.
 
+func (j mdJournal) quarantinePath() string {
+	return filepath.Join(j.dir, "md_journal_quarantine")
+}
+
 func (j mdJournal) mdsPath() string {
 	return filepath.Join(j.dir, "mds")
 }
@@ -147,23 +644,37 @@ func (j mdJournal) mdPath(id MdID) string {
 	return filepath.Join(j.mdsPath(), idStr[:4], idStr[4:])
 }
 
-// getMD verifies the MD data and the writer signature (but not the
-// key) for the given ID and returns it. It also returns the
-// last-modified timestamp of the file.
-func (j mdJournal) getMD(id MdID) (BareRootMetadata, time.Time, error) {
-	// Read file.
+// sigPath is the path of the sidecar file holding the writer
+// signature of the MD with the given ID, if it was stored with
+// detachedSigs set.
+func (j mdJournal) sigPath(id MdID) string {
+	return j.mdPath(id) + ".sig"
+}
 
-	path := j.mdPath(id)
-	data, err := ioutil.ReadFile(path)
+// readMD reads and decodes the MD stored under the given ID, and
+// checks that it matches that ID, but doesn't verify it otherwise.
+func (j mdJournal) readMD(id MdID) (*BareRootMetadataV2, error) {
+	data, err := ioutil.ReadFile(j.mdPath(id))
 	if err != nil {
-		return nil, time.Time{}, err
+		return nil, err
 	}
 
 	// TODO: the file needs to encode the version
 	var rmd BareRootMetadataV2
 	err = j.codec.Decode(data, &rmd)
 	if err != nil {
-		return nil, time.Time{}, err
+		return nil, err
+	}
+
+	// Reattach the writer signature, if it was stored separately.
+	sigData, err := ioutil.ReadFile(j.sigPath(id))
+	if err == nil {
+		err = j.codec.Decode(sigData, &rmd.WriterMetadataSigInfo)
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
 	}
 
 	// Check integrity.
@@ -171,14 +682,26 @@ func (j mdJournal) getMD(id MdID) (BareRootMetadata, time.Time, error) {
 	// TODO: MakeMdID serializes rmd -- use data instead.
 	mdID, err := j.crypto.MakeMdID(&rmd)
 	if err != nil {
-		return nil, time.Time{}, err
+		return nil, err
 	}
 
 	if mdID != id {
-		return nil, time.Time{}, fmt.Errorf(
+		return nil, fmt.Errorf(
 			"Metadata ID mismatch: expected %s, got %s", id, mdID)
 	}
 
+	return &rmd, nil
+}
+
+// getMD verifies the MD data and the writer signature (but not the
+// key) for the given ID and returns it. It also returns the
+// last-modified timestamp of the file.
+func (j mdJournal) getMD(id MdID) (BareRootMetadata, time.Time, error) {
+	rmd, err := j.readMD(id)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
 	// TODO: Plumb through currentUID and currentVerifyingKey and
 	// call IsLastModifiedBy().
 
@@ -193,12 +716,12 @@ func (j mdJournal) getMD(id MdID) (BareRootMetadata, time.Time, error) {
 			j.branchID, rmd.BID())
 	}
 
-	fi, err := os.Stat(path)
+	fi, err := os.Stat(j.mdPath(id))
 	if err != nil {
 		return nil, time.Time{}, err
 	}
 
-	return &rmd, fi.ModTime(), nil
+	return rmd, fi.ModTime(), nil
 }
 
 // putMD stores the given metadata under its ID, if it's not already
@@ -206,16 +729,47 @@ func (j mdJournal) getMD(id MdID) (BareRootMetadata, time.Time, error) {
 func (j mdJournal) putMD(
 	rmd BareRootMetadata, currentUID keybase1.UID,
 	currentVerifyingKey VerifyingKey) (MdID, error) {
-	err := rmd.IsValidAndSigned(j.codec, j.crypto)
+	err := j.checkMD(rmd, currentUID, currentVerifyingKey)
 	if err != nil {
 		return MdID{}, err
 	}
 
+	return j.storeMD(rmd)
+}
+
+// checkMD does the validity, signature, and size checks that putMD
+// does before storing an MD.
+func (j mdJournal) checkMD(
+	rmd BareRootMetadata, currentUID keybase1.UID,
+	currentVerifyingKey VerifyingKey) error {
+	err := rmd.IsValidAndSigned(j.codec, j.crypto)
+	if err != nil {
+		return err
+	}
+
 	err = rmd.IsLastModifiedBy(currentUID, currentVerifyingKey)
 	if err != nil {
-		return MdID{}, err
+		return err
+	}
+
+	if j.maxMDBytes > 0 {
+		buf, err := j.codec.Encode(rmd)
+		if err != nil {
+			return err
+		}
+		if uint64(len(buf)) > j.maxMDBytes {
+			return MDJournalTooLargeError{
+				rmd.RevisionNumber(), uint64(len(buf)), j.maxMDBytes}
+		}
 	}
 
+	return nil
+}
+
+// storeMD writes the given MD to disk without any validity or
+// permission checks, which must be done by the caller. It returns
+// the MD's ID whether or not it was already stored.
+func (j mdJournal) storeMD(rmd BareRootMetadata) (MdID, error) {
 	id, err := j.crypto.MakeMdID(rmd)
 	if err != nil {
 		return MdID{}, err
@@ -228,7 +782,7 @@ func (j mdJournal) putMD(
 		return MdID{}, err
 	} else {
 		// Entry exists, so nothing else to do.
-		return MdID{}, nil
+		return id, nil
 	}
 
 	path := j.mdPath(id)
@@ -243,6 +797,13 @@ func (j mdJournal) putMD(
 		return MdID{}, err
 	}
 
+	if j.detachedSigs {
+		buf, err = j.storeDetachedSig(id, buf)
+		if err != nil {
+			return MdID{}, err
+		}
+	}
+
 	err = ioutil.WriteFile(path, buf, 0600)
 	if err != nil {
 		return MdID{}, err
@@ -251,49 +812,200 @@ func (j mdJournal) putMD(
 	return id, nil
 }
 
-func (j mdJournal) getEarliest() (ImmutableBareRootMetadata, error) {
-	earliestID, err := j.j.getEarliest()
-	if err != nil {
-		return ImmutableBareRootMetadata{}, err
-	}
-	if earliestID == (MdID{}) {
-		return ImmutableBareRootMetadata{}, nil
-	}
-	earliest, ts, err := j.getMD(earliestID)
+// storeDetachedSig writes the writer signature of the given encoded
+// MD to the sidecar file for id, and returns the MD re-encoded
+// without it. The sidecar is written first, so that an MD file is
+// never left on disk without its signature.
+func (j mdJournal) storeDetachedSig(id MdID, buf []byte) ([]byte, error) {
+	// TODO: the file needs to encode the version
+	var rmd BareRootMetadataV2
+	err := j.codec.Decode(buf, &rmd)
 	if err != nil {
-		return ImmutableBareRootMetadata{}, err
+		return nil, err
 	}
-	return MakeImmutableBareRootMetadata(earliest, earliestID, ts), nil
-}
 
-func (j mdJournal) getLatest() (ImmutableBareRootMetadata, error) {
-	latestID, err := j.j.getLatest()
+	sigBuf, err := j.codec.Encode(rmd.WriterMetadataSigInfo)
 	if err != nil {
-		return ImmutableBareRootMetadata{}, err
-	}
-	if latestID == (MdID{}) {
-		return ImmutableBareRootMetadata{}, nil
+		return nil, err
 	}
-	latest, ts, err := j.getMD(latestID)
+
+	err = ioutil.WriteFile(j.sigPath(id), sigBuf, 0600)
 	if err != nil {
-		return ImmutableBareRootMetadata{}, err
+		return nil, err
 	}
-	return MakeImmutableBareRootMetadata(latest, latestID, ts), nil
+
+	rmd.WriterMetadataSigInfo = SignatureInfo{}
+	return j.codec.Encode(&rmd)
 }
 
-func (j mdJournal) checkGetParams(currentUID keybase1.UID) (
-	ImmutableBareRootMetadata, error) {
-	head, err := j.getLatest()
-	if err != nil {
-		return ImmutableBareRootMetadata{}, err
+// liveMDPaths returns the set of paths under mdsPath that are still
+// referenced, i.e. those of the MDs (and their detached signatures)
+// of the entries on disk from the earliest revision up to the
+// highest on-disk one, and of the quarantined entries.
+func (j mdJournal) liveMDPaths() (map[string]bool, error) {
+	live := make(map[string]bool)
+	addID := func(id MdID) {
+		live[j.mdPath(id)] = true
+		live[j.sigPath(id)] = true
 	}
 
-	if head != (ImmutableBareRootMetadata{}) {
-		ok, err := isReader(currentUID, head.BareRootMetadata)
+	earliest, err := j.j.readEarliestRevision()
+	if err != nil {
+		return nil, err
+	}
+	if earliest != MetadataRevisionUninitialized {
+		// Go up to the highest on-disk entry, instead of just
+		// the latest revision, so that a torn journal can
+		// still be repaired.
+		highest, err := j.j.readHighestOnDiskRevision()
 		if err != nil {
-			return ImmutableBareRootMetadata{}, err
+			return nil, err
 		}
-		if !ok {
+		for r := earliest; r <= highest; r++ {
+			id, err := j.j.readMdID(r)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			addID(id)
+		}
+	}
+
+	// Keep the MDs of quarantined entries around for as long as
+	// the entries themselves.
+	fileInfos, err := ioutil.ReadDir(j.quarantinePath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range fileInfos {
+		if fi.IsDir() {
+			continue
+		}
+		buf, err := ioutil.ReadFile(
+			filepath.Join(j.quarantinePath(), fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var entry mdIDJournalEntry
+		err = j.codec.Decode(buf, &entry)
+		if err != nil {
+			return nil, err
+		}
+		addID(entry.ID)
+	}
+
+	return live, nil
+}
+
+// compact removes the stored MDs, and their detached signatures,
+// that are no longer referenced by any journal entry, e.g. those of
+// replaced heads or of flushed revisions, and returns the number of
+// bytes freed. It never removes the MD of an entry still in the
+// journal or in quarantine, though it first prunes the quarantine
+// (see pruneQuarantine). Like the other mdJournal methods, it
+// must be called with the tlfJournal lock held, so that it doesn't
+// race with reads, or with a put that has stored its MD but not yet
+// added its entry.
+func (j mdJournal) compact(ctx context.Context) (reclaimed uint64, err error) {
+	err = j.pruneQuarantine()
+	if err != nil {
+		return 0, err
+	}
+
+	live, err := j.liveMDPaths()
+	if err != nil {
+		return 0, err
+	}
+
+	// The MDs are in one subdirectory per ID prefix (see mdPath).
+	dirInfos, err := ioutil.ReadDir(j.mdsPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, dirInfo := range dirInfos {
+		if !dirInfo.IsDir() {
+			continue
+		}
+		dir := filepath.Join(j.mdsPath(), dirInfo.Name())
+		fileInfos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return reclaimed, err
+		}
+		kept := 0
+		for _, fi := range fileInfos {
+			p := filepath.Join(dir, fi.Name())
+			if fi.IsDir() || live[p] {
+				kept++
+				continue
+			}
+			err := os.Remove(p)
+			if err != nil {
+				return reclaimed, err
+			}
+			reclaimed += uint64(fi.Size())
+			removed++
+		}
+		if kept == 0 {
+			err := os.Remove(dir)
+			if err != nil {
+				return reclaimed, err
+			}
+		}
+	}
+
+	j.log.CDebugf(ctx, "Compacted MD journal in %s: removed %d files, "+
+		"reclaiming %d bytes", j.dir, removed, reclaimed)
+	return reclaimed, nil
+}
+
+func (j mdJournal) getEarliest() (ImmutableBareRootMetadata, error) {
+	earliestID, err := j.j.getEarliest()
+	if err != nil {
+		return ImmutableBareRootMetadata{}, err
+	}
+	if earliestID == (MdID{}) {
+		return ImmutableBareRootMetadata{}, nil
+	}
+	earliest, ts, err := j.getMD(earliestID)
+	if err != nil {
+		return ImmutableBareRootMetadata{}, err
+	}
+	return MakeImmutableBareRootMetadata(earliest, earliestID, ts), nil
+}
+
+func (j mdJournal) getLatest() (ImmutableBareRootMetadata, error) {
+	latestID, err := j.j.getLatest()
+	if err != nil {
+		return ImmutableBareRootMetadata{}, err
+	}
+	if latestID == (MdID{}) {
+		return ImmutableBareRootMetadata{}, nil
+	}
+	latest, ts, err := j.getMD(latestID)
+	if err != nil {
+		return ImmutableBareRootMetadata{}, err
+	}
+	return MakeImmutableBareRootMetadata(latest, latestID, ts), nil
+}
+
+func (j mdJournal) checkGetParams(currentUID keybase1.UID) (
+	ImmutableBareRootMetadata, error) {
+	head, err := j.getLatest()
+	if err != nil {
+		return ImmutableBareRootMetadata{}, err
+	}
+
+	if head != (ImmutableBareRootMetadata{}) {
+		ok, err := isReader(currentUID, head.BareRootMetadata)
+		if err != nil {
+			return ImmutableBareRootMetadata{}, err
+		}
+		if !ok {
 			// TODO: Use a non-server error.
 			return ImmutableBareRootMetadata{},
 				MDServerErrorUnauthorized{}
@@ -303,14 +1015,18 @@ func (j mdJournal) checkGetParams(currentUID keybase1.UID) (
 	return head, nil
 }
 
-func (j *mdJournal) convertToBranch(
+// rewriteJournal rewrites every entry in the journal into a temp
+// journal, applying modify to each MD and then re-signing its writer
+// metadata with signer and fixing up its prev root. The temp journal
+// is swapped in only if every entry was rewritten successfully, so
+// that on error the journal is left unchanged. Entries that came from
+// the server are already flushed, so they're dropped, just as
+// flushOne would drop them, rather than being re-signed with the
+// local key and pushed again.
+func (j *mdJournal) rewriteJournal(
 	ctx context.Context, signer cryptoSigner,
-	currentUID keybase1.UID, currentVerifyingKey VerifyingKey) (err error) {
-	if j.branchID != NullBranchID {
-		return fmt.Errorf(
-			"convertToBranch called with BID=%s", j.branchID)
-	}
-
+	currentUID keybase1.UID, currentVerifyingKey VerifyingKey,
+	modify func(MutableBareRootMetadata)) (err error) {
 	earliestRevision, err := j.j.readEarliestRevision()
 	if err != nil {
 		return err
@@ -324,23 +1040,18 @@ func (j *mdJournal) convertToBranch(
 	j.log.CDebugf(
 		ctx, "rewriting MDs %s to %s", earliestRevision, latestRevision)
 
-	_, allMdIDs, err := j.j.getRange(earliestRevision, latestRevision)
-	if err != nil {
-		return err
-	}
-
-	bid, err := j.crypto.MakeRandomBranchID()
+	_, allEntries, err := j.j.getEntryRange(
+		earliestRevision, latestRevision)
 	if err != nil {
 		return err
 	}
 
-	j.log.CDebugf(ctx, "New branch ID=%s", bid)
-
-	journalTempDirName, err := ioutil.TempDir(j.dir, "md_journal")
+	// ioutil.TempDir returns the full path of the new directory,
+	// so it mustn't be joined with j.dir again.
+	journalTempDir, err := ioutil.TempDir(j.dir, "md_journal")
 	if err != nil {
 		return err
 	}
-	journalTempDir := filepath.Join(j.dir, journalTempDirName)
 	j.log.CDebugf(ctx, "Using temp dir %s for rewriting", journalTempDir)
 	defer func() {
 		if err != nil {
@@ -356,8 +1067,17 @@ func (j *mdJournal) convertToBranch(
 	tempJournal := makeMdIDJournal(j.codec, journalTempDir)
 
 	var prevID MdID
+	var lastDroppedID MdID
+	var replacedIDs []MdID
+
+	for i, entry := range allEntries {
+		id := entry.ID
+		if entry.FromServer {
+			j.log.CDebugf(ctx, "Dropping server-sourced MD with id=%s", id)
+			lastDroppedID = id
+			continue
+		}
 
-	for i, id := range allMdIDs {
 		ibrmd, _, err := j.getMD(id)
 		if err != nil {
 			return err
@@ -366,8 +1086,7 @@ func (j *mdJournal) convertToBranch(
 		if !ok {
 			return MutableBareRootMetadataNoImplError{}
 		}
-		brmd.SetUnmerged()
-		brmd.SetBranchID(bid)
+		modify(brmd)
 
 		// Re-sign the writer metadata.
 		buf, err := brmd.GetSerializedWriterMetadata(j.codec)
@@ -384,7 +1103,7 @@ func (j *mdJournal) convertToBranch(
 		j.log.CDebugf(ctx, "Old prev root of rev=%s is %s",
 			brmd.RevisionNumber(), brmd.GetPrevRoot())
 
-		if i > 0 {
+		if i > 0 && prevID != (MdID{}) {
 			j.log.CDebugf(ctx, "Changing prev root of rev=%s to %s",
 				brmd.RevisionNumber(), prevID)
 			brmd.SetPrevRoot(prevID)
@@ -401,12 +1120,18 @@ func (j *mdJournal) convertToBranch(
 			return err
 		}
 
-		err = tempJournal.append(brmd.RevisionNumber(), newID)
+		err = tempJournal.append(brmd.RevisionNumber(), mdIDJournalEntry{
+			ID:            newID,
+			CorrelationID: entry.CorrelationID,
+		})
 		if err != nil {
 			return err
 		}
 
 		prevID = newID
+		if newID != id {
+			replacedIDs = append(replacedIDs, id)
+		}
 
 		j.log.CDebugf(ctx, "Changing ID for rev=%s from %s to %s",
 			brmd.RevisionNumber(), id, newID)
@@ -428,9 +1153,133 @@ func (j *mdJournal) convertToBranch(
 	}
 
 	j.j = tempJournal
+	j.diskUsageValid = false
+
+	// The replaced MDs are no longer referenced, so remove any
+	// detached signatures they had. The rewrite has already
+	// succeeded, so failing to do so is only worth a warning.
+	for _, id := range replacedIDs {
+		removeErr := os.Remove(j.sigPath(id))
+		if removeErr != nil && !os.IsNotExist(removeErr) {
+			j.log.CWarningf(ctx, "Error when removing signature of "+
+				"replaced MD %s: %v", id, removeErr)
+		}
+	}
+
+	// If every entry was dropped, the journal is now empty, so
+	// save the last MdID, as flushOne does.
+	if prevID == (MdID{}) && lastDroppedID != (MdID{}) {
+		j.lastMdID = lastDroppedID
+	}
+
+	return nil
+}
+
+func (j *mdJournal) convertToBranch(
+	ctx context.Context, signer cryptoSigner,
+	currentUID keybase1.UID, currentVerifyingKey VerifyingKey,
+	reason MDJournalBranchReason) (err error) {
+	if j.branchID != NullBranchID {
+		return fmt.Errorf(
+			"convertToBranch called with BID=%s", j.branchID)
+	}
+
+	bid, err := j.crypto.MakeRandomBranchID()
+	if err != nil {
+		return err
+	}
+
+	j.log.CDebugf(ctx, "New branch ID=%s, reason=%s", bid, reason)
+
+	// Record the reason first, so that it's there if the
+	// journal is reloaded right after the rewrite.
+	err = j.writeBranchReason(bid, reason)
+	if err != nil {
+		return err
+	}
+
+	// getMD checks the branch ID of each MD against j.branchID,
+	// so only switch it over once the rewrite has succeeded.
+	err = j.rewriteJournal(ctx, signer, currentUID, currentVerifyingKey,
+		func(brmd MutableBareRootMetadata) {
+			brmd.SetUnmerged()
+			brmd.SetBranchID(bid)
+		})
+	if err != nil {
+		return err
+	}
+
 	j.branchID = bid
+	j.branchReason = reason
+	j.branchOnServer = false
 
-	return err
+	return nil
+}
+
+// previewConvertToBranch reports what convertToBranch would do,
+// without re-signing or changing anything: the number of merged
+// entries that would become unmerged, and the merged revision the
+// new branch would fork from, i.e. the last server-sourced entry if
+// there is one, and otherwise the one just before the earliest
+// entry. For an empty journal, it returns 0 and
+// MetadataRevisionUninitialized.
+func (j mdJournal) previewConvertToBranch() (
+	count int, wouldForkFrom MetadataRevision, err error) {
+	if j.branchID != NullBranchID {
+		return 0, MetadataRevisionUninitialized, fmt.Errorf(
+			"previewConvertToBranch called with BID=%s", j.branchID)
+	}
+
+	earliestRevision, err := j.j.readEarliestRevision()
+	if err != nil {
+		return 0, MetadataRevisionUninitialized, err
+	}
+	if earliestRevision == MetadataRevisionUninitialized {
+		return 0, MetadataRevisionUninitialized, nil
+	}
+
+	latestRevision, err := j.j.readLatestRevision()
+	if err != nil {
+		return 0, MetadataRevisionUninitialized, err
+	}
+
+	realStart, allEntries, err := j.j.getEntryRange(
+		earliestRevision, latestRevision)
+	if err != nil {
+		return 0, MetadataRevisionUninitialized, err
+	}
+
+	// Mirror rewriteJournal, which drops server-sourced entries,
+	// so that the new branch forks from the last dropped one.
+	wouldForkFrom = realStart - 1
+	for i, entry := range allEntries {
+		if entry.FromServer {
+			wouldForkFrom = realStart + MetadataRevision(i)
+			continue
+		}
+		count++
+	}
+	return count, wouldForkFrom, nil
+}
+
+// resign re-signs every entry in the journal with the given signer,
+// e.g. after the current device's signing key has been rotated. Like
+// convertToBranch, either all entries are re-signed or, on error,
+// the journal is left unchanged.
+func (j *mdJournal) resign(
+	ctx context.Context, signer cryptoSigner,
+	currentUID keybase1.UID, currentVerifyingKey VerifyingKey) (err error) {
+	j.log.CDebugf(ctx, "Re-signing journal with key %s", currentVerifyingKey)
+	defer func() {
+		if err != nil {
+			j.deferLog.CDebugf(ctx,
+				"Re-signing journal with key %s failed with %v",
+				currentVerifyingKey, err)
+		}
+	}()
+
+	return j.rewriteJournal(ctx, signer, currentUID, currentVerifyingKey,
+		func(MutableBareRootMetadata) {})
 }
 
 func (j mdJournal) pushEarliestToServer(
@@ -480,170 +1329,1390 @@ func (j mdJournal) length() (uint64, error) {
 	return j.j.length()
 }
 
-func (j mdJournal) getHead(currentUID keybase1.UID) (
-	ImmutableBareRootMetadata, error) {
-	return j.checkGetParams(currentUID)
+// entryDiskUsage returns the number of bytes on disk used by the MD
+// with the given ID, including any detached signature, and the index
+// entry for the given revision.
+func (j mdJournal) entryDiskUsage(
+	r MetadataRevision, id MdID) (uint64, error) {
+	mdInfo, err := os.Stat(j.mdPath(id))
+	if err != nil {
+		return 0, err
+	}
+	entryPath, err := j.j.journalEntryPath(r)
+	if err != nil {
+		return 0, err
+	}
+	entryInfo, err := os.Stat(entryPath)
+	if err != nil {
+		return 0, err
+	}
+	usage := uint64(mdInfo.Size()) + uint64(entryInfo.Size())
+
+	sigInfo, err := os.Stat(j.sigPath(id))
+	if err == nil {
+		usage += uint64(sigInfo.Size())
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	return usage, nil
 }
 
-func (j mdJournal) getRange(
-	currentUID keybase1.UID, start, stop MetadataRevision) (
-	[]ImmutableBareRootMetadata, error) {
-	_, err := j.checkGetParams(currentUID)
-	if err != nil {
-		return nil, err
+// diskUsage returns the number of bytes on disk used by the MDs in
+// the journal and their index entries. MDs and entries that have
+// been flushed or cleared aren't counted, even if they're still on
+// disk. The total is cached, so this is cheap to call except after
+// a change that invalidates it (see diskUsageValid).
+func (j *mdJournal) diskUsage() (uint64, error) {
+	if j.diskUsageValid {
+		return j.diskUsageBytes, nil
 	}
 
-	realStart, mdIDs, err := j.j.getRange(start, stop)
+	earliest, err := j.j.readEarliestRevision()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	var rmds []ImmutableBareRootMetadata
-	for i, mdID := range mdIDs {
-		expectedRevision := realStart + MetadataRevision(i)
-		rmd, ts, err := j.getMD(mdID)
-		if err != nil {
-			return nil, err
-		}
-		if expectedRevision != rmd.RevisionNumber() {
-			panic(fmt.Errorf("expected revision %v, got %v",
-				expectedRevision, rmd.RevisionNumber()))
-		}
-		irmd := MakeImmutableBareRootMetadata(rmd, mdID, ts)
-		rmds = append(rmds, irmd)
+	latest, err := j.j.readLatestRevision()
+	if err != nil {
+		return 0, err
 	}
 
-	return rmds, nil
+	var usage uint64
+	err = j.j.iterateEntryRange(earliest, latest,
+		func(r MetadataRevision, entry mdIDJournalEntry) error {
+			entryUsage, err := j.entryDiskUsage(r, entry.ID)
+			if err != nil {
+				return err
+			}
+			usage += entryUsage
+			return nil
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	j.diskUsageBytes = usage
+	j.diskUsageValid = true
+	return usage, nil
 }
 
-// MDJournalConflictError is an error that is returned when a put
-// detects a rewritten journal.
-type MDJournalConflictError struct{}
+// addEntryDiskUsage adds the disk usage of the given entry to the
+// cached total, if there is one. If the entry's usage can't be
+// determined, the cached total is dropped instead.
+func (j *mdJournal) addEntryDiskUsage(r MetadataRevision, id MdID) {
+	if !j.diskUsageValid {
+		return
+	}
+	entryUsage, err := j.entryDiskUsage(r, id)
+	if err != nil {
+		j.diskUsageValid = false
+		return
+	}
+	j.diskUsageBytes += entryUsage
+}
 
-func (e MDJournalConflictError) Error() string {
-	return "MD journal conflict error"
+// removeEntryDiskUsage is the inverse of addEntryDiskUsage.
+func (j *mdJournal) removeEntryDiskUsage(r MetadataRevision, id MdID) {
+	if !j.diskUsageValid {
+		return
+	}
+	entryUsage, err := j.entryDiskUsage(r, id)
+	if err != nil || entryUsage > j.diskUsageBytes {
+		j.diskUsageValid = false
+		return
+	}
+	j.diskUsageBytes -= entryUsage
 }
 
-// put verifies and stores the given RootMetadata in the journal,
-// modifying it as needed. In particular, if this is an unmerged
-// RootMetadata but the branch ID isn't set, it will be set to the
-// journal's branch ID, which is assumed to be non-zero. As a special
-// case, if the revision of the given RootMetadata matches that of the
-// head, the given RootMetadata will replace the head.
-func (j *mdJournal) put(
-	ctx context.Context, signer cryptoSigner, ekg encryptionKeyGetter,
-	bsplit BlockSplitter, rmd *RootMetadata, currentUID keybase1.UID,
-	currentVerifyingKey VerifyingKey) (mdID MdID, err error) {
-	j.log.CDebugf(ctx, "Putting MD for TLF=%s with rev=%s bid=%s",
-		rmd.TlfID(), rmd.Revision(), rmd.BID())
-	defer func() {
-		if err != nil {
-			j.deferLog.CDebugf(ctx,
-				"Put MD for TLF=%s with rev=%s bid=%s failed with %v",
-				rmd.TlfID(), rmd.Revision(), rmd.BID(), err)
-		}
-	}()
+// MDJournalStatus describes the state of an MD journal, for display
+// in diagnostics. It is suitable for encoding directly as JSON. The
+// zero value describes an empty journal on the merged branch.
+type MDJournalStatus struct {
+	// The hex-encoded ID of the branch the journal is on, or
+	// empty if it's on the merged branch.
+	BranchID string `json:",omitempty"`
+	// Why the branch was created, or empty if the journal is on
+	// the merged branch.
+	BranchReason string `json:",omitempty"`
+	MergedStatus MergeStatus
+	// Both are MetadataRevisionUninitialized if the journal is
+	// empty.
+	RevisionStart MetadataRevision
+	RevisionEnd   MetadataRevision
+	EntryCount    uint64
+	// The number of bytes on disk used by the MDs in the journal
+	// and their index entries; see diskUsage.
+	DiskUsage uint64
+}
 
-	head, err := j.getLatest()
+// getStatus returns the current status of the journal. Like getHead,
+// it fails if currentUID can't read the head of the journal.
+func (j *mdJournal) getStatus(currentUID keybase1.UID) (
+	MDJournalStatus, error) {
+	_, err := j.checkGetParams(currentUID)
 	if err != nil {
-		return MdID{}, err
+		return MDJournalStatus{}, err
 	}
 
-	var lastMdID MdID
-	var lastBranchID BranchID
-	if head == (ImmutableBareRootMetadata{}) {
-		lastMdID = j.lastMdID
-		lastBranchID = j.branchID
-	} else {
-		lastMdID = head.mdID
-		lastBranchID = head.BID()
+	earliestRevision, err := j.j.readEarliestRevision()
+	if err != nil {
+		return MDJournalStatus{}, err
+	}
+	latestRevision, err := j.j.readLatestRevision()
+	if err != nil {
+		return MDJournalStatus{}, err
+	}
+	length, err := j.j.length()
+	if err != nil {
+		return MDJournalStatus{}, err
+	}
+	diskUsage, err := j.diskUsage()
+	if err != nil {
+		return MDJournalStatus{}, err
 	}
 
-	mStatus := rmd.MergedStatus()
+	status := MDJournalStatus{
+		MergedStatus:  Merged,
+		RevisionStart: earliestRevision,
+		RevisionEnd:   latestRevision,
+		EntryCount:    length,
+		DiskUsage:     diskUsage,
+	}
+	if j.branchID != NullBranchID {
+		status.BranchID = j.branchID.String()
+		status.BranchReason = j.branchReason.String()
+		status.MergedStatus = Unmerged
+	}
+	return status, nil
+}
 
-	if (mStatus == Unmerged) && (rmd.BID() == NullBranchID) {
-		j.log.CDebugf(
-			ctx, "Changing branch ID to %s and prev root to %s for MD for TLF=%s with rev=%s",
-			lastBranchID, lastMdID, rmd.TlfID(), rmd.Revision(), rmd.BID())
-		rmd.SetBranchID(lastBranchID)
-		rmd.SetPrevRoot(lastMdID)
+// FlushStats summarizes the MDs flushed from a journal over some
+// period of time. It is suitable for encoding directly as JSON.
+type FlushStats struct {
+	// The number of MDs pushed to the server.
+	Flushes int
+	// The number of bytes on disk that those MDs used in the
+	// journal, including their index entries.
+	Bytes uint64
+	// The number of revision conflicts hit while pushing those
+	// MDs.
+	Conflicts int
+}
+
+// recordFlush adds a flush event for an MD that used the given
+// number of bytes, and trims old events.
+func (j *mdJournal) recordFlush(bytes uint64, conflicts int) {
+	now := j.clock.Now()
+	j.flushEvents = append(j.flushEvents, mdJournalFlushEvent{
+		time:      now,
+		bytes:     bytes,
+		conflicts: conflicts,
+	})
+
+	cutoff := now.Add(-mdJournalFlushEventRetention)
+	drop := len(j.flushEvents) - mdJournalMaxFlushEvents
+	if drop < 0 {
+		drop = 0
 	}
+	for drop < len(j.flushEvents) && j.flushEvents[drop].time.Before(cutoff) {
+		drop++
+	}
+	if drop > 0 {
+		j.flushEvents = append(
+			[]mdJournalFlushEvent(nil), j.flushEvents[drop:]...)
+	}
+}
 
-	if (mStatus == Merged) != (rmd.BID() == NullBranchID) {
-		return MdID{}, errors.New("Invalid branch ID")
+// flushStats returns statistics on the MDs flushed at or after the
+// given time. Only recent flushes are remembered (see flushEvents),
+// so this may undercount if since is too far in the past. MDs that
+// came from the server, and so didn't need to be pushed, aren't
+// counted.
+func (j mdJournal) flushStats(since time.Time) FlushStats {
+	// Events are in time order, so find the first one in range.
+	i := sort.Search(len(j.flushEvents), func(i int) bool {
+		return !j.flushEvents[i].time.Before(since)
+	})
+	var stats FlushStats
+	for _, e := range j.flushEvents[i:] {
+		stats.Flushes++
+		stats.Bytes += e.bytes
+		stats.Conflicts += e.conflicts
+	}
+	return stats
+}
+
+// enableStaleBranchCheck makes every period-th put onto a branch
+// first check with mdserver whether the branch still exists, and
+// fail with MDJournalStaleBranchError if it doesn't. A period of 0
+// disables the check.
+func (j *mdJournal) enableStaleBranchCheck(mdserver MDServer, period int) {
+	j.staleBranchCheckPeriod = period
+	j.staleBranchMDServer = mdserver
+	j.putsSinceBranchCheck = 0
+}
+
+// checkForStaleBranch checks with the given server whether the
+// journal's branch still exists, and returns
+// MDJournalStaleBranchError if it doesn't. A branch that hasn't yet
+// made it to the server isn't considered stale.
+func (j *mdJournal) checkForStaleBranch(
+	ctx context.Context, mdserver MDServer, tlfID TlfID) error {
+	if j.branchID == NullBranchID {
+		return nil
 	}
 
-	// If we're trying to push a merged MD onto a branch, return a
-	// conflict error so the caller can retry with an unmerged MD.
-	if mStatus == Merged && lastBranchID != NullBranchID {
-		return MdID{}, MDJournalConflictError{}
+	if j.staleBranchID == j.branchID {
+		return MDJournalStaleBranchError{j.branchID}
+	}
+
+	rmds, err := mdserver.GetForTLF(ctx, tlfID, NullBranchID, Unmerged)
+	if err != nil {
+		return err
+	}
+
+	if rmds != nil && rmds.MD.BID() == j.branchID {
+		j.branchOnServer = true
+		return nil
+	}
+
+	if !j.branchOnServer {
+		return nil
+	}
+
+	j.log.CDebugf(ctx, "Branch %s for TLF=%s no longer exists on the server",
+		j.branchID, tlfID)
+	j.staleBranchID = j.branchID
+	return MDJournalStaleBranchError{j.branchID}
+}
+
+func (j mdJournal) getHead(currentUID keybase1.UID) (
+	ImmutableBareRootMetadata, error) {
+	return j.checkGetParams(currentUID)
+}
+
+func (j mdJournal) getRange(
+	currentUID keybase1.UID, start, stop MetadataRevision) (
+	[]ImmutableBareRootMetadata, error) {
+	var rmds []ImmutableBareRootMetadata
+	err := j.iterateRange(currentUID, start, stop,
+		func(irmd ImmutableBareRootMetadata) error {
+			rmds = append(rmds, irmd)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return rmds, nil
+}
+
+// iterateRange is like getRange, but instead of returning the whole
+// range at once, it reads and verifies one MD at a time and passes
+// it to fn, stopping at (and returning) the first error fn
+// returns. The journal must not be modified until iterateRange
+// returns, so callers should hold the same lock across the whole
+// iteration as they would for getRange. An MD that can't be read
+// is reported as an MDJournalDecodeError.
+func (j mdJournal) iterateRange(
+	currentUID keybase1.UID, start, stop MetadataRevision,
+	fn func(ImmutableBareRootMetadata) error) error {
+	_, err := j.checkGetParams(currentUID)
+	if err != nil {
+		return err
+	}
+
+	return j.j.iterateEntryRange(start, stop,
+		func(r MetadataRevision, entry mdIDJournalEntry) error {
+			rmd, ts, err := j.getMD(entry.ID)
+			if err != nil {
+				return MDJournalDecodeError{r, entry.ID, err}
+			}
+			if r != rmd.RevisionNumber() {
+				panic(fmt.Errorf("expected revision %v, got %v",
+					r, rmd.RevisionNumber()))
+			}
+			return fn(MakeImmutableBareRootMetadata(rmd, entry.ID, ts))
+		})
+}
+
+// mdJournalSnapshot records the head of an mdJournal at some point in
+// time, so that later reads can be limited to what the journal held
+// then. See snapshot and getRangeAtSnapshot.
+type mdJournalSnapshot struct {
+	revision MetadataRevision
+	mdID     MdID
+	branchID BranchID
+}
+
+// snapshot returns the current head of the journal, which can be
+// passed to getRangeAtSnapshot to read a range that's consistent with
+// it even if more MDs are put in the meantime. Like getHead, it must
+// be called under the same lock as the operations that modify the
+// journal.
+func (j mdJournal) snapshot() (mdJournalSnapshot, error) {
+	revision, err := j.j.readLatestRevision()
+	if err != nil {
+		return mdJournalSnapshot{}, err
+	}
+	var mdID MdID
+	if revision != MetadataRevisionUninitialized {
+		mdID, err = j.j.readMdID(revision)
+		if err != nil {
+			return mdJournalSnapshot{}, err
+		}
+	}
+	return mdJournalSnapshot{revision, mdID, j.branchID}, nil
+}
+
+// getRangeAtSnapshot is like getRange, but leaves out any MDs put
+// after snap was taken. MDs that have been flushed since then are
+// left out too, as with getRange. If the head at the time of snap
+// has since been replaced, truncated, or converted to a branch, an
+// MDJournalSnapshotStaleError is returned, since the range would no
+// longer be consistent with it.
+func (j mdJournal) getRangeAtSnapshot(
+	currentUID keybase1.UID, snap mdJournalSnapshot,
+	start, stop MetadataRevision) ([]ImmutableBareRootMetadata, error) {
+	if j.branchID != snap.branchID {
+		return nil, MDJournalSnapshotStaleError{snap.revision, snap.mdID}
+	}
+
+	if snap.revision == MetadataRevisionUninitialized {
+		return nil, nil
+	}
+
+	earliestRevision, err := j.j.readEarliestRevision()
+	if err != nil {
+		return nil, err
+	}
+	latestRevision, err := j.j.readLatestRevision()
+	if err != nil {
+		return nil, err
+	}
+
+	// Unless it's been flushed, the head at the time of the
+	// snapshot must still be in the journal, unchanged.
+	if earliestRevision != MetadataRevisionUninitialized &&
+		earliestRevision <= snap.revision {
+		if latestRevision < snap.revision {
+			return nil, MDJournalSnapshotStaleError{
+				snap.revision, snap.mdID}
+		}
+		mdID, err := j.j.readMdID(snap.revision)
+		if err != nil {
+			return nil, err
+		}
+		if mdID != snap.mdID {
+			return nil, MDJournalSnapshotStaleError{
+				snap.revision, snap.mdID}
+		}
+	}
+
+	if stop > snap.revision {
+		stop = snap.revision
+	}
+	if start > stop {
+		return nil, nil
+	}
+	return j.getRange(currentUID, start, stop)
+}
+
+// mdJournalRevisionInfo describes a single entry in the journal.
+type mdJournalRevisionInfo struct {
+	revision      MetadataRevision
+	mdID          MdID
+	correlationID string
+}
+
+// listRevisions returns information about every entry in the
+// journal, in revision order, without reading the MDs themselves.
+func (j mdJournal) listRevisions() ([]mdJournalRevisionInfo, error) {
+	earliestRevision, err := j.j.readEarliestRevision()
+	if err != nil {
+		return nil, err
+	}
+
+	latestRevision, err := j.j.readLatestRevision()
+	if err != nil {
+		return nil, err
+	}
+
+	realStart, entries, err := j.j.getEntryRange(
+		earliestRevision, latestRevision)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []mdJournalRevisionInfo
+	for i, entry := range entries {
+		infos = append(infos, mdJournalRevisionInfo{
+			revision:      realStart + MetadataRevision(i),
+			mdID:          entry.ID,
+			correlationID: entry.CorrelationID,
+		})
+	}
+	return infos, nil
+}
+
+// distinctWriters returns the UIDs of the last-modifying writers of
+// all the MDs in the journal, each along with the distinct verifying
+// keys they signed with, in the order they were first seen. MDs whose
+// writer metadata was copied from an earlier revision are skipped,
+// since their writer signature wasn't made for this journal.
+func (j mdJournal) distinctWriters() (
+	map[keybase1.UID][]VerifyingKey, error) {
+	earliestRevision, err := j.j.readEarliestRevision()
+	if err != nil {
+		return nil, err
+	}
+
+	latestRevision, err := j.j.readLatestRevision()
+	if err != nil {
+		return nil, err
+	}
+
+	writers := make(map[keybase1.UID][]VerifyingKey)
+	err = j.j.iterateEntryRange(earliestRevision, latestRevision,
+		func(r MetadataRevision, entry mdIDJournalEntry) error {
+			rmd, _, err := j.getMD(entry.ID)
+			if err != nil {
+				return MDJournalDecodeError{r, entry.ID, err}
+			}
+			if rmd.IsWriterMetadataCopiedSet() {
+				return nil
+			}
+
+			writer := rmd.LastModifyingWriter()
+			key := rmd.GetWriterMetadataSigInfo().VerifyingKey
+			for _, k := range writers[writer] {
+				if k == key {
+					return nil
+				}
+			}
+			writers[writer] = append(writers[writer], key)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return writers, nil
+}
+
+// verify checks every entry in the journal, from earliest to latest,
+// without modifying the journal. Each MD must decode to its recorded
+// ID and revision, be validly signed and last modified by the given
+// user with one of the given verifying keys, be on the journal's
+// branch, and be a valid successor of the entry before it. The keys
+// may include those of the user's other devices, e.g. from before a
+// key rotation, and entries that came from the server may have been
+// last modified by anyone with any key. The first violation is
+// returned as an MDJournalVerifyError, and no later entries are
+// read.
+//
+// Entries are streamed one at a time, and only the previous MD is
+// kept around for the successor check, so memory use is bounded by
+// the size of a couple of MDs regardless of the journal's length.
+func (j mdJournal) verify(ctx context.Context, currentUID keybase1.UID,
+	verifyingKeys []VerifyingKey) (err error) {
+	j.log.CDebugf(ctx, "Verifying journal")
+	defer func() {
+		if err != nil {
+			j.deferLog.CDebugf(ctx, "Verifying journal failed with %v",
+				err)
+		}
+	}()
+
+	earliestRevision, err := j.j.readEarliestRevision()
+	if err != nil {
+		return err
+	}
+
+	latestRevision, err := j.j.readLatestRevision()
+	if err != nil {
+		return err
+	}
+
+	// Don't hold on to anything but the previous MD, so that
+	// earlier entries can be garbage-collected.
+	var prev BareRootMetadata
+	var prevID MdID
+	return j.j.iterateEntryRange(earliestRevision, latestRevision,
+		func(r MetadataRevision, entry mdIDJournalEntry) error {
+			fail := func(invariant MDJournalInvariant, err error) error {
+				return MDJournalVerifyError{r, invariant, err}
+			}
+
+			rmd, err := j.readMD(entry.ID)
+			if err != nil {
+				return fail(MDJournalInvariantDecode, err)
+			}
+			if rmd.RevisionNumber() != r {
+				return fail(MDJournalInvariantRevision, fmt.Errorf(
+					"Entry has MD for revision %s", rmd.RevisionNumber()))
+			}
+			err = rmd.IsValidAndSigned(j.codec, j.crypto)
+			if err != nil {
+				return fail(MDJournalInvariantSignature, err)
+			}
+			if !entry.FromServer {
+				err = isLastModifiedByAny(rmd, currentUID, verifyingKeys)
+				if err != nil {
+					return fail(MDJournalInvariantLastModifiedBy, err)
+				}
+			}
+			if rmd.BID() != j.branchID {
+				return fail(MDJournalInvariantBranchID, fmt.Errorf(
+					"Branch ID mismatch: expected %s, got %s",
+					j.branchID, rmd.BID()))
+			}
+			if prev != nil {
+				err = prev.CheckValidSuccessor(prevID, rmd)
+				if err != nil {
+					return fail(MDJournalInvariantSuccessor, err)
+				}
+			}
+
+			prev = rmd
+			prevID = entry.ID
+			return nil
+		})
+}
+
+// isLastModifiedByAny is like IsLastModifiedBy, except that rmd may
+// have been signed with any of the given keys.
+func isLastModifiedByAny(rmd BareRootMetadata, uid keybase1.UID,
+	keys []VerifyingKey) error {
+	err := fmt.Errorf("No verifying keys given for %s", uid)
+	for _, key := range keys {
+		err = rmd.IsLastModifiedBy(uid, key)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// headDelta compares the head of the journal against the merged head
+// on the given server, and returns both revisions along with whether
+// the journal has diverged from the server's merged history, i.e. it
+// is on a branch or its entries don't chain onto the server's. If the
+// journal is empty, there's nothing to compare, so both revisions are
+// MetadataRevisionUninitialized.
+func (j mdJournal) headDelta(
+	ctx context.Context, mdserver MDServer, currentUID keybase1.UID) (
+	localHead, serverHead MetadataRevision, forked bool, err error) {
+	head, err := j.getHead(currentUID)
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, false, err
+	}
+	if head == (ImmutableBareRootMetadata{}) {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, false, nil
+	}
+	localHead = head.RevisionNumber()
+
+	tlfID := head.TlfID()
+	rmds, err := mdserver.GetForTLF(ctx, tlfID, NullBranchID, Merged)
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, false, err
+	}
+	serverHead = MetadataRevisionUninitialized
+	if rmds != nil {
+		serverHead = rmds.MD.RevisionNumber()
+	}
+
+	if head.BID() != NullBranchID {
+		return localHead, serverHead, true, nil
+	}
+
+	earliest, err := j.getEarliest()
+	if err != nil {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, false, err
+	}
+
+	// Find the latest revision that both sides should agree on,
+	// and the ID the journal expects for it.
+	shared := serverHead
+	if localHead < shared {
+		shared = localHead
+	}
+	var localID MdID
+	switch {
+	case shared >= earliest.RevisionNumber():
+		_, mdIDs, err := j.j.getRange(shared, shared)
+		if err != nil {
+			return MetadataRevisionUninitialized,
+				MetadataRevisionUninitialized, false, err
+		}
+		if len(mdIDs) != 1 {
+			return MetadataRevisionUninitialized,
+				MetadataRevisionUninitialized, false, fmt.Errorf(
+					"Expected 1 journal entry for rev=%s, got %d",
+					shared, len(mdIDs))
+		}
+		localID = mdIDs[0]
+	case shared == earliest.RevisionNumber()-1:
+		localID = earliest.GetPrevRoot()
+	default:
+		// The server is missing revisions that the journal
+		// builds on, so the two can't be on the same history.
+		return localHead, serverHead, true, nil
+	}
+
+	serverID := MdID{}
+	if shared != MetadataRevisionUninitialized {
+		serverID, err = getMdID(
+			ctx, mdserver, j.crypto, tlfID, NullBranchID, Merged, shared)
+		if err != nil {
+			return MetadataRevisionUninitialized,
+				MetadataRevisionUninitialized, false, err
+		}
+	}
+
+	return localHead, serverHead, serverID != localID, nil
+}
+
+// MDJournalConflictError is an error that is returned when a put
+// detects a rewritten journal.
+type MDJournalConflictError struct{}
+
+func (e MDJournalConflictError) Error() string {
+	return "MD journal conflict error"
+}
+
+// MDJournalTooLargeError is an error that is returned when a put
+// is given an MD that serializes to more than the journal's max MD
+// size.
+type MDJournalTooLargeError struct {
+	Revision MetadataRevision
+	Size     uint64
+	Max      uint64
+}
+
+func (e MDJournalTooLargeError) Error() string {
+	return fmt.Sprintf("MD for revision %s is %d bytes, which exceeds "+
+		"the max of %d bytes", e.Revision, e.Size, e.Max)
+}
+
+// MDJournalHeadMismatchError is an error that is returned when an MD
+// journal's recorded head revision has no entry on disk.
+type MDJournalHeadMismatchError struct {
+	Head          MetadataRevision
+	HighestOnDisk MetadataRevision
+}
+
+func (e MDJournalHeadMismatchError) Error() string {
+	return fmt.Sprintf("MD journal head is %s, but the highest "+
+		"on-disk entry is %s", e.Head, e.HighestOnDisk)
+}
+
+// MDJournalRepairedError is returned along with a usable journal when
+// an MD journal's head had to be repaired on load. NewHead is
+// MetadataRevisionUninitialized if no valid entries remained.
+type MDJournalRepairedError struct {
+	OldHead       MetadataRevision
+	NewHead       MetadataRevision
+	QuarantineDir string
+}
+
+func (e MDJournalRepairedError) Error() string {
+	return fmt.Sprintf("MD journal head repaired from %s to %s; "+
+		"entries beyond it moved to %s",
+		e.OldHead, e.NewHead, e.QuarantineDir)
+}
+
+// MDJournalStaleBranchError is an error that is returned when a put
+// detects that the journal's branch no longer exists on the server,
+// e.g. because it was pruned.
+type MDJournalStaleBranchError struct {
+	BID BranchID
+}
+
+func (e MDJournalStaleBranchError) Error() string {
+	return fmt.Sprintf("MD journal branch %s is stale", e.BID)
+}
+
+// MDJournalDecodeError is an error that is returned when the MD for
+// a journal entry can't be read or fails verification.
+type MDJournalDecodeError struct {
+	Revision MetadataRevision
+	ID       MdID
+	Err      error
+}
+
+func (e MDJournalDecodeError) Error() string {
+	return fmt.Sprintf("Couldn't read MD %s for revision %s: %v",
+		e.ID, e.Revision, e.Err)
+}
+
+// MDJournalInvariant names a property that every entry of an MD
+// journal must have.
+type MDJournalInvariant int
+
+const (
+	// MDJournalInvariantDecode means the MD must be readable and
+	// match the ID recorded for it.
+	MDJournalInvariantDecode MDJournalInvariant = iota
+	// MDJournalInvariantRevision means the MD must have the
+	// revision of its journal entry.
+	MDJournalInvariantRevision
+	// MDJournalInvariantSignature means the MD must be valid and
+	// correctly signed.
+	MDJournalInvariantSignature
+	// MDJournalInvariantLastModifiedBy means the MD must have been
+	// last modified by the journal's user, with one of the
+	// expected verifying keys.
+	MDJournalInvariantLastModifiedBy
+	// MDJournalInvariantBranchID means the MD must be on the
+	// journal's branch.
+	MDJournalInvariantBranchID
+	// MDJournalInvariantSuccessor means the MD must be a valid
+	// successor of the previous entry.
+	MDJournalInvariantSuccessor
+)
+
+func (i MDJournalInvariant) String() string {
+	switch i {
+	case MDJournalInvariantDecode:
+		return "decode"
+	case MDJournalInvariantRevision:
+		return "revision"
+	case MDJournalInvariantSignature:
+		return "signature"
+	case MDJournalInvariantLastModifiedBy:
+		return "last modified by"
+	case MDJournalInvariantBranchID:
+		return "branch ID"
+	case MDJournalInvariantSuccessor:
+		return "successor"
+	default:
+		return fmt.Sprintf("MDJournalInvariant(%d)", int(i))
+	}
+}
+
+// MDJournalVerifyError is returned by mdJournal.verify for the first
+// journal entry that violates one of the journal's invariants.
+type MDJournalVerifyError struct {
+	Revision  MetadataRevision
+	Invariant MDJournalInvariant
+	Err       error
+}
+
+func (e MDJournalVerifyError) Error() string {
+	return fmt.Sprintf("MD journal revision %s fails %s check: %v",
+		e.Revision, e.Invariant, e.Err)
+}
+
+// MDJournalFormatVersionError is returned when an MD journal's
+// on-disk format version isn't one this code knows how to read.
+type MDJournalFormatVersionError struct {
+	Version mdJournalFormatVer
+	Current mdJournalFormatVer
+}
+
+func (e MDJournalFormatVersionError) Error() string {
+	return fmt.Sprintf("MD journal has unsupported format version %d "+
+		"(current is %d)", e.Version, e.Current)
+}
+
+// MDJournalClearRangeError is an error that is returned when
+// clearRange is given a range that isn't a suffix of the journal,
+// i.e. it doesn't lie within [Earliest, Latest] and end at Latest.
+type MDJournalClearRangeError struct {
+	Start, Stop      MetadataRevision
+	Earliest, Latest MetadataRevision
+}
+
+func (e MDJournalClearRangeError) Error() string {
+	return fmt.Sprintf("Cannot clear revisions %s to %s from an MD "+
+		"journal holding revisions %s to %s; only a suffix may be "+
+		"cleared", e.Start, e.Stop, e.Earliest, e.Latest)
+}
+
+// MDJournalSnapshotStaleError is returned by getRangeAtSnapshot when
+// the head recorded by the snapshot is no longer in the journal as it
+// was, e.g. because it was replaced or the journal was converted to a
+// branch.
+type MDJournalSnapshotStaleError struct {
+	Revision MetadataRevision
+	ID       MdID
+}
+
+func (e MDJournalSnapshotStaleError) Error() string {
+	return fmt.Sprintf("Snapshot of MD journal head %s (revision %s) "+
+		"is stale", e.ID, e.Revision)
+}
+
+// put verifies and stores the given RootMetadata in the journal,
+// modifying it as needed. In particular, if this is an unmerged
+// RootMetadata but the branch ID isn't set, it will be set to the
+// journal's branch ID, which is assumed to be non-zero. As a special
+// case, if the revision of the given RootMetadata matches that of the
+// head, the given RootMetadata will replace the head. However, if
+// the given RootMetadata has the same content as the queued entry
+// with its revision, nothing is written, and the ID of that entry is
+// returned.
+func (j *mdJournal) put(
+	ctx context.Context, signer cryptoSigner, ekg encryptionKeyGetter,
+	bsplit BlockSplitter, rmd *RootMetadata, currentUID keybase1.UID,
+	currentVerifyingKey VerifyingKey) (mdID MdID, err error) {
+	return j.putWithCorrelationID(ctx, signer, ekg, bsplit, rmd,
+		currentUID, currentVerifyingKey, "")
+}
+
+// putWithCorrelationID is like put, but also stores the given opaque
+// correlation ID alongside the new journal entry. The correlation ID
+// is stored only in the journal, so it doesn't affect the MdID or
+// the signed MD, and it can be retrieved via listRevisions.
+func (j *mdJournal) putWithCorrelationID(
+	ctx context.Context, signer cryptoSigner, ekg encryptionKeyGetter,
+	bsplit BlockSplitter, rmd *RootMetadata, currentUID keybase1.UID,
+	currentVerifyingKey VerifyingKey, correlationID string) (
+	mdID MdID, err error) {
+	irmd, err := j.putHelper(ctx, signer, ekg, bsplit, rmd,
+		currentUID, currentVerifyingKey, correlationID)
+	if err != nil {
+		return MdID{}, err
+	}
+	return irmd.mdID, nil
+}
+
+// putAndGet is like put, but returns the stored MD, which is what a
+// subsequent call to getHead would return, so that the caller can
+// avoid re-reading it.
+func (j *mdJournal) putAndGet(
+	ctx context.Context, signer cryptoSigner, ekg encryptionKeyGetter,
+	bsplit BlockSplitter, rmd *RootMetadata, currentUID keybase1.UID,
+	currentVerifyingKey VerifyingKey) (ImmutableBareRootMetadata, error) {
+	return j.putHelper(ctx, signer, ekg, bsplit, rmd,
+		currentUID, currentVerifyingKey, "")
+}
+
+func (j *mdJournal) putHelper(
+	ctx context.Context, signer cryptoSigner, ekg encryptionKeyGetter,
+	bsplit BlockSplitter, rmd *RootMetadata, currentUID keybase1.UID,
+	currentVerifyingKey VerifyingKey, correlationID string) (
+	irmd ImmutableBareRootMetadata, err error) {
+	j.log.CDebugf(ctx, "Putting MD for TLF=%s with rev=%s bid=%s",
+		rmd.TlfID(), rmd.Revision(), rmd.BID())
+	defer func() {
+		if err != nil {
+			j.deferLog.CDebugf(ctx,
+				"Put MD for TLF=%s with rev=%s bid=%s failed with %v",
+				rmd.TlfID(), rmd.Revision(), rmd.BID(), err)
+		}
+	}()
+
+	err = j.checkBranchBeforePut(ctx, rmd.TlfID(), 1)
+	if err != nil {
+		return ImmutableBareRootMetadata{}, err
+	}
+
+	head, lastMdID, lastBranchID, err := j.getPutParent()
+	if err != nil {
+		return ImmutableBareRootMetadata{}, err
+	}
+
+	if (rmd.MergedStatus() == Unmerged) && (rmd.BID() == NullBranchID) {
+		j.log.CDebugf(
+			ctx, "Changing branch ID to %s and prev root to %s for MD for TLF=%s with rev=%s",
+			lastBranchID, lastMdID, rmd.TlfID(), rmd.Revision(), rmd.BID())
+		rmd.SetBranchID(lastBranchID)
+		rmd.SetPrevRoot(lastMdID)
+	}
+
+	err = j.checkPutBranch(rmd, lastBranchID)
+	if err != nil {
+		return ImmutableBareRootMetadata{}, err
+	}
+
+	contentHash, err := j.makeContentHash(rmd, currentUID)
+	if err != nil {
+		return ImmutableBareRootMetadata{}, err
+	}
+
+	// A re-put of content identical to an already-queued
+	// revision, e.g. a retry after an ambiguous error, succeeds
+	// without changing the journal.
+	if head != (ImmutableBareRootMetadata{}) &&
+		rmd.Revision() <= head.RevisionNumber() {
+		existing, ok, err := j.getIdenticalEntry(
+			rmd.Revision(), contentHash)
+		if err != nil {
+			return ImmutableBareRootMetadata{}, err
+		}
+		if ok {
+			j.log.CDebugf(ctx, "Ignoring re-put of identical MD "+
+				"for TLF=%s with rev=%s bid=%s", rmd.TlfID(),
+				rmd.Revision(), rmd.BID())
+			return existing, nil
+		}
+	}
+
+	// Check permissions and consistency with head, if it exists,
+	// unless rmd replaces it.
+	var prev BareRootMetadata
+	if head != (ImmutableBareRootMetadata{}) {
+		prev = head.BareRootMetadata
+	}
+	err = j.checkPutSuccessor(bsplit, currentUID, prev, head.mdID, rmd,
+		prev != nil && rmd.Revision() != head.RevisionNumber())
+	if err != nil {
+		return ImmutableBareRootMetadata{}, err
+	}
+
+	brmd, err := encryptMDPrivateData(
+		ctx, j.codec, j.crypto, signer, ekg,
+		currentUID, rmd.ReadOnly())
+	if err != nil {
+		return ImmutableBareRootMetadata{}, err
+	}
+
+	id, err := j.putMD(brmd, currentUID, currentVerifyingKey)
+	if err != nil {
+		return ImmutableBareRootMetadata{}, err
+	}
+
+	if head != (ImmutableBareRootMetadata{}) &&
+		rmd.Revision() == head.RevisionNumber() {
+		j.log.CDebugf(
+			ctx, "Replacing head MD for TLF=%s with rev=%s bid=%s",
+			rmd.TlfID(), rmd.Revision(), rmd.BID())
+		// This has to be done before the head's entry is
+		// overwritten.
+		j.removeEntryDiskUsage(head.RevisionNumber(), head.mdID)
+		err = j.j.replaceHead(mdIDJournalEntry{
+			ID:            id,
+			CorrelationID: correlationID,
+			ContentHash:   contentHash,
+		})
+		if err != nil {
+			j.diskUsageValid = false
+			return ImmutableBareRootMetadata{}, err
+		}
+	} else {
+		err = j.j.append(brmd.RevisionNumber(), mdIDJournalEntry{
+			ID:            id,
+			CorrelationID: correlationID,
+			ContentHash:   contentHash,
+		})
+		if err != nil {
+			j.diskUsageValid = false
+			return ImmutableBareRootMetadata{}, err
+		}
+	}
+	j.addEntryDiskUsage(brmd.RevisionNumber(), id)
+
+	// Since the journal is now non-empty, clear lastMdID.
+	j.lastMdID = MdID{}
+
+	fi, err := os.Stat(j.mdPath(id))
+	if err != nil {
+		return ImmutableBareRootMetadata{}, err
+	}
+
+	return MakeImmutableBareRootMetadata(brmd, id, fi.ModTime()), nil
+}
+
+// checkBranchBeforePut returns MDJournalStaleBranchError if the
+// journal's branch is already known to be stale. Otherwise, it counts
+// the given number of puts towards the next check with the server
+// for whether it's become stale, and does that check if it's due.
+func (j *mdJournal) checkBranchBeforePut(
+	ctx context.Context, tlfID TlfID, puts int) error {
+	if j.branchID == NullBranchID {
+		return nil
+	}
+
+	if j.staleBranchID == j.branchID {
+		return MDJournalStaleBranchError{j.branchID}
+	}
+
+	if j.staleBranchCheckPeriod > 0 {
+		j.putsSinceBranchCheck += puts
+		if j.putsSinceBranchCheck >= j.staleBranchCheckPeriod {
+			j.putsSinceBranchCheck = 0
+			return j.checkForStaleBranch(
+				ctx, j.staleBranchMDServer, tlfID)
+		}
+	}
+	return nil
+}
+
+// getPutParent returns the head of the journal, if any, along with
+// the MD ID and branch ID that the next MD put onto the journal
+// follows.
+func (j mdJournal) getPutParent() (head ImmutableBareRootMetadata,
+	lastMdID MdID, lastBranchID BranchID, err error) {
+	head, err = j.getLatest()
+	if err != nil {
+		return ImmutableBareRootMetadata{}, MdID{}, NullBranchID, err
+	}
+
+	if head == (ImmutableBareRootMetadata{}) {
+		return head, j.lastMdID, j.branchID, nil
+	}
+	return head, head.mdID, head.BID(), nil
+}
+
+// checkPutBranch checks that rmd, which must already have its branch
+// ID filled in, can be put onto the journal after an MD on the
+// branch with the given ID.
+func (j mdJournal) checkPutBranch(
+	rmd *RootMetadata, lastBranchID BranchID) error {
+	mStatus := rmd.MergedStatus()
+	if (mStatus == Merged) != (rmd.BID() == NullBranchID) {
+		return errors.New("Invalid branch ID")
+	}
+
+	// If we're trying to push a merged MD onto a branch, return a
+	// conflict error so the caller can retry with an unmerged MD.
+	if mStatus == Merged && lastBranchID != NullBranchID {
+		return MDJournalConflictError{}
 	}
 
 	if rmd.BID() != j.branchID {
-		return MdID{}, fmt.Errorf(
-			"Branch ID mismatch: expected %s, got %s",
+		return fmt.Errorf("Branch ID mismatch: expected %s, got %s",
 			j.branchID, rmd.BID())
 	}
+	return nil
+}
+
+// checkPutSuccessor checks that currentUID may put rmd after prev,
+// whose ID is prevID, that rmd is a valid successor of prev if
+// checkSuccessor is set, and that rmd's block changes are unembedded
+// if they need to be. prev is nil if the journal is empty.
+func (j mdJournal) checkPutSuccessor(bsplit BlockSplitter,
+	currentUID keybase1.UID, prev BareRootMetadata, prevID MdID,
+	rmd *RootMetadata, checkSuccessor bool) error {
+	if prev != nil {
+		ok, err := isWriterOrValidRekey(
+			j.codec, currentUID, prev, rmd.bareMd)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// TODO: Use a non-server error.
+			return MDServerErrorUnauthorized{}
+		}
+
+		if checkSuccessor {
+			err = prev.CheckValidSuccessorForServer(prevID, rmd.bareMd)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Ensure that the block changes are properly unembedded.
+	if rmd.data.Changes.Info.BlockPointer == zeroPtr &&
+		!bsplit.ShouldEmbedBlockChanges(&rmd.data.Changes) {
+		return errors.New("MD has embedded block changes, but shouldn't")
+	}
+	return nil
+}
+
+// makeContentHash returns a hash of the content of the given MD, as
+// it would be put by currentUID. Since private data is encrypted with
+// a random nonce, the hash covers the plaintext private data, along
+// with the bare MD minus the serialized private data and writer
+// signature, so that two puts of the same content have the same hash
+// even though they'd have different MdIDs.
+func (j mdJournal) makeContentHash(
+	rmd *RootMetadata, currentUID keybase1.UID) ([]byte, error) {
+	brmdCopy, err := rmd.bareMd.DeepCopy(j.codec)
+	if err != nil {
+		return nil, err
+	}
+	mbrmd, ok := brmdCopy.(MutableBareRootMetadata)
+	if !ok {
+		return nil, MutableBareRootMetadataNoImplError{}
+	}
+	// Normalize the fields that encryptMDPrivateData fills in.
+	mbrmd.SetSerializedPrivateMetadata(nil)
+	mbrmd.SetWriterMetadataSigInfo(SignatureInfo{})
+	if mbrmd.TlfID().IsPublic() || !mbrmd.IsWriterMetadataCopiedSet() {
+		mbrmd.SetLastModifyingWriter(currentUID)
+	}
+	mbrmd.SetLastModifyingUser(currentUID)
+
+	bareBuf, err := j.codec.Encode(mbrmd)
+	if err != nil {
+		return nil, err
+	}
+	dataBuf, err := j.codec.Encode(rmd.data)
+	if err != nil {
+		return nil, err
+	}
+	h, err := DefaultHash(append(bareBuf, dataBuf...))
+	if err != nil {
+		return nil, err
+	}
+	return h.Bytes(), nil
+}
+
+// getIdenticalEntry returns the MD in the journal with the given
+// revision, along with true, if it was put with the given content
+// hash.
+func (j mdJournal) getIdenticalEntry(
+	r MetadataRevision, contentHash []byte) (
+	ImmutableBareRootMetadata, bool, error) {
+	earliestRevision, err := j.j.readEarliestRevision()
+	if err != nil {
+		return ImmutableBareRootMetadata{}, false, err
+	}
+	if earliestRevision == MetadataRevisionUninitialized ||
+		r < earliestRevision {
+		return ImmutableBareRootMetadata{}, false, nil
+	}
+
+	entry, err := j.j.readJournalEntry(r)
+	if err != nil {
+		return ImmutableBareRootMetadata{}, false, err
+	}
+	if len(entry.ContentHash) == 0 ||
+		!bytes.Equal(entry.ContentHash, contentHash) {
+		return ImmutableBareRootMetadata{}, false, nil
+	}
+
+	brmd, ts, err := j.getMD(entry.ID)
+	if err != nil {
+		return ImmutableBareRootMetadata{}, false, err
+	}
+	return MakeImmutableBareRootMetadata(brmd, entry.ID, ts), true, nil
+}
+
+// putRange is like calling put on each of the given RootMetadata
+// objects in order, except that the whole batch is validated before
+// anything is written, and the journal is then extended by a single
+// update. Each RootMetadata after the first must have the next
+// revision; if one has no prev root set, it's set to the ID of the
+// one before it. If any of them fails validation, nothing is
+// written. Unlike put, putRange can't replace the head, and it
+// doesn't modify the given RootMetadata objects.
+func (j *mdJournal) putRange(
+	ctx context.Context, signer cryptoSigner, ekg encryptionKeyGetter,
+	bsplit BlockSplitter, rmds []*RootMetadata, currentUID keybase1.UID,
+	currentVerifyingKey VerifyingKey) (mdIDs []MdID, err error) {
+	if len(rmds) == 0 {
+		return nil, nil
+	}
+
+	first := rmds[0]
+	last := rmds[len(rmds)-1]
+	j.log.CDebugf(ctx, "Putting %d MDs for TLF=%s with revs=%s-%s bid=%s",
+		len(rmds), first.TlfID(), first.Revision(), last.Revision(),
+		first.BID())
+	defer func() {
+		if err != nil {
+			j.deferLog.CDebugf(ctx,
+				"Put %d MDs for TLF=%s with revs=%s-%s bid=%s "+
+					"failed with %v", len(rmds), first.TlfID(),
+				first.Revision(), last.Revision(), first.BID(), err)
+		}
+	}()
+
+	err = j.checkBranchBeforePut(ctx, first.TlfID(), len(rmds))
+	if err != nil {
+		return nil, err
+	}
+
+	head, lastMdID, lastBranchID, err := j.getPutParent()
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate and sign everything before writing anything. This
+	// is done on copies, since filling in the branch IDs and prev
+	// roots and signing modify the MDs, and the given ones
+	// shouldn't be modified if a later one fails.
+	brmds := make([]BareRootMetadata, 0, len(rmds))
+	contentHashes := make([][]byte, 0, len(rmds))
+	var prev BareRootMetadata
+	if head != (ImmutableBareRootMetadata{}) {
+		prev = head.BareRootMetadata
+	}
+	for i, origRmd := range rmds {
+		rmd, err := origRmd.deepCopy(j.codec, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if (rmd.MergedStatus() == Unmerged) && (rmd.BID() == NullBranchID) {
+			rmd.SetBranchID(lastBranchID)
+			rmd.SetPrevRoot(lastMdID)
+		} else if i > 0 && rmd.PrevRoot() == (MdID{}) {
+			rmd.SetPrevRoot(lastMdID)
+		}
+
+		err = j.checkPutBranch(rmd, lastBranchID)
+		if err != nil {
+			return nil, err
+		}
+
+		err = j.checkPutSuccessor(
+			bsplit, currentUID, prev, lastMdID, rmd, true)
+		if err != nil {
+			return nil, err
+		}
+
+		contentHash, err := j.makeContentHash(rmd, currentUID)
+		if err != nil {
+			return nil, err
+		}
+
+		brmd, err := encryptMDPrivateData(
+			ctx, j.codec, j.crypto, signer, ekg,
+			currentUID, rmd.ReadOnly())
+		if err != nil {
+			return nil, err
+		}
 
-	// Check permissions and consistency with head, if it exists.
-	if head != (ImmutableBareRootMetadata{}) {
-		ok, err := isWriterOrValidRekey(
-			j.codec, currentUID, head.BareRootMetadata, rmd.bareMd)
+		err = j.checkMD(brmd, currentUID, currentVerifyingKey)
 		if err != nil {
-			return MdID{}, err
+			return nil, err
 		}
-		if !ok {
-			// TODO: Use a non-server error.
-			return MdID{}, MDServerErrorUnauthorized{}
+
+		id, err := j.crypto.MakeMdID(brmd)
+		if err != nil {
+			return nil, err
 		}
 
-		// Consistency checks
-		if rmd.Revision() != head.RevisionNumber() {
-			err = head.CheckValidSuccessorForServer(head.mdID, rmd.bareMd)
-			if err != nil {
-				return MdID{}, err
-			}
+		brmds = append(brmds, brmd)
+		contentHashes = append(contentHashes, contentHash)
+		mdIDs = append(mdIDs, id)
+		prev = brmd
+		lastMdID = id
+	}
+
+	entries := make([]mdIDJournalEntry, 0, len(brmds))
+	for i, brmd := range brmds {
+		_, err := j.storeMD(brmd)
+		if err != nil {
+			return nil, err
 		}
+		entries = append(entries, mdIDJournalEntry{
+			ID:          mdIDs[i],
+			ContentHash: contentHashes[i],
+		})
 	}
 
-	// Ensure that the block changes are properly unembedded.
-	if rmd.data.Changes.Info.BlockPointer == zeroPtr &&
-		!bsplit.ShouldEmbedBlockChanges(&rmd.data.Changes) {
-		return MdID{},
-			errors.New("MD has embedded block changes, but shouldn't")
+	err = j.j.appendRange(brmds[0].RevisionNumber(), entries)
+	if err != nil {
+		j.diskUsageValid = false
+		return nil, err
+	}
+	for i, brmd := range brmds {
+		j.addEntryDiskUsage(brmd.RevisionNumber(), mdIDs[i])
 	}
 
-	brmd, err := encryptMDPrivateData(
-		ctx, j.codec, j.crypto, signer, ekg,
-		currentUID, rmd.ReadOnly())
+	// Since the journal is now non-empty, clear lastMdID.
+	j.lastMdID = MdID{}
+
+	return mdIDs, nil
+}
+
+// isEarliestFromServer returns whether the earliest entry in the
+// journal was appended via appendFromServer, and so doesn't need to
+// be pushed to the server.
+func (j mdJournal) isEarliestFromServer() (bool, error) {
+	earliestRevision, err := j.j.readEarliestRevision()
 	if err != nil {
-		return MdID{}, err
+		return false, err
+	} else if earliestRevision == MetadataRevisionUninitialized {
+		return false, nil
+	}
+	entry, err := j.j.readJournalEntry(earliestRevision)
+	if err != nil {
+		return false, err
 	}
+	return entry.FromServer, nil
+}
 
-	id, err := j.putMD(brmd, currentUID, currentVerifyingKey)
+// appendFromServer appends the given MD, which must have come from
+// the server, to the journal. The MD must be a valid successor to
+// the current head, if any, and all existing entries must also have
+// come from the server. The appended entry is treated as already
+// flushed, i.e. flushOne will remove it without pushing it to the
+// server. This can be used to maintain a local copy of a TLF's
+// recent history for offline reads.
+func (j *mdJournal) appendFromServer(rmds *RootMetadataSigned) error {
+	brmd := rmds.MD
+	err := brmd.IsValidAndSigned(j.codec, j.crypto)
 	if err != nil {
-		return MdID{}, err
+		return err
 	}
 
-	if head != (ImmutableBareRootMetadata{}) &&
-		rmd.Revision() == head.RevisionNumber() {
-		j.log.CDebugf(
-			ctx, "Replacing head MD for TLF=%s with rev=%s bid=%s",
-			rmd.TlfID(), rmd.Revision(), rmd.BID())
-		err = j.j.replaceHead(id)
-		if err != nil {
-			return MdID{}, err
+	if brmd.BID() != j.branchID {
+		return fmt.Errorf(
+			"Branch ID mismatch: expected %s, got %s",
+			j.branchID, brmd.BID())
+	}
+
+	head, err := j.getLatest()
+	if err != nil {
+		return err
+	}
+
+	if head == (ImmutableBareRootMetadata{}) {
+		if j.lastMdID != (MdID{}) && brmd.GetPrevRoot() != j.lastMdID {
+			return MDPrevRootMismatch{
+				prevRoot:         brmd.GetPrevRoot(),
+				expectedPrevRoot: j.lastMdID,
+			}
 		}
 	} else {
-		err = j.j.append(brmd.RevisionNumber(), id)
+		latestRevision, err := j.j.readLatestRevision()
 		if err != nil {
-			return MdID{}, err
+			return err
+		}
+		entry, err := j.j.readJournalEntry(latestRevision)
+		if err != nil {
+			return err
 		}
+		if !entry.FromServer {
+			return fmt.Errorf(
+				"Cannot append server MD rev=%s onto unflushed "+
+					"journal head rev=%s",
+				brmd.RevisionNumber(), head.RevisionNumber())
+		}
+
+		err = head.CheckValidSuccessorForServer(head.mdID, brmd)
+		if err != nil {
+			return err
+		}
+	}
+
+	id, err := j.crypto.MakeMdID(brmd)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.storeMD(brmd)
+	if err != nil {
+		return err
+	}
+
+	err = j.j.append(brmd.RevisionNumber(), mdIDJournalEntry{
+		ID:         id,
+		FromServer: true,
+	})
+	if err != nil {
+		j.diskUsageValid = false
+		return err
+	}
+	j.addEntryDiskUsage(brmd.RevisionNumber(), id)
+
+	if brmd.BID() != NullBranchID {
+		j.branchOnServer = true
 	}
 
 	// Since the journal is now non-empty, clear lastMdID.
 	j.lastMdID = MdID{}
 
-	return id, nil
+	return nil
 }
 
 func getMdID(ctx context.Context, mdserver MDServer, crypto cryptoPure,
@@ -664,13 +2733,59 @@ func getMdID(ctx context.Context, mdserver MDServer, crypto cryptoPure,
 	return crypto.MakeMdID(rmdses[0].MD)
 }
 
+// isAlreadyFlushed returns whether the MD with the given ID has
+// already been put to mdserver at the given revision of the given
+// branch, e.g. by a put that was canceled but went through anyway.
+// flushOneHelper calls this before putting an MD whose last put was
+// ambiguous, so that it isn't sent again after a reconnect, and after
+// a put fails with a revision conflict: if the server has no MD at
+// that revision, or a different one, then the conflict is real.
+func isAlreadyFlushed(ctx context.Context, mdserver MDServer,
+	tlfID TlfID, bid BranchID, revision MetadataRevision,
+	expectedMdID MdID) (bool, error) {
+	mStatus := Merged
+	if bid != NullBranchID {
+		mStatus = Unmerged
+	}
+	ok, mdID, err := mdserver.HasRevision(
+		ctx, tlfID, bid, mStatus, revision)
+	if err != nil {
+		return false, err
+	}
+	return ok && mdID == expectedMdID, nil
+}
+
+// isAmbiguousPutError returns whether a put that failed with err may
+// still have been stored by the server, i.e. whether err didn't come
+// from the server itself, e.g. because the put was canceled or the
+// connection was lost before the reply arrived.
+func isAmbiguousPutError(err error) bool {
+	_, fromServer := err.(keybase1.ToStatusAble)
+	return !fromServer
+}
+
 // flushOne sends the earliest MD in the journal to the given MDServer
 // if one exists, and then removes it. Returns whether there was an MD
-// that was put.
+// that was put. If a merged MD hits a revision conflict, the server's
+// merged head is refetched, and if the MD is still a valid successor
+// of it, i.e. the conflict was transient, the put is retried, up to
+// conflictRetries times, before the journal is converted to a branch.
 func (j *mdJournal) flushOne(
 	ctx context.Context, signer cryptoSigner, currentUID keybase1.UID,
-	currentVerifyingKey VerifyingKey, mdserver MDServer) (
-	flushed bool, err error) {
+	currentVerifyingKey VerifyingKey, mdserver MDServer,
+	conflictRetries int) (flushed bool, err error) {
+	return j.flushOneHelper(ctx, signer, currentUID, currentVerifyingKey,
+		mdserver, conflictRetries, true)
+}
+
+// flushOneHelper is flushOne, except that if convertOnConflict is
+// false, a merged MD that still conflicts after conflictRetries
+// retries is left in the journal, which isn't converted to a branch,
+// and the conflict error is returned instead.
+func (j *mdJournal) flushOneHelper(
+	ctx context.Context, signer cryptoSigner, currentUID keybase1.UID,
+	currentVerifyingKey VerifyingKey, mdserver MDServer,
+	conflictRetries int, convertOnConflict bool) (flushed bool, err error) {
 	j.log.CDebugf(ctx, "Flushing one MD to server")
 	defer func() {
 		if err != nil {
@@ -678,46 +2793,151 @@ func (j *mdJournal) flushOne(
 		}
 	}()
 
-	rmd, pushErr := j.pushEarliestToServer(ctx, signer, mdserver)
-	if isRevisionConflict(pushErr) {
-		mdID, err := getMdID(
-			ctx, mdserver, j.crypto, rmd.TlfID(), rmd.BID(),
-			rmd.MergedStatus(), rmd.RevisionNumber())
+	fromServer, err := j.isEarliestFromServer()
+	if err != nil {
+		return false, err
+	}
+
+	var rmd ImmutableBareRootMetadata
+	var pushErr error
+	if fromServer {
+		// The server already has this MD, so there's no
+		// need to push it.
+		rmd, err = j.getEarliest()
+		if err != nil {
+			return false, err
+		}
+		j.log.CDebugf(ctx, "Skipping flush of server-sourced MD "+
+			"for TLF=%s with id=%s, rev=%s, bid=%s",
+			rmd.TlfID(), rmd.mdID, rmd.RevisionNumber(), rmd.BID())
+	} else {
+		rmd, err = j.getEarliest()
+		if err != nil {
+			return false, err
+		}
+		if rmd == (ImmutableBareRootMetadata{}) {
+			return false, nil
+		}
+
+		// A put whose reply was lost, e.g. due to a disconnect,
+		// may have gone through anyway, so check with the
+		// server before sending the whole MD again.
+		alreadyFlushed := false
+		if rmd.RevisionNumber() == j.ambiguousPutRevision {
+			alreadyFlushed, err = isAlreadyFlushed(
+				ctx, mdserver, rmd.TlfID(), rmd.BID(),
+				rmd.RevisionNumber(), rmd.mdID)
+			if err != nil {
+				j.log.CWarningf(ctx,
+					"isAlreadyFlushed failed for TLF %s, BID %s, "+
+						"and revision %d: %v",
+					rmd.TlfID(), rmd.BID(), rmd.RevisionNumber(), err)
+				alreadyFlushed = false
+			}
+		}
+		if alreadyFlushed {
+			j.log.CDebugf(ctx, "Skipping flush of already-flushed "+
+				"MD for TLF=%s with id=%s, rev=%s, bid=%s",
+				rmd.TlfID(), rmd.mdID, rmd.RevisionNumber(), rmd.BID())
+		} else {
+			rmd, pushErr = j.pushEarliestToServer(
+				ctx, signer, mdserver)
+		}
+	}
+	conflicts := 0
+	for retries := 0; isRevisionConflict(pushErr); retries++ {
+		j.logFlushConflict(ctx, rmd, pushErr)
+		alreadyFlushed, err := isAlreadyFlushed(
+			ctx, mdserver, rmd.TlfID(), rmd.BID(),
+			rmd.RevisionNumber(), rmd.mdID)
 		if err != nil {
 			j.log.CWarningf(ctx,
-				"getMdID failed for TLF %s, BID %s, and revision %d: %v",
+				"isAlreadyFlushed failed for TLF %s, BID %s, "+
+					"and revision %d: %v",
 				rmd.TlfID(), rmd.BID(), rmd.RevisionNumber(), err)
-		} else if mdID == rmd.mdID {
-			if rmd.mdID == (MdID{}) {
-				panic("nil earliestID and revision conflict error returned by pushEarliestToServer")
-			}
+			break
+		} else if alreadyFlushed {
 			// We must have already flushed this MD, so continue.
 			pushErr = nil
-		} else if rmd.MergedStatus() == Merged {
+		} else if rmd.MergedStatus() != Merged {
+			break
+		} else if retries < conflictRetries &&
+			j.canRetryConflictedPut(ctx, mdserver, rmd) {
+			conflicts++
+			j.log.CDebugf(ctx, "Conflict detected %v; retrying "+
+				"(%d of %d)", pushErr, retries+1, conflictRetries)
+
+			rmd, pushErr = j.pushEarliestToServer(
+				ctx, signer, mdserver)
+		} else if !convertOnConflict {
+			j.log.CDebugf(ctx, "Conflict detected %v; not converting "+
+				"to a branch", pushErr)
+			break
+		} else {
+			conflicts++
 			j.log.CDebugf(ctx, "Conflict detected %v", pushErr)
 
 			err := j.convertToBranch(
-				ctx, signer, currentUID, currentVerifyingKey)
+				ctx, signer, currentUID, currentVerifyingKey,
+				MDJournalBranchReasonConflict)
 			if err != nil {
 				return false, err
 			}
 
 			rmd, pushErr = j.pushEarliestToServer(
 				ctx, signer, mdserver)
+			break
 		}
 	}
 	if pushErr != nil {
+		if rmd != (ImmutableBareRootMetadata{}) &&
+			isAmbiguousPutError(pushErr) {
+			j.ambiguousPutRevision = rmd.RevisionNumber()
+		}
 		return false, pushErr
 	}
 	if rmd.mdID == (MdID{}) {
 		return false, nil
 	}
+	j.ambiguousPutRevision = MetadataRevisionUninitialized
+
+	// Measure the entry before it's removed from the journal.
+	var flushedBytes uint64
+	if !fromServer {
+		flushedBytes, err = j.entryDiskUsage(
+			rmd.RevisionNumber(), rmd.mdID)
+		if err != nil {
+			j.log.CDebugf(ctx, "Couldn't get disk usage of flushed "+
+				"MD %s: %v", rmd.mdID, err)
+			flushedBytes = 0
+		}
+	}
 
 	empty, err := j.j.removeEarliest()
 	if err != nil {
+		j.diskUsageValid = false
 		return false, err
 	}
 
+	if empty {
+		j.diskUsageBytes = 0
+		j.diskUsageValid = true
+	} else {
+		j.removeEntryDiskUsage(rmd.RevisionNumber(), rmd.mdID)
+	}
+
+	if rmd.BID() != NullBranchID && rmd.BID() == j.branchID {
+		j.branchOnServer = true
+	}
+
+	if !fromServer {
+		j.log.CDebugf(ctx, "Flushed MD for TLF=%s with id=%s, rev=%s, "+
+			"bid=%s, mStatus=%s, size=%d, conflicts=%d",
+			rmd.TlfID(), rmd.mdID, rmd.RevisionNumber(), rmd.BID(),
+			rmd.MergedStatus(), flushedBytes, conflicts)
+		j.recordFlush(flushedBytes, conflicts)
+	}
+
 	// Since the journal is now empty, set lastMdID.
 	if empty {
 		j.log.CDebugf(ctx,
@@ -728,6 +2948,164 @@ func (j *mdJournal) flushOne(
 	return true, nil
 }
 
+// canRetryConflictedPut refetches the server's merged head, and
+// returns whether rmd is still a valid successor of it, so that
+// putting rmd again may succeed.
+func (j *mdJournal) canRetryConflictedPut(ctx context.Context,
+	mdserver MDServer, rmd ImmutableBareRootMetadata) bool {
+	head, err := mdserver.GetForTLF(
+		ctx, rmd.TlfID(), NullBranchID, Merged)
+	if err != nil {
+		j.log.CDebugf(ctx, "Couldn't refetch merged head: %v", err)
+		return false
+	}
+	if head == nil {
+		return true
+	}
+	headID, err := j.crypto.MakeMdID(head.MD)
+	if err != nil {
+		j.log.CDebugf(ctx, "Couldn't get ID of merged head: %v", err)
+		return false
+	}
+	err = head.MD.CheckValidSuccessorForServer(headID, rmd.BareRootMetadata)
+	if err != nil {
+		j.log.CDebugf(ctx, "Not retrying conflicted put of rev=%s "+
+			"onto head rev=%s: %v", rmd.RevisionNumber(),
+			head.MD.RevisionNumber(), err)
+		return false
+	}
+	return true
+}
+
+// logFlushConflict logs the conflict error pushErr that the server
+// returned for a put of rmd, including the server's expected and
+// actual revisions, if it gave them.
+func (j *mdJournal) logFlushConflict(ctx context.Context,
+	rmd ImmutableBareRootMetadata, pushErr error) {
+	if e, ok := pushErr.(MDServerErrorConflictRevision); ok {
+		j.log.CDebugf(ctx, "Flush conflict for TLF=%s with id=%s, "+
+			"rev=%s, bid=%s, mStatus=%s: expected rev=%s, "+
+			"actual rev=%s", rmd.TlfID(), rmd.mdID,
+			rmd.RevisionNumber(), rmd.BID(), rmd.MergedStatus(),
+			e.Expected, e.Actual)
+		return
+	}
+	j.log.CDebugf(ctx, "Flush conflict for TLF=%s with id=%s, "+
+		"rev=%s, bid=%s, mStatus=%s: %v", rmd.TlfID(), rmd.mdID,
+		rmd.RevisionNumber(), rmd.BID(), rmd.MergedStatus(), pushErr)
+}
+
+// flushUntil flushes MDs from the front of the journal, as flushOne
+// does, until every MD with a revision up to and including targetRev
+// has been flushed or the journal is empty, and returns how many MDs
+// it flushed. It stops at the first conflict without converting the
+// journal to a branch, leaving the conflicting MD and everything
+// after it in the journal, and returns the number flushed so far
+// along with the conflict error, for which isRevisionConflict
+// returns true.
+func (j *mdJournal) flushUntil(
+	ctx context.Context, signer cryptoSigner, currentUID keybase1.UID,
+	currentVerifyingKey VerifyingKey, mdserver MDServer,
+	targetRev MetadataRevision) (flushed int, err error) {
+	for {
+		earliestRevision, err := j.readEarliestRevision()
+		if err != nil {
+			return flushed, err
+		}
+		if earliestRevision == MetadataRevisionUninitialized ||
+			earliestRevision > targetRev {
+			return flushed, nil
+		}
+
+		ok, err := j.flushOneHelper(ctx, signer, currentUID,
+			currentVerifyingKey, mdserver, 0, false)
+		if err != nil {
+			return flushed, err
+		}
+		if !ok {
+			return flushed, nil
+		}
+		flushed++
+	}
+}
+
+// flushOnePreview reports what flushOne would do with the earliest
+// MD in the journal, without pushing anything to mdserver or
+// modifying the journal: whether there is an MD to flush, and
+// whether pushing it is expected to hit a conflict, which for a
+// merged MD means the journal would be converted to a branch. The
+// check is done with mdserver.TrialPut, so it's only as accurate as
+// the server's view at the time of the call.
+func (j mdJournal) flushOnePreview(
+	ctx context.Context, signer cryptoSigner, currentUID keybase1.UID,
+	currentVerifyingKey VerifyingKey, mdserver MDServer) (
+	wouldFlush bool, expectConflict bool, err error) {
+	j.log.CDebugf(ctx, "Previewing flush of one MD to server")
+	defer func() {
+		if err != nil {
+			j.deferLog.CDebugf(ctx, "Flush preview failed with %v", err)
+		}
+	}()
+
+	rmd, err := j.getEarliest()
+	if err != nil {
+		return false, false, err
+	}
+	if rmd == (ImmutableBareRootMetadata{}) {
+		return false, false, nil
+	}
+
+	fromServer, err := j.isEarliestFromServer()
+	if err != nil {
+		return false, false, err
+	}
+	if fromServer {
+		// flushOne would just drop this MD from the journal.
+		return true, false, nil
+	}
+
+	err = rmd.IsLastModifiedBy(currentUID, currentVerifyingKey)
+	if err != nil {
+		return false, false, err
+	}
+
+	mbrmd, ok := rmd.BareRootMetadata.(MutableBareRootMetadata)
+	if !ok {
+		return false, false, MutableBareRootMetadataNoImplError{}
+	}
+
+	rmds := RootMetadataSigned{MD: mbrmd}
+	err = signMD(ctx, j.codec, signer, &rmds)
+	if err != nil {
+		return false, false, err
+	}
+
+	trialErr := mdserver.TrialPut(ctx, &rmds)
+	if trialErr == nil {
+		return true, false, nil
+	}
+	if !isRevisionConflict(trialErr) {
+		return false, false, trialErr
+	}
+
+	// As in flushOne, the conflict may just be because this MD
+	// was already flushed.
+	alreadyFlushed, err := isAlreadyFlushed(
+		ctx, mdserver, rmd.TlfID(), rmd.BID(),
+		rmd.RevisionNumber(), rmd.mdID)
+	if err != nil {
+		return false, false, err
+	}
+	if alreadyFlushed {
+		return true, false, nil
+	}
+
+	j.log.CDebugf(ctx, "Flush of MD for TLF=%s with rev=%s bid=%s "+
+		"would conflict: %v", rmd.TlfID(), rmd.RevisionNumber(),
+		rmd.BID(), trialErr)
+	return true, true, nil
+}
+
 func (j *mdJournal) clear(
 	ctx context.Context, currentUID keybase1.UID, bid BranchID) (
 	err error) {
@@ -755,8 +3133,127 @@ func (j *mdJournal) clear(
 	}
 
 	j.branchID = NullBranchID
+	j.branchReason = MDJournalBranchReasonUnknown
+	j.branchOnServer = false
 
 	// No need to set lastMdID in this case.
 
-	return j.j.clear()
+	err = j.j.clear()
+	if err != nil {
+		j.diskUsageValid = false
+		return err
+	}
+	j.diskUsageBytes = 0
+	j.diskUsageValid = true
+	return nil
+}
+
+// clearRange removes the revisions from start to stop, inclusive,
+// from the journal if its head is on the given branch. The range
+// must be a suffix of the journal, so that what remains is still a
+// valid chain ending at a real head; otherwise,
+// MDJournalClearRangeError is returned. The journal's branch ID is
+// preserved unless every entry is cleared.
+func (j *mdJournal) clearRange(
+	ctx context.Context, currentUID keybase1.UID, bid BranchID,
+	start, stop MetadataRevision) (err error) {
+	j.log.CDebugf(ctx, "Clearing revisions %s to %s for branch %s",
+		start, stop, bid)
+	defer func() {
+		if err != nil {
+			j.deferLog.CDebugf(ctx,
+				"Clearing revisions %s to %s for branch %s failed with %v",
+				start, stop, bid, err)
+		}
+	}()
+
+	head, err := j.getHead(currentUID)
+	if err != nil {
+		return err
+	}
+
+	if head == (ImmutableBareRootMetadata{}) || head.BID() != bid {
+		// Nothing to do.
+		return nil
+	}
+
+	earliest, err := j.j.readEarliestRevision()
+	if err != nil {
+		return err
+	}
+	latest := head.RevisionNumber()
+
+	if start > stop || start < earliest || stop != latest {
+		return MDJournalClearRangeError{start, stop, earliest, latest}
+	}
+
+	j.diskUsageValid = false
+
+	if start == earliest {
+		j.branchID = NullBranchID
+		j.branchReason = MDJournalBranchReasonUnknown
+		j.branchOnServer = false
+		err = j.j.clear()
+	} else {
+		err = j.j.writeLatestRevision(start - 1)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Remove the cleared entries too, so that compact doesn't
+	// treat their MDs as live, and later appends don't land on
+	// stale files.
+	return j.j.removeEntriesFrom(start)
+}
+
+// errMDJournalTruncateBeforeEarliest is returned by truncateAfter when
+// asked to truncate to a revision before the journal's earliest one.
+var errMDJournalTruncateBeforeEarliest = errors.New(
+	"Cannot truncate MD journal before its earliest revision")
+
+// truncateAfter removes every entry with a revision greater than rev
+// from the journal, so that rev becomes the new head. Since at least
+// one entry is always kept, the journal's branch ID is preserved. If
+// rev is before the earliest entry, nothing is removed and
+// errMDJournalTruncateBeforeEarliest is returned; if rev is at or
+// beyond the head, or the journal is empty, nothing is removed.
+func (j *mdJournal) truncateAfter(
+	ctx context.Context, currentUID keybase1.UID, rev MetadataRevision) (
+	err error) {
+	j.log.CDebugf(ctx, "Truncating journal after revision %s", rev)
+	defer func() {
+		if err != nil {
+			j.deferLog.CDebugf(ctx,
+				"Truncating journal after revision %s failed with %v",
+				rev, err)
+		}
+	}()
+
+	head, err := j.getHead(currentUID)
+	if err != nil {
+		return err
+	}
+
+	if head == (ImmutableBareRootMetadata{}) {
+		// Nothing to do.
+		return nil
+	}
+
+	earliest, err := j.j.readEarliestRevision()
+	if err != nil {
+		return err
+	}
+
+	if rev < earliest {
+		return errMDJournalTruncateBeforeEarliest
+	}
+
+	if rev >= head.RevisionNumber() {
+		// Nothing to do.
+		return nil
+	}
+
+	return j.clearRange(
+		ctx, currentUID, head.BID(), rev+1, head.RevisionNumber())
 }
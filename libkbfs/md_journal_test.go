@@ -5,10 +5,15 @@
 package libkbfs
 
 import (
+	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -50,6 +55,8 @@ func setupMDJournalTest(t *testing.T) (
 	signer = cryptoSignerLocal{signingKey}
 	verifyingKey = signingKey.GetVerifyingKey()
 	ekg = singleEncryptionKeyGetter{MakeTLFCryptKey([32]byte{0x1})}
+	bsplit, err = NewBlockSplitterSimpleExact(64*1024, 8*1024)
+	require.NoError(t, err)
 
 	// Do this last so we don't have to worry about cleaning up
 	// the tempdir if anything else errors.
@@ -60,8 +67,6 @@ func setupMDJournalTest(t *testing.T) (
 	j, err = makeMDJournal(codec, crypto, tempdir, log)
 	require.NoError(t, err)
 
-	bsplit = &BlockSplitterSimple{64 * 1024, 8 * 1024}
-
 	return codec, crypto, uid, id, h, signer, verifyingKey, ekg,
 		bsplit, tempdir, j
 }
@@ -83,6 +88,26 @@ func makeMDForTest(t *testing.T, id TlfID, h BareTlfHandle,
 	return md
 }
 
+// putMDRangeForTest puts mdCount MDs with consecutive revisions,
+// starting at firstRevision, into j. The first one's prev root is
+// set to firstPrevRoot, and the ID of the last one is returned.
+func putMDRangeForTest(t *testing.T, j *mdJournal, signer cryptoSigner,
+	ekg encryptionKeyGetter, bsplit BlockSplitter, id TlfID,
+	h BareTlfHandle, uid keybase1.UID, verifyingKey VerifyingKey,
+	firstRevision MetadataRevision, firstPrevRoot MdID,
+	mdCount int) MdID {
+	ctx := context.Background()
+	prevRoot := firstPrevRoot
+	for i := 0; i < mdCount; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+		require.NoError(t, err)
+		prevRoot = mdID
+	}
+	return prevRoot
+}
+
 func TestMDJournalBasic(t *testing.T) {
 	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
 		setupMDJournalTest(t)
@@ -180,6 +205,148 @@ func TestMDJournalReplaceHead(t *testing.T) {
 	require.Equal(t, md.DiskUsage(), head.DiskUsage())
 }
 
+func TestMDJournalCompact(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	// Nothing to do for an empty journal.
+	reclaimed, err := j.compact(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), reclaimed)
+
+	firstRevision := MetadataRevision(10)
+	firstPrevRoot := fakeMdID(1)
+	mdCount := 3
+
+	prevRoot := putMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, firstRevision, firstPrevRoot,
+		mdCount)
+
+	// Nothing is orphaned yet.
+	reclaimed, err = j.compact(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), reclaimed)
+
+	// Replace the head a few times, orphaning each replaced MD.
+	revision := firstRevision + MetadataRevision(mdCount) - 1
+	first, err := j.getEarliest()
+	require.NoError(t, err)
+	mds, err := j.getRange(uid, firstRevision, revision)
+	require.NoError(t, err)
+	prevRoot = mds[len(mds)-2].mdID
+	var orphanedPaths []string
+	var orphanedBytes uint64
+	for i := 0; i < 3; i++ {
+		head, err := j.getHead(uid)
+		require.NoError(t, err)
+		fi, err := os.Stat(j.mdPath(head.mdID))
+		require.NoError(t, err)
+		orphanedPaths = append(orphanedPaths, j.mdPath(head.mdID))
+		orphanedBytes += uint64(fi.Size())
+
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		md.SetDiskUsage(uint64(501 + i))
+		_, err = j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+		require.NoError(t, err)
+	}
+
+	reclaimed, err = j.compact(ctx)
+	require.NoError(t, err)
+	require.Equal(t, orphanedBytes, reclaimed)
+	for _, p := range orphanedPaths {
+		_, err := os.Stat(p)
+		require.True(t, os.IsNotExist(err), p)
+	}
+
+	// The live chain is untouched.
+	mds, err = j.getRange(uid, firstRevision, revision)
+	require.NoError(t, err)
+	require.Equal(t, mdCount, len(mds))
+	require.Equal(t, first.mdID, mds[0].mdID)
+	require.Equal(t, uint64(503), mds[len(mds)-1].DiskUsage())
+
+	// A second pass has nothing left to do.
+	reclaimed, err = j.compact(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), reclaimed)
+}
+
+func TestMDJournalIdenticalReput(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	firstPrevRoot := fakeMdID(1)
+	mdCount := 3
+
+	var mds []*RootMetadata
+	var mdIDs []MdID
+	prevRoot := firstPrevRoot
+	for i := 0; i < mdCount; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+		require.NoError(t, err)
+		mds = append(mds, md)
+		mdIDs = append(mdIDs, mdID)
+		prevRoot = mdID
+	}
+
+	// Re-putting the same MD object, or an identical new one, for
+	// any queued revision should return the existing ID without
+	// changing the journal.
+	for i := 0; i < mdCount; i++ {
+		mdID, err := j.put(
+			ctx, signer, ekg, bsplit, mds[i], uid, verifyingKey)
+		require.NoError(t, err)
+		require.Equal(t, mdIDs[i], mdID)
+
+		prevRoot := firstPrevRoot
+		if i > 0 {
+			prevRoot = mdIDs[i-1]
+		}
+		md := makeMDForTest(
+			t, id, h, mds[i].Revision(), uid, prevRoot)
+		mdID, err = j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+		require.NoError(t, err)
+		require.Equal(t, mdIDs[i], mdID)
+
+		require.Equal(t, mdCount, getTlfJournalLength(t, j))
+	}
+
+	head, err := j.getHead(uid)
+	require.NoError(t, err)
+	require.Equal(t, mdIDs[mdCount-1], head.mdID)
+
+	// A head with the same revision but different content should
+	// still replace the head.
+	md := makeMDForTest(t, id, h, mds[mdCount-1].Revision(), uid,
+		mdIDs[mdCount-2])
+	md.SetDiskUsage(501)
+	mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.NoError(t, err)
+	require.NotEqual(t, mdIDs[mdCount-1], mdID)
+	require.Equal(t, mdCount, getTlfJournalLength(t, j))
+
+	head, err = j.getHead(uid)
+	require.NoError(t, err)
+	require.Equal(t, mdID, head.mdID)
+	require.Equal(t, uint64(501), head.DiskUsage())
+
+	// A different MD for an earlier revision is still rejected.
+	md = makeMDForTest(t, id, h, firstRevision, uid, firstPrevRoot)
+	md.SetDiskUsage(501)
+	_, err = j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.Error(t, err)
+	require.Equal(t, mdCount, getTlfJournalLength(t, j))
+}
+
 func TestMDJournalBranchConversion(t *testing.T) {
 	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
 		setupMDJournalTest(t)
@@ -200,7 +367,8 @@ func TestMDJournalBranchConversion(t *testing.T) {
 		prevRoot = mdID
 	}
 
-	err := j.convertToBranch(ctx, signer, uid, verifyingKey)
+	err := j.convertToBranch(ctx, signer, uid, verifyingKey,
+		MDJournalBranchReasonExplicitFork)
 	require.NoError(t, err)
 
 	ibrmds, err := j.getRange(
@@ -238,6 +406,95 @@ func TestMDJournalBranchConversion(t *testing.T) {
 	require.Equal(t, ibrmds[len(ibrmds)-1], head)
 }
 
+// Tests that rewriting the journal (here, to convert it to a
+// branch) turns its temp dir into the new journal, rather than
+// leaving it behind.
+func TestMDJournalRewriteNoTempDir(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	putMDRangeForTest(t, j, signer, ekg, bsplit, id, h, uid,
+		verifyingKey, MetadataRevision(10), fakeMdID(1), 3)
+
+	before, err := ioutil.ReadDir(tempdir)
+	require.NoError(t, err)
+	beforeNames := make(map[string]bool)
+	for _, fi := range before {
+		beforeNames[fi.Name()] = true
+	}
+
+	err = j.convertToBranch(ctx, signer, uid, verifyingKey,
+		MDJournalBranchReasonExplicitFork)
+	require.NoError(t, err)
+
+	// Apart from the branch reason, the only new entry should be
+	// the old journal, which is moved to the temp dir's name plus
+	// ".old".
+	after, err := ioutil.ReadDir(tempdir)
+	require.NoError(t, err)
+	for _, fi := range after {
+		name := fi.Name()
+		if beforeNames[name] ||
+			filepath.Join(tempdir, name) == j.branchReasonPath() {
+			continue
+		}
+		require.True(t, strings.HasSuffix(name, ".old"),
+			"Temp dir %s left behind", name)
+	}
+}
+
+func TestMDJournalPreviewConvertToBranch(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	count, forkFrom, err := j.previewConvertToBranch()
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+	require.Equal(t, MetadataRevisionUninitialized, forkFrom)
+
+	firstRevision := MetadataRevision(10)
+	firstPrevRoot := fakeMdID(1)
+	mdCount := 10
+
+	prevRoot := putMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, firstRevision, firstPrevRoot,
+		mdCount)
+
+	count, forkFrom, err = j.previewConvertToBranch()
+	require.NoError(t, err)
+	require.Equal(t, mdCount, count)
+	require.Equal(t, firstRevision-1, forkFrom)
+
+	// The preview shouldn't have changed anything.
+	head, err := j.getHead(uid)
+	require.NoError(t, err)
+	require.Equal(t, Merged, head.MergedStatus())
+	require.Equal(t, prevRoot, head.mdID)
+
+	err = j.convertToBranch(ctx, signer, uid, verifyingKey,
+		MDJournalBranchReasonExplicitFork)
+	require.NoError(t, err)
+
+	ibrmds, err := j.getRange(
+		uid, 1, firstRevision+MetadataRevision(2*mdCount))
+	require.NoError(t, err)
+	require.Equal(t, count, len(ibrmds))
+	require.Equal(t, forkFrom+1, ibrmds[0].RevisionNumber())
+	for _, ibrmd := range ibrmds {
+		require.Equal(t, Unmerged, ibrmd.MergedStatus())
+	}
+
+	// A journal that's already on a branch can't be converted.
+	_, _, err = j.previewConvertToBranch()
+	require.Error(t, err)
+}
+
 type limitedCryptoSigner struct {
 	cryptoSigner
 	remaining int
@@ -274,7 +531,8 @@ func TestMDJournalBranchConversionAtomic(t *testing.T) {
 
 	limitedSigner := limitedCryptoSigner{signer, 5}
 
-	err := j.convertToBranch(ctx, &limitedSigner, uid, verifyingKey)
+	err := j.convertToBranch(ctx, &limitedSigner, uid, verifyingKey,
+		MDJournalBranchReasonExplicitFork)
 	require.NotNil(t, err)
 
 	// All entries should remain unchanged, since the conversion
@@ -314,9 +572,38 @@ func TestMDJournalBranchConversionAtomic(t *testing.T) {
 
 type shimMDServer struct {
 	MDServer
-	rmdses       []*RootMetadataSigned
-	nextGetRange []*RootMetadataSigned
-	nextErr      error
+	rmdses         []*RootMetadataSigned
+	nextGetRange   []*RootMetadataSigned
+	nextErr        error
+	prunedBranches map[BranchID]bool
+	hasRevisions   int
+}
+
+func (s *shimMDServer) GetForTLF(
+	ctx context.Context, id TlfID, bid BranchID, mStatus MergeStatus) (
+	*RootMetadataSigned, error) {
+	// Return the latest put MD with the given merge status, unless
+	// its branch has been pruned.
+	for i := len(s.rmdses) - 1; i >= 0; i-- {
+		rmds := s.rmdses[i]
+		if rmds.MD.MergedStatus() != mStatus {
+			continue
+		}
+		if s.prunedBranches[rmds.MD.BID()] {
+			return nil, nil
+		}
+		return rmds, nil
+	}
+	return nil, nil
+}
+
+func (s *shimMDServer) PruneBranch(
+	ctx context.Context, id TlfID, bid BranchID) error {
+	if s.prunedBranches == nil {
+		s.prunedBranches = make(map[BranchID]bool)
+	}
+	s.prunedBranches[bid] = true
+	return nil
 }
 
 func (s *shimMDServer) GetRange(
@@ -327,6 +614,21 @@ func (s *shimMDServer) GetRange(
 	return rmdses, nil
 }
 
+func (s *shimMDServer) HasRevision(
+	ctx context.Context, id TlfID, bid BranchID, mStatus MergeStatus,
+	rev MetadataRevision) (bool, MdID, error) {
+	s.hasRevisions++
+	rmdses, err := s.GetRange(ctx, id, bid, mStatus, rev, rev)
+	if err != nil || len(rmdses) == 0 {
+		return false, MdID{}, err
+	}
+	mdID, err := MakeCryptoCommon(NewCodecMsgpack()).MakeMdID(rmdses[0].MD)
+	if err != nil {
+		return false, MdID{}, err
+	}
+	return true, mdID, nil
+}
+
 func (s *shimMDServer) Put(
 	ctx context.Context, rmds *RootMetadataSigned) error {
 	if s.nextErr != nil {
@@ -345,6 +647,66 @@ func (s *shimMDServer) Put(
 	return nil
 }
 
+// TrialPut returns nextErr, if set, without consuming it, since
+// nothing is put.
+func (s *shimMDServer) TrialPut(
+	ctx context.Context, rmds *RootMetadataSigned) error {
+	return s.nextErr
+}
+
+func TestMDJournalFlushUntil(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	mdCount := 10
+	putMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, firstRevision, fakeMdID(1),
+		mdCount)
+
+	var mdserver shimMDServer
+
+	flushed, err := j.flushUntil(
+		ctx, signer, uid, verifyingKey, &mdserver, firstRevision+3)
+	require.NoError(t, err)
+	require.Equal(t, 4, flushed)
+	require.Equal(t, 4, len(mdserver.rmdses))
+	require.Equal(t, mdCount-4, getTlfJournalLength(t, j))
+	earliest, err := j.readEarliestRevision()
+	require.NoError(t, err)
+	require.Equal(t, firstRevision+4, earliest)
+
+	// A target that's already been flushed is a no-op.
+	flushed, err = j.flushUntil(
+		ctx, signer, uid, verifyingKey, &mdserver, firstRevision)
+	require.NoError(t, err)
+	require.Equal(t, 0, flushed)
+
+	// A conflict should stop the flush and leave the journal
+	// alone.
+	mdserver.nextErr = MDServerErrorConflictRevision{}
+	flushed, err = j.flushUntil(
+		ctx, signer, uid, verifyingKey, &mdserver, firstRevision+7)
+	require.True(t, isRevisionConflict(err))
+	require.Equal(t, 0, flushed)
+	require.Equal(t, mdCount-4, getTlfJournalLength(t, j))
+	require.Equal(t, NullBranchID, j.branchID)
+	head, err := j.getHead(uid)
+	require.NoError(t, err)
+	require.Equal(t, Merged, head.MergedStatus())
+
+	// Flushing past the end should empty the journal.
+	flushed, err = j.flushUntil(ctx, signer, uid, verifyingKey, &mdserver,
+		firstRevision+MetadataRevision(2*mdCount))
+	require.NoError(t, err)
+	require.Equal(t, mdCount-4, flushed)
+	require.Equal(t, mdCount, len(mdserver.rmdses))
+	require.Equal(t, 0, getTlfJournalLength(t, j))
+}
+
 func TestMDJournalFlushBasic(t *testing.T) {
 	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
 		setupMDJournalTest(t)
@@ -369,11 +731,11 @@ func TestMDJournalFlushBasic(t *testing.T) {
 	var mdserver shimMDServer
 	for i := 0; i < mdCount; i++ {
 		flushed, err := j.flushOne(
-			ctx, signer, uid, verifyingKey, &mdserver)
+			ctx, signer, uid, verifyingKey, &mdserver, 0)
 		require.NoError(t, err)
 		require.True(t, flushed)
 	}
-	flushed, err := j.flushOne(ctx, signer, uid, verifyingKey, &mdserver)
+	flushed, err := j.flushOne(ctx, signer, uid, verifyingKey, &mdserver, 0)
 	require.NoError(t, err)
 	require.False(t, flushed)
 	require.Equal(t, 0, getTlfJournalLength(t, j))
@@ -402,6 +764,61 @@ func TestMDJournalFlushBasic(t *testing.T) {
 	}
 }
 
+func TestMDJournalFlushOnePreview(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	var mdserver shimMDServer
+
+	// Nothing to flush yet.
+	wouldFlush, expectConflict, err := j.flushOnePreview(
+		ctx, signer, uid, verifyingKey, &mdserver)
+	require.NoError(t, err)
+	require.False(t, wouldFlush)
+	require.False(t, expectConflict)
+
+	firstRevision := MetadataRevision(10)
+	mdCount := 2
+	putMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, firstRevision, fakeMdID(1),
+		mdCount)
+
+	wouldFlush, expectConflict, err = j.flushOnePreview(
+		ctx, signer, uid, verifyingKey, &mdserver)
+	require.NoError(t, err)
+	require.True(t, wouldFlush)
+	require.False(t, expectConflict)
+
+	// A conflict should be predicted, without converting the
+	// journal to a branch.
+	mdserver.nextErr = MDServerErrorConflictRevision{}
+	wouldFlush, expectConflict, err = j.flushOnePreview(
+		ctx, signer, uid, verifyingKey, &mdserver)
+	require.NoError(t, err)
+	require.True(t, wouldFlush)
+	require.True(t, expectConflict)
+	require.Equal(t, NullBranchID, j.branchID)
+
+	// If the server already has the MD, there's no conflict.
+	earliest, err := j.getEarliest()
+	require.NoError(t, err)
+	mdserver.nextGetRange = []*RootMetadataSigned{{
+		MD: earliest.BareRootMetadata.(MutableBareRootMetadata)}}
+	wouldFlush, expectConflict, err = j.flushOnePreview(
+		ctx, signer, uid, verifyingKey, &mdserver)
+	require.NoError(t, err)
+	require.True(t, wouldFlush)
+	require.False(t, expectConflict)
+
+	// Nothing should have been put or removed.
+	require.Len(t, mdserver.rmdses, 0)
+	require.Equal(t, mdCount, getTlfJournalLength(t, j))
+	require.Equal(t, MDServerErrorConflictRevision{}, mdserver.nextErr)
+}
+
 func TestMDJournalFlushConflict(t *testing.T) {
 	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
 		setupMDJournalTest(t)
@@ -428,7 +845,7 @@ func TestMDJournalFlushConflict(t *testing.T) {
 	// Simulate a flush with a conflict error halfway through.
 	{
 		flushed, err := j.flushOne(
-			ctx, signer, uid, verifyingKey, &mdserver)
+			ctx, signer, uid, verifyingKey, &mdserver, 0)
 		require.NoError(t, err)
 		require.True(t, flushed)
 
@@ -455,11 +872,11 @@ func TestMDJournalFlushConflict(t *testing.T) {
 	// Flush remaining entries.
 	for i := 0; i < mdCount-1; i++ {
 		flushed, err := j.flushOne(
-			ctx, signer, uid, verifyingKey, &mdserver)
+			ctx, signer, uid, verifyingKey, &mdserver, 0)
 		require.NoError(t, err)
 		require.True(t, flushed)
 	}
-	flushed, err := j.flushOne(ctx, signer, uid, verifyingKey, &mdserver)
+	flushed, err := j.flushOne(ctx, signer, uid, verifyingKey, &mdserver, 0)
 	require.NoError(t, err)
 	require.False(t, flushed)
 	require.Equal(t, 0, getTlfJournalLength(t, j))
@@ -494,69 +911,331 @@ func TestMDJournalFlushConflict(t *testing.T) {
 	}
 }
 
-// TestMDJournalPreservesBranchID tests that the branch ID is
-// preserved even if the journal is fully drained. This is a
-// regression test for KBFS-1344.
-func TestMDJournalPreservesBranchID(t *testing.T) {
-	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+func TestMDJournalFlushConflictRetry(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
 		setupMDJournalTest(t)
 	defer teardownMDJournalTest(t, tempdir)
 
 	ctx := context.Background()
 
-	firstRevision := MetadataRevision(10)
-	firstPrevRoot := fakeMdID(1)
-	mdCount := 10
-
-	prevRoot := firstPrevRoot
-	for i := 0; i < mdCount-1; i++ {
-		revision := firstRevision + MetadataRevision(i)
-		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
-		mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
-		require.NoError(t, err)
-		prevRoot = mdID
-	}
+	md := makeMDForTest(t, id, h, MetadataRevision(10), uid, fakeMdID(1))
+	mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.NoError(t, err)
 
+	// The first put hits a transient conflict, but the retry
+	// should go through without forking.
 	var mdserver shimMDServer
 	mdserver.nextErr = MDServerErrorConflictRevision{}
 
-	// Flush all entries, with the first one encountering a
-	// conflict error.
-	for i := 0; i < mdCount-1; i++ {
-		flushed, err := j.flushOne(
-			ctx, signer, uid, verifyingKey, &mdserver)
-		require.NoError(t, err)
-		require.True(t, flushed)
-	}
-
-	flushed, err := j.flushOne(ctx, signer, uid, verifyingKey, &mdserver)
+	flushed, err := j.flushOne(ctx, signer, uid, verifyingKey, &mdserver, 1)
 	require.NoError(t, err)
-	require.False(t, flushed)
+	require.True(t, flushed)
+	require.Equal(t, NullBranchID, j.branchID)
 	require.Equal(t, 0, getTlfJournalLength(t, j))
 
-	// Put last revision and flush it.
-	{
-		revision := firstRevision + MetadataRevision(mdCount-1)
-		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
-		mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
-		require.IsType(t, MDJournalConflictError{}, err)
+	require.Equal(t, 1, len(mdserver.rmdses))
+	require.Equal(t, Merged, mdserver.rmdses[0].MD.MergedStatus())
+	putID, err := j.crypto.MakeMdID(mdserver.rmdses[0].MD)
+	require.NoError(t, err)
+	require.Equal(t, mdID, putID)
+}
 
-		md.SetUnmerged()
-		mdID, err = j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
-		require.NoError(t, err)
-		prevRoot = mdID
+func TestMDJournalFlushConflictNoRetryOnRealConflict(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
 
-		flushed, err := j.flushOne(
-			ctx, signer, uid, verifyingKey, &mdserver)
-		require.NoError(t, err)
-		require.True(t, flushed)
+	ctx := context.Background()
 
-		flushed, err = j.flushOne(
-			ctx, signer, uid, verifyingKey, &mdserver)
-		require.NoError(t, err)
-		require.False(t, flushed)
-		require.Equal(t, 0, getTlfJournalLength(t, j))
-	}
+	md := makeMDForTest(t, id, h, MetadataRevision(10), uid, fakeMdID(1))
+	_, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.NoError(t, err)
+
+	// Someone else has already put revision 10, so the local
+	// MD isn't a valid successor of the server's head, and
+	// retrying can't help.
+	var mdserver shimMDServer
+	otherMD := makeMDForTest(
+		t, id, h, MetadataRevision(10), uid, fakeMdID(2))
+	otherBRMD, err := encryptMDPrivateData(
+		ctx, j.codec, j.crypto, signer, ekg, uid, otherMD.ReadOnly())
+	require.NoError(t, err)
+	otherRMDS := &RootMetadataSigned{
+		MD: otherBRMD.(MutableBareRootMetadata)}
+	err = signMD(ctx, j.codec, signer, otherRMDS)
+	require.NoError(t, err)
+	mdserver.rmdses = append(mdserver.rmdses, otherRMDS)
+	mdserver.nextErr = MDServerErrorConflictRevision{}
+
+	flushed, err := j.flushOne(ctx, signer, uid, verifyingKey, &mdserver, 1)
+	require.NoError(t, err)
+	require.True(t, flushed)
+	require.NotEqual(t, NullBranchID, j.branchID)
+
+	// Only the converted MD should have been put.
+	require.Equal(t, 2, len(mdserver.rmdses))
+	require.Equal(t, Unmerged, mdserver.rmdses[1].MD.MergedStatus())
+}
+
+func TestMDJournalGetStatus(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	// An empty journal has the zero status.
+	status, err := j.getStatus(uid)
+	require.NoError(t, err)
+	require.Equal(t, MDJournalStatus{}, status)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	mdCount := 3
+	putMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, firstRevision, fakeMdID(1),
+		mdCount)
+
+	diskUsage := requireMDJournalDiskUsage(t, j)
+	status, err = j.getStatus(uid)
+	require.NoError(t, err)
+	require.Equal(t, MDJournalStatus{
+		MergedStatus:  Merged,
+		RevisionStart: firstRevision,
+		RevisionEnd:   firstRevision + MetadataRevision(mdCount) - 1,
+		EntryCount:    uint64(mdCount),
+		DiskUsage:     diskUsage,
+	}, status)
+
+	err = j.convertToBranch(ctx, signer, uid, verifyingKey,
+		MDJournalBranchReasonExplicitFork)
+	require.NoError(t, err)
+
+	status, err = j.getStatus(uid)
+	require.NoError(t, err)
+	require.Equal(t, j.branchID.String(), status.BranchID)
+	require.Equal(t, Unmerged, status.MergedStatus)
+	require.Equal(t, uint64(mdCount), status.EntryCount)
+
+	// The status should survive a round trip through JSON.
+	buf, err := json.Marshal(status)
+	require.NoError(t, err)
+	var decoded MDJournalStatus
+	err = json.Unmarshal(buf, &decoded)
+	require.NoError(t, err)
+	require.Equal(t, status, decoded)
+
+	// Someone who can't read the journal can't get its status.
+	_, err = j.getStatus(keybase1.MakeTestUID(2))
+	require.IsType(t, MDServerErrorUnauthorized{}, err)
+}
+
+func TestMDJournalBranchReason(t *testing.T) {
+	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	mdCount := 3
+	putMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, firstRevision, fakeMdID(1),
+		mdCount)
+
+	status, err := j.getStatus(uid)
+	require.NoError(t, err)
+	require.Equal(t, "", status.BranchReason)
+
+	err = j.convertToBranch(ctx, signer, uid, verifyingKey,
+		MDJournalBranchReasonReanchor)
+	require.NoError(t, err)
+
+	status, err = j.getStatus(uid)
+	require.NoError(t, err)
+	require.Equal(t, MDJournalBranchReasonReanchor.String(),
+		status.BranchReason)
+
+	// The reason should survive a reload.
+	bid := j.branchID
+	log := logger.NewTestLogger(t)
+	j, err = makeMDJournal(codec, crypto, tempdir, log)
+	require.NoError(t, err)
+	require.Equal(t, bid, j.branchID)
+	status, err = j.getStatus(uid)
+	require.NoError(t, err)
+	require.Equal(t, MDJournalBranchReasonReanchor.String(),
+		status.BranchReason)
+
+	// Clearing the branch should forget the reason.
+	err = j.clear(ctx, uid, bid)
+	require.NoError(t, err)
+	require.Equal(t, MDJournalBranchReasonUnknown, j.branchReason)
+}
+
+func TestMDJournalReloadBranch(t *testing.T) {
+	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	mdCount := 3
+	putMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, firstRevision, fakeMdID(1),
+		mdCount)
+
+	err := j.convertToBranch(ctx, signer, uid, verifyingKey,
+		MDJournalBranchReasonExplicitFork)
+	require.NoError(t, err)
+	bid := j.branchID
+	require.NotEqual(t, NullBranchID, bid)
+
+	head, err := j.getHead(uid)
+	require.NoError(t, err)
+
+	// A converted journal should load with its branch ID and the
+	// same head.
+	log := logger.NewTestLogger(t)
+	j, err = makeMDJournal(codec, crypto, tempdir, log)
+	require.NoError(t, err)
+	require.Equal(t, bid, j.branchID)
+
+	reloadedHead, err := j.getHead(uid)
+	require.NoError(t, err)
+	require.Equal(t, head.mdID, reloadedHead.mdID)
+	require.Equal(t, bid, reloadedHead.BID())
+}
+
+func TestMDJournalFlushStats(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	clock, t0 := newTestClockAndTimeNow()
+	j.clock = clock
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	prevRoot := fakeMdID(1)
+	mdCount := 5
+	var sizes []uint64
+	for i := 0; i < mdCount; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+		require.NoError(t, err)
+		size, err := j.entryDiskUsage(revision, mdID)
+		require.NoError(t, err)
+		sizes = append(sizes, size)
+		prevRoot = mdID
+	}
+
+	// Flush an MD every hour, with the second one hitting a
+	// conflict first.
+	var mdserver shimMDServer
+	for i := 0; i < mdCount-1; i++ {
+		clock.Set(t0.Add(time.Duration(i) * time.Hour))
+		if i == 1 {
+			mdserver.nextErr = MDServerErrorConflictRevision{}
+		}
+		flushed, err := j.flushOne(
+			ctx, signer, uid, verifyingKey, &mdserver, 1)
+		require.NoError(t, err)
+		require.True(t, flushed)
+	}
+
+	require.Equal(t, FlushStats{
+		Flushes:   4,
+		Bytes:     sizes[0] + sizes[1] + sizes[2] + sizes[3],
+		Conflicts: 1,
+	}, j.flushStats(t0))
+	require.Equal(t, FlushStats{
+		Flushes:   3,
+		Bytes:     sizes[1] + sizes[2] + sizes[3],
+		Conflicts: 1,
+	}, j.flushStats(t0.Add(time.Hour)))
+	require.Equal(t, FlushStats{
+		Flushes: 2,
+		Bytes:   sizes[2] + sizes[3],
+	}, j.flushStats(t0.Add(90*time.Minute)))
+	require.Equal(t, FlushStats{}, j.flushStats(t0.Add(4*time.Hour)))
+
+	// Flushing more than a day later forgets the oldest flushes.
+	clock.Set(t0.Add(25*time.Hour + 30*time.Minute))
+	flushed, err := j.flushOne(ctx, signer, uid, verifyingKey, &mdserver, 1)
+	require.NoError(t, err)
+	require.True(t, flushed)
+	require.Equal(t, FlushStats{
+		Flushes: 3,
+		Bytes:   sizes[2] + sizes[3] + sizes[4],
+	}, j.flushStats(t0))
+}
+
+// TestMDJournalPreservesBranchID tests that the branch ID is
+// preserved even if the journal is fully drained. This is a
+// regression test for KBFS-1344.
+func TestMDJournalPreservesBranchID(t *testing.T) {
+	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	firstPrevRoot := fakeMdID(1)
+	mdCount := 10
+
+	prevRoot := firstPrevRoot
+	for i := 0; i < mdCount-1; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+		require.NoError(t, err)
+		prevRoot = mdID
+	}
+
+	var mdserver shimMDServer
+	mdserver.nextErr = MDServerErrorConflictRevision{}
+
+	// Flush all entries, with the first one encountering a
+	// conflict error.
+	for i := 0; i < mdCount-1; i++ {
+		flushed, err := j.flushOne(
+			ctx, signer, uid, verifyingKey, &mdserver, 0)
+		require.NoError(t, err)
+		require.True(t, flushed)
+	}
+
+	flushed, err := j.flushOne(ctx, signer, uid, verifyingKey, &mdserver, 0)
+	require.NoError(t, err)
+	require.False(t, flushed)
+	require.Equal(t, 0, getTlfJournalLength(t, j))
+
+	// Put last revision and flush it.
+	{
+		revision := firstRevision + MetadataRevision(mdCount-1)
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+		require.IsType(t, MDJournalConflictError{}, err)
+
+		md.SetUnmerged()
+		mdID, err = j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+		require.NoError(t, err)
+		prevRoot = mdID
+
+		flushed, err := j.flushOne(
+			ctx, signer, uid, verifyingKey, &mdserver, 0)
+		require.NoError(t, err)
+		require.True(t, flushed)
+
+		flushed, err = j.flushOne(
+			ctx, signer, uid, verifyingKey, &mdserver, 0)
+		require.NoError(t, err)
+		require.False(t, flushed)
+		require.Equal(t, 0, getTlfJournalLength(t, j))
+	}
 
 	rmdses := mdserver.rmdses
 	require.Equal(t, mdCount, len(rmdses))
@@ -610,19 +1289,63 @@ func TestMDJournalDoubleFlush(t *testing.T) {
 	// Simulate a flush that is cancelled but succeeds anyway.
 	ctx2, cancel := context.WithCancel(ctx)
 	cancel()
-	flushed, err := j.flushOne(ctx2, signer, uid, verifyingKey, &mdserver)
+	flushed, err := j.flushOne(ctx2, signer, uid, verifyingKey, &mdserver, 0)
 	require.Equal(t, ctx2.Err(), err)
 	require.False(t, flushed)
 	require.Equal(t, 1, len(mdserver.rmdses))
+	// Nothing was known to be ambiguous before the put, so the
+	// server shouldn't have been asked about it.
+	require.Equal(t, 0, mdserver.hasRevisions)
 
-	// Simulate the conflict error and GetRange call resulting
-	// from the successful put.
-	mdserver.nextErr = MDServerErrorConflictRevision{}
+	// The server reports that it already has the MD, so it
+	// shouldn't be put again.
 	mdserver.nextGetRange = mdserver.rmdses
-	flushed, err = j.flushOne(ctx, signer, uid, verifyingKey, &mdserver)
+	flushed, err = j.flushOne(ctx, signer, uid, verifyingKey, &mdserver, 0)
 	require.NoError(t, err)
 	require.True(t, flushed)
+	require.Equal(t, 1, len(mdserver.rmdses))
+	require.Equal(t, 1, mdserver.hasRevisions)
 	require.Equal(t, Merged, mdserver.rmdses[0].MD.MergedStatus())
+	require.Equal(t, 0, getTlfJournalLength(t, j))
+}
+
+func TestMDJournalIsAlreadyFlushed(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	revision := MetadataRevision(10)
+	md := makeMDForTest(t, id, h, revision, uid, fakeMdID(1))
+	mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.NoError(t, err)
+
+	var mdserver shimMDServer
+	flushed, err := j.flushOne(ctx, signer, uid, verifyingKey, &mdserver, 0)
+	require.NoError(t, err)
+	require.True(t, flushed)
+	require.Equal(t, 1, len(mdserver.rmdses))
+
+	// An empty range means the conflict is real.
+	alreadyFlushed, err := isAlreadyFlushed(
+		ctx, &mdserver, id, NullBranchID, revision, mdID)
+	require.NoError(t, err)
+	require.False(t, alreadyFlushed)
+
+	// So does a different MD at that revision.
+	mdserver.nextGetRange = mdserver.rmdses
+	alreadyFlushed, err = isAlreadyFlushed(
+		ctx, &mdserver, id, NullBranchID, revision, fakeMdID(2))
+	require.NoError(t, err)
+	require.False(t, alreadyFlushed)
+
+	// A matching MD means it was already flushed.
+	mdserver.nextGetRange = mdserver.rmdses
+	alreadyFlushed, err = isAlreadyFlushed(
+		ctx, &mdserver, id, NullBranchID, revision, mdID)
+	require.NoError(t, err)
+	require.True(t, alreadyFlushed)
 }
 
 func TestMDJournalClear(t *testing.T) {
@@ -645,7 +1368,8 @@ func TestMDJournalClear(t *testing.T) {
 		prevRoot = mdID
 	}
 
-	err := j.convertToBranch(ctx, signer, uid, verifyingKey)
+	err := j.convertToBranch(ctx, signer, uid, verifyingKey,
+		MDJournalBranchReasonExplicitFork)
 	require.NoError(t, err)
 	require.NotEqual(t, NullBranchID, j.branchID)
 
@@ -686,3 +1410,1806 @@ func TestMDJournalClear(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, ImmutableBareRootMetadata{}, head)
 }
+
+func TestMDJournalClearRange(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	firstPrevRoot := fakeMdID(1)
+	mdCount := 10
+
+	putMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, firstRevision, firstPrevRoot,
+		mdCount)
+
+	err := j.convertToBranch(ctx, signer, uid, verifyingKey,
+		MDJournalBranchReasonExplicitFork)
+	require.NoError(t, err)
+	bid := j.branchID
+	require.NotEqual(t, NullBranchID, bid)
+
+	latest := firstRevision + MetadataRevision(mdCount-1)
+
+	// Only suffixes can be cleared.
+	err = j.clearRange(ctx, uid, bid, firstRevision, latest-1)
+	require.IsType(t, MDJournalClearRangeError{}, err)
+	err = j.clearRange(ctx, uid, bid, firstRevision-1, latest)
+	require.IsType(t, MDJournalClearRangeError{}, err)
+	err = j.clearRange(ctx, uid, bid, latest, latest+1)
+	require.IsType(t, MDJournalClearRangeError{}, err)
+	require.Equal(t, mdCount, getTlfJournalLength(t, j))
+
+	// Clearing the last three entries should leave a valid chain
+	// on the same branch.
+	err = j.clearRange(ctx, uid, bid, latest-2, latest)
+	require.NoError(t, err)
+	require.Equal(t, bid, j.branchID)
+	require.Equal(t, mdCount-3, getTlfJournalLength(t, j))
+
+	// The cleared entries shouldn't be left on disk.
+	highest, err := j.j.readHighestOnDiskRevision()
+	require.NoError(t, err)
+	require.Equal(t, latest-3, highest)
+
+	head, err := j.getHead(uid)
+	require.NoError(t, err)
+	require.Equal(t, latest-3, head.RevisionNumber())
+	require.Equal(t, bid, head.BID())
+
+	ibrmds, err := j.getRange(uid, firstRevision, latest)
+	require.NoError(t, err)
+	require.Equal(t, mdCount-3, len(ibrmds))
+	for i := 1; i < len(ibrmds); i++ {
+		err := ibrmds[i-1].CheckValidSuccessor(
+			ibrmds[i-1].mdID, ibrmds[i].BareRootMetadata)
+		require.NoError(t, err)
+	}
+	require.Equal(t, head, ibrmds[len(ibrmds)-1])
+
+	// Puts should now build on the new head.
+	md := makeMDForTest(t, id, h, latest-2, uid, head.mdID)
+	md.SetUnmerged()
+	_, err = j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.NoError(t, err)
+	require.Equal(t, mdCount-2, getTlfJournalLength(t, j))
+
+	// Clearing everything should reset the branch ID.
+	err = j.clearRange(ctx, uid, bid, firstRevision, latest-2)
+	require.NoError(t, err)
+	require.Equal(t, NullBranchID, j.branchID)
+
+	head, err = j.getHead(uid)
+	require.NoError(t, err)
+	require.Equal(t, ImmutableBareRootMetadata{}, head)
+}
+
+func TestMDJournalTruncateAfter(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	// Truncating an empty journal is a no-op.
+	err := j.truncateAfter(ctx, uid, MetadataRevision(10))
+	require.NoError(t, err)
+
+	firstRevision := MetadataRevision(10)
+	mdCount := 5
+	putMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, firstRevision, fakeMdID(1),
+		mdCount)
+
+	err = j.convertToBranch(ctx, signer, uid, verifyingKey,
+		MDJournalBranchReasonExplicitFork)
+	require.NoError(t, err)
+	bid := j.branchID
+	require.NotEqual(t, NullBranchID, bid)
+
+	latest := firstRevision + MetadataRevision(mdCount-1)
+
+	// Revisions before the earliest one, or at or after the head,
+	// leave the journal alone.
+	err = j.truncateAfter(ctx, uid, firstRevision-1)
+	require.Equal(t, errMDJournalTruncateBeforeEarliest, err)
+	err = j.truncateAfter(ctx, uid, latest)
+	require.NoError(t, err)
+	err = j.truncateAfter(ctx, uid, latest+1)
+	require.NoError(t, err)
+	require.Equal(t, mdCount, getTlfJournalLength(t, j))
+
+	// Truncating to the earliest revision should keep just it,
+	// on the same branch.
+	err = j.truncateAfter(ctx, uid, firstRevision)
+	require.NoError(t, err)
+	require.Equal(t, 1, getTlfJournalLength(t, j))
+	require.Equal(t, bid, j.branchID)
+
+	head, err := j.getHead(uid)
+	require.NoError(t, err)
+	require.Equal(t, firstRevision, head.RevisionNumber())
+	require.Equal(t, bid, head.BID())
+}
+
+func TestMDJournalCompactAfterTruncate(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	prevRoot := fakeMdID(1)
+	mdCount := 5
+	var mdIDs []MdID
+	for i := 0; i < mdCount; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, mdID)
+		prevRoot = mdID
+	}
+
+	// Truncating should remove the entries past the new head,
+	// not just move the head back.
+	newHead := firstRevision + 1
+	err := j.truncateAfter(ctx, uid, newHead)
+	require.NoError(t, err)
+	highest, err := j.j.readHighestOnDiskRevision()
+	require.NoError(t, err)
+	require.Equal(t, newHead, highest)
+
+	// So compact should reclaim their MDs, and only theirs.
+	reclaimed, err := j.compact(ctx)
+	require.NoError(t, err)
+	require.NotZero(t, reclaimed)
+	for i, mdID := range mdIDs {
+		_, err := os.Stat(j.mdPath(mdID))
+		if firstRevision+MetadataRevision(i) <= newHead {
+			require.NoError(t, err)
+		} else {
+			require.True(t, os.IsNotExist(err))
+		}
+	}
+
+	// Puts should still build on the new head.
+	md := makeMDForTest(t, id, h, newHead+1, uid, mdIDs[1])
+	_, err = j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.NoError(t, err)
+	require.Equal(t, 3, getTlfJournalLength(t, j))
+	head, err := j.getHead(uid)
+	require.NoError(t, err)
+	require.Equal(t, newHead+1, head.RevisionNumber())
+}
+
+// requireMDJournalDiskUsage checks that j's cached disk usage, if
+// any, matches a fresh computation, and returns it.
+func requireMDJournalDiskUsage(t *testing.T, j *mdJournal) uint64 {
+	usage, err := j.diskUsage()
+	require.NoError(t, err)
+	j.diskUsageValid = false
+	freshUsage, err := j.diskUsage()
+	require.NoError(t, err)
+	require.Equal(t, freshUsage, usage)
+	return usage
+}
+
+func TestMDJournalDiskUsage(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	require.Equal(t, uint64(0), requireMDJournalDiskUsage(t, j))
+
+	firstRevision := MetadataRevision(10)
+	prevRoot := fakeMdID(1)
+	mdCount := 5
+	var usage uint64
+	for i := 0; i < mdCount; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+		require.NoError(t, err)
+		prevRoot = mdID
+
+		newUsage := requireMDJournalDiskUsage(t, j)
+		require.True(t, newUsage > usage,
+			"newUsage=%d, usage=%d", newUsage, usage)
+		usage = newUsage
+	}
+
+	// Flushing shrinks the usage, even though the flushed files
+	// stay on disk.
+	var mdserver shimMDServer
+	flushed, err := j.flushOne(ctx, signer, uid, verifyingKey, &mdserver, 0)
+	require.NoError(t, err)
+	require.True(t, flushed)
+	newUsage := requireMDJournalDiskUsage(t, j)
+	require.True(t, newUsage < usage,
+		"newUsage=%d, usage=%d", newUsage, usage)
+
+	// Converting to a branch rewrites every entry.
+	err = j.convertToBranch(ctx, signer, uid, verifyingKey,
+		MDJournalBranchReasonExplicitFork)
+	require.NoError(t, err)
+	requireMDJournalDiskUsage(t, j)
+
+	err = j.clear(ctx, uid, j.branchID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), requireMDJournalDiskUsage(t, j))
+}
+
+func TestMDJournalDetachedSigs(t *testing.T) {
+	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	log := logger.NewTestLogger(t)
+	j, err := makeMDJournalWithOptions(codec, crypto, tempdir, log,
+		mdJournalOptions{detachedSigs: true})
+	require.NoError(t, err)
+
+	firstRevision := MetadataRevision(10)
+	prevRoot := fakeMdID(1)
+	mdCount := 3
+	var mdIDs []MdID
+	for i := 0; i < mdCount; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+		require.NoError(t, err)
+		prevRoot = mdID
+		mdIDs = append(mdIDs, mdID)
+	}
+
+	// The stored MDs shouldn't have signatures of their own.
+	for _, mdID := range mdIDs {
+		data, err := ioutil.ReadFile(j.mdPath(mdID))
+		require.NoError(t, err)
+		var rmd BareRootMetadataV2
+		err = codec.Decode(data, &rmd)
+		require.NoError(t, err)
+		require.True(t, rmd.WriterMetadataSigInfo.IsNil())
+
+		_, err = os.Stat(j.sigPath(mdID))
+		require.NoError(t, err)
+	}
+
+	// A reloaded journal, without detachedSigs set, should
+	// reassemble and verify them.
+	j, err = makeMDJournal(codec, crypto, tempdir, log)
+	require.NoError(t, err)
+
+	ibrmds, err := j.getRange(
+		uid, firstRevision, firstRevision+MetadataRevision(mdCount-1))
+	require.NoError(t, err)
+	require.Equal(t, mdCount, len(ibrmds))
+	for i, ibrmd := range ibrmds {
+		require.Equal(t, mdIDs[i], ibrmd.mdID)
+		err = ibrmd.IsValidAndSigned(codec, crypto)
+		require.NoError(t, err)
+		err = ibrmd.IsLastModifiedBy(uid, verifyingKey)
+		require.NoError(t, err)
+	}
+
+	err = j.verify(ctx, uid, []VerifyingKey{verifyingKey})
+	require.NoError(t, err)
+
+	// Rewriting the journal should remove the signatures of the
+	// replaced MDs, and detach those of their replacements.
+	j, err = makeMDJournalWithOptions(codec, crypto, tempdir, log,
+		mdJournalOptions{detachedSigs: true})
+	require.NoError(t, err)
+	err = j.convertToBranch(ctx, signer, uid, verifyingKey,
+		MDJournalBranchReasonExplicitFork)
+	require.NoError(t, err)
+
+	for _, mdID := range mdIDs {
+		_, err = os.Stat(j.sigPath(mdID))
+		require.True(t, os.IsNotExist(err))
+	}
+
+	ibrmds, err = j.getRange(
+		uid, firstRevision, firstRevision+MetadataRevision(mdCount-1))
+	require.NoError(t, err)
+	require.Equal(t, mdCount, len(ibrmds))
+	for _, ibrmd := range ibrmds {
+		_, err = os.Stat(j.sigPath(ibrmd.mdID))
+		require.NoError(t, err)
+		err = ibrmd.IsValidAndSigned(codec, crypto)
+		require.NoError(t, err)
+	}
+}
+
+func TestMDJournalVerifyOtherDevicesAndServer(t *testing.T) {
+	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	// MDs signed by another of the user's devices are valid
+	// journal contents.
+	signingKey2 := MakeFakeSigningKeyOrBust("fake seed 2")
+	signer2 := cryptoSignerLocal{signingKey2}
+	verifyingKey2 := signingKey2.GetVerifyingKey()
+
+	firstRevision := MetadataRevision(10)
+	prevRoot := fakeMdID(1)
+	mdCount := 4
+	for i := 0; i < mdCount; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		s, k := signer, verifyingKey
+		if i >= mdCount/2 {
+			s, k = signer2, verifyingKey2
+		}
+		mdID, err := j.put(ctx, s, ekg, bsplit, md, uid, k)
+		require.NoError(t, err)
+		prevRoot = mdID
+	}
+
+	err := j.verify(ctx, uid, []VerifyingKey{verifyingKey, verifyingKey2})
+	require.NoError(t, err)
+
+	// But not if their keys aren't given.
+	err = j.verify(ctx, uid, []VerifyingKey{verifyingKey})
+	require.IsType(t, MDJournalVerifyError{}, err)
+	require.Equal(t, firstRevision+MetadataRevision(mdCount/2),
+		err.(MDJournalVerifyError).Revision)
+	require.Equal(t, MDJournalInvariantLastModifiedBy,
+		err.(MDJournalVerifyError).Invariant)
+
+	// MDs from the server may have been last modified by anyone.
+	var mdserver shimMDServer
+	for i := 0; i < mdCount; i++ {
+		flushed, err := j.flushOne(
+			ctx, signer, uid, verifyingKey, &mdserver, 0)
+		require.NoError(t, err)
+		require.True(t, flushed)
+	}
+
+	log := logger.NewTestLogger(t)
+	mirror, err := makeMDJournal(
+		codec, crypto, filepath.Join(tempdir, "mirror"), log)
+	require.NoError(t, err)
+	for _, rmds := range mdserver.rmdses {
+		err := mirror.appendFromServer(rmds)
+		require.NoError(t, err)
+	}
+
+	err = mirror.verify(ctx, keybase1.MakeTestUID(2), nil)
+	require.NoError(t, err)
+}
+
+func TestMDJournalPutRange(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	firstPrevRoot := fakeMdID(1)
+	md := makeMDForTest(t, id, h, firstRevision, uid, firstPrevRoot)
+	headID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.NoError(t, err)
+
+	// Only the first MD in a batch needs its prev root set.
+	batchCount := 4
+	var rmds []*RootMetadata
+	for i := 1; i <= batchCount; i++ {
+		prevRoot := MdID{}
+		if i == 1 {
+			prevRoot = headID
+		}
+		rmds = append(rmds, makeMDForTest(
+			t, id, h, firstRevision+MetadataRevision(i), uid, prevRoot))
+	}
+	mdIDs, err := j.putRange(
+		ctx, signer, ekg, bsplit, rmds, uid, verifyingKey)
+	require.NoError(t, err)
+	require.Equal(t, batchCount, len(mdIDs))
+	require.Equal(t, batchCount+1, getTlfJournalLength(t, j))
+
+	ibrmds, err := j.getRange(uid, firstRevision,
+		firstRevision+MetadataRevision(batchCount))
+	require.NoError(t, err)
+	require.Equal(t, batchCount+1, len(ibrmds))
+	for i := 1; i < len(ibrmds); i++ {
+		require.Equal(t, mdIDs[i-1], ibrmds[i].mdID)
+		err := ibrmds[i-1].CheckValidSuccessor(
+			ibrmds[i-1].mdID, ibrmds[i].BareRootMetadata)
+		require.NoError(t, err)
+	}
+
+	// Like a put, an identical re-put of a batched MD should
+	// return the existing ID without changing the journal.
+	md = makeMDForTest(t, id, h, firstRevision+2, uid, mdIDs[0])
+	mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.NoError(t, err)
+	require.Equal(t, mdIDs[1], mdID)
+	require.Equal(t, batchCount+1, getTlfJournalLength(t, j))
+
+	head, err := j.getHead(uid)
+	require.NoError(t, err)
+	require.Equal(t, mdIDs[batchCount-1], head.mdID)
+
+	// A batch with a gap in the middle should be rejected without
+	// writing anything.
+	nextRevision := firstRevision + MetadataRevision(batchCount+1)
+	badRmds := []*RootMetadata{
+		makeMDForTest(t, id, h, nextRevision, uid, head.mdID),
+		makeMDForTest(t, id, h, nextRevision+1, uid, MdID{}),
+		makeMDForTest(t, id, h, nextRevision+3, uid, MdID{}),
+	}
+	_, err = j.putRange(
+		ctx, signer, ekg, bsplit, badRmds, uid, verifyingKey)
+	require.Error(t, err)
+	require.Equal(t, batchCount+1, getTlfJournalLength(t, j))
+	newHead, err := j.getHead(uid)
+	require.NoError(t, err)
+	require.Equal(t, head, newHead)
+	// The given MDs shouldn't have been modified either.
+	require.Equal(t, MdID{}, badRmds[1].PrevRoot())
+	require.Equal(t, SignatureInfo{}, badRmds[0].bareMd.GetWriterMetadataSigInfo())
+
+	// So should a batch that doesn't build on the head.
+	badRmds = []*RootMetadata{
+		makeMDForTest(t, id, h, nextRevision, uid, fakeMdID(2)),
+	}
+	_, err = j.putRange(
+		ctx, signer, ekg, bsplit, badRmds, uid, verifyingKey)
+	require.Error(t, err)
+	require.Equal(t, batchCount+1, getTlfJournalLength(t, j))
+
+	// Puts should still work afterwards.
+	md = makeMDForTest(t, id, h, nextRevision, uid, head.mdID)
+	_, err = j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.NoError(t, err)
+	require.Equal(t, batchCount+2, getTlfJournalLength(t, j))
+}
+
+func TestMDJournalResign(t *testing.T) {
+	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	firstPrevRoot := fakeMdID(1)
+	mdCount := 10
+
+	putMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, firstRevision, firstPrevRoot,
+		mdCount)
+
+	newSigningKey := MakeFakeSigningKeyOrBust("new fake seed")
+	newSigner := cryptoSignerLocal{newSigningKey}
+	newVerifyingKey := newSigningKey.GetVerifyingKey()
+
+	err := j.resign(ctx, newSigner, uid, newVerifyingKey)
+	require.NoError(t, err)
+
+	ibrmds, err := j.getRange(
+		uid, 1, firstRevision+MetadataRevision(2*mdCount))
+	require.NoError(t, err)
+	require.Equal(t, mdCount, len(ibrmds))
+
+	require.Equal(t, firstRevision, ibrmds[0].RevisionNumber())
+	require.Equal(t, firstPrevRoot, ibrmds[0].GetPrevRoot())
+	require.Equal(t, Merged, ibrmds[0].MergedStatus())
+
+	for i := 0; i < len(ibrmds); i++ {
+		err := ibrmds[i].IsValidAndSigned(codec, crypto)
+		require.NoError(t, err)
+		err = ibrmds[i].IsLastModifiedBy(uid, newVerifyingKey)
+		require.NoError(t, err)
+		err = ibrmds[i].IsLastModifiedBy(uid, verifyingKey)
+		require.Error(t, err)
+		if i > 0 {
+			err = ibrmds[i-1].CheckValidSuccessor(
+				ibrmds[i-1].mdID, ibrmds[i].BareRootMetadata)
+			require.NoError(t, err)
+		}
+	}
+
+	require.Equal(t, mdCount, getTlfJournalLength(t, j))
+}
+
+func TestMDJournalResignSameKey(t *testing.T) {
+	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, _ :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	log := logger.NewTestLogger(t)
+	j, err := makeMDJournalWithOptions(codec, crypto, tempdir, log,
+		mdJournalOptions{detachedSigs: true})
+	require.NoError(t, err)
+
+	firstRevision := MetadataRevision(10)
+	firstPrevRoot := fakeMdID(1)
+	mdCount := 5
+
+	putMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, firstRevision, firstPrevRoot,
+		mdCount)
+
+	newSigningKey := MakeFakeSigningKeyOrBust("new fake seed")
+	newSigner := cryptoSignerLocal{newSigningKey}
+	newVerifyingKey := newSigningKey.GetVerifyingKey()
+
+	err = j.resign(ctx, newSigner, uid, newVerifyingKey)
+	require.NoError(t, err)
+
+	ibrmds, err := j.getRange(
+		uid, firstRevision, firstRevision+MetadataRevision(mdCount-1))
+	require.NoError(t, err)
+	require.Equal(t, mdCount, len(ibrmds))
+
+	// Signing is deterministic, so re-signing with the same key
+	// produces the same MDs, which are already stored, and the
+	// journal should still refer to them.
+	err = j.resign(ctx, newSigner, uid, newVerifyingKey)
+	require.NoError(t, err)
+
+	ibrmds2, err := j.getRange(
+		uid, firstRevision, firstRevision+MetadataRevision(mdCount-1))
+	require.NoError(t, err)
+	require.Equal(t, mdCount, len(ibrmds2))
+	for i, ibrmd := range ibrmds2 {
+		require.NotEqual(t, MdID{}, ibrmd.mdID)
+		require.Equal(t, ibrmds[i].mdID, ibrmd.mdID)
+		err = ibrmd.IsLastModifiedBy(uid, newVerifyingKey)
+		require.NoError(t, err)
+
+		// The MDs are still live, so their signatures must
+		// still be there.
+		_, err = os.Stat(j.sigPath(ibrmd.mdID))
+		require.NoError(t, err)
+	}
+}
+
+func TestMDJournalResignAtomic(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	firstPrevRoot := fakeMdID(1)
+	mdCount := 10
+
+	putMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, firstRevision, firstPrevRoot,
+		mdCount)
+
+	newSigningKey := MakeFakeSigningKeyOrBust("new fake seed")
+	limitedSigner := limitedCryptoSigner{
+		cryptoSignerLocal{newSigningKey}, 5}
+	newVerifyingKey := newSigningKey.GetVerifyingKey()
+
+	err := j.resign(ctx, &limitedSigner, uid, newVerifyingKey)
+	require.NotNil(t, err)
+
+	// All entries should still be signed with the old key, since
+	// the re-signing encountered an error.
+
+	ibrmds, err := j.getRange(
+		uid, 1, firstRevision+MetadataRevision(2*mdCount))
+	require.NoError(t, err)
+	require.Equal(t, mdCount, len(ibrmds))
+
+	for _, ibrmd := range ibrmds {
+		err = ibrmd.IsLastModifiedBy(uid, verifyingKey)
+		require.NoError(t, err)
+	}
+}
+
+func TestMDJournalCorrelationIDs(t *testing.T) {
+	_, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	firstPrevRoot := fakeMdID(1)
+	mdCount := 4
+	correlationIDs := []string{"action1", "action1", "", "action2"}
+
+	var mdIDs []MdID
+	prevRoot := firstPrevRoot
+	for i := 0; i < mdCount; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		mdID, err := j.putWithCorrelationID(ctx, signer, ekg, bsplit,
+			md, uid, verifyingKey, correlationIDs[i])
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, mdID)
+		prevRoot = mdID
+	}
+
+	infos, err := j.listRevisions()
+	require.NoError(t, err)
+	require.Equal(t, mdCount, len(infos))
+	for i, info := range infos {
+		require.Equal(t, firstRevision+MetadataRevision(i), info.revision)
+		require.Equal(t, mdIDs[i], info.mdID)
+		require.Equal(t, correlationIDs[i], info.correlationID)
+	}
+
+	// The correlation ID shouldn't affect the MdID.
+	ibrmds, err := j.getRange(uid, firstRevision, firstRevision)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(ibrmds))
+	mdID, err := crypto.MakeMdID(ibrmds[0].BareRootMetadata)
+	require.NoError(t, err)
+	require.Equal(t, mdIDs[0], mdID)
+
+	// Correlation IDs should survive a branch conversion.
+	err = j.convertToBranch(ctx, signer, uid, verifyingKey,
+		MDJournalBranchReasonExplicitFork)
+	require.NoError(t, err)
+
+	infos, err = j.listRevisions()
+	require.NoError(t, err)
+	require.Equal(t, mdCount, len(infos))
+	for i, info := range infos {
+		require.Equal(t, correlationIDs[i], info.correlationID)
+	}
+}
+
+func TestMDJournalStaleBranch(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	var mdserver shimMDServer
+	j.enableStaleBranchCheck(&mdserver, 1)
+
+	firstRevision := MetadataRevision(10)
+	firstPrevRoot := fakeMdID(1)
+	mdCount := 4
+
+	prevRoot := putMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, firstRevision, firstPrevRoot,
+		mdCount/2)
+
+	// Flush with a conflict, which converts the journal to a
+	// branch and flushes the first entry onto it.
+	mdserver.nextErr = MDServerErrorConflictRevision{}
+	flushed, err := j.flushOne(ctx, signer, uid, verifyingKey, &mdserver, 0)
+	require.NoError(t, err)
+	require.True(t, flushed)
+	bid := j.branchID
+	require.NotEqual(t, NullBranchID, bid)
+
+	// A checked put should succeed while the branch still exists.
+	revision := firstRevision + MetadataRevision(mdCount/2)
+	md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+	md.SetUnmerged()
+	mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.NoError(t, err)
+	prevRoot = mdID
+
+	// Prune the branch on the server; the next checked put should
+	// be rejected.
+	err = mdserver.PruneBranch(ctx, id, bid)
+	require.NoError(t, err)
+
+	revision++
+	md = makeMDForTest(t, id, h, revision, uid, prevRoot)
+	md.SetUnmerged()
+	_, err = j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.Equal(t, MDJournalStaleBranchError{bid}, err)
+
+	// Further puts should be rejected without another check.
+	j.enableStaleBranchCheck(&mdserver, 0)
+	_, err = j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.Equal(t, MDJournalStaleBranchError{bid}, err)
+
+	require.Equal(t, mdCount/2, getTlfJournalLength(t, j))
+}
+
+func TestMDJournalAppendFromServer(t *testing.T) {
+	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	firstPrevRoot := fakeMdID(1)
+	mdCount := 5
+
+	// Generate some server-side MDs by flushing a journal.
+	putMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, firstRevision, firstPrevRoot,
+		mdCount)
+
+	var mdserver shimMDServer
+	for i := 0; i < mdCount; i++ {
+		flushed, err := j.flushOne(
+			ctx, signer, uid, verifyingKey, &mdserver, 0)
+		require.NoError(t, err)
+		require.True(t, flushed)
+	}
+	require.Equal(t, mdCount, len(mdserver.rmdses))
+
+	log := logger.NewTestLogger(t)
+	mirror, err := makeMDJournal(
+		codec, crypto, filepath.Join(tempdir, "mirror"), log)
+	require.NoError(t, err)
+
+	for _, rmds := range mdserver.rmdses {
+		err := mirror.appendFromServer(rmds)
+		require.NoError(t, err)
+	}
+
+	// Appending an MD that doesn't chain onto the head should
+	// fail.
+	err = mirror.appendFromServer(mdserver.rmdses[1])
+	require.Error(t, err)
+
+	ibrmds, err := mirror.getRange(
+		uid, firstRevision, firstRevision+MetadataRevision(mdCount))
+	require.NoError(t, err)
+	require.Equal(t, mdCount, len(ibrmds))
+	for i, ibrmd := range ibrmds {
+		mdID, err := crypto.MakeMdID(mdserver.rmdses[i].MD)
+		require.NoError(t, err)
+		require.Equal(t, mdID, ibrmd.mdID)
+		require.Equal(t,
+			firstRevision+MetadataRevision(i), ibrmd.RevisionNumber())
+	}
+
+	// Flushing shouldn't push anything to the server.
+	var mirrorServer shimMDServer
+	for i := 0; i < mdCount; i++ {
+		flushed, err := mirror.flushOne(
+			ctx, signer, uid, verifyingKey, &mirrorServer, 0)
+		require.NoError(t, err)
+		require.True(t, flushed)
+	}
+	flushed, err := mirror.flushOne(
+		ctx, signer, uid, verifyingKey, &mirrorServer, 0)
+	require.NoError(t, err)
+	require.False(t, flushed)
+	require.Equal(t, 0, getTlfJournalLength(t, mirror))
+	require.Equal(t, 0, len(mirrorServer.rmdses))
+}
+
+func TestMDJournalAppendFromServerOntoUnflushed(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	md := makeMDForTest(t, id, h, MetadataRevision(10), uid, fakeMdID(1))
+	mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.NoError(t, err)
+
+	// Make a server MD that chains onto the local head.
+	md2 := makeMDForTest(t, id, h, MetadataRevision(11), uid, mdID)
+	brmd, err := encryptMDPrivateData(
+		ctx, j.codec, j.crypto, signer, ekg, uid, md2.ReadOnly())
+	require.NoError(t, err)
+	rmds := RootMetadataSigned{MD: brmd.(MutableBareRootMetadata)}
+	err = signMD(ctx, j.codec, signer, &rmds)
+	require.NoError(t, err)
+
+	// The local head hasn't been flushed yet, so this should
+	// fail.
+	err = j.appendFromServer(&rmds)
+	require.Error(t, err)
+	require.Equal(t, 1, getTlfJournalLength(t, j))
+}
+
+func TestMDJournalBranchConversionFromServer(t *testing.T) {
+	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	mdCount := 3
+
+	// Generate some server-side MDs by flushing a journal.
+	prevRoot := putMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, firstRevision, fakeMdID(1),
+		mdCount)
+
+	var mdserver shimMDServer
+	for i := 0; i < mdCount; i++ {
+		flushed, err := j.flushOne(
+			ctx, signer, uid, verifyingKey, &mdserver, 0)
+		require.NoError(t, err)
+		require.True(t, flushed)
+	}
+
+	log := logger.NewTestLogger(t)
+	mirror, err := makeMDJournal(
+		codec, crypto, filepath.Join(tempdir, "mirror"), log)
+	require.NoError(t, err)
+
+	for _, rmds := range mdserver.rmdses {
+		err := mirror.appendFromServer(rmds)
+		require.NoError(t, err)
+	}
+
+	// Add a local MD on top of the server ones.
+	localRevision := firstRevision + MetadataRevision(mdCount)
+	md := makeMDForTest(t, id, h, localRevision, uid, prevRoot)
+	_, err = mirror.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.NoError(t, err)
+
+	// The preview should skip the server MDs, too.
+	count, forkFrom, err := mirror.previewConvertToBranch()
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	require.Equal(t, localRevision-1, forkFrom)
+
+	err = mirror.convertToBranch(ctx, signer, uid, verifyingKey,
+		MDJournalBranchReasonExplicitFork)
+	require.NoError(t, err)
+
+	// Only the local MD should be left, still chained onto the
+	// last server MD.
+	require.Equal(t, 1, getTlfJournalLength(t, mirror))
+	ibrmds, err := mirror.getRange(uid, 1, localRevision+1)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(ibrmds))
+	require.Equal(t, localRevision, ibrmds[0].RevisionNumber())
+	require.Equal(t, prevRoot, ibrmds[0].GetPrevRoot())
+	require.Equal(t, Unmerged, ibrmds[0].MergedStatus())
+
+	// Converting a journal with only server MDs should leave it
+	// empty, with the last one saved.
+	mirror2, err := makeMDJournal(
+		codec, crypto, filepath.Join(tempdir, "mirror2"), log)
+	require.NoError(t, err)
+	for _, rmds := range mdserver.rmdses {
+		err := mirror2.appendFromServer(rmds)
+		require.NoError(t, err)
+	}
+	count, forkFrom, err = mirror2.previewConvertToBranch()
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+	require.Equal(t, localRevision-1, forkFrom)
+	err = mirror2.convertToBranch(ctx, signer, uid, verifyingKey,
+		MDJournalBranchReasonExplicitFork)
+	require.NoError(t, err)
+	require.Equal(t, 0, getTlfJournalLength(t, mirror2))
+	require.Equal(t, prevRoot, mirror2.lastMdID)
+}
+
+func TestMDJournalPutAndGet(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	prevRoot := fakeMdID(1)
+	for i := 0; i < 3; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		irmd, err := j.putAndGet(
+			ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+		require.NoError(t, err)
+		require.Equal(t, revision, irmd.RevisionNumber())
+
+		head, err := j.getHead(uid)
+		require.NoError(t, err)
+		require.Equal(t, head, irmd)
+		prevRoot = irmd.mdID
+	}
+}
+
+func TestMDJournalIterateRange(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	prevRoot := fakeMdID(1)
+	mdCount := 5
+	var mdIDs []MdID
+	for i := 0; i < mdCount; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, mdID)
+		prevRoot = mdID
+	}
+
+	// Iterating should yield the same MDs as getRange, in order.
+	ibrmds, err := j.getRange(uid, 1, firstRevision+MetadataRevision(mdCount))
+	require.NoError(t, err)
+	var iterated []ImmutableBareRootMetadata
+	err = j.iterateRange(uid, 1, firstRevision+MetadataRevision(mdCount),
+		func(ibrmd ImmutableBareRootMetadata) error {
+			iterated = append(iterated, ibrmd)
+			return nil
+		})
+	require.NoError(t, err)
+	require.Equal(t, ibrmds, iterated)
+
+	// An error from the callback should stop the iteration.
+	stopErr := errors.New("stop")
+	var revisions []MetadataRevision
+	err = j.iterateRange(uid, firstRevision, firstRevision+3,
+		func(ibrmd ImmutableBareRootMetadata) error {
+			revisions = append(revisions, ibrmd.RevisionNumber())
+			if len(revisions) == 2 {
+				return stopErr
+			}
+			return nil
+		})
+	require.Equal(t, stopErr, err)
+	require.Equal(t,
+		[]MetadataRevision{firstRevision, firstRevision + 1}, revisions)
+
+	// A corrupt MD should be reported along with its revision,
+	// after the entries before it have been yielded.
+	err = ioutil.WriteFile(j.mdPath(mdIDs[2]), []byte("garbage"), 0600)
+	require.NoError(t, err)
+	revisions = nil
+	err = j.iterateRange(uid, firstRevision,
+		firstRevision+MetadataRevision(mdCount),
+		func(ibrmd ImmutableBareRootMetadata) error {
+			revisions = append(revisions, ibrmd.RevisionNumber())
+			return nil
+		})
+	require.IsType(t, MDJournalDecodeError{}, err)
+	require.Equal(t, firstRevision+2, err.(MDJournalDecodeError).Revision)
+	require.Equal(t, mdIDs[2], err.(MDJournalDecodeError).ID)
+	require.Equal(t,
+		[]MetadataRevision{firstRevision, firstRevision + 1}, revisions)
+}
+
+func TestMDJournalSnapshot(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	// An empty journal has an empty snapshot.
+	snap, err := j.snapshot()
+	require.NoError(t, err)
+	ibrmds, err := j.getRangeAtSnapshot(uid, snap, 1, 100)
+	require.NoError(t, err)
+	require.Nil(t, ibrmds)
+
+	firstRevision := MetadataRevision(10)
+	mdCount := 5
+	prevRoot := putMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, firstRevision, fakeMdID(1),
+		mdCount)
+
+	snap, err = j.snapshot()
+	require.NoError(t, err)
+
+	// Put more MDs concurrently with reads at the snapshot, with
+	// lock standing in for the tlfJournalBundle lock. The MDs are
+	// made here, since makeMDForTest can fail the test, which
+	// mustn't be done from another goroutine; errors from the
+	// puts are sent back on errCh instead.
+	var mds []*RootMetadata
+	for i := mdCount; i < 2*mdCount; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		mds = append(mds, makeMDForTest(t, id, h, revision, uid, MdID{}))
+	}
+	var lock sync.Mutex
+	errCh := make(chan error, 1)
+	go func() {
+		prevRoot := prevRoot
+		for _, md := range mds {
+			md.SetPrevRoot(prevRoot)
+			lock.Lock()
+			mdID, err := j.put(
+				ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+			lock.Unlock()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			prevRoot = mdID
+		}
+		errCh <- nil
+	}()
+
+	stop := firstRevision + MetadataRevision(2*mdCount)
+	checkRange := func() {
+		lock.Lock()
+		defer lock.Unlock()
+		ibrmds, err := j.getRangeAtSnapshot(uid, snap, 1, stop)
+		require.NoError(t, err)
+		require.Equal(t, mdCount, len(ibrmds))
+		for i, ibrmd := range ibrmds {
+			require.Equal(t, firstRevision+MetadataRevision(i),
+				ibrmd.RevisionNumber())
+		}
+	}
+	for i := 0; i < mdCount; i++ {
+		checkRange()
+	}
+	require.NoError(t, <-errCh)
+	checkRange()
+	require.Equal(t, 2*mdCount, getTlfJournalLength(t, j))
+
+	// Replacing the head invalidates a snapshot of it.
+	snap, err = j.snapshot()
+	require.NoError(t, err)
+	head, err := j.getHead(uid)
+	require.NoError(t, err)
+	md := makeMDForTest(t, id, h, stop-1, uid, head.GetPrevRoot())
+	md.SetDiskUsage(501)
+	_, err = j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.NoError(t, err)
+	_, err = j.getRangeAtSnapshot(uid, snap, 1, stop)
+	require.IsType(t, MDJournalSnapshotStaleError{}, err)
+}
+
+func TestMDJournalDistinctWriters(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	writers, err := j.distinctWriters()
+	require.NoError(t, err)
+	require.Equal(t, map[keybase1.UID][]VerifyingKey{}, writers)
+
+	ctx := context.Background()
+
+	// Put some MDs from the first device, then some from a
+	// second one.
+	signingKey2 := MakeFakeSigningKeyOrBust("fake seed 2")
+	signer2 := cryptoSignerLocal{signingKey2}
+	verifyingKey2 := signingKey2.GetVerifyingKey()
+
+	firstRevision := MetadataRevision(10)
+	prevRoot := fakeMdID(1)
+	mdCount := 4
+	for i := 0; i < mdCount; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		s, k := signer, verifyingKey
+		if i >= mdCount/2 {
+			s, k = signer2, verifyingKey2
+		}
+		mdID, err := j.put(ctx, s, ekg, bsplit, md, uid, k)
+		require.NoError(t, err)
+		prevRoot = mdID
+	}
+
+	writers, err = j.distinctWriters()
+	require.NoError(t, err)
+	require.Equal(t, map[keybase1.UID][]VerifyingKey{
+		uid: {verifyingKey, verifyingKey2},
+	}, writers)
+}
+
+func TestMDJournalVerify(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	err := j.verify(ctx, uid, []VerifyingKey{verifyingKey})
+	require.NoError(t, err)
+
+	firstRevision := MetadataRevision(10)
+	prevRoot := fakeMdID(1)
+	mdCount := 5
+	var mdIDs []MdID
+	for i := 0; i < mdCount; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, mdID)
+		prevRoot = mdID
+	}
+
+	err = j.verify(ctx, uid, []VerifyingKey{verifyingKey})
+	require.NoError(t, err)
+
+	// A different user should fail on the first entry.
+	err = j.verify(ctx, keybase1.MakeTestUID(2), []VerifyingKey{verifyingKey})
+	require.IsType(t, MDJournalVerifyError{}, err)
+	require.Equal(t, firstRevision, err.(MDJournalVerifyError).Revision)
+	require.Equal(t, MDJournalInvariantLastModifiedBy,
+		err.(MDJournalVerifyError).Invariant)
+
+	// Point an entry at the wrong MD.
+	badRevision := firstRevision + 2
+	err = j.j.j.writeJournalEntry(journalOrdinal(badRevision),
+		mdIDJournalEntry{ID: mdIDs[0]})
+	require.NoError(t, err)
+	err = j.verify(ctx, uid, []VerifyingKey{verifyingKey})
+	require.IsType(t, MDJournalVerifyError{}, err)
+	require.Equal(t, badRevision, err.(MDJournalVerifyError).Revision)
+	require.Equal(t, MDJournalInvariantRevision,
+		err.(MDJournalVerifyError).Invariant)
+
+	// Restore it, and corrupt a later MD instead.
+	err = j.j.j.writeJournalEntry(journalOrdinal(badRevision),
+		mdIDJournalEntry{ID: mdIDs[2]})
+	require.NoError(t, err)
+	err = ioutil.WriteFile(j.mdPath(mdIDs[3]), []byte("garbage"), 0600)
+	require.NoError(t, err)
+	err = j.verify(ctx, uid, []VerifyingKey{verifyingKey})
+	require.IsType(t, MDJournalVerifyError{}, err)
+	require.Equal(t, firstRevision+3, err.(MDJournalVerifyError).Revision)
+	require.Equal(t, MDJournalInvariantDecode,
+		err.(MDJournalVerifyError).Invariant)
+
+	// Verifying shouldn't have changed the journal.
+	require.Equal(t, mdCount, getTlfJournalLength(t, j))
+	latest, err := j.j.getLatest()
+	require.NoError(t, err)
+	require.Equal(t, mdIDs[mdCount-1], latest)
+}
+
+// countingCodec is a Codec that records how much data is decoded
+// through it.
+type countingCodec struct {
+	Codec
+	decodes      int
+	decodedBytes int
+	maxDecode    int
+}
+
+func (c *countingCodec) Decode(buf []byte, obj interface{}) error {
+	c.decodes++
+	c.decodedBytes += len(buf)
+	if len(buf) > c.maxDecode {
+		c.maxDecode = len(buf)
+	}
+	return c.Codec.Decode(buf, obj)
+}
+
+func TestMDJournalVerifyLarge(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	prevRoot := fakeMdID(1)
+	mdCount := 100
+	var mdIDs []MdID
+	for i := 0; i < mdCount; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, mdID)
+		prevRoot = mdID
+	}
+
+	var totalMDBytes, maxMDBytes int
+	for _, mdID := range mdIDs {
+		fi, err := os.Stat(j.mdPath(mdID))
+		require.NoError(t, err)
+		size := int(fi.Size())
+		totalMDBytes += size
+		if size > maxMDBytes {
+			maxMDBytes = size
+		}
+	}
+
+	codec := &countingCodec{Codec: j.codec}
+	j.codec = codec
+
+	err := j.verify(ctx, uid, []VerifyingKey{verifyingKey})
+	require.NoError(t, err)
+
+	// Nothing bigger than a single MD should have been decoded at
+	// once, and each MD should only have been decoded a bounded
+	// number of times.
+	require.True(t, codec.maxDecode <= maxMDBytes,
+		"max decode %d > max MD size %d", codec.maxDecode, maxMDBytes)
+	require.True(t, codec.decodedBytes <= 2*totalMDBytes,
+		"decoded %d bytes for %d bytes of MDs",
+		codec.decodedBytes, totalMDBytes)
+	fullDecodes := codec.decodes
+
+	// Plant a break in the middle of the chain: a validly-signed
+	// MD for the right revision that doesn't point to its
+	// predecessor.
+	badRevision := firstRevision + MetadataRevision(mdCount/2)
+	md := makeMDForTest(t, id, h, badRevision, uid, fakeMdID(2))
+	brmd, err := encryptMDPrivateData(
+		ctx, j.codec, j.crypto, signer, ekg, uid, md.ReadOnly())
+	require.NoError(t, err)
+	rmds := RootMetadataSigned{MD: brmd.(MutableBareRootMetadata)}
+	err = signMD(ctx, j.codec, signer, &rmds)
+	require.NoError(t, err)
+	badID, err := j.putMD(rmds.MD, uid, verifyingKey)
+	require.NoError(t, err)
+	err = j.j.j.writeJournalEntry(journalOrdinal(badRevision),
+		mdIDJournalEntry{ID: badID})
+	require.NoError(t, err)
+
+	*codec = countingCodec{Codec: codec.Codec}
+	err = j.verify(ctx, uid, []VerifyingKey{verifyingKey})
+	require.IsType(t, MDJournalVerifyError{}, err)
+	require.Equal(t, badRevision, err.(MDJournalVerifyError).Revision)
+	require.Equal(t, MDJournalInvariantSuccessor,
+		err.(MDJournalVerifyError).Invariant)
+
+	// Verification should have stopped at the break.
+	require.True(t, codec.decodes < fullDecodes,
+		"%d decodes with a break, %d without", codec.decodes, fullDecodes)
+}
+
+// writeLegacyMDJournalEntries rewrites the entries of j for the given
+// revisions as bare MdIDs, the way journals stored them before
+// mdIDJournalEntry was added.
+func writeLegacyMDJournalEntries(t *testing.T, codec Codec, j *mdJournal,
+	start, stop MetadataRevision) {
+	for r := start; r <= stop; r++ {
+		entry, err := j.j.readJournalEntry(r)
+		require.NoError(t, err)
+		buf, err := codec.Encode(entry.ID)
+		require.NoError(t, err)
+		p, err := j.j.journalEntryPath(r)
+		require.NoError(t, err)
+		err = ioutil.WriteFile(p, buf, 0600)
+		require.NoError(t, err)
+	}
+}
+
+func TestMDJournalLegacyEntries(t *testing.T) {
+	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	prevRoot := fakeMdID(1)
+	mdCount := 3
+	var mdIDs []MdID
+	for i := 0; i < mdCount; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, mdID)
+		prevRoot = mdID
+	}
+
+	lastRevision := firstRevision + MetadataRevision(mdCount-1)
+	writeLegacyMDJournalEntries(t, codec, j, firstRevision, lastRevision)
+
+	// A journal with legacy entries should still be readable.
+	log := logger.NewTestLogger(t)
+	legacy, err := makeMDJournal(codec, crypto, tempdir, log)
+	require.NoError(t, err)
+	ibrmds, err := legacy.getRange(uid, firstRevision, lastRevision)
+	require.NoError(t, err)
+	require.Equal(t, mdCount, len(ibrmds))
+	for i, ibrmd := range ibrmds {
+		require.Equal(t, mdIDs[i], ibrmd.mdID)
+	}
+
+	// And writable.
+	md := makeMDForTest(t, id, h, lastRevision+1, uid, prevRoot)
+	_, err = legacy.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.NoError(t, err)
+	require.Equal(t, mdCount+1, getTlfJournalLength(t, legacy))
+}
+
+func TestMDJournalFormatVersionMigration(t *testing.T) {
+	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	// A new journal opened without migration shouldn't record
+	// anything.
+	v, recorded, err := j.readFormatVersion()
+	require.NoError(t, err)
+	require.Equal(t, currentMDJournalFormatVer, v)
+	require.False(t, recorded)
+	_, err = os.Stat(j.formatVersionPath())
+	require.True(t, os.IsNotExist(err))
+
+	firstRevision := MetadataRevision(10)
+	mdCount := 3
+	prevRoot := putMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, firstRevision, fakeMdID(1),
+		mdCount)
+
+	// Turn it into an unversioned journal with bare MdID entries.
+	lastRevision := firstRevision + MetadataRevision(mdCount-1)
+	writeLegacyMDJournalEntries(t, codec, j, firstRevision, lastRevision)
+
+	log := logger.NewTestLogger(t)
+
+	// Without migration, it should be left as is.
+	_, err = makeMDJournal(codec, crypto, tempdir, log)
+	require.NoError(t, err)
+	v, recorded, err = j.readFormatVersion()
+	require.NoError(t, err)
+	require.Equal(t, mdJournalFormatVerUnversioned, v)
+	require.False(t, recorded)
+
+	migrated, err := makeMDJournalWithOptions(
+		codec, crypto, tempdir, log, mdJournalOptions{migrate: true})
+	require.NoError(t, err)
+	v, recorded, err = migrated.readFormatVersion()
+	require.NoError(t, err)
+	require.Equal(t, currentMDJournalFormatVer, v)
+	require.True(t, recorded)
+
+	// Every entry should now be stored in the current format.
+	for r := firstRevision; r <= lastRevision; r++ {
+		p, err := migrated.j.journalEntryPath(r)
+		require.NoError(t, err)
+		buf, err := ioutil.ReadFile(p)
+		require.NoError(t, err)
+		var entry mdIDJournalEntry
+		err = codec.Decode(buf, &entry)
+		require.NoError(t, err)
+	}
+
+	ibrmds, err := migrated.getRange(
+		uid, firstRevision, firstRevision+MetadataRevision(mdCount))
+	require.NoError(t, err)
+	require.Equal(t, mdCount, len(ibrmds))
+	require.Equal(t, prevRoot, ibrmds[mdCount-1].mdID)
+
+	// A version from the future should be rejected.
+	err = migrated.writeFormatVersion(currentMDJournalFormatVer + 1)
+	require.NoError(t, err)
+	_, err = makeMDJournalWithOptions(
+		codec, crypto, tempdir, log, mdJournalOptions{migrate: true})
+	require.Equal(t, MDJournalFormatVersionError{
+		Version: currentMDJournalFormatVer + 1,
+		Current: currentMDJournalFormatVer,
+	}, err)
+}
+
+func TestMDJournalRepairHead(t *testing.T) {
+	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	firstRevision := MetadataRevision(10)
+	prevRoot := fakeMdID(1)
+	mdCount := 5
+	var mdIDs []MdID
+	for i := 0; i < mdCount; i++ {
+		revision := firstRevision + MetadataRevision(i)
+		md := makeMDForTest(t, id, h, revision, uid, prevRoot)
+		mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, mdID)
+		prevRoot = mdID
+	}
+
+	// Simulate a torn write: the head is recorded past the last
+	// entry, and the last entry doesn't chain onto the one
+	// before it.
+	lastRevision := firstRevision + MetadataRevision(mdCount-1)
+	err := j.j.j.writeJournalEntry(journalOrdinal(lastRevision),
+		mdIDJournalEntry{ID: mdIDs[mdCount-3]})
+	require.NoError(t, err)
+	err = j.j.writeLatestRevision(lastRevision + 2)
+	require.NoError(t, err)
+
+	log := logger.NewTestLogger(t)
+	_, err = makeMDJournal(codec, crypto, tempdir, log)
+	require.Equal(t, MDJournalHeadMismatchError{
+		Head:          lastRevision + 2,
+		HighestOnDisk: lastRevision,
+	}, err)
+
+	repaired, err := makeMDJournalWithOptions(
+		codec, crypto, tempdir, log, mdJournalOptions{repair: true})
+	quarantineDir := filepath.Join(tempdir, "md_journal_quarantine")
+	require.Equal(t, MDJournalRepairedError{
+		OldHead:       lastRevision + 2,
+		NewHead:       lastRevision - 1,
+		QuarantineDir: quarantineDir,
+	}, err)
+	require.NotNil(t, repaired)
+
+	head, err := repaired.getHead(uid)
+	require.NoError(t, err)
+	require.Equal(t, lastRevision-1, head.RevisionNumber())
+	require.Equal(t, mdIDs[mdCount-2], head.mdID)
+	require.Equal(t, mdCount-1, getTlfJournalLength(t, repaired))
+
+	require.Len(t,
+		quarantinedPathsForTest(t, repaired, lastRevision), 1)
+
+	// The repaired journal should now load cleanly.
+	_, err = makeMDJournal(codec, crypto, tempdir, log)
+	require.NoError(t, err)
+}
+
+// quarantinedPathsForTest returns the paths of the entries for
+// revision r that have been moved into j's quarantine directory.
+func quarantinedPathsForTest(
+	t *testing.T, j *mdJournal, r MetadataRevision) []string {
+	paths, err := filepath.Glob(filepath.Join(
+		j.quarantinePath(), journalOrdinal(r).String()+"-*"))
+	require.NoError(t, err)
+	return paths
+}
+
+// putTornMDRangeForTest puts mdCount MDs into j like
+// putMDRangeForTest, and then simulates a torn write of the last
+// one, so that repairing the journal quarantines it. It returns the
+// revision of the torn entry.
+func putTornMDRangeForTest(t *testing.T, j *mdJournal,
+	signer cryptoSigner, ekg encryptionKeyGetter, bsplit BlockSplitter,
+	id TlfID, h BareTlfHandle, uid keybase1.UID,
+	verifyingKey VerifyingKey, firstRevision MetadataRevision,
+	mdCount int) MetadataRevision {
+	putMDRangeForTest(t, j, signer, ekg, bsplit, id, h, uid,
+		verifyingKey, firstRevision, fakeMdID(1), mdCount)
+
+	lastRevision := firstRevision + MetadataRevision(mdCount-1)
+	err := j.j.j.writeJournalEntry(journalOrdinal(lastRevision),
+		mdIDJournalEntry{ID: fakeMdID(2)})
+	require.NoError(t, err)
+	err = j.j.writeLatestRevision(lastRevision + 1)
+	require.NoError(t, err)
+	return lastRevision
+}
+
+func TestMDJournalPruneQuarantine(t *testing.T) {
+	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	mdCount := 3
+	lastRevision := putTornMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, MetadataRevision(10), mdCount)
+
+	log := logger.NewTestLogger(t)
+	repaired, err := makeMDJournalWithOptions(
+		codec, crypto, tempdir, log, mdJournalOptions{repair: true})
+	require.IsType(t, MDJournalRepairedError{}, err)
+	quarantinedPaths := quarantinedPathsForTest(t, repaired, lastRevision)
+	require.Len(t, quarantinedPaths, 1)
+	quarantinedPath := quarantinedPaths[0]
+	_, err = os.Stat(quarantinedPath)
+	require.NoError(t, err)
+
+	clock, now := newTestClockAndTimeNow()
+	repaired.clock = clock
+
+	// With no retention policy, nothing is pruned.
+	clock.Set(now.Add(365 * 24 * time.Hour))
+	err = repaired.pruneQuarantine()
+	require.NoError(t, err)
+	_, err = os.Stat(quarantinedPath)
+	require.NoError(t, err)
+
+	// Within the retention window, nothing is pruned.
+	repaired.quarantineRetention = 7 * 24 * time.Hour
+	clock.Set(now.Add(6 * 24 * time.Hour))
+	err = repaired.pruneQuarantine()
+	require.NoError(t, err)
+	_, err = os.Stat(quarantinedPath)
+	require.NoError(t, err)
+
+	// Past the retention window, the quarantined entry is
+	// removed.
+	clock.Set(now.Add(8 * 24 * time.Hour))
+	err = repaired.pruneQuarantine()
+	require.NoError(t, err)
+	_, err = os.Stat(quarantinedPath)
+	require.True(t, os.IsNotExist(err))
+
+	// The journal itself is unaffected.
+	require.Equal(t, mdCount-1, getTlfJournalLength(t, repaired))
+}
+
+func TestMDJournalPruneQuarantineOnOpen(t *testing.T) {
+	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	mdCount := 3
+	lastRevision := putTornMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, MetadataRevision(10), mdCount)
+
+	log := logger.NewTestLogger(t)
+	retention := 7 * 24 * time.Hour
+	clock, now := newTestClockAndTimeNow()
+	options := mdJournalOptions{
+		repair:              true,
+		quarantineRetention: retention,
+		clock:               clock,
+	}
+	repaired, err := makeMDJournalWithOptions(
+		codec, crypto, tempdir, log, options)
+	require.IsType(t, MDJournalRepairedError{}, err)
+	require.Equal(t, clock, repaired.clock)
+	quarantinedPaths := quarantinedPathsForTest(t, repaired, lastRevision)
+	require.Len(t, quarantinedPaths, 1)
+	quarantinedPath := quarantinedPaths[0]
+	_, err = os.Stat(quarantinedPath)
+	require.NoError(t, err)
+
+	// Reopening within the retention window keeps the
+	// quarantined entry.
+	options.repair = false
+	clock.Set(now.Add(6 * 24 * time.Hour))
+	_, err = makeMDJournalWithOptions(codec, crypto, tempdir, log, options)
+	require.NoError(t, err)
+	_, err = os.Stat(quarantinedPath)
+	require.NoError(t, err)
+
+	// Reopening once it's past the retention window removes it.
+	clock.Set(now.Add(8 * 24 * time.Hour))
+	reopened, err := makeMDJournalWithOptions(
+		codec, crypto, tempdir, log, options)
+	require.NoError(t, err)
+	_, err = os.Stat(quarantinedPath)
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, mdCount-1, getTlfJournalLength(t, reopened))
+}
+
+func TestMDJournalPruneQuarantineOnCompact(t *testing.T) {
+	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+
+	mdCount := 3
+	lastRevision := putTornMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, MetadataRevision(10), mdCount)
+
+	log := logger.NewTestLogger(t)
+	retention := 7 * 24 * time.Hour
+	repaired, err := makeMDJournalWithOptions(codec, crypto, tempdir, log,
+		mdJournalOptions{repair: true, quarantineRetention: retention})
+	require.IsType(t, MDJournalRepairedError{}, err)
+	quarantinedPaths := quarantinedPathsForTest(t, repaired, lastRevision)
+	require.Len(t, quarantinedPaths, 1)
+	quarantinedPath := quarantinedPaths[0]
+
+	clock, now := newTestClockAndTimeNow()
+	repaired.clock = clock
+
+	// Compacting within the retention window keeps the
+	// quarantined entry.
+	clock.Set(now.Add(6 * 24 * time.Hour))
+	_, err = repaired.compact(ctx)
+	require.NoError(t, err)
+	_, err = os.Stat(quarantinedPath)
+	require.NoError(t, err)
+
+	// Compacting once it's past the retention window removes it.
+	clock.Set(now.Add(8 * 24 * time.Hour))
+	_, err = repaired.compact(ctx)
+	require.NoError(t, err)
+	_, err = os.Stat(quarantinedPath)
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, mdCount-1, getTlfJournalLength(t, repaired))
+}
+
+// Tests that an entry quarantined by a second repair doesn't
+// overwrite one with the same revision from an earlier repair, or
+// reset its retention.
+func TestMDJournalQuarantineTwoRepairs(t *testing.T) {
+	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	log := logger.NewTestLogger(t)
+	retention := 7 * 24 * time.Hour
+	clock, now := newTestClockAndTimeNow()
+	options := mdJournalOptions{
+		repair:              true,
+		quarantineRetention: retention,
+		clock:               clock,
+	}
+
+	mdCount := 3
+	lastRevision := putTornMDRangeForTest(t, j, signer, ekg, bsplit,
+		id, h, uid, verifyingKey, MetadataRevision(10), mdCount)
+	repaired, err := makeMDJournalWithOptions(
+		codec, crypto, tempdir, log, options)
+	require.IsType(t, MDJournalRepairedError{}, err)
+	firstPaths := quarantinedPathsForTest(t, repaired, lastRevision)
+	require.Len(t, firstPaths, 1)
+
+	// Tear the same revision again, and repair it a day later.
+	clock.Set(now.Add(24 * time.Hour))
+	err = repaired.j.j.writeJournalEntry(journalOrdinal(lastRevision),
+		mdIDJournalEntry{ID: fakeMdID(3)})
+	require.NoError(t, err)
+	err = repaired.j.writeLatestRevision(lastRevision + 1)
+	require.NoError(t, err)
+	repaired, err = makeMDJournalWithOptions(
+		codec, crypto, tempdir, log, options)
+	require.IsType(t, MDJournalRepairedError{}, err)
+
+	// Both quarantined entries should be there.
+	paths := quarantinedPathsForTest(t, repaired, lastRevision)
+	require.Len(t, paths, 2)
+	require.Contains(t, paths, firstPaths[0])
+
+	// Once the first entry's retention is up, only it is pruned.
+	clock.Set(now.Add(retention + time.Hour))
+	err = repaired.pruneQuarantine()
+	require.NoError(t, err)
+	paths = quarantinedPathsForTest(t, repaired, lastRevision)
+	require.Len(t, paths, 1)
+	require.NotEqual(t, firstPaths[0], paths[0])
+	require.Equal(t, mdCount-1, getTlfJournalLength(t, repaired))
+}
+
+func TestMDJournalMDTooLarge(t *testing.T) {
+	_, _, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+	j.maxMDBytes = 100
+
+	md := makeMDForTest(t, id, h, MetadataRevision(10), uid, fakeMdID(1))
+	_, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.IsType(t, MDJournalTooLargeError{}, err)
+	require.Equal(t, 0, getTlfJournalLength(t, j))
+
+	// Removing the limit should let the put through.
+	j.maxMDBytes = 0
+	md = makeMDForTest(t, id, h, MetadataRevision(10), uid, fakeMdID(1))
+	_, err = j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.NoError(t, err)
+	require.Equal(t, 1, getTlfJournalLength(t, j))
+}
+
+func TestMDJournalMDTooLargePrivateMetadata(t *testing.T) {
+	codec, crypto, uid, id, h, signer, verifyingKey, ekg, bsplit, tempdir, _ :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+	const maxMDBytes = 4096
+	log := logger.NewTestLogger(t)
+	j, err := makeMDJournalWithOptions(codec, crypto, tempdir, log,
+		mdJournalOptions{maxMDBytes: maxMDBytes})
+	require.NoError(t, err)
+
+	// A small MD fits.
+	md := makeMDForTest(t, id, h, MetadataRevision(10), uid, fakeMdID(1))
+	mdID, err := j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	require.NoError(t, err)
+
+	// But one whose private metadata serializes to more than the
+	// limit doesn't.
+	md = makeMDForTest(t, id, h, MetadataRevision(11), uid, mdID)
+	md.data.Dir.SymPath = strings.Repeat("x", 2*maxMDBytes)
+	_, err = j.put(ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+	tooLargeErr, ok := err.(MDJournalTooLargeError)
+	require.True(t, ok, "Unexpected error %v", err)
+	require.Equal(t, MetadataRevision(11), tooLargeErr.Revision)
+	require.True(t, tooLargeErr.Size > maxMDBytes)
+	require.Equal(t, uint64(maxMDBytes), tooLargeErr.Max)
+	require.Equal(t, 1, getTlfJournalLength(t, j))
+}
+
+func TestMDJournalHeadDelta(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	mdserver, err := NewMDServerMemory(config)
+	require.NoError(t, err)
+	defer mdserver.Shutdown()
+
+	ctx := context.Background()
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	verifyingKey, err := config.KBPKI().GetCurrentVerifyingKey(ctx)
+	require.NoError(t, err)
+	signer := config.Crypto()
+	ekg := singleEncryptionKeyGetter{MakeTLFCryptKey([32]byte{0x1})}
+	bsplit, err := NewBlockSplitterSimpleExact(64*1024, 8*1024)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdserver.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "md_journal_head_delta")
+	require.NoError(t, err)
+	defer teardownMDJournalTest(t, tempdir)
+	j, err := makeMDJournal(config.Codec(), config.Crypto(), tempdir,
+		logger.NewTestLogger(t))
+	require.NoError(t, err)
+
+	checkDelta := func(expectedLocal, expectedServer MetadataRevision,
+		expectedForked bool) {
+		localHead, serverHead, forked, err := j.headDelta(ctx, mdserver, uid)
+		require.NoError(t, err)
+		require.Equal(t, expectedLocal, localHead)
+		require.Equal(t, expectedServer, serverHead)
+		require.Equal(t, expectedForked, forked)
+	}
+
+	prevRoot := MdID{}
+	putMDs := func(start, stop MetadataRevision) {
+		for rev := start; rev <= stop; rev++ {
+			md := makeMDForTest(t, id, h, rev, uid, prevRoot)
+			mdID, err := j.put(
+				ctx, signer, ekg, bsplit, md, uid, verifyingKey)
+			require.NoError(t, err)
+			prevRoot = mdID
+		}
+	}
+
+	// Nothing to compare with an empty journal.
+	checkDelta(MetadataRevisionUninitialized,
+		MetadataRevisionUninitialized, false)
+
+	// Nothing has been flushed yet, but the journal chains onto
+	// the (empty) server history.
+	putMDs(MetadataRevisionInitial, 3)
+	checkDelta(3, MetadataRevisionUninitialized, false)
+
+	// In sync: flush everything, but leave the head in the
+	// journal, as if we crashed right after pushing it.
+	for i := 0; i < 2; i++ {
+		flushed, err := j.flushOne(ctx, signer, uid, verifyingKey, mdserver, 0)
+		require.NoError(t, err)
+		require.True(t, flushed)
+	}
+	_, err = j.pushEarliestToServer(ctx, signer, mdserver)
+	require.NoError(t, err)
+	checkDelta(3, 3, false)
+
+	// Local ahead.
+	putMDs(4, 5)
+	checkDelta(5, 3, false)
+
+	// Forked: someone else puts a different revision 4.
+	rmds, err := mdserver.GetForTLF(ctx, id, NullBranchID, Merged)
+	require.NoError(t, err)
+	serverPrevRoot, err := config.Crypto().MakeMdID(rmds.MD)
+	require.NoError(t, err)
+	rmds4 := makeRMDSForTest(t, id, h, 4, uid, serverPrevRoot)
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds4)
+	err = mdserver.Put(ctx, rmds4)
+	require.NoError(t, err)
+	checkDelta(5, 4, true)
+}
@@ -8,9 +8,11 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol"
 	"golang.org/x/net/context"
 )
 
@@ -46,20 +48,39 @@ func (md *MDOpsStandard) convertVerifyingKeyError(ctx context.Context,
 	return UnverifiableTlfUpdateError{tlf, writer, err}
 }
 
+// checkVerifyingKey checks that the given key is a valid verifying
+// key for the given user.  For final handles, any key the user has
+// ever had is accepted; otherwise the key must have been valid at
+// the given server time.  If that fails and the config allows
+// unverified keys, fall back to accepting any known key for the
+// user, with a warning.
+func (md *MDOpsStandard) checkVerifyingKey(ctx context.Context,
+	handle *TlfHandle, uid keybase1.UID, key VerifyingKey,
+	atServerTime time.Time) error {
+	kbpki := md.config.KBPKI()
+	if handle.IsFinal() {
+		return kbpki.HasUnverifiedVerifyingKey(ctx, uid, key)
+	}
+	err := kbpki.HasVerifyingKey(ctx, uid, key, atServerTime)
+	if err == nil || !md.config.AllowUnverifiedKeys() {
+		return err
+	}
+	if unverifiedErr := kbpki.HasUnverifiedVerifyingKey(
+		ctx, uid, key); unverifiedErr != nil {
+		return err
+	}
+	md.log.CWarningf(ctx, "Accepting unverified key %s for user %s "+
+		"in TLF %s: %v", key, uid, handle.GetCanonicalPath(), err)
+	return nil
+}
+
 func (md *MDOpsStandard) verifyWriterKey(
 	ctx context.Context, rmds *RootMetadataSigned, handle *TlfHandle) error {
 	if !rmds.MD.IsWriterMetadataCopiedSet() {
-		var err error
-		if handle.IsFinal() {
-			err = md.config.KBPKI().HasUnverifiedVerifyingKey(ctx,
-				rmds.MD.LastModifyingWriter(),
-				rmds.MD.GetWriterMetadataSigInfo().VerifyingKey)
-		} else {
-			err = md.config.KBPKI().HasVerifyingKey(ctx,
-				rmds.MD.LastModifyingWriter(),
-				rmds.MD.GetWriterMetadataSigInfo().VerifyingKey,
-				rmds.untrustedServerTimestamp)
-		}
+		err := md.checkVerifyingKey(ctx, handle,
+			rmds.MD.LastModifyingWriter(),
+			rmds.MD.GetWriterMetadataSigInfo().VerifyingKey,
+			rmds.untrustedServerTimestamp)
 		if err != nil {
 			return md.convertVerifyingKeyError(ctx, rmds, handle, err)
 		}
@@ -137,16 +158,9 @@ func (md *MDOpsStandard) processMetadata(
 		return ImmutableRootMetadata{}, err
 	}
 
-	if handle.IsFinal() {
-		err = md.config.KBPKI().HasUnverifiedVerifyingKey(
-			ctx, rmds.MD.GetLastModifyingUser(),
-			rmds.SigInfo.VerifyingKey)
-	} else {
-		err = md.config.KBPKI().HasVerifyingKey(
-			ctx, rmds.MD.GetLastModifyingUser(),
-			rmds.SigInfo.VerifyingKey,
-			rmds.untrustedServerTimestamp)
-	}
+	err = md.checkVerifyingKey(ctx, handle,
+		rmds.MD.GetLastModifyingUser(), rmds.SigInfo.VerifyingKey,
+		rmds.untrustedServerTimestamp)
 	if err != nil {
 		return ImmutableRootMetadata{}, md.convertVerifyingKeyError(ctx, rmds, handle, err)
 	}
@@ -457,6 +471,19 @@ func (md *MDOpsStandard) GetRange(ctx context.Context, id TlfID,
 	return md.getRange(ctx, id, NullBranchID, Merged, start, stop)
 }
 
+// GetReferencedBlocks returns the IDs of all the blocks referenced by
+// the merged revisions of the given TLF between start and stop
+// (inclusive), deduplicated across revisions. This is useful for
+// warming the block cache, or for planning garbage collection.
+func (md *MDOpsStandard) GetReferencedBlocks(ctx context.Context, id TlfID,
+	start, stop MetadataRevision) ([]BlockID, error) {
+	rmds, err := md.GetRange(ctx, id, start, stop)
+	if err != nil {
+		return nil, err
+	}
+	return getReferencedBlocks(rmds), nil
+}
+
 // GetUnmergedRange implements the MDOps interface for MDOpsStandard.
 func (md *MDOpsStandard) GetUnmergedRange(ctx context.Context, id TlfID,
 	bid BranchID, start, stop MetadataRevision) ([]ImmutableRootMetadata, error) {
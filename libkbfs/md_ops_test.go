@@ -366,6 +366,53 @@ func TestMDOpsGetForHandlePublicFailFindKey(t *testing.T) {
 	}
 }
 
+func TestMDOpsGetForHandlePublicAllowUnverifiedKeys(t *testing.T) {
+	mockCtrl, config, ctx := mdOpsInit(t)
+	defer mdOpsShutdown(mockCtrl, config)
+
+	rmds, h := newRMDS(t, config, true)
+
+	// The key can't be verified at the server time, but it is a
+	// known key for the user.  Expect two gets.
+	verifyMDForPublic(config, rmds, nil, KeyNotFoundError{})
+	verifyMDForPublic(config, rmds, nil, KeyNotFoundError{})
+	config.mockKbpki.EXPECT().HasUnverifiedVerifyingKey(gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+	config.mockCodec.EXPECT().Decode(
+		rmds.MD.GetSerializedPrivateMetadata(), gomock.Any()).Return(nil)
+	config.mockMdserv.EXPECT().GetForHandle(ctx, h.ToBareHandleOrBust(),
+		Merged).Times(2).Return(NullTlfID, rmds, nil)
+
+	// Rejected by default.
+	_, _, err := config.MDOps().GetForHandle(ctx, h, Merged)
+	require.IsType(t, UnverifiableTlfUpdateError{}, err)
+
+	// Accepted once unverified keys are allowed.
+	config.SetAllowUnverifiedKeys(true)
+	_, rmd2, err := config.MDOps().GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+	require.Equal(t, rmds.MD, rmd2.bareMd)
+}
+
+func TestMDOpsGetForHandlePublicAllowUnverifiedKeysFailFindKey(t *testing.T) {
+	mockCtrl, config, ctx := mdOpsInit(t)
+	defer mdOpsShutdown(mockCtrl, config)
+
+	rmds, h := newRMDS(t, config, true)
+
+	// Even an unverified lookup can't find the key, so the MD must
+	// still be rejected.
+	config.SetAllowUnverifiedKeys(true)
+	verifyMDForPublic(config, rmds, nil, KeyNotFoundError{})
+	config.mockKbpki.EXPECT().HasUnverifiedVerifyingKey(gomock.Any(),
+		gomock.Any(), gomock.Any()).AnyTimes().Return(KeyNotFoundError{})
+	config.mockMdserv.EXPECT().GetForHandle(ctx, h.ToBareHandleOrBust(),
+		Merged).Return(NullTlfID, rmds, nil)
+
+	_, _, err := config.MDOps().GetForHandle(ctx, h, Merged)
+	require.IsType(t, UnverifiableTlfUpdateError{}, err)
+}
+
 func TestMDOpsGetForHandlePublicFailVerify(t *testing.T) {
 	mockCtrl, config, ctx := mdOpsInit(t)
 	defer mdOpsShutdown(mockCtrl, config)
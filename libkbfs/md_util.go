@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol"
@@ -222,6 +223,439 @@ func getMergedMDUpdates(ctx context.Context, config Config, id TlfID,
 	return mergedRmds, nil
 }
 
+// branchPoint identifies the merged MD that an unmerged branch
+// diverged from.
+type branchPoint struct {
+	rev      MetadataRevision
+	prevRoot MdID
+}
+
+// getBranchPoint returns the merged revision and MdID that the given
+// unmerged branch diverged from, by finding the branch's earliest
+// MD. It returns ok == false if the branch has no MDs.
+func getBranchPoint(ctx context.Context, mdserver MDServer, id TlfID,
+	bid BranchID) (bp branchPoint, ok bool, err error) {
+	bp, _, ok, err = getBranchRange(ctx, mdserver, id, bid)
+	return bp, ok, err
+}
+
+// getBranchRange is like getBranchPoint, but also returns the
+// revision of the head of the branch.
+func getBranchRange(ctx context.Context, mdserver MDServer, id TlfID,
+	bid BranchID) (bp branchPoint, headRev MetadataRevision, ok bool,
+	err error) {
+	head, err := mdserver.GetForTLF(ctx, id, bid, Unmerged)
+	if err != nil {
+		return branchPoint{}, MetadataRevisionUninitialized, false, err
+	}
+	if head == nil {
+		return branchPoint{}, MetadataRevisionUninitialized, false, nil
+	}
+
+	// Walk backwards until we find the start of the branch.
+	earliest := head.MD
+	stop := head.MD.RevisionNumber()
+	for stop >= MetadataRevisionInitial {
+		start := stop - maxMDsAtATime + 1 // (MetadataRevision is signed)
+		if start < MetadataRevisionInitial {
+			start = MetadataRevisionInitial
+		}
+		rmdses, err := mdserver.GetRange(ctx, id, bid, Unmerged, start, stop)
+		if err != nil {
+			return branchPoint{}, MetadataRevisionUninitialized,
+				false, err
+		}
+		if len(rmdses) == 0 {
+			break
+		}
+		earliest = rmdses[0].MD
+		if earliest.RevisionNumber() > start {
+			break
+		}
+		stop = start - 1
+	}
+
+	return branchPoint{
+		rev:      earliest.RevisionNumber() - 1,
+		prevRoot: earliest.GetPrevRoot(),
+	}, head.MD.RevisionNumber(), true, nil
+}
+
+// getBranchesOrCurrent returns the unmerged branches of the given
+// TLF, as GetBranches does. If the server doesn't support
+// GetBranches, it returns just the current device's branch, if any,
+// which is the only one the server exposes.
+func getBranchesOrCurrent(ctx context.Context, mdserver MDServer,
+	id TlfID) ([]BranchID, error) {
+	bids, err := mdserver.GetBranches(ctx, id)
+	if _, ok := err.(MDServerUnsupportedError); !ok {
+		return bids, err
+	}
+
+	head, err := mdserver.GetForTLF(ctx, id, NullBranchID, Unmerged)
+	if err != nil {
+		return nil, err
+	}
+	if head == nil {
+		return nil, nil
+	}
+	return []BranchID{head.MD.BID()}, nil
+}
+
+// getServerConflicts returns a ConflictInfo for each unmerged branch
+// of the given TLF on the server that has at least one MD, in branch
+// ID order.
+func getServerConflicts(ctx context.Context, mdserver MDServer,
+	id TlfID) ([]ConflictInfo, error) {
+	bids, err := getBranchesOrCurrent(ctx, mdserver, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var conflicts []ConflictInfo
+	for _, bid := range bids {
+		bp, headRev, ok, err := getBranchRange(ctx, mdserver, id, bid)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		conflicts = append(conflicts, ConflictInfo{
+			Tlf:            id,
+			BID:            bid,
+			MergedRevision: bp.rev,
+			RevisionStart:  bp.rev + 1,
+			RevisionEnd:    headRev,
+		})
+	}
+	return conflicts, nil
+}
+
+// FindForkedBranches returns the unmerged branches of the given TLF
+// that diverge from the same merged MD as at least one other
+// unmerged branch, e.g. because two devices each converted their
+// journals to a different branch after the same conflict. All such
+// branches need to be resolved together. The returned branches are
+// sorted by ID. If the server doesn't support GetBranches, only the
+// current device's branch is visible, so no forks are found.
+func FindForkedBranches(ctx context.Context, config Config, id TlfID) (
+	[]BranchID, error) {
+	mdserver := config.MDServer()
+	bids, err := getBranchesOrCurrent(ctx, mdserver, id)
+	if err != nil {
+		return nil, err
+	}
+
+	branchesByPoint := make(map[branchPoint][]BranchID)
+	for _, bid := range bids {
+		bp, ok, err := getBranchPoint(ctx, mdserver, id, bid)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		branchesByPoint[bp] = append(branchesByPoint[bp], bid)
+	}
+
+	var forked []BranchID
+	for _, bpBids := range branchesByPoint {
+		if len(bpBids) > 1 {
+			forked = append(forked, bpBids...)
+		}
+	}
+	sortBranchIDs(forked)
+	return forked, nil
+}
+
+// TaggedRootMetadataSigned is an MD returned by GetRangeAll, tagged
+// with the line of history it's on.
+type TaggedRootMetadataSigned struct {
+	RMDS        *RootMetadataSigned
+	BID         BranchID
+	MergeStatus MergeStatus
+}
+
+type taggedRMDSByRevision []TaggedRootMetadataSigned
+
+func (t taggedRMDSByRevision) Len() int { return len(t) }
+
+func (t taggedRMDSByRevision) Less(i, j int) bool {
+	return t[i].RMDS.MD.RevisionNumber() < t[j].RMDS.MD.RevisionNumber()
+}
+
+func (t taggedRMDSByRevision) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+
+// validateRevisionRange returns an MDServerErrorBadRequest unless
+// start and stop make a valid range of revisions to get from an
+// MDServer. Both endpoints are inclusive, so start == stop selects a
+// single revision; neither may be MetadataRevisionUninitialized (or
+// negative), and stop may not be less than start. A valid range may
+// still extend past the revisions the server has, in which case only
+// the existing ones are returned.
+func validateRevisionRange(start, stop MetadataRevision) error {
+	if start < MetadataRevisionInitial || stop < MetadataRevisionInitial {
+		return MDServerErrorBadRequest{Reason: fmt.Sprintf(
+			"Invalid revision range [%s, %s]: revisions must be at least %s",
+			start, stop, MetadataRevisionInitial)}
+	}
+	if stop < start {
+		return MDServerErrorBadRequest{Reason: fmt.Sprintf(
+			"Invalid revision range [%s, %s]: stop is before start",
+			start, stop)}
+	}
+	return nil
+}
+
+// filterRMDSesByWriter returns the elements of rmdses whose last
+// modifying writer is the given user, in the same order.
+func filterRMDSesByWriter(
+	rmdses []*RootMetadataSigned, writer keybase1.UID) []*RootMetadataSigned {
+	var filtered []*RootMetadataSigned
+	for _, rmds := range rmdses {
+		if rmds.MD.LastModifyingWriter() == writer {
+			filtered = append(filtered, rmds)
+		}
+	}
+	return filtered
+}
+
+// GetRangeAll returns the MDs of the given TLF between start and
+// stop, inclusive, from both the merged history and every unmerged
+// branch on the server (or just the current device's, if the server
+// doesn't support GetBranches). Each MD is tagged with its branch ID and
+// merge status. The result is sorted by revision; for the same
+// revision, the merged MD comes first, followed by the unmerged ones
+// in branch ID order.
+func GetRangeAll(ctx context.Context, mdserver MDServer, id TlfID,
+	start, stop MetadataRevision) ([]TaggedRootMetadataSigned, error) {
+	rmdses, err := mdserver.GetRange(
+		ctx, id, NullBranchID, Merged, start, stop)
+	if err != nil {
+		return nil, err
+	}
+	var tagged []TaggedRootMetadataSigned
+	for _, rmds := range rmdses {
+		tagged = append(tagged,
+			TaggedRootMetadataSigned{rmds, NullBranchID, Merged})
+	}
+
+	bids, err := getBranchesOrCurrent(ctx, mdserver, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, bid := range bids {
+		rmdses, err := mdserver.GetRange(
+			ctx, id, bid, Unmerged, start, stop)
+		if err != nil {
+			return nil, err
+		}
+		for _, rmds := range rmdses {
+			tagged = append(tagged,
+				TaggedRootMetadataSigned{rmds, bid, Unmerged})
+		}
+	}
+
+	// GetBranches returns the branches in ID order, so a stable
+	// sort keeps the order described above.
+	sort.Stable(taggedRMDSByRevision(tagged))
+	return tagged, nil
+}
+
+// MDRangeToken is an opaque continuation token returned by
+// GetRangePaged, for fetching the next page of a range of MDs. The
+// empty token means that there are no more pages.
+type MDRangeToken string
+
+func makeMDRangeToken(next, stop MetadataRevision) MDRangeToken {
+	return MDRangeToken(fmt.Sprintf("%d:%d", next, stop))
+}
+
+func (t MDRangeToken) decode() (next, stop MetadataRevision, err error) {
+	var n, s int64
+	_, err = fmt.Sscanf(string(t), "%d:%d", &n, &s)
+	if err != nil || n < int64(MetadataRevisionInitial) || s < n {
+		return MetadataRevisionUninitialized,
+			MetadataRevisionUninitialized, InvalidMDRangeTokenError{t}
+	}
+	return MetadataRevision(n), MetadataRevision(s), nil
+}
+
+// GetRangePaged is like MDServer.GetRange, except that it only asks
+// the server for the first limit revisions between start and stop,
+// inclusive, so that a single call never returns more than limit
+// MDs. It also returns a token that can be passed to
+// GetRangePagedFromToken to fetch the next page, which is empty if
+// the page reaches stop or the server's head. A page may be empty
+// even if later pages aren't, e.g. if the range starts before an
+// unmerged branch does. If limit is non-positive, maxMDsAtATime is
+// used.
+func GetRangePaged(ctx context.Context, mdserver MDServer, id TlfID,
+	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision,
+	limit int) ([]*RootMetadataSigned, MDRangeToken, error) {
+	if limit <= 0 {
+		limit = maxMDsAtATime
+	}
+	if start < MetadataRevisionInitial {
+		start = MetadataRevisionInitial
+	}
+	if stop < start {
+		return nil, "", nil
+	}
+
+	pageStop := start + MetadataRevision(limit) - 1
+	if pageStop >= stop || pageStop < start {
+		// The last check catches overflow.
+		pageStop = stop
+	}
+
+	rmdses, err := mdserver.GetRange(ctx, id, bid, mStatus, start, pageStop)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if pageStop == stop {
+		return rmdses, "", nil
+	}
+
+	// A page that comes back short has gone past the head, so
+	// there's nothing left to fetch. An empty page might just be
+	// before the start of a branch, though, so check the head in
+	// that case.
+	if len(rmdses) > 0 {
+		if rmdses[len(rmdses)-1].MD.RevisionNumber() < pageStop {
+			return rmdses, "", nil
+		}
+	} else {
+		head, err := mdserver.GetForTLF(ctx, id, bid, mStatus)
+		if err != nil {
+			return nil, "", err
+		}
+		if head == nil || head.MD.RevisionNumber() < start {
+			return nil, "", nil
+		}
+	}
+	return rmdses, makeMDRangeToken(pageStop+1, stop), nil
+}
+
+// GetRangePagedFromToken returns the page of MDs following the one
+// that returned token, along with the token for the page after
+// that. The other parameters must be the same as for the original
+// call to GetRangePaged, except limit, which may change between
+// pages.
+func GetRangePagedFromToken(ctx context.Context, mdserver MDServer,
+	id TlfID, bid BranchID, mStatus MergeStatus, token MDRangeToken,
+	limit int) ([]*RootMetadataSigned, MDRangeToken, error) {
+	if token == "" {
+		return nil, "", nil
+	}
+	next, stop, err := token.decode()
+	if err != nil {
+		return nil, "", err
+	}
+	return GetRangePaged(
+		ctx, mdserver, id, bid, mStatus, next, stop, limit)
+}
+
+// getReferencedBlockPointers returns pointers to all the blocks
+// referenced by the given MDs, deduplicated by block ID across all of
+// them. This includes the root directory block of each MD, along
+// with any block newly referenced by one of its ops (which includes
+// any unembedded block changes block).
+func getReferencedBlockPointers(rmds []ImmutableRootMetadata) []BlockPointer {
+	seen := make(map[BlockID]bool)
+	var ptrs []BlockPointer
+	addPtr := func(ptr BlockPointer) {
+		if ptr == zeroPtr || seen[ptr.ID] {
+			return
+		}
+		seen[ptr.ID] = true
+		ptrs = append(ptrs, ptr)
+	}
+	for _, rmd := range rmds {
+		addPtr(rmd.data.Dir.BlockPointer)
+		addPtr(rmd.data.Changes.Info.BlockPointer)
+		for _, op := range rmd.data.Changes.Ops {
+			for _, ptr := range op.Refs() {
+				addPtr(ptr)
+			}
+			for _, update := range op.AllUpdates() {
+				addPtr(update.Ref)
+			}
+		}
+	}
+	return ptrs
+}
+
+// typedBlockPointer is a block pointer along with a constructor for
+// the type of the block it points to.
+type typedBlockPointer struct {
+	ptr      BlockPointer
+	newBlock makeNewBlock
+}
+
+// getTypedBlockPointers returns the pointers to the blocks referenced
+// by the given MD, like getReferencedBlockPointers, but only those
+// whose types can be told from how they're referenced, each with a
+// constructor for its type. The blocks referenced by other ops,
+// e.g. resolutionOps, whose updates may be of files or directories,
+// are left out.
+func getTypedBlockPointers(rmd ImmutableRootMetadata) []typedBlockPointer {
+	seen := make(map[BlockID]bool)
+	var ptrs []typedBlockPointer
+	addPtr := func(ptr BlockPointer, newBlock makeNewBlock) {
+		if ptr == zeroPtr || seen[ptr.ID] {
+			return
+		}
+		seen[ptr.ID] = true
+		ptrs = append(ptrs, typedBlockPointer{ptr, newBlock})
+	}
+	addPtr(rmd.data.Dir.BlockPointer, NewDirBlock)
+	// The changes block is also an implicit ref of the first op,
+	// so add it before any of the ops.
+	addPtr(rmd.data.Changes.Info.BlockPointer, NewFileBlock)
+	for _, op := range rmd.data.Changes.Ops {
+		switch realOp := op.(type) {
+		case *createOp:
+			newBlock := NewFileBlock
+			if realOp.Type == Dir {
+				newBlock = NewDirBlock
+			}
+			for _, ptr := range realOp.Refs() {
+				addPtr(ptr, newBlock)
+			}
+		case *syncOp:
+			addPtr(realOp.File.Ref, NewFileBlock)
+			for _, ptr := range realOp.Refs() {
+				addPtr(ptr, NewFileBlock)
+			}
+		case *rmOp, *renameOp, *setAttrOp:
+		default:
+			// The other ops' updates aren't necessarily
+			// of directories.
+			continue
+		}
+		// The rest of the updates are of the directories along
+		// the op's path.
+		for _, update := range op.AllUpdates() {
+			addPtr(update.Ref, NewDirBlock)
+		}
+	}
+	return ptrs
+}
+
+// getReferencedBlocks returns the IDs of all the blocks referenced by
+// the given MDs, as described in getReferencedBlockPointers.
+func getReferencedBlocks(rmds []ImmutableRootMetadata) []BlockID {
+	ptrs := getReferencedBlockPointers(rmds)
+	ids := make([]BlockID, 0, len(ptrs))
+	for _, ptr := range ptrs {
+		ids = append(ids, ptr.ID)
+	}
+	return ids
+}
+
 // getUnmergedMDUpdates returns a slice of the unmerged MDs for a TLF
 // and unmerged branch, between the merge point for that branch and
 // startRev (inclusive).  The returned MDs are the same instances that
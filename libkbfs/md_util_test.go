@@ -0,0 +1,230 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/protocol"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func makeBlockPointerForTest(b byte) BlockPointer {
+	return BlockPointer{ID: fakeBlockID(b)}
+}
+
+func TestGetReferencedBlocks(t *testing.T) {
+	makeIRMD := func(rev MetadataRevision, root byte, refs []byte,
+		updates [][2]byte) ImmutableRootMetadata {
+		rmd := NewRootMetadata()
+		rmd.SetRevision(rev)
+		rmd.data.Dir.BlockPointer = makeBlockPointerForTest(root)
+		co, err := newCreateOp("x", makeBlockPointerForTest(root), File)
+		require.NoError(t, err)
+		for _, ref := range refs {
+			co.AddRefBlock(makeBlockPointerForTest(ref))
+		}
+		for _, update := range updates {
+			co.AddUpdate(makeBlockPointerForTest(update[0]),
+				makeBlockPointerForTest(update[1]))
+		}
+		rmd.AddOp(co)
+		return MakeImmutableRootMetadata(
+			rmd, fakeMdID(byte(rev)), time.Now())
+	}
+
+	rmds := []ImmutableRootMetadata{
+		makeIRMD(1, 1, []byte{10, 11}, [][2]byte{{1, 2}}),
+		// Overlaps with the refs of revision 1.
+		makeIRMD(2, 2, []byte{11, 12}, [][2]byte{{2, 3}}),
+		// Refs nothing new.
+		makeIRMD(3, 3, []byte{10, 12}, [][2]byte{{3, 2}}),
+	}
+
+	ids := getReferencedBlocks(rmds)
+	expected := []BlockID{
+		fakeBlockID(1), fakeBlockID(10), fakeBlockID(11),
+		fakeBlockID(2), fakeBlockID(12), fakeBlockID(3),
+	}
+	require.Equal(t, expected, ids)
+}
+
+func testFindForkedBranches(t *testing.T, config Config) {
+	mdServer := config.MDServer()
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	// Put some merged MDs.
+	var mergedIDs []MdID
+	prevRoot := MdID{}
+	for i := MetadataRevision(1); i <= 5; i++ {
+		rmds := makeRMDSForTest(t, id, h, i, uid, prevRoot)
+		signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+		err = mdServer.Put(ctx, rmds)
+		require.NoError(t, err)
+		prevRoot, err = config.Crypto().MakeMdID(rmds.MD)
+		require.NoError(t, err)
+		mergedIDs = append(mergedIDs, prevRoot)
+	}
+
+	// putBranch puts count unmerged MDs on a new branch, from
+	// the current device, diverging after the given merged
+	// revision.
+	putBranch := func(after MetadataRevision, count int) BranchID {
+		bid, err := config.Crypto().MakeRandomBranchID()
+		require.NoError(t, err)
+		prevRoot := mergedIDs[after-1]
+		for i := 1; i <= count; i++ {
+			rmds := makeRMDSForTest(
+				t, id, h, after+MetadataRevision(i), uid, prevRoot)
+			rmds.MD.SetUnmerged()
+			rmds.MD.SetBranchID(bid)
+			signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+			err = mdServer.Put(ctx, rmds)
+			require.NoError(t, err)
+			prevRoot, err = config.Crypto().MakeMdID(rmds.MD)
+			require.NoError(t, err)
+		}
+		return bid
+	}
+
+	// Two devices fork off of revision 3, and a third branches
+	// off of revision 5 on its own. The forked branches are
+	// long enough to need more than one GetRange to find their
+	// start.
+	bid1 := putBranch(3, 2*maxMDsAtATime+1)
+
+	devIndex := AddDeviceForLocalUserOrBust(t, config, uid)
+	SwitchDeviceForLocalUserOrBust(t, config, devIndex)
+	bid2 := putBranch(3, 2)
+
+	devIndex = AddDeviceForLocalUserOrBust(t, config, uid)
+	SwitchDeviceForLocalUserOrBust(t, config, devIndex)
+	bid3 := putBranch(5, 1)
+
+	bids, err := mdServer.GetBranches(ctx, id)
+	require.NoError(t, err)
+	expectedBids := []BranchID{bid1, bid2, bid3}
+	sortBranchIDs(expectedBids)
+	require.Equal(t, expectedBids, bids)
+
+	forked, err := FindForkedBranches(ctx, config, id)
+	require.NoError(t, err)
+	expectedForked := []BranchID{bid1, bid2}
+	sortBranchIDs(expectedForked)
+	require.Equal(t, expectedForked, forked)
+
+	// A server that can't list branches only exposes the current
+	// device's branch, which can't fork on its own.
+	config.SetMDServer(noBranchesMDServer{mdServer})
+	forked, err = FindForkedBranches(ctx, config, id)
+	require.NoError(t, err)
+	require.Len(t, forked, 0)
+	config.SetMDServer(mdServer)
+}
+
+func TestFindForkedBranchesMemory(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	testFindForkedBranches(t, config)
+}
+
+func TestFindForkedBranchesDisk(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	mdServer, err := NewMDServerTempDir(config)
+	require.NoError(t, err)
+	config.MDServer().Shutdown()
+	config.SetMDServer(mdServer)
+	testFindForkedBranches(t, config)
+}
+
+func TestGetRangeAll(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	mdServer := config.MDServer()
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	// Put merged revisions 1-5, and an unmerged branch with
+	// revisions 4-6 diverging after revision 3.
+	var mergedIDs []MdID
+	prevRoot := MdID{}
+	for i := MetadataRevision(1); i <= 5; i++ {
+		rmds := makeRMDSForTest(t, id, h, i, uid, prevRoot)
+		signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+		err = mdServer.Put(ctx, rmds)
+		require.NoError(t, err)
+		prevRoot, err = config.Crypto().MakeMdID(rmds.MD)
+		require.NoError(t, err)
+		mergedIDs = append(mergedIDs, prevRoot)
+	}
+
+	bid, err := config.Crypto().MakeRandomBranchID()
+	require.NoError(t, err)
+	prevRoot = mergedIDs[2]
+	for i := MetadataRevision(4); i <= 6; i++ {
+		rmds := makeRMDSForTest(t, id, h, i, uid, prevRoot)
+		rmds.MD.SetUnmerged()
+		rmds.MD.SetBranchID(bid)
+		signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+		err = mdServer.Put(ctx, rmds)
+		require.NoError(t, err)
+		prevRoot, err = config.Crypto().MakeMdID(rmds.MD)
+		require.NoError(t, err)
+	}
+
+	tagged, err := GetRangeAll(ctx, mdServer, id, 2, 6)
+	require.NoError(t, err)
+
+	type tag struct {
+		rev     MetadataRevision
+		bid     BranchID
+		mStatus MergeStatus
+	}
+	expectedTags := []tag{
+		{2, NullBranchID, Merged},
+		{3, NullBranchID, Merged},
+		{4, NullBranchID, Merged},
+		{4, bid, Unmerged},
+		{5, NullBranchID, Merged},
+		{5, bid, Unmerged},
+		{6, bid, Unmerged},
+	}
+	var tags []tag
+	for _, trmds := range tagged {
+		// The tags should agree with the MDs themselves.
+		require.Equal(t, trmds.BID, trmds.RMDS.MD.BID())
+		require.Equal(t, trmds.MergeStatus, trmds.RMDS.MD.MergedStatus())
+		tags = append(tags, tag{
+			trmds.RMDS.MD.RevisionNumber(), trmds.BID, trmds.MergeStatus})
+	}
+	require.Equal(t, expectedTags, tags)
+
+	// A server that can't list branches still exposes the current
+	// device's branch.
+	noBranchesTagged, err := GetRangeAll(
+		ctx, noBranchesMDServer{mdServer}, id, 2, 6)
+	require.NoError(t, err)
+	require.Equal(t, tagged, noBranchesTagged)
+}
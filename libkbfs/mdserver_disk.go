@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -17,15 +18,17 @@ import (
 	"github.com/keybase/client/go/logger"
 	keybase1 "github.com/keybase/client/go/protocol"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	"golang.org/x/net/context"
 )
 
 type mdServerDiskShared struct {
 	dirPath string
 
-	// Protects handleDb, branchDb, tlfStorage, and
-	// truncateLockManager. After Shutdown() is called, handleDb,
-	// branchDb, tlfStorage, and truncateLockManager are nil.
+	// Protects handleDb, branchDb, tlfStorage,
+	// truncateLockManager, and maxBranchRevisions. After
+	// Shutdown() is called, handleDb, branchDb, tlfStorage, and
+	// truncateLockManager are nil.
 	lock sync.RWMutex
 	// Bare TLF handle -> TLF ID
 	handleDb *leveldb.DB
@@ -35,8 +38,12 @@ type mdServerDiskShared struct {
 	// Always use memory for the lock storage, so it gets wiped
 	// after a restart.
 	truncateLockManager *mdServerLocalTruncateLockManager
+	// If non-zero, the maximum number of revisions an unmerged
+	// branch may have.
+	maxBranchRevisions uint64
 
 	updateManager *mdServerLocalUpdateManager
+	quotaManager  *mdServerLocalQuotaManager
 
 	shutdownFunc func(logger.Logger)
 }
@@ -65,6 +72,19 @@ func newMDServerDisk(config Config, dirPath string,
 	if err != nil {
 		return nil, err
 	}
+	quotaPath := filepath.Join(dirPath, "quota_usage")
+	quotaUsage, err := readMDServerDiskQuotaUsage(config.Codec(), quotaPath)
+	if err != nil {
+		return nil, err
+	}
+	saveQuotaUsage := func(usage mdServerLocalQuotaUsage) error {
+		buf, err := config.Codec().Encode(usage)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(quotaPath, buf, 0600)
+	}
+
 	log := config.MakeLogger("")
 	truncateLockManager := newMDServerLocalTruncatedLockManager()
 	shared := mdServerDiskShared{
@@ -74,12 +94,32 @@ func newMDServerDisk(config Config, dirPath string,
 		tlfStorage:          make(map[TlfID]*mdServerTlfStorage),
 		truncateLockManager: &truncateLockManager,
 		updateManager:       newMDServerLocalUpdateManager(),
-		shutdownFunc:        shutdownFunc,
+		quotaManager: newMDServerLocalQuotaManagerWithSave(
+			quotaUsage, saveQuotaUsage),
+		shutdownFunc: shutdownFunc,
 	}
 	mdserv := &MDServerDisk{config, log, &shared}
 	return mdserv, nil
 }
 
+// readMDServerDiskQuotaUsage reads the metadata usage saved at the
+// given path, or returns empty usage if nothing has been saved yet.
+func readMDServerDiskQuotaUsage(codec Codec, path string) (
+	mdServerLocalQuotaUsage, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return makeMDServerLocalQuotaUsage(), nil
+	} else if err != nil {
+		return mdServerLocalQuotaUsage{}, err
+	}
+	var usage mdServerLocalQuotaUsage
+	err = codec.Decode(buf, &usage)
+	if err != nil {
+		return mdServerLocalQuotaUsage{}, err
+	}
+	return usage, nil
+}
+
 // NewMDServerDir constructs a new MDServerDisk that stores its data
 // in the given directory.
 func NewMDServerDir(config Config, dirPath string) (*MDServerDisk, error) {
@@ -134,7 +174,7 @@ func (md *MDServerDisk) getStorage(tlfID TlfID) (*mdServerTlfStorage, error) {
 
 	path := filepath.Join(md.dirPath, tlfID.String())
 	storage = makeMDServerTlfStorage(
-		md.config.Codec(), md.config.Crypto(), path)
+		md.config.Codec(), md.config.Crypto(), md.log, path)
 
 	md.tlfStorage[tlfID] = storage
 	return storage, nil
@@ -298,6 +338,51 @@ func (md *MDServerDisk) deleteBranchID(ctx context.Context, id TlfID) error {
 	return nil
 }
 
+// GetBranches implements the MDServer interface for MDServerDisk.
+func (md *MDServerDisk) GetBranches(ctx context.Context, id TlfID) (
+	[]BranchID, error) {
+	_, currentUID, err := md.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+
+	tlfStorage, err := md.getStorage(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check read permission.
+	_, err = tlfStorage.getForTLF(currentUID, NullBranchID)
+	if err != nil {
+		return nil, err
+	}
+
+	md.lock.RLock()
+	defer md.lock.RUnlock()
+
+	if md.branchDb == nil {
+		return nil, errMDServerDiskShutdown
+	}
+
+	var bids []BranchID
+	iter := md.branchDb.NewIterator(util.BytesPrefix(id.Bytes()), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var bid BranchID
+		err := md.config.Codec().Decode(iter.Value(), &bid)
+		if err != nil {
+			return nil, MDServerError{err}
+		}
+		bids = append(bids, bid)
+	}
+	err = iter.Error()
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+	sortBranchIDs(bids)
+	return bids, nil
+}
+
 // GetForTLF implements the MDServer interface for MDServerDisk.
 func (md *MDServerDisk) GetForTLF(ctx context.Context, id TlfID,
 	bid BranchID, mStatus MergeStatus) (*RootMetadataSigned, error) {
@@ -331,10 +416,13 @@ func (md *MDServerDisk) GetRange(ctx context.Context, id TlfID,
 	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
 	[]*RootMetadataSigned, error) {
 	md.log.CDebugf(ctx, "GetRange %d %d (%s)", start, stop, mStatus)
+	err := validateRevisionRange(start, stop)
+	if err != nil {
+		return nil, err
+	}
 
 	// Lookup the branch ID if not supplied
 	if mStatus == Unmerged && bid == NullBranchID {
-		var err error
 		bid, err = md.getBranchID(ctx, id)
 		if err != nil {
 			return nil, err
@@ -357,8 +445,82 @@ func (md *MDServerDisk) GetRange(ctx context.Context, id TlfID,
 	return tlfStorage.getRange(currentUID, bid, start, stop)
 }
 
+// GetRangeByWriter implements the MDServer interface for
+// MDServerDisk.
+func (md *MDServerDisk) GetRangeByWriter(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision,
+	writer keybase1.UID) ([]*RootMetadataSigned, error) {
+	rmdses, err := md.GetRange(ctx, id, bid, mStatus, start, stop)
+	if err != nil {
+		return nil, err
+	}
+	return filterRMDSesByWriter(rmdses, writer), nil
+}
+
+// GetRevisionTime returns the timestamp recorded by the server for
+// the given revision of the given TLF and branch.
+func (md *MDServerDisk) GetRevisionTime(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus, revision MetadataRevision) (
+	time.Time, error) {
+	rmdses, err := md.GetRange(ctx, id, bid, mStatus, revision, revision)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(rmdses) != 1 {
+		return time.Time{}, MDServerErrorBadRequest{
+			Reason: fmt.Sprintf("No revision %s for TLF %s", revision, id),
+		}
+	}
+	return rmdses[0].untrustedServerTimestamp, nil
+}
+
+// HasRevision implements the MDServer interface for MDServerDisk.
+func (md *MDServerDisk) HasRevision(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus, rev MetadataRevision) (
+	bool, MdID, error) {
+	err := validateRevisionRange(rev, rev)
+	if err != nil {
+		return false, MdID{}, err
+	}
+
+	// Lookup the branch ID if not supplied
+	if mStatus == Unmerged && bid == NullBranchID {
+		bid, err = md.getBranchID(ctx, id)
+		if err != nil {
+			return false, MdID{}, err
+		}
+		if bid == NullBranchID {
+			return false, MdID{}, nil
+		}
+	}
+
+	_, currentUID, err := md.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return false, MdID{}, MDServerError{err}
+	}
+
+	tlfStorage, err := md.getStorage(id)
+	if err != nil {
+		return false, MdID{}, err
+	}
+
+	return tlfStorage.hasRevision(currentUID, bid, rev)
+}
+
 // Put implements the MDServer interface for MDServerDisk.
 func (md *MDServerDisk) Put(ctx context.Context, rmds *RootMetadataSigned) error {
+	return md.put(ctx, rmds, false)
+}
+
+// putImported implements the mdServerHistoryImporter interface for
+// MDServerDisk.
+func (md *MDServerDisk) putImported(
+	ctx context.Context, rmds *RootMetadataSigned) error {
+	return md.put(ctx, rmds, true)
+}
+
+func (md *MDServerDisk) put(
+	ctx context.Context, rmds *RootMetadataSigned, imported bool) error {
 	_, currentUID, err := md.config.KBPKI().GetCurrentUserInfo(ctx)
 	if err != nil {
 		return MDServerError{err}
@@ -369,14 +531,41 @@ func (md *MDServerDisk) Put(ctx context.Context, rmds *RootMetadataSigned) error
 		return MDServerError{err}
 	}
 
+	err = checkMDSize(md.config.Codec(), md.config.MaxMDBytes(), rmds)
+	if err != nil {
+		return err
+	}
+
 	tlfStorage, err := md.getStorage(rmds.MD.TlfID())
 	if err != nil {
 		return err
 	}
 
-	recordBranchID, err := tlfStorage.put(
-		currentUID, currentVerifyingKey, rmds)
+	encodedMd, err := md.config.Codec().Encode(rmds)
+	if err != nil {
+		return MDServerError{err}
+	}
+	size := uint64(len(encodedMd))
+	err = md.quotaManager.reserve(currentUID, rmds.MD.BID(), size)
+	if err != nil {
+		return err
+	}
+
+	var recordBranchID bool
+	if imported {
+		recordBranchID, err = tlfStorage.putImported(ctx,
+			currentUID, md.getMaxBranchRevisions(), rmds)
+	} else {
+		recordBranchID, err = tlfStorage.put(ctx, currentUID,
+			currentVerifyingKey, md.getMaxBranchRevisions(), rmds)
+	}
 	if err != nil {
+		releaseErr := md.quotaManager.release(
+			currentUID, rmds.MD.BID(), size)
+		if releaseErr != nil {
+			md.log.CWarningf(ctx, "Couldn't release quota for a "+
+				"failed put: %v", releaseErr)
+		}
 		return err
 	}
 
@@ -389,6 +578,13 @@ func (md *MDServerDisk) Put(ctx context.Context, rmds *RootMetadataSigned) error
 	}
 
 	mStatus := rmds.MD.MergedStatus()
+	if mStatus == Merged {
+		err = md.updateLatestHandle(ctx, rmds)
+		if err != nil {
+			return err
+		}
+	}
+
 	if mStatus == Merged &&
 		// Don't send notifies if it's just a rekey (the real mdserver
 		// sends a "folder needs rekey" notification in this case).
@@ -399,6 +595,83 @@ func (md *MDServerDisk) Put(ctx context.Context, rmds *RootMetadataSigned) error
 	return nil
 }
 
+// updateLatestHandle makes the handle of the given merged MD the
+// latest one for its TLF, and notifies the observers of handle
+// changes, if it resolves some of the assertions of the TLF's
+// current latest handle.
+func (md *MDServerDisk) updateLatestHandle(
+	ctx context.Context, rmds *RootMetadataSigned) error {
+	id := rmds.MD.TlfID()
+	oldH, err := md.GetLatestHandleForTLF(ctx, id)
+	if err != nil {
+		return err
+	}
+	newH, err := rmds.MD.MakeBareTlfHandle()
+	if err != nil {
+		return MDServerError{err}
+	}
+	if !handleResolvesAssertions(oldH, newH) {
+		return nil
+	}
+
+	newHBytes, err := md.config.Codec().Encode(newH)
+	if err != nil {
+		return MDServerError{err}
+	}
+	idBytes, err := id.MarshalBinary()
+	if err != nil {
+		return MDServerError{err}
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if md.handleDb == nil {
+		return errMDServerDiskShutdown
+	}
+	err = md.handleDb.Put(newHBytes, idBytes, nil)
+	if err != nil {
+		return MDServerError{err}
+	}
+	md.updateManager.setHandle(id, newH)
+	return nil
+}
+
+// TrialPut implements the MDServer interface for MDServerDisk.
+func (md *MDServerDisk) TrialPut(
+	ctx context.Context, rmds *RootMetadataSigned) error {
+	_, currentUID, err := md.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return MDServerError{err}
+	}
+
+	currentVerifyingKey, err := md.config.KBPKI().GetCurrentVerifyingKey(ctx)
+	if err != nil {
+		return MDServerError{err}
+	}
+
+	err = checkMDSize(md.config.Codec(), md.config.MaxMDBytes(), rmds)
+	if err != nil {
+		return err
+	}
+
+	tlfStorage, err := md.getStorage(rmds.MD.TlfID())
+	if err != nil {
+		return err
+	}
+
+	err = tlfStorage.trialPut(currentUID, currentVerifyingKey,
+		md.getMaxBranchRevisions(), rmds)
+	if err != nil {
+		return err
+	}
+
+	encodedMd, err := md.config.Codec().Encode(rmds)
+	if err != nil {
+		return MDServerError{err}
+	}
+	return md.quotaManager.check(currentUID, uint64(len(encodedMd)))
+}
+
 // PruneBranch implements the MDServer interface for MDServerDisk.
 func (md *MDServerDisk) PruneBranch(ctx context.Context, id TlfID, bid BranchID) error {
 	if bid == NullBranchID {
@@ -415,8 +688,13 @@ func (md *MDServerDisk) PruneBranch(ctx context.Context, id TlfID, bid BranchID)
 
 	// Don't actually delete unmerged history. This is intentional
 	// to be consistent with the mdserver behavior-- it garbage
-	// collects discarded branches in the background.
-	return md.deleteBranchID(ctx, id)
+	// collects discarded branches in the background. It no longer
+	// counts against anyone's quota, though.
+	err = md.deleteBranchID(ctx, id)
+	if err != nil {
+		return err
+	}
+	return md.quotaManager.pruneBranch(bid)
 }
 
 func (md *MDServerDisk) getCurrentMergedHeadRevision(
@@ -445,6 +723,71 @@ func (md *MDServerDisk) RegisterForUpdate(ctx context.Context, id TlfID,
 	return c, nil
 }
 
+// RegisterForHandleChange implements the MDServer interface for
+// MDServerDisk.
+func (md *MDServerDisk) RegisterForHandleChange(ctx context.Context,
+	id TlfID) (<-chan BareTlfHandle, error) {
+	// GetLatestHandleForTLF checks that the caller is a reader.
+	_, err := md.GetLatestHandleForTLF(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return md.updateManager.registerForHandleChange(id, md), nil
+}
+
+// PauseNotifications holds back update notifications to observers
+// registered with RegisterForUpdate, for any instance sharing this
+// on-disk server's data, until ResumeNotifications is called. This
+// models a server undergoing maintenance.
+func (md *MDServerDisk) PauseNotifications() {
+	md.updateManager.pause()
+}
+
+// ResumeNotifications delivers the update notifications held back
+// since PauseNotifications was called. Each waiting observer gets a
+// single notification, no matter how many revisions were put to its
+// TLF while paused.
+func (md *MDServerDisk) ResumeNotifications() {
+	md.updateManager.resume()
+}
+
+// GetQuotaInfo implements the MDServer interface for MDServerDisk.
+func (md *MDServerDisk) GetQuotaInfo(ctx context.Context) (
+	used, limit uint64, err error) {
+	_, currentUID, err := md.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return 0, 0, MDServerError{err}
+	}
+	used, limit = md.quotaManager.getQuotaInfo(currentUID)
+	return used, limit, nil
+}
+
+// SetQuotaLimit sets the number of bytes of metadata each user may
+// put to any instance sharing this on-disk server's data. Usage is
+// saved along with the data, but the limit isn't. A limit of 0, the
+// default, means there is none.
+func (md *MDServerDisk) SetQuotaLimit(limit uint64) {
+	md.quotaManager.setLimit(limit)
+}
+
+// SetMaxBranchRevisions sets the maximum number of revisions an
+// unmerged branch may have on any instance sharing this on-disk
+// server's data. Puts that would make a branch longer fail with
+// MDServerErrorTooManyRevisions. A maximum of 0, the default, means
+// there is none.
+func (md *MDServerDisk) SetMaxBranchRevisions(max uint64) {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	md.maxBranchRevisions = max
+}
+
+func (md *MDServerDisk) getMaxBranchRevisions() uint64 {
+	md.lock.RLock()
+	defer md.lock.RUnlock()
+	return md.maxBranchRevisions
+}
+
 // TruncateLock implements the MDServer interface for MDServerDisk.
 func (md *MDServerDisk) TruncateLock(ctx context.Context, id TlfID) (
 	bool, error) {
@@ -502,6 +845,8 @@ func (md *MDServerDisk) Shutdown() {
 		s.shutdown()
 	}
 
+	md.updateManager.shutdownHandleObservers(md)
+
 	if md.shutdownFunc != nil {
 		md.shutdownFunc(md.log)
 	}
@@ -576,17 +921,27 @@ func (md *MDServerDisk) addNewAssertionForTest(uid keybase1.UID,
 		if err != nil {
 			return err
 		}
-		id := iter.Value()
-		if err := md.handleDb.Put(newHandleBytes, id, nil); err != nil {
+		idBytes := iter.Value()
+		if err := md.handleDb.Put(newHandleBytes, idBytes, nil); err != nil {
+			return err
+		}
+		var id TlfID
+		if err := id.UnmarshalBinary(idBytes); err != nil {
 			return err
 		}
+		md.updateManager.setHandle(id, newHandle)
 	}
 	return iter.Error()
 }
 
 // GetLatestHandleForTLF implements the MDServer interface for MDServerDisk.
-func (md *MDServerDisk) GetLatestHandleForTLF(_ context.Context, id TlfID) (
+func (md *MDServerDisk) GetLatestHandleForTLF(ctx context.Context, id TlfID) (
 	BareTlfHandle, error) {
+	_, uid, err := md.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return BareTlfHandle{}, MDServerError{err}
+	}
+
 	md.lock.RLock()
 	defer md.lock.RUnlock()
 
@@ -594,7 +949,13 @@ func (md *MDServerDisk) GetLatestHandleForTLF(_ context.Context, id TlfID) (
 		return BareTlfHandle{}, errMDServerDiskShutdown
 	}
 
+	// Resolving assertions (see addNewAssertionForTest) adds a
+	// handle for the TLF with fewer unresolved users than the
+	// handles it already has, so the latest handle is the one
+	// with the fewest unresolved users.
 	var handle BareTlfHandle
+	found := false
+	unresolved := 0
 	iter := md.handleDb.NewIterator(nil, nil)
 	defer iter.Release()
 	for iter.Next() {
@@ -608,11 +969,24 @@ func (md *MDServerDisk) GetLatestHandleForTLF(_ context.Context, id TlfID) (
 			continue
 		}
 		handleBytes := iter.Key()
-		handle = BareTlfHandle{}
-		err = md.config.Codec().Decode(handleBytes, &handle)
+		var h BareTlfHandle
+		err = md.config.Codec().Decode(handleBytes, &h)
 		if err != nil {
 			return BareTlfHandle{}, err
 		}
+		hUnresolved := len(h.UnresolvedWriters) + len(h.UnresolvedReaders)
+		if !found || hUnresolved < unresolved {
+			handle = h
+			found = true
+			unresolved = hUnresolved
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return BareTlfHandle{}, err
+	}
+
+	if found && !handle.IsReader(uid) {
+		return BareTlfHandle{}, MDServerErrorUnauthorized{}
 	}
 	return handle, nil
 }
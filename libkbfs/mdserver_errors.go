@@ -5,8 +5,12 @@
 package libkbfs
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	keybase1 "github.com/keybase/client/go/protocol"
@@ -39,8 +43,90 @@ const (
 	// StatusCodeMDServerErrorConflictFolderMapping is the error code for a folder handle to folder ID
 	// mapping conflict error.
 	StatusCodeMDServerErrorConflictFolderMapping = 2810
+	// StatusCodeMDServerErrorQuotaExceeded is the error code to indicate the client has used up
+	// its metadata quota.
+	StatusCodeMDServerErrorQuotaExceeded = 2811
+	// StatusCodeMDServerErrorTooManyRevisions is the error code to indicate a put would make
+	// an unmerged branch longer than the server allows.
+	StatusCodeMDServerErrorTooManyRevisions = 2812
+	// StatusCodeMDServerErrorRateLimit is the error code to indicate the client has exceeded
+	// a per-user or per-TLF write rate limit.
+	StatusCodeMDServerErrorRateLimit = 2813
 )
 
+// mdServerStatusInfo is the symbolic name and a short explanation
+// for one of the StatusCodeMDServerError* constants.
+type mdServerStatusInfo struct {
+	name        string
+	explanation string
+}
+
+var mdServerStatusInfos = map[int]mdServerStatusInfo{
+	StatusCodeMDServerError: {
+		"StatusCodeMDServerError", "generic server error"},
+	StatusCodeMDServerErrorBadRequest: {
+		"StatusCodeMDServerErrorBadRequest", "generic client error"},
+	StatusCodeMDServerErrorConflictRevision: {
+		"StatusCodeMDServerErrorConflictRevision",
+		"revision is inconsistent with the current history"},
+	StatusCodeMDServerErrorConflictPrevRoot: {
+		"StatusCodeMDServerErrorConflictPrevRoot",
+		"previous root is inconsistent with the current history"},
+	StatusCodeMDServerErrorConflictDiskUsage: {
+		"StatusCodeMDServerErrorConflictDiskUsage",
+		"disk usage is inconsistent with the current history"},
+	StatusCodeMDServerErrorLocked: {
+		"StatusCodeMDServerErrorLocked",
+		"folder truncation lock is held by someone else"},
+	StatusCodeMDServerErrorUnauthorized: {
+		"StatusCodeMDServerErrorUnauthorized",
+		"client is unauthorized, or the object wasn't found"},
+	StatusCodeMDServerErrorThrottle: {
+		"StatusCodeMDServerErrorThrottle",
+		"client should back off"},
+	StatusCodeMDServerErrorConditionFailed: {
+		"StatusCodeMDServerErrorConditionFailed",
+		"conditional write failed"},
+	StatusCodeMDServerErrorWriteAccess: {
+		"StatusCodeMDServerErrorWriteAccess",
+		"client isn't authorized to write to the folder"},
+	StatusCodeMDServerErrorConflictFolderMapping: {
+		"StatusCodeMDServerErrorConflictFolderMapping",
+		"folder handle to folder ID mapping conflict"},
+	StatusCodeMDServerErrorQuotaExceeded: {
+		"StatusCodeMDServerErrorQuotaExceeded",
+		"client has exceeded its metadata quota"},
+	StatusCodeMDServerErrorTooManyRevisions: {
+		"StatusCodeMDServerErrorTooManyRevisions",
+		"unmerged branch would exceed the maximum length"},
+	StatusCodeMDServerErrorRateLimit: {
+		"StatusCodeMDServerErrorRateLimit",
+		"client is writing faster than its rate limit allows"},
+}
+
+// DescribeStatus returns a human-readable description of the given
+// status, e.g. as returned by the ToStatus method of one of the
+// MDServer errors. It includes the symbolic name of the status code,
+// along with the status name, description, and any fields.
+func DescribeStatus(s keybase1.Status) string {
+	var buf bytes.Buffer
+	if info, ok := mdServerStatusInfos[s.Code]; ok {
+		fmt.Fprintf(&buf, "%s (%d): %s", info.name, s.Code, info.explanation)
+	} else {
+		fmt.Fprintf(&buf, "Unknown status code %d", s.Code)
+	}
+	if s.Name != "" {
+		fmt.Fprintf(&buf, "; name=%s", s.Name)
+	}
+	if s.Desc != "" {
+		fmt.Fprintf(&buf, "; desc=%q", s.Desc)
+	}
+	for _, f := range s.Fields {
+		fmt.Fprintf(&buf, "; %s=%q", f.Key, f.Value)
+	}
+	return buf.String()
+}
+
 // MDServerError is a generic server-side error.
 type MDServerError struct {
 	Err error
@@ -80,6 +166,46 @@ func (e MDServerErrorBadRequest) Error() string {
 	return fmt.Sprintf("Bad MD server request: %s", e.Reason)
 }
 
+const (
+	// mdServerConflictExpectedKey and mdServerConflictActualKey
+	// are the status fields that hold the expected and actual
+	// values of MDServerErrorConflictRevision and
+	// MDServerErrorConflictPrevRoot.
+	mdServerConflictExpectedKey = "EXPECTED"
+	mdServerConflictActualKey   = "ACTUAL"
+
+	// These make up the default descriptions of
+	// MDServerErrorConflictRevision and
+	// MDServerErrorConflictPrevRoot, which are parsed when a
+	// status doesn't have the fields above.
+	mdServerConflictRevisionFormat = "Conflict: expected revision %d, actual %d"
+	mdServerConflictPrevRootPrefix = "Conflict: expected previous root "
+	mdServerConflictPrevRootSep    = ", actual "
+)
+
+func mdServerConflictFields(expected, actual string) []keybase1.StringKVPair {
+	return []keybase1.StringKVPair{
+		{Key: mdServerConflictExpectedKey, Value: expected},
+		{Key: mdServerConflictActualKey, Value: actual},
+	}
+}
+
+// getMDServerConflictFields returns the expected and actual values
+// from the given status, and whether it has both of them.
+func getMDServerConflictFields(s keybase1.Status) (
+	expected, actual string, ok bool) {
+	var hasExpected, hasActual bool
+	for _, f := range s.Fields {
+		switch f.Key {
+		case mdServerConflictExpectedKey:
+			expected, hasExpected = f.Value, true
+		case mdServerConflictActualKey:
+			actual, hasActual = f.Value, true
+		}
+	}
+	return expected, actual, hasExpected && hasActual
+}
+
 // MDServerErrorConflictRevision is returned when the passed MD block is inconsistent with current history.
 type MDServerErrorConflictRevision struct {
 	Desc     string
@@ -90,7 +216,7 @@ type MDServerErrorConflictRevision struct {
 // Error implements the Error interface for MDServerErrorConflictRevision.
 func (e MDServerErrorConflictRevision) Error() string {
 	if e.Desc == "" {
-		return fmt.Sprintf("Conflict: expected revision %d, actual %d", e.Expected, e.Actual)
+		return fmt.Sprintf(mdServerConflictRevisionFormat, e.Expected, e.Actual)
 	}
 	return "MDServerConflictRevision{" + e.Desc + "}"
 }
@@ -100,9 +226,50 @@ func (e MDServerErrorConflictRevision) ToStatus() (s keybase1.Status) {
 	s.Code = StatusCodeMDServerErrorConflictRevision
 	s.Name = "CONFLICT_REVISION"
 	s.Desc = e.Error()
+	if e.Expected != 0 || e.Actual != 0 {
+		s.Fields = mdServerConflictFields(
+			strconv.FormatInt(int64(e.Expected), 10),
+			strconv.FormatInt(int64(e.Actual), 10))
+	}
 	return
 }
 
+func mdServerErrorConflictRevisionFromStatus(
+	s keybase1.Status) MDServerErrorConflictRevision {
+	var expected, actual int64
+	if expectedStr, actualStr, ok := getMDServerConflictFields(s); ok {
+		// Ignore malformed values, like for the description
+		// below.
+		var err error
+		expected, err = strconv.ParseInt(expectedStr, 10, 64)
+		if err == nil {
+			actual, err = strconv.ParseInt(actualStr, 10, 64)
+		}
+		if err != nil {
+			expected, actual = 0, 0
+		}
+	} else {
+		// Older servers only send the description, so parse
+		// the values out of that if it's in the default format.
+		_, err := fmt.Sscanf(
+			s.Desc, mdServerConflictRevisionFormat, &expected, &actual)
+		if err != nil {
+			expected, actual = 0, 0
+		}
+	}
+
+	e := MDServerErrorConflictRevision{
+		Expected: MetadataRevision(expected),
+		Actual:   MetadataRevision(actual),
+	}
+	// Keep the description only if it isn't the default one, so
+	// that the error round-trips.
+	if s.Desc != e.Error() {
+		e.Desc = s.Desc
+	}
+	return e
+}
+
 // MDServerErrorConflictPrevRoot is returned when the passed MD block is inconsistent with current history.
 type MDServerErrorConflictPrevRoot struct {
 	Desc     string
@@ -113,7 +280,8 @@ type MDServerErrorConflictPrevRoot struct {
 // Error implements the Error interface for MDServerErrorConflictPrevRoot.
 func (e MDServerErrorConflictPrevRoot) Error() string {
 	if e.Desc == "" {
-		return fmt.Sprintf("Conflict: expected previous root %v, actual %v", e.Expected, e.Actual)
+		return mdServerConflictPrevRootPrefix + e.Expected.String() +
+			mdServerConflictPrevRootSep + e.Actual.String()
 	}
 	return "MDServerConflictPrevRoot{" + e.Desc + "}"
 }
@@ -123,9 +291,42 @@ func (e MDServerErrorConflictPrevRoot) ToStatus() (s keybase1.Status) {
 	s.Code = StatusCodeMDServerErrorConflictPrevRoot
 	s.Name = "CONFLICT_PREV_ROOT"
 	s.Desc = e.Error()
+	if e.Expected != (MdID{}) || e.Actual != (MdID{}) {
+		s.Fields = mdServerConflictFields(
+			e.Expected.String(), e.Actual.String())
+	}
 	return
 }
 
+func mdServerErrorConflictPrevRootFromStatus(
+	s keybase1.Status) MDServerErrorConflictPrevRoot {
+	expectedStr, actualStr, ok := getMDServerConflictFields(s)
+	if !ok && strings.HasPrefix(s.Desc, mdServerConflictPrevRootPrefix) {
+		// Older servers only send the description, so parse
+		// the IDs out of that if it's in the default format.
+		parts := strings.Split(strings.TrimPrefix(
+			s.Desc, mdServerConflictPrevRootPrefix),
+			mdServerConflictPrevRootSep)
+		if len(parts) == 2 {
+			expectedStr, actualStr = parts[0], parts[1]
+		}
+	}
+
+	// Ignore malformed IDs, like for the revision conflict.
+	var e MDServerErrorConflictPrevRoot
+	expected, expectedErr := mdIDFromString(expectedStr)
+	actual, actualErr := mdIDFromString(actualStr)
+	if expectedErr == nil && actualErr == nil {
+		e.Expected, e.Actual = expected, actual
+	}
+	// Keep the description only if it isn't the default one, so
+	// that the error round-trips.
+	if s.Desc != e.Error() {
+		e.Desc = s.Desc
+	}
+	return e
+}
+
 // MDServerErrorConflictDiskUsage is returned when the passed MD block is inconsistent with current history.
 type MDServerErrorConflictDiskUsage struct {
 	Desc     string
@@ -208,8 +409,16 @@ func (e MDServerErrorWriteAccess) ToStatus() (s keybase1.Status) {
 // MDServerErrorThrottle is returned when the server wants the client to backoff.
 type MDServerErrorThrottle struct {
 	Err error
+	// SuggestedWait is how long the server wants the client to
+	// wait before retrying. Zero means the client should use its
+	// default backoff.
+	SuggestedWait time.Duration
 }
 
+// mdServerThrottleSuggestedWaitKey is the status field that holds
+// MDServerErrorThrottle.SuggestedWait, in milliseconds.
+const mdServerThrottleSuggestedWaitKey = "SUGGESTED_WAIT_MS"
+
 // Error implements the Error interface for MDServerErrorThrottle.
 func (e MDServerErrorThrottle) Error() string {
 	return "MDServerErrorThrottle{" + e.Err.Error() + "}"
@@ -220,6 +429,13 @@ func (e MDServerErrorThrottle) ToStatus() (s keybase1.Status) {
 	s.Code = StatusCodeMDServerErrorThrottle
 	s.Name = "THROTTLE"
 	s.Desc = e.Err.Error()
+	if e.SuggestedWait != 0 {
+		s.Fields = append(s.Fields, keybase1.StringKVPair{
+			Key: mdServerThrottleSuggestedWaitKey,
+			Value: strconv.FormatInt(
+				int64(e.SuggestedWait/time.Millisecond), 10),
+		})
+	}
 	return
 }
 
@@ -267,6 +483,156 @@ func (e MDServerErrorConflictFolderMapping) ToStatus() (s keybase1.Status) {
 	return
 }
 
+// MDServerErrorQuotaExceeded is returned when a put would take the
+// user's metadata usage over its limit.
+type MDServerErrorQuotaExceeded struct {
+	Desc  string
+	Used  uint64
+	Limit uint64
+}
+
+// Error implements the Error interface for MDServerErrorQuotaExceeded.
+func (e MDServerErrorQuotaExceeded) Error() string {
+	if e.Desc == "" {
+		return fmt.Sprintf("Metadata quota exceeded: %d bytes used "+
+			"of %d", e.Used, e.Limit)
+	}
+	return "MDServerErrorQuotaExceeded{" + e.Desc + "}"
+}
+
+// mdServerQuotaUsedKey and mdServerQuotaLimitKey are the status
+// fields that hold the usage and limit of MDServerErrorQuotaExceeded.
+const (
+	mdServerQuotaUsedKey  = "USED"
+	mdServerQuotaLimitKey = "LIMIT"
+)
+
+// ToStatus implements the ExportableError interface for MDServerErrorQuotaExceeded.
+func (e MDServerErrorQuotaExceeded) ToStatus() (s keybase1.Status) {
+	s.Code = StatusCodeMDServerErrorQuotaExceeded
+	s.Name = "QUOTA_EXCEEDED"
+	s.Desc = e.Error()
+	if e.Used != 0 || e.Limit != 0 {
+		s.Fields = []keybase1.StringKVPair{
+			{
+				Key:   mdServerQuotaUsedKey,
+				Value: strconv.FormatUint(e.Used, 10),
+			},
+			{
+				Key:   mdServerQuotaLimitKey,
+				Value: strconv.FormatUint(e.Limit, 10),
+			},
+		}
+	}
+	return
+}
+
+// MDServerErrorTooManyRevisions is returned when a put would make an
+// unmerged branch longer than the maximum number of revisions the
+// server allows. Clients should treat it like a conflict, and wait
+// for conflict resolution to merge the branch back in before
+// retrying the write.
+type MDServerErrorTooManyRevisions struct {
+	Desc   string
+	Max    uint64
+	Actual uint64
+}
+
+// Error implements the Error interface for MDServerErrorTooManyRevisions.
+func (e MDServerErrorTooManyRevisions) Error() string {
+	if e.Desc == "" {
+		return fmt.Sprintf("Too many revisions: branch would have %d, "+
+			"max is %d", e.Actual, e.Max)
+	}
+	return "MDServerErrorTooManyRevisions{" + e.Desc + "}"
+}
+
+// mdServerTooManyRevisionsMaxKey and
+// mdServerTooManyRevisionsActualKey are the status fields that hold
+// the max and actual branch lengths of MDServerErrorTooManyRevisions.
+const (
+	mdServerTooManyRevisionsMaxKey    = "MAX"
+	mdServerTooManyRevisionsActualKey = "ACTUAL"
+)
+
+// ToStatus implements the ExportableError interface for MDServerErrorTooManyRevisions.
+func (e MDServerErrorTooManyRevisions) ToStatus() (s keybase1.Status) {
+	s.Code = StatusCodeMDServerErrorTooManyRevisions
+	s.Name = "TOO_MANY_REVISIONS"
+	s.Desc = e.Error()
+	if e.Max != 0 || e.Actual != 0 {
+		s.Fields = []keybase1.StringKVPair{
+			{
+				Key:   mdServerTooManyRevisionsMaxKey,
+				Value: strconv.FormatUint(e.Max, 10),
+			},
+			{
+				Key:   mdServerTooManyRevisionsActualKey,
+				Value: strconv.FormatUint(e.Actual, 10),
+			},
+		}
+	}
+	return
+}
+
+const (
+	// MDServerRateLimitScopeUser is the MDServerErrorRateLimit
+	// scope for a limit on all of a user's writes.
+	MDServerRateLimitScopeUser = "user"
+	// MDServerRateLimitScopeTlf is the MDServerErrorRateLimit
+	// scope for a limit on the writes to a single TLF.
+	MDServerRateLimitScopeTlf = "tlf"
+)
+
+// MDServerErrorRateLimit is returned when the client has exceeded a
+// write rate limit. Unlike MDServerErrorThrottle, which means the
+// server is overloaded, this is specific to the client's own writes,
+// so it isn't retried automatically and should be surfaced to the
+// user.
+type MDServerErrorRateLimit struct {
+	// Scope is what the limit applies to, e.g.
+	// MDServerRateLimitScopeUser or MDServerRateLimitScopeTlf.
+	Scope string
+	// RetryAfter is how long the client should wait before
+	// writing again. Zero means the server didn't say.
+	RetryAfter time.Duration
+}
+
+// mdServerRateLimitScopeKey and mdServerRateLimitRetryAfterKey are
+// the status fields that hold MDServerErrorRateLimit.Scope and
+// MDServerErrorRateLimit.RetryAfter, in milliseconds.
+const (
+	mdServerRateLimitScopeKey      = "SCOPE"
+	mdServerRateLimitRetryAfterKey = "RETRY_AFTER_MS"
+)
+
+// Error implements the Error interface for MDServerErrorRateLimit.
+func (e MDServerErrorRateLimit) Error() string {
+	return fmt.Sprintf("MDServerErrorRateLimit{scope=%s, retryAfter=%s}",
+		e.Scope, e.RetryAfter)
+}
+
+// ToStatus implements the ExportableError interface for MDServerErrorRateLimit.
+func (e MDServerErrorRateLimit) ToStatus() (s keybase1.Status) {
+	s.Code = StatusCodeMDServerErrorRateLimit
+	s.Name = "RATE_LIMIT"
+	s.Desc = e.Error()
+	if e.Scope != "" {
+		s.Fields = append(s.Fields, keybase1.StringKVPair{
+			Key:   mdServerRateLimitScopeKey,
+			Value: e.Scope,
+		})
+	}
+	if e.RetryAfter != 0 {
+		s.Fields = append(s.Fields, keybase1.StringKVPair{
+			Key: mdServerRateLimitRetryAfterKey,
+			Value: strconv.FormatInt(
+				int64(e.RetryAfter/time.Millisecond), 10),
+		})
+	}
+	return
+}
+
 // MDServerErrorUnwrapper is an implementation of rpc.ErrorUnwrapper
 // for errors coming from the MDServer.
 type MDServerErrorUnwrapper struct{}
@@ -297,10 +663,10 @@ func (eu MDServerErrorUnwrapper) UnwrapError(arg interface{}) (appError error, d
 		appError = MDServerErrorBadRequest{Reason: s.Desc}
 		break
 	case StatusCodeMDServerErrorConflictRevision:
-		appError = MDServerErrorConflictRevision{Desc: s.Desc}
+		appError = mdServerErrorConflictRevisionFromStatus(*s)
 		break
 	case StatusCodeMDServerErrorConflictPrevRoot:
-		appError = MDServerErrorConflictPrevRoot{Desc: s.Desc}
+		appError = mdServerErrorConflictPrevRootFromStatus(*s)
 		break
 	case StatusCodeMDServerErrorConflictDiskUsage:
 		appError = MDServerErrorConflictDiskUsage{Desc: s.Desc}
@@ -312,7 +678,17 @@ func (eu MDServerErrorUnwrapper) UnwrapError(arg interface{}) (appError error, d
 		appError = MDServerErrorUnauthorized{}
 		break
 	case StatusCodeMDServerErrorThrottle:
-		appError = MDServerErrorThrottle{errors.New(s.Desc)}
+		throttleErr := MDServerErrorThrottle{Err: errors.New(s.Desc)}
+		for _, f := range s.Fields {
+			if f.Key == mdServerThrottleSuggestedWaitKey {
+				// Ignore malformed values, and fall back to
+				// the client's default backoff.
+				ms, _ := strconv.ParseInt(f.Value, 10, 64)
+				throttleErr.SuggestedWait =
+					time.Duration(ms) * time.Millisecond
+			}
+		}
+		appError = throttleErr
 		break
 	case StatusCodeMDServerErrorConditionFailed:
 		appError = MDServerErrorConditionFailed{errors.New(s.Desc)}
@@ -323,6 +699,55 @@ func (eu MDServerErrorUnwrapper) UnwrapError(arg interface{}) (appError error, d
 	case StatusCodeMDServerErrorConflictFolderMapping:
 		appError = MDServerErrorConflictFolderMapping{Desc: s.Desc}
 		break
+	case StatusCodeMDServerErrorQuotaExceeded:
+		quotaErr := MDServerErrorQuotaExceeded{Desc: s.Desc}
+		for _, f := range s.Fields {
+			// Ignore malformed values, like for
+			// MDServerErrorThrottle.
+			switch f.Key {
+			case mdServerQuotaUsedKey:
+				quotaErr.Used, _ = strconv.ParseUint(f.Value, 10, 64)
+			case mdServerQuotaLimitKey:
+				quotaErr.Limit, _ = strconv.ParseUint(f.Value, 10, 64)
+			}
+		}
+		appError = quotaErr
+		break
+	case StatusCodeMDServerErrorTooManyRevisions:
+		var tooManyErr MDServerErrorTooManyRevisions
+		for _, f := range s.Fields {
+			// Ignore malformed values, like for
+			// MDServerErrorThrottle.
+			switch f.Key {
+			case mdServerTooManyRevisionsMaxKey:
+				tooManyErr.Max, _ = strconv.ParseUint(f.Value, 10, 64)
+			case mdServerTooManyRevisionsActualKey:
+				tooManyErr.Actual, _ = strconv.ParseUint(f.Value, 10, 64)
+			}
+		}
+		// Keep the description only if it isn't the default one,
+		// like for MDServerErrorConflictRevision.
+		if s.Desc != tooManyErr.Error() {
+			tooManyErr.Desc = s.Desc
+		}
+		appError = tooManyErr
+		break
+	case StatusCodeMDServerErrorRateLimit:
+		var rateLimitErr MDServerErrorRateLimit
+		for _, f := range s.Fields {
+			switch f.Key {
+			case mdServerRateLimitScopeKey:
+				rateLimitErr.Scope = f.Value
+			case mdServerRateLimitRetryAfterKey:
+				// Ignore malformed values, like for
+				// MDServerErrorThrottle.
+				ms, _ := strconv.ParseInt(f.Value, 10, 64)
+				rateLimitErr.RetryAfter =
+					time.Duration(ms) * time.Millisecond
+			}
+		}
+		appError = rateLimitErr
+		break
 	default:
 		ase := libkb.AppStatusError{
 			Code:   s.Code,
@@ -0,0 +1,237 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescribeStatus(t *testing.T) {
+	exportableErrs := []libkb.ExportableError{
+		MDServerError{errors.New("server error")},
+		MDServerErrorBadRequest{Reason: "bad request"},
+		MDServerErrorConflictRevision{Expected: 2, Actual: 1},
+		MDServerErrorConflictPrevRoot{Desc: "prev root"},
+		MDServerErrorConflictDiskUsage{Expected: 2, Actual: 1},
+		MDServerErrorLocked{},
+		MDServerErrorUnauthorized{},
+		MDServerErrorThrottle{Err: errors.New("throttle")},
+		MDServerErrorConditionFailed{errors.New("condition")},
+		MDServerErrorWriteAccess{},
+		MDServerErrorConflictFolderMapping{Desc: "folder mapping"},
+		MDServerErrorQuotaExceeded{Used: 2, Limit: 1},
+		MDServerErrorTooManyRevisions{Max: 1, Actual: 2},
+		MDServerErrorRateLimit{Scope: MDServerRateLimitScopeUser},
+	}
+
+	for _, e := range exportableErrs {
+		s := e.ToStatus()
+		desc := DescribeStatus(s)
+		info, ok := mdServerStatusInfos[s.Code]
+		require.True(t, ok, "No info for code %d", s.Code)
+		require.True(t, strings.HasPrefix(desc, info.name), desc)
+		require.Contains(t, desc, info.explanation)
+		require.Contains(t, desc, "name="+s.Name)
+	}
+
+	// Make sure every known status code has a description.
+	for code := StatusCodeMDServerError; code <=
+		StatusCodeMDServerErrorRateLimit; code++ {
+		desc := DescribeStatus(keybase1.Status{Code: code})
+		require.False(t, strings.HasPrefix(desc, "Unknown"), desc)
+	}
+
+	s := keybase1.Status{
+		Code: 1234,
+		Name: "SOMETHING",
+		Desc: "something happened",
+		Fields: []keybase1.StringKVPair{
+			{Key: "key", Value: "value"},
+		},
+	}
+	require.Equal(t, `Unknown status code 1234; name=SOMETHING; `+
+		`desc="something happened"; key="value"`, DescribeStatus(s))
+}
+
+func TestMDServerErrorThrottleSuggestedWait(t *testing.T) {
+	var eu MDServerErrorUnwrapper
+
+	// Without a suggested wait, the status shouldn't have any
+	// fields, as before.
+	e := MDServerErrorThrottle{Err: errors.New("throttle")}
+	s := e.ToStatus()
+	require.Empty(t, s.Fields)
+	appErr, dispatchErr := eu.UnwrapError(&s)
+	require.NoError(t, dispatchErr)
+	require.Equal(t, e, appErr)
+
+	e.SuggestedWait = 1500 * time.Millisecond
+	s = e.ToStatus()
+	appErr, dispatchErr = eu.UnwrapError(&s)
+	require.NoError(t, dispatchErr)
+	require.Equal(t, e, appErr)
+
+	// A malformed value should fall back to the client default.
+	s.Fields[0].Value = "soon"
+	appErr, dispatchErr = eu.UnwrapError(&s)
+	require.NoError(t, dispatchErr)
+	require.Equal(t, MDServerErrorThrottle{Err: e.Err}, appErr)
+}
+
+func TestMDServerErrorConflictRevisionRoundTrip(t *testing.T) {
+	var eu MDServerErrorUnwrapper
+
+	e := MDServerErrorConflictRevision{Expected: 2, Actual: 1}
+	s := e.ToStatus()
+	appErr, dispatchErr := eu.UnwrapError(&s)
+	require.NoError(t, dispatchErr)
+	require.Equal(t, e, appErr)
+
+	// The values should survive a custom description too.
+	s = MDServerErrorConflictRevision{
+		Desc: "conflict", Expected: 2, Actual: 1}.ToStatus()
+	appErr, dispatchErr = eu.UnwrapError(&s)
+	require.NoError(t, dispatchErr)
+	require.Equal(t, MDServerErrorConflictRevision{
+		Desc: s.Desc, Expected: 2, Actual: 1}, appErr)
+
+	// Without the fields, the values should be parsed out of the
+	// default description.
+	s = e.ToStatus()
+	s.Fields = nil
+	appErr, dispatchErr = eu.UnwrapError(&s)
+	require.NoError(t, dispatchErr)
+	require.Equal(t, MDServerErrorConflictRevision{Expected: 2, Actual: 1},
+		appErr)
+
+	// Malformed fields are ignored.
+	s = MDServerErrorConflictRevision{Expected: 2, Actual: 1}.ToStatus()
+	s.Fields[0].Value = "two"
+	appErr, dispatchErr = eu.UnwrapError(&s)
+	require.NoError(t, dispatchErr)
+	require.Equal(t, MDServerErrorConflictRevision{Desc: s.Desc}, appErr)
+}
+
+func TestMDServerErrorConflictPrevRootRoundTrip(t *testing.T) {
+	var eu MDServerErrorUnwrapper
+
+	for _, e := range []MDServerErrorConflictPrevRoot{
+		{Expected: fakeMdID(2), Actual: fakeMdID(1)},
+		{Expected: fakeMdID(2)},
+	} {
+		s := e.ToStatus()
+		appErr, dispatchErr := eu.UnwrapError(&s)
+		require.NoError(t, dispatchErr)
+		require.Equal(t, e, appErr)
+	}
+
+	// The IDs should survive a custom description too.
+	s := MDServerErrorConflictPrevRoot{Desc: "conflict",
+		Expected: fakeMdID(2), Actual: fakeMdID(1)}.ToStatus()
+	appErr, dispatchErr := eu.UnwrapError(&s)
+	require.NoError(t, dispatchErr)
+	require.Equal(t, MDServerErrorConflictPrevRoot{Desc: s.Desc,
+		Expected: fakeMdID(2), Actual: fakeMdID(1)}, appErr)
+
+	// Without the fields, the IDs should be parsed out of the
+	// default description.
+	e := MDServerErrorConflictPrevRoot{
+		Expected: fakeMdID(2), Actual: fakeMdID(1)}
+	s = e.ToStatus()
+	s.Fields = nil
+	appErr, dispatchErr = eu.UnwrapError(&s)
+	require.NoError(t, dispatchErr)
+	require.Equal(t, e, appErr)
+
+	// Malformed fields are ignored.
+	s = e.ToStatus()
+	s.Fields[1].Value = "not an ID"
+	appErr, dispatchErr = eu.UnwrapError(&s)
+	require.NoError(t, dispatchErr)
+	require.Equal(t, MDServerErrorConflictPrevRoot{Desc: s.Desc}, appErr)
+}
+
+func TestMDServerErrorRateLimitRoundTrip(t *testing.T) {
+	var eu MDServerErrorUnwrapper
+
+	for _, e := range []MDServerErrorRateLimit{
+		{},
+		{Scope: MDServerRateLimitScopeUser},
+		{Scope: MDServerRateLimitScopeTlf, RetryAfter: 2 * time.Second},
+	} {
+		s := e.ToStatus()
+		require.Equal(t, StatusCodeMDServerErrorRateLimit, s.Code)
+		appErr, dispatchErr := eu.UnwrapError(&s)
+		require.NoError(t, dispatchErr)
+		require.Equal(t, e, appErr)
+	}
+
+	// A malformed retry time should be ignored.
+	e := MDServerErrorRateLimit{
+		Scope: MDServerRateLimitScopeTlf, RetryAfter: time.Second}
+	s := e.ToStatus()
+	s.Fields[1].Value = "soon"
+	appErr, dispatchErr := eu.UnwrapError(&s)
+	require.NoError(t, dispatchErr)
+	require.Equal(t,
+		MDServerErrorRateLimit{Scope: MDServerRateLimitScopeTlf}, appErr)
+
+	// Unlike a throttle error, it shouldn't be retried.
+	var md MDServerRemote
+	require.False(t, md.ShouldRetry("put", e))
+	require.True(t, md.ShouldRetry("put",
+		MDServerErrorThrottle{Err: errors.New("throttle")}))
+}
+
+func TestMDServerErrorQuotaExceededRoundTrip(t *testing.T) {
+	var eu MDServerErrorUnwrapper
+
+	s := MDServerErrorQuotaExceeded{Used: 2, Limit: 1}.ToStatus()
+	appErr, dispatchErr := eu.UnwrapError(&s)
+	require.NoError(t, dispatchErr)
+	require.Equal(t, MDServerErrorQuotaExceeded{
+		Desc: s.Desc, Used: 2, Limit: 1}, appErr)
+
+	// Malformed fields are ignored.
+	s.Fields[0].Value = "two"
+	appErr, dispatchErr = eu.UnwrapError(&s)
+	require.NoError(t, dispatchErr)
+	require.Equal(t, MDServerErrorQuotaExceeded{Desc: s.Desc, Limit: 1},
+		appErr)
+}
+
+func TestMDServerErrorTooManyRevisionsRoundTrip(t *testing.T) {
+	var eu MDServerErrorUnwrapper
+
+	e := MDServerErrorTooManyRevisions{Max: 1, Actual: 2}
+	s := e.ToStatus()
+	appErr, dispatchErr := eu.UnwrapError(&s)
+	require.NoError(t, dispatchErr)
+	require.Equal(t, e, appErr)
+	require.Equal(t, e.Error(), appErr.Error())
+
+	// The values should survive a custom description too.
+	s = MDServerErrorTooManyRevisions{
+		Desc: "too many", Max: 1, Actual: 2}.ToStatus()
+	appErr, dispatchErr = eu.UnwrapError(&s)
+	require.NoError(t, dispatchErr)
+	require.Equal(t, MDServerErrorTooManyRevisions{
+		Desc: s.Desc, Max: 1, Actual: 2}, appErr)
+
+	// Malformed fields are ignored.
+	s = e.ToStatus()
+	s.Fields[0].Value = "one"
+	appErr, dispatchErr = eu.UnwrapError(&s)
+	require.NoError(t, dispatchErr)
+	require.Equal(t, MDServerErrorTooManyRevisions{
+		Desc: s.Desc, Actual: 2}, appErr)
+}
@@ -0,0 +1,222 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/net/context"
+)
+
+// tlfHistoryFormatVer is the version of the stream format written
+// by ExportTLFHistory.
+type tlfHistoryFormatVer int
+
+const (
+	firstValidTLFHistoryFormatVer tlfHistoryFormatVer = 1
+	currentTLFHistoryFormatVer                        = firstValidTLFHistoryFormatVer
+)
+
+// tlfHistoryCodecMsgpack is the only codec that TLF history
+// archives are currently written with.
+const tlfHistoryCodecMsgpack = "msgpack"
+
+// maxTLFHistoryFrameSize bounds the size of a single frame in a TLF
+// history archive, so that a corrupt length prefix can't make us
+// allocate an arbitrary amount of memory.
+const maxTLFHistoryFrameSize = 64 << 20
+
+// tlfHistoryHeader is the first frame of a TLF history archive.
+type tlfHistoryHeader struct {
+	FormatVersion tlfHistoryFormatVer
+	Codec         string
+	TlfID         TlfID
+	BranchID      BranchID
+	MergeStatus   MergeStatus
+}
+
+// tlfHistoryEntry is a single revision in a TLF history archive. MD
+// holds the encoded RootMetadataSigned, which must be decoded
+// according to Version.
+type tlfHistoryEntry struct {
+	Version MetadataVer
+	MD      []byte
+}
+
+// mdServerHistoryImporter is implemented by MD servers that can
+// take MDs last modified by writers and devices other than the
+// current one, as ImportTLFHistory needs to. Other servers are
+// just given the MDs with Put.
+type mdServerHistoryImporter interface {
+	putImported(ctx context.Context, rmds *RootMetadataSigned) error
+}
+
+func writeTLFHistoryFrame(codec Codec, w io.Writer, v interface{}) error {
+	buf, err := codec.Encode(v)
+	if err != nil {
+		return err
+	}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(buf)))
+	_, err = w.Write(lenBuf[:])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// readTLFHistoryFrame reads the next frame into v. It returns io.EOF
+// if there are no more frames.
+func readTLFHistoryFrame(codec Codec, r io.Reader, v interface{}) error {
+	var lenBuf [4]byte
+	_, err := io.ReadFull(r, lenBuf[:])
+	if err != nil {
+		return err
+	}
+	frameLen := binary.BigEndian.Uint32(lenBuf[:])
+	if frameLen > maxTLFHistoryFrameSize {
+		return fmt.Errorf("TLF history frame too large: %d bytes", frameLen)
+	}
+	buf := make([]byte, frameLen)
+	_, err = io.ReadFull(r, buf)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	return codec.Decode(buf, v)
+}
+
+// ExportTLFHistory writes every revision of the given TLF branch
+// stored in mdserver to w, as a stream of length-prefixed frames. The
+// first frame is a header recording the TLF ID and the stream
+// format, and each following frame holds one signed MD, in revision
+// order. The output can be read back by ImportTLFHistory.
+func ExportTLFHistory(ctx context.Context, mdserver MDServer, id TlfID,
+	bid BranchID, mStatus MergeStatus, w io.Writer) error {
+	codec := NewCodecMsgpack()
+	header := tlfHistoryHeader{
+		FormatVersion: currentTLFHistoryFormatVer,
+		Codec:         tlfHistoryCodecMsgpack,
+		TlfID:         id,
+		BranchID:      bid,
+		MergeStatus:   mStatus,
+	}
+	err := writeTLFHistoryFrame(codec, w, header)
+	if err != nil {
+		return err
+	}
+
+	start := MetadataRevisionInitial
+	for {
+		stop := start + maxMDsAtATime - 1
+		rmdses, err := mdserver.GetRange(ctx, id, bid, mStatus, start, stop)
+		if err != nil {
+			return err
+		}
+		for _, rmds := range rmdses {
+			buf, err := codec.Encode(rmds)
+			if err != nil {
+				return err
+			}
+			entry := tlfHistoryEntry{
+				Version: rmds.Version(),
+				MD:      buf,
+			}
+			err = writeTLFHistoryFrame(codec, w, entry)
+			if err != nil {
+				return err
+			}
+		}
+		if len(rmdses) < maxMDsAtATime {
+			return nil
+		}
+		start = rmdses[len(rmdses)-1].MD.RevisionNumber() + 1
+	}
+}
+
+// ImportTLFHistory reads a stream written by ExportTLFHistory from r,
+// checks that each MD is validly signed, belongs to the TLF and
+// branch named in the header, and is a valid successor of the one
+// before it, and then puts each one to mdserver in order. The MDs
+// may have been written by any of the TLF's writers and devices. An
+// error partway through leaves the MDs before it in place.
+func ImportTLFHistory(
+	ctx context.Context, mdserver MDServer, r io.Reader) error {
+	codec := NewCodecMsgpack()
+	crypto := MakeCryptoCommon(codec)
+
+	var header tlfHistoryHeader
+	err := readTLFHistoryFrame(codec, r, &header)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	if header.FormatVersion < firstValidTLFHistoryFormatVer ||
+		header.FormatVersion > currentTLFHistoryFormatVer {
+		return fmt.Errorf("Unsupported TLF history format version %d",
+			header.FormatVersion)
+	}
+	if header.Codec != tlfHistoryCodecMsgpack {
+		return fmt.Errorf("Unsupported TLF history codec %q", header.Codec)
+	}
+
+	var prev *RootMetadataSigned
+	var prevID MdID
+	for {
+		var entry tlfHistoryEntry
+		err := readTLFHistoryFrame(codec, r, &entry)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		rmds, err := DecodeRootMetadataSigned(codec, header.TlfID,
+			entry.Version, InitialExtraMetadataVer, entry.MD)
+		if err != nil {
+			return err
+		}
+		if rmds.MD.TlfID() != header.TlfID {
+			return fmt.Errorf("MD for TLF %s in history for TLF %s",
+				rmds.MD.TlfID(), header.TlfID)
+		}
+		if rmds.MD.BID() != header.BranchID ||
+			rmds.MD.MergedStatus() != header.MergeStatus {
+			return fmt.Errorf("MD for branch %s (%s) in history for "+
+				"branch %s (%s)", rmds.MD.BID(), rmds.MD.MergedStatus(),
+				header.BranchID, header.MergeStatus)
+		}
+		err = rmds.IsValidAndSigned(codec, crypto)
+		if err != nil {
+			return err
+		}
+		if prev != nil {
+			err = prev.MD.CheckValidSuccessor(prevID, rmds.MD)
+			if err != nil {
+				return err
+			}
+		}
+
+		if importer, ok := mdserver.(mdServerHistoryImporter); ok {
+			err = importer.putImported(ctx, rmds)
+		} else {
+			err = mdserver.Put(ctx, rmds)
+		}
+		if err != nil {
+			return err
+		}
+
+		prevID, err = crypto.MakeMdID(rmds.MD)
+		if err != nil {
+			return err
+		}
+		prev = rmds
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/keybase/client/go/protocol"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestTLFHistoryExportImport(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	ctx := context.Background()
+
+	srcServer, err := NewMDServerMemory(config)
+	require.NoError(t, err)
+	defer srcServer.Shutdown()
+	dstServer, err := NewMDServerMemory(config)
+	require.NoError(t, err)
+	defer dstServer.Shutdown()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	id, _, err := srcServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	// Put more than one GetRange batch's worth of MDs.
+	const mdCount = 2*maxMDsAtATime + 3
+	prevRoot := MdID{}
+	for i := MetadataRevisionInitial; i <= mdCount; i++ {
+		rmds := makeRMDSForTest(t, id, h, i, uid, prevRoot)
+		signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+		err = srcServer.Put(ctx, rmds)
+		require.NoError(t, err)
+		prevRoot, err = config.Crypto().MakeMdID(rmds.MD)
+		require.NoError(t, err)
+	}
+
+	var buf bytes.Buffer
+	err = ExportTLFHistory(ctx, srcServer, id, NullBranchID, Merged, &buf)
+	require.NoError(t, err)
+
+	err = ImportTLFHistory(ctx, dstServer, &buf)
+	require.NoError(t, err)
+
+	srcRMDSes, err := srcServer.GetRange(
+		ctx, id, NullBranchID, Merged, MetadataRevisionInitial, mdCount)
+	require.NoError(t, err)
+	dstRMDSes, err := dstServer.GetRange(
+		ctx, id, NullBranchID, Merged, MetadataRevisionInitial, mdCount)
+	require.NoError(t, err)
+	require.Equal(t, mdCount, len(srcRMDSes))
+	require.Equal(t, len(srcRMDSes), len(dstRMDSes))
+	for i := range srcRMDSes {
+		require.Equal(t, srcRMDSes[i].MD, dstRMDSes[i].MD)
+		require.Equal(t, srcRMDSes[i].SigInfo, dstRMDSes[i].SigInfo)
+	}
+}
+
+func TestTLFHistoryImportBrokenChain(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	ctx := context.Background()
+
+	dstServer, err := NewMDServerMemory(config)
+	require.NoError(t, err)
+	defer dstServer.Shutdown()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id := FakeTlfID(1, false)
+
+	// Write an archive whose second MD doesn't point back to the
+	// first.
+	var rmdses []*RootMetadataSigned
+	prevRoots := []MdID{{}, fakeMdID(1)}
+	for i, prevRoot := range prevRoots {
+		rmds := makeRMDSForTest(t, id, h,
+			MetadataRevisionInitial+MetadataRevision(i), uid, prevRoot)
+		signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+		rmdses = append(rmdses, rmds)
+	}
+	buf := writeTLFHistoryForTest(t, tlfHistoryHeader{
+		FormatVersion: currentTLFHistoryFormatVer,
+		Codec:         tlfHistoryCodecMsgpack,
+		TlfID:         id,
+		MergeStatus:   Merged,
+	}, rmdses)
+
+	err = ImportTLFHistory(ctx, dstServer, buf)
+	require.IsType(t, MDPrevRootMismatch{}, err)
+
+	// Only the first MD should have been put.
+	head, err := dstServer.GetForTLF(ctx, id, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevisionInitial, head.MD.RevisionNumber())
+}
+
+// writeTLFHistoryForTest writes an archive of rmdses by hand, in the
+// format ExportTLFHistory uses.
+func writeTLFHistoryForTest(t *testing.T, header tlfHistoryHeader,
+	rmdses []*RootMetadataSigned) *bytes.Buffer {
+	codec := NewCodecMsgpack()
+	var buf bytes.Buffer
+	err := writeTLFHistoryFrame(codec, &buf, header)
+	require.NoError(t, err)
+	for _, rmds := range rmdses {
+		encoded, err := codec.Encode(rmds)
+		require.NoError(t, err)
+		err = writeTLFHistoryFrame(codec, &buf, tlfHistoryEntry{
+			Version: rmds.Version(),
+			MD:      encoded,
+		})
+		require.NoError(t, err)
+	}
+	return &buf
+}
+
+func TestTLFHistoryImportOtherDevice(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	ctx := context.Background()
+
+	memServer, err := NewMDServerMemory(config)
+	require.NoError(t, err)
+	defer memServer.Shutdown()
+	diskServer, err := NewMDServerTempDir(config)
+	require.NoError(t, err)
+	defer diskServer.Shutdown()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id := FakeTlfID(1, false)
+
+	// Sign the history with a device other than the current one.
+	signer := cryptoSignerLocal{MakeFakeSigningKeyOrBust("other device")}
+	const mdCount = 3
+	var rmdses []*RootMetadataSigned
+	prevRoot := MdID{}
+	for i := MetadataRevisionInitial; i <= mdCount; i++ {
+		rmds := makeRMDSForTest(t, id, h, i, uid, prevRoot)
+		signRMDSForTest(t, config.Codec(), signer, rmds)
+		rmdses = append(rmdses, rmds)
+		prevRoot, err = config.Crypto().MakeMdID(rmds.MD)
+		require.NoError(t, err)
+	}
+
+	// A plain put needs the current device to be the last
+	// modifier.
+	err = memServer.Put(ctx, rmdses[0])
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+
+	header := tlfHistoryHeader{
+		FormatVersion: currentTLFHistoryFormatVer,
+		Codec:         tlfHistoryCodecMsgpack,
+		TlfID:         id,
+		MergeStatus:   Merged,
+	}
+	for _, mdServer := range []MDServer{memServer, diskServer} {
+		err = ImportTLFHistory(
+			ctx, mdServer, writeTLFHistoryForTest(t, header, rmdses))
+		require.NoError(t, err)
+
+		head, err := mdServer.GetForTLF(ctx, id, NullBranchID, Merged)
+		require.NoError(t, err)
+		require.Equal(t, MetadataRevision(mdCount), head.MD.RevisionNumber())
+	}
+}
+
+func TestTLFHistoryImportWrongBranch(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	ctx := context.Background()
+
+	dstServer, err := NewMDServerMemory(config)
+	require.NoError(t, err)
+	defer dstServer.Shutdown()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id := FakeTlfID(1, false)
+
+	rmds := makeRMDSForTest(t, id, h, MetadataRevisionInitial, uid, MdID{})
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+
+	// A merged MD in history claiming to be for a branch should be
+	// rejected before anything is put.
+	err = ImportTLFHistory(ctx, dstServer, writeTLFHistoryForTest(t,
+		tlfHistoryHeader{
+			FormatVersion: currentTLFHistoryFormatVer,
+			Codec:         tlfHistoryCodecMsgpack,
+			TlfID:         id,
+			BranchID:      FakeBranchID(1),
+			MergeStatus:   Unmerged,
+		}, []*RootMetadataSigned{rmds}))
+	require.Error(t, err)
+
+	head, err := dstServer.GetForTLF(ctx, id, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.Nil(t, head)
+}
@@ -11,6 +11,25 @@ import (
 	keybase1 "github.com/keybase/client/go/protocol"
 )
 
+// checkMDSize returns an MDServerErrorBadRequest if rmds serializes
+// to more than maxMDBytes bytes. A max of 0 means there's no limit.
+func checkMDSize(
+	codec Codec, maxMDBytes uint64, rmds *RootMetadataSigned) error {
+	if maxMDBytes == 0 {
+		return nil
+	}
+	buf, err := codec.Encode(rmds)
+	if err != nil {
+		return MDServerError{err}
+	}
+	if uint64(len(buf)) > maxMDBytes {
+		return MDServerErrorBadRequest{Reason: fmt.Sprintf(
+			"MD of %d bytes exceeds the max of %d bytes",
+			len(buf), maxMDBytes)}
+	}
+	return nil
+}
+
 // Helper to aid in enforcement that only specified public keys can
 // access TLF metadata. mergedMasterHead can be nil, in which case
 // true is returned.
@@ -97,28 +116,33 @@ func (m mdServerLocalTruncateLockManager) truncateUnlock(
 // referenced by multiple mdServerLocal instances sharing the same
 // data. It is goroutine-safe.
 type mdServerLocalUpdateManager struct {
-	// Protects observers and sessionHeads.
-	lock         sync.Mutex
-	observers    map[TlfID]map[mdServerLocal]chan<- error
-	sessionHeads map[TlfID]mdServerLocal
+	// Protects observers, handleObservers, sessionHeads, paused,
+	// and pausedWriters.
+	lock            sync.Mutex
+	observers       map[TlfID]map[mdServerLocal]chan<- error
+	handleObservers map[TlfID]map[mdServerLocal][]chan<- BareTlfHandle
+	sessionHeads    map[TlfID]mdServerLocal
+	paused          bool
+	// pausedWriters records, for each TLF, the sessions that set
+	// a new head while notifications were paused.
+	pausedWriters map[TlfID]map[mdServerLocal]bool
 }
 
 func newMDServerLocalUpdateManager() *mdServerLocalUpdateManager {
 	return &mdServerLocalUpdateManager{
-		observers:    make(map[TlfID]map[mdServerLocal]chan<- error),
-		sessionHeads: make(map[TlfID]mdServerLocal),
+		observers:       make(map[TlfID]map[mdServerLocal]chan<- error),
+		handleObservers: make(map[TlfID]map[mdServerLocal][]chan<- BareTlfHandle),
+		sessionHeads:    make(map[TlfID]mdServerLocal),
+		pausedWriters:   make(map[TlfID]map[mdServerLocal]bool),
 	}
 }
 
-func (m *mdServerLocalUpdateManager) setHead(id TlfID, server mdServerLocal) {
-	m.lock.Lock()
-	defer m.lock.Unlock()
-
-	m.sessionHeads[id] = server
-
-	// now fire all the observers that aren't from this session
+// fireObserversLocked notifies and unregisters every observer of the
+// given TLF for which shouldFire returns true. m.lock must be held.
+func (m *mdServerLocalUpdateManager) fireObserversLocked(
+	id TlfID, shouldFire func(server mdServerLocal) bool) {
 	for k, v := range m.observers[id] {
-		if k != server {
+		if shouldFire(k) {
 			v <- nil
 			close(v)
 			delete(m.observers[id], k)
@@ -129,6 +153,54 @@ func (m *mdServerLocalUpdateManager) setHead(id TlfID, server mdServerLocal) {
 	}
 }
 
+func (m *mdServerLocalUpdateManager) setHead(id TlfID, server mdServerLocal) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.sessionHeads[id] = server
+
+	if m.paused {
+		if _, ok := m.pausedWriters[id]; !ok {
+			m.pausedWriters[id] = make(map[mdServerLocal]bool)
+		}
+		m.pausedWriters[id][server] = true
+		return
+	}
+
+	// now fire all the observers that aren't from this session
+	m.fireObserversLocked(id, func(k mdServerLocal) bool {
+		return k != server
+	})
+}
+
+// pause holds back all update notifications until resume is called.
+func (m *mdServerLocalUpdateManager) pause() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.paused = true
+}
+
+// resume delivers the update notifications held back since pause
+// was called. Each observer gets at most one notification, no matter
+// how many new heads were set for its TLF in the meantime.
+func (m *mdServerLocalUpdateManager) resume() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.paused {
+		return
+	}
+	m.paused = false
+
+	for id, writers := range m.pausedWriters {
+		m.fireObserversLocked(id, func(k mdServerLocal) bool {
+			// Fire unless the observer's own session was the
+			// only writer.
+			return len(writers) > 1 || !writers[k]
+		})
+	}
+	m.pausedWriters = make(map[TlfID]map[mdServerLocal]bool)
+}
+
 func (m *mdServerLocalUpdateManager) registerForUpdate(
 	id TlfID, currHead, currMergedHeadRev MetadataRevision,
 	server mdServerLocal) <-chan error {
@@ -137,9 +209,18 @@ func (m *mdServerLocalUpdateManager) registerForUpdate(
 
 	c := make(chan error, 1)
 	if currMergedHeadRev > currHead && server != m.sessionHeads[id] {
-		c <- nil
-		close(c)
-		return c
+		if !m.paused {
+			c <- nil
+			close(c)
+			return c
+		}
+		// Hold the notification until resume, as if the current
+		// head had been set while paused.
+		head := m.sessionHeads[id]
+		if _, ok := m.pausedWriters[id]; !ok {
+			m.pausedWriters[id] = make(map[mdServerLocal]bool)
+		}
+		m.pausedWriters[id][head] = true
 	}
 
 	if _, ok := m.observers[id]; !ok {
@@ -159,3 +240,228 @@ func (m *mdServerLocalUpdateManager) registerForUpdate(
 	m.observers[id][server] = c
 	return c
 }
+
+// setHandle notifies and unregisters every observer of handle
+// changes for the given TLF.
+func (m *mdServerLocalUpdateManager) setHandle(id TlfID, h BareTlfHandle) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, cs := range m.handleObservers[id] {
+		for _, c := range cs {
+			c <- h
+			close(c)
+		}
+	}
+	delete(m.handleObservers, id)
+}
+
+func (m *mdServerLocalUpdateManager) registerForHandleChange(
+	id TlfID, server mdServerLocal) <-chan BareTlfHandle {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	c := make(chan BareTlfHandle, 1)
+	if m.handleObservers[id] == nil {
+		m.handleObservers[id] = make(map[mdServerLocal][]chan<- BareTlfHandle)
+	}
+	m.handleObservers[id][server] = append(m.handleObservers[id][server], c)
+	return c
+}
+
+// shutdownHandleObservers closes, without sending anything, every
+// channel returned by registerForHandleChange for the given server.
+func (m *mdServerLocalUpdateManager) shutdownHandleObservers(
+	server mdServerLocal) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for id, observers := range m.handleObservers {
+		for _, c := range observers[server] {
+			close(c)
+		}
+		delete(observers, server)
+		if len(observers) == 0 {
+			delete(m.handleObservers, id)
+		}
+	}
+}
+
+// handleResolvesAssertions returns whether newH has fewer unresolved
+// users than oldH, i.e. whether putting an MD with newH resolves some
+// of the assertions of a TLF whose latest handle is oldH.
+func handleResolvesAssertions(oldH, newH BareTlfHandle) bool {
+	oldUnresolved := len(oldH.UnresolvedWriters) + len(oldH.UnresolvedReaders)
+	newUnresolved := len(newH.UnresolvedWriters) + len(newH.UnresolvedReaders)
+	return newUnresolved < oldUnresolved
+}
+
+// mdServerLocalQuotaUsage is the metadata usage recorded by an
+// mdServerLocalQuotaManager, in a form that can be persisted.
+type mdServerLocalQuotaUsage struct {
+	// User -> bytes put.
+	Users map[keybase1.UID]uint64
+	// Branch ID string -> user -> bytes put to that branch, which
+	// are released when the branch is pruned.
+	Branches map[string]map[keybase1.UID]uint64
+}
+
+func makeMDServerLocalQuotaUsage() mdServerLocalQuotaUsage {
+	return mdServerLocalQuotaUsage{
+		Users:    make(map[keybase1.UID]uint64),
+		Branches: make(map[string]map[keybase1.UID]uint64),
+	}
+}
+
+// mdServerLocalQuotaManager tracks the number of bytes of metadata
+// put by each user to a set of mdServerLocal instances sharing the
+// same data, and enforces an optional limit on it. It is
+// goroutine-safe.
+type mdServerLocalQuotaManager struct {
+	// Protects usage and limit.
+	lock  sync.Mutex
+	usage mdServerLocalQuotaUsage
+	// 0 means no limit.
+	limit uint64
+	// If non-nil, called with lock held after every change to
+	// usage, so that it can be persisted.
+	save func(mdServerLocalQuotaUsage) error
+}
+
+func newMDServerLocalQuotaManager() *mdServerLocalQuotaManager {
+	return &mdServerLocalQuotaManager{
+		usage: makeMDServerLocalQuotaUsage(),
+	}
+}
+
+// newMDServerLocalQuotaManagerWithSave returns an
+// mdServerLocalQuotaManager that starts with the given usage, and
+// calls save with the new usage after every change to it.
+func newMDServerLocalQuotaManagerWithSave(usage mdServerLocalQuotaUsage,
+	save func(mdServerLocalQuotaUsage) error) *mdServerLocalQuotaManager {
+	if usage.Users == nil {
+		usage.Users = make(map[keybase1.UID]uint64)
+	}
+	if usage.Branches == nil {
+		usage.Branches = make(map[string]map[keybase1.UID]uint64)
+	}
+	return &mdServerLocalQuotaManager{
+		usage: usage,
+		save:  save,
+	}
+}
+
+func (m *mdServerLocalQuotaManager) setLimit(limit uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.limit = limit
+}
+
+func (m *mdServerLocalQuotaManager) getQuotaInfo(
+	uid keybase1.UID) (used, limit uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.usage.Users[uid], m.limit
+}
+
+func (m *mdServerLocalQuotaManager) checkLocked(
+	uid keybase1.UID, size uint64) error {
+	used := m.usage.Users[uid]
+	if m.limit != 0 && used+size > m.limit {
+		return MDServerErrorQuotaExceeded{Used: used, Limit: m.limit}
+	}
+	return nil
+}
+
+func (m *mdServerLocalQuotaManager) saveLocked() error {
+	if m.save == nil {
+		return nil
+	}
+	return m.save(m.usage)
+}
+
+// addLocked adds size to uid's usage if add is true, or subtracts it
+// otherwise, and does the same for uid's usage on bid if it's not
+// NullBranchID.
+func (m *mdServerLocalQuotaManager) addLocked(
+	uid keybase1.UID, bid BranchID, size uint64, add bool) {
+	if add {
+		m.usage.Users[uid] += size
+	} else {
+		m.usage.Users[uid] -= size
+	}
+	if bid == NullBranchID {
+		return
+	}
+	key := bid.String()
+	branchUsage := m.usage.Branches[key]
+	if branchUsage == nil {
+		branchUsage = make(map[keybase1.UID]uint64)
+		m.usage.Branches[key] = branchUsage
+	}
+	if add {
+		branchUsage[uid] += size
+	} else {
+		branchUsage[uid] -= size
+	}
+}
+
+// check returns MDServerErrorQuotaExceeded if putting size more bytes
+// for uid would take it over the limit.
+func (m *mdServerLocalQuotaManager) check(
+	uid keybase1.UID, size uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.checkLocked(uid, size)
+}
+
+// reserve is like check, but also adds size to uid's usage, and to
+// its usage on bid, if it's within the limit. The caller must call
+// release if the put then fails.
+func (m *mdServerLocalQuotaManager) reserve(
+	uid keybase1.UID, bid BranchID, size uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	err := m.checkLocked(uid, size)
+	if err != nil {
+		return err
+	}
+	m.addLocked(uid, bid, size, true)
+	err = m.saveLocked()
+	if err != nil {
+		m.addLocked(uid, bid, size, false)
+		return MDServerError{err}
+	}
+	return nil
+}
+
+// release undoes a call to reserve with the same arguments.
+func (m *mdServerLocalQuotaManager) release(
+	uid keybase1.UID, bid BranchID, size uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.addLocked(uid, bid, size, false)
+	err := m.saveLocked()
+	if err != nil {
+		return MDServerError{err}
+	}
+	return nil
+}
+
+// pruneBranch releases everything put to bid, since a pruned branch
+// no longer counts against anyone's quota.
+func (m *mdServerLocalQuotaManager) pruneBranch(bid BranchID) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := bid.String()
+	branchUsage, ok := m.usage.Branches[key]
+	if !ok {
+		return nil
+	}
+	for uid, size := range branchUsage {
+		m.usage.Users[uid] -= size
+	}
+	delete(m.usage.Branches, key)
+	err := m.saveLocked()
+	if err != nil {
+		return MDServerError{err}
+	}
+	return nil
+}
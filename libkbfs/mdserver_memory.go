@@ -42,9 +42,9 @@ type mdBlockMemList struct {
 }
 
 type mdServerMemShared struct {
-	// Protects all *db variables and truncateLockManager. After
-	// Shutdown() is called, all *db variables and
-	// truncateLockManager are nil.
+	// Protects all *db variables, truncateLockManager, and
+	// maxBranchRevisions. After Shutdown() is called, all *db
+	// variables and truncateLockManager are nil.
 	lock sync.RWMutex
 	// Bare TLF handle -> TLF ID
 	handleDb map[mdHandleKey]TlfID
@@ -55,8 +55,12 @@ type mdServerMemShared struct {
 	// (TLF ID, device KID) -> branch ID
 	branchDb            map[mdBranchKey]BranchID
 	truncateLockManager *mdServerLocalTruncateLockManager
+	// If non-zero, the maximum number of revisions an unmerged
+	// branch may have.
+	maxBranchRevisions uint64
 
 	updateManager *mdServerLocalUpdateManager
+	quotaManager  *mdServerLocalQuotaManager
 }
 
 // MDServerMemory just stores metadata objects in memory.
@@ -85,6 +89,7 @@ func NewMDServerMemory(config Config) (*MDServerMemory, error) {
 		branchDb:            branchDb,
 		truncateLockManager: &truncateLockManager,
 		updateManager:       newMDServerLocalUpdateManager(),
+		quotaManager:        newMDServerLocalQuotaManager(),
 	}
 	mdserv := &MDServerMemory{config, log, &shared}
 	return mdserv, nil
@@ -266,7 +271,11 @@ func (md *MDServerMemory) GetRange(ctx context.Context, id TlfID,
 	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
 	[]*RootMetadataSigned, error) {
 	md.log.CDebugf(ctx, "GetRange %d %d (%s)", start, stop, mStatus)
-	bid, err := md.checkGetParams(ctx, id, bid, mStatus)
+	err := validateRevisionRange(start, stop)
+	if err != nil {
+		return nil, err
+	}
+	bid, err = md.checkGetParams(ctx, id, bid, mStatus)
 	if err != nil {
 		return nil, err
 	}
@@ -321,27 +330,127 @@ func (md *MDServerMemory) GetRange(ctx context.Context, id TlfID,
 	return rmdses, nil
 }
 
-// Put implements the MDServer interface for MDServerMemory.
-func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned) error {
+// GetRangeByWriter implements the MDServer interface for
+// MDServerMemory.
+func (md *MDServerMemory) GetRangeByWriter(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision,
+	writer keybase1.UID) ([]*RootMetadataSigned, error) {
+	rmdses, err := md.GetRange(ctx, id, bid, mStatus, start, stop)
+	if err != nil {
+		return nil, err
+	}
+	return filterRMDSesByWriter(rmdses, writer), nil
+}
+
+// HasRevision implements the MDServer interface for MDServerMemory.
+func (md *MDServerMemory) HasRevision(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus, rev MetadataRevision) (
+	bool, MdID, error) {
+	err := validateRevisionRange(rev, rev)
+	if err != nil {
+		return false, MdID{}, err
+	}
+	bid, err = md.checkGetParams(ctx, id, bid, mStatus)
+	if err != nil {
+		return false, MdID{}, err
+	}
+	if mStatus == Unmerged && bid == NullBranchID {
+		return false, MdID{}, nil
+	}
+
+	key, err := md.getMDKey(id, bid, mStatus)
+	if err != nil {
+		return false, MdID{}, MDServerError{err}
+	}
+
+	buf, err := func() ([]byte, error) {
+		md.lock.Lock()
+		defer md.lock.Unlock()
+		if md.mdDb == nil {
+			return nil, errMDServerMemoryShutdown
+		}
+
+		blockList, ok := md.mdDb[key]
+		if !ok {
+			return nil, nil
+		}
+		i := int(rev - blockList.initialRevision)
+		if i < 0 || i >= len(blockList.blocks) {
+			return nil, nil
+		}
+		return blockList.blocks[i].encodedMd, nil
+	}()
+	if err != nil {
+		return false, MdID{}, err
+	}
+	if buf == nil {
+		return false, MdID{}, nil
+	}
+
+	ver := md.config.MetadataVersion()
+	rmds, err := DecodeRootMetadataSigned(md.config.Codec(), id, ver, ver, buf)
+	if err != nil {
+		return false, MdID{}, MDServerError{err}
+	}
+	mdID, err := md.config.Crypto().MakeMdID(rmds.MD)
+	if err != nil {
+		return false, MdID{}, MDServerError{err}
+	}
+	return true, mdID, nil
+}
+
+// GetRevisionTime returns the timestamp recorded by the server for
+// the given revision of the given TLF and branch.
+func (md *MDServerMemory) GetRevisionTime(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus, revision MetadataRevision) (
+	time.Time, error) {
+	rmdses, err := md.GetRange(ctx, id, bid, mStatus, revision, revision)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(rmdses) != 1 {
+		return time.Time{}, MDServerErrorBadRequest{
+			Reason: fmt.Sprintf("No revision %s for TLF %s", revision, id),
+		}
+	}
+	return rmdses[0].untrustedServerTimestamp, nil
+}
+
+// checkPut performs all the validation that Put does on rmds,
+// without storing anything. It returns the head that rmds would be
+// the successor of, if any, and whether rmds would start a new
+// branch whose ID needs to be recorded. If imported is set, rmds
+// may have been last modified by any writer and device, as for an
+// MD imported by ImportTLFHistory.
+func (md *MDServerMemory) checkPut(
+	ctx context.Context, rmds *RootMetadataSigned, imported bool) (
+	head *RootMetadataSigned, recordBranchID bool, err error) {
 	_, currentUID, err := md.config.KBPKI().GetCurrentUserInfo(ctx)
 	if err != nil {
-		return MDServerError{err}
+		return nil, false, MDServerError{err}
 	}
 
 	currentVerifyingKey, err :=
 		md.config.KBPKI().GetCurrentVerifyingKey(ctx)
 	if err != nil {
-		return MDServerError{err}
+		return nil, false, MDServerError{err}
 	}
 
 	err = rmds.IsValidAndSigned(md.config.Codec(), md.config.Crypto())
 	if err != nil {
-		return MDServerErrorBadRequest{Reason: err.Error()}
+		return nil, false, MDServerErrorBadRequest{Reason: err.Error()}
 	}
 
-	err = rmds.IsLastModifiedBy(currentUID, currentVerifyingKey)
+	err = checkMDSize(md.config.Codec(), md.config.MaxMDBytes(), rmds)
 	if err != nil {
-		return MDServerErrorBadRequest{Reason: err.Error()}
+		return nil, false, err
+	}
+
+	if !imported {
+		err = rmds.IsLastModifiedBy(currentUID, currentVerifyingKey)
+		if err != nil {
+			return nil, false, MDServerErrorBadRequest{Reason: err.Error()}
+		}
 	}
 
 	id := rmds.MD.TlfID()
@@ -351,7 +460,7 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned) err
 	mergedMasterHead, err :=
 		md.getHeadForTLF(ctx, id, NullBranchID, Merged)
 	if err != nil {
-		return MDServerError{err}
+		return nil, false, MDServerError{err}
 	}
 
 	// TODO: Figure out nil case.
@@ -360,32 +469,30 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned) err
 			md.config.Codec(), currentUID,
 			mergedMasterHead.MD, rmds.MD)
 		if err != nil {
-			return MDServerError{err}
+			return nil, false, MDServerError{err}
 		}
 		if !ok {
-			return MDServerErrorUnauthorized{}
+			return nil, false, MDServerErrorUnauthorized{}
 		}
 	}
 
 	bid := rmds.MD.BID()
 	mStatus := rmds.MD.MergedStatus()
 
-	head, err := md.getHeadForTLF(ctx, id, bid, mStatus)
+	head, err = md.getHeadForTLF(ctx, id, bid, mStatus)
 	if err != nil {
-		return MDServerError{err}
+		return nil, false, MDServerError{err}
 	}
 
-	var recordBranchID bool
-
 	if mStatus == Unmerged && head == nil {
 		// currHead for unmerged history might be on the main branch
 		prevRev := rmds.MD.RevisionNumber() - 1
 		rmdses, err := md.GetRange(ctx, id, NullBranchID, Merged, prevRev, prevRev)
 		if err != nil {
-			return MDServerError{err}
+			return nil, false, MDServerError{err}
 		}
 		if len(rmdses) != 1 {
-			return MDServerError{
+			return nil, false, MDServerError{
 				Err: fmt.Errorf("Expected 1 MD block got %d", len(rmdses)),
 			}
 		}
@@ -397,11 +504,117 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned) err
 	if head != nil {
 		id, err := md.config.Crypto().MakeMdID(head.MD)
 		if err != nil {
-			return err
+			return nil, false, err
 		}
 		err = head.MD.CheckValidSuccessorForServer(id, rmds.MD)
 		if err != nil {
-			return err
+			return nil, false, err
+		}
+	}
+
+	if mStatus == Unmerged {
+		err = md.checkBranchLength(id, bid, recordBranchID)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	return head, recordBranchID, nil
+}
+
+// checkBranchLength returns MDServerErrorTooManyRevisions if putting
+// one more revision to the given unmerged branch would make it
+// longer than maxBranchRevisions. newBranch says whether the put
+// would start the branch.
+func (md *MDServerMemory) checkBranchLength(
+	id TlfID, bid BranchID, newBranch bool) error {
+	md.lock.RLock()
+	defer md.lock.RUnlock()
+	if md.mdDb == nil {
+		return errMDServerMemoryShutdown
+	}
+
+	if md.maxBranchRevisions == 0 {
+		return nil
+	}
+
+	actual := uint64(1)
+	if !newBranch {
+		revKey, err := md.getMDKey(id, bid, Unmerged)
+		if err != nil {
+			return MDServerError{err}
+		}
+		actual += uint64(len(md.mdDb[revKey].blocks))
+	}
+	if actual > md.maxBranchRevisions {
+		return MDServerErrorTooManyRevisions{
+			Max: md.maxBranchRevisions, Actual: actual}
+	}
+	return nil
+}
+
+// Put implements the MDServer interface for MDServerMemory.
+func (md *MDServerMemory) Put(ctx context.Context,
+	rmds *RootMetadataSigned) error {
+	return md.put(ctx, rmds, false)
+}
+
+// putImported implements the mdServerHistoryImporter interface for
+// MDServerMemory.
+func (md *MDServerMemory) putImported(ctx context.Context,
+	rmds *RootMetadataSigned) error {
+	return md.put(ctx, rmds, true)
+}
+
+func (md *MDServerMemory) put(ctx context.Context,
+	rmds *RootMetadataSigned, imported bool) (err error) {
+	head, recordBranchID, err := md.checkPut(ctx, rmds, imported)
+	if err != nil {
+		return err
+	}
+
+	encodedMd, err := md.config.Codec().Encode(rmds)
+	if err != nil {
+		return MDServerError{err}
+	}
+
+	_, currentUID, err := md.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return MDServerError{err}
+	}
+	size := uint64(len(encodedMd))
+	err = md.quotaManager.reserve(currentUID, rmds.MD.BID(), size)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			releaseErr := md.quotaManager.release(
+				currentUID, rmds.MD.BID(), size)
+			if releaseErr != nil {
+				md.log.CWarningf(ctx, "Couldn't release quota "+
+					"for a failed put: %v", releaseErr)
+			}
+		}
+	}()
+
+	id := rmds.MD.TlfID()
+	bid := rmds.MD.BID()
+	mStatus := rmds.MD.MergedStatus()
+
+	// A merged MD can carry a handle with some of the TLF's
+	// assertions resolved, which becomes the TLF's latest handle
+	// below.
+	var newH BareTlfHandle
+	var newHBytes []byte
+	if mStatus == Merged {
+		newH, err = rmds.MD.MakeBareTlfHandle()
+		if err != nil {
+			return MDServerError{err}
+		}
+		newHBytes, err = md.config.Codec().Encode(newH)
+		if err != nil {
+			return MDServerError{err}
 		}
 	}
 
@@ -425,12 +638,20 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned) err
 		}
 	}
 
-	encodedMd, err := md.config.Codec().Encode(rmds)
-	if err != nil {
-		return MDServerError{err}
+	// Don't let revision timestamps go backwards, e.g. due to
+	// clock skew between writers; instead, clamp the new
+	// timestamp to the previous head's.
+	timestamp := md.config.Clock().Now()
+	if head != nil && timestamp.Before(head.untrustedServerTimestamp) {
+		md.log.CWarningf(ctx,
+			"Clamping timestamp for rev=%s of TLF %s from %s "+
+				"to previous head's %s",
+			rmds.MD.RevisionNumber(), id, timestamp,
+			head.untrustedServerTimestamp)
+		timestamp = head.untrustedServerTimestamp
 	}
 
-	block := mdBlockMem{encodedMd, md.config.Clock().Now()}
+	block := mdBlockMem{encodedMd, timestamp}
 
 	// Add an entry with the revision key.
 	revKey, err := md.getMDKey(id, bid, mStatus)
@@ -455,6 +676,13 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned) err
 		}
 	}
 
+	if mStatus == Merged &&
+		handleResolvesAssertions(md.latestHandleDb[id], newH) {
+		md.handleDb[mdHandleKey(newHBytes)] = id
+		md.latestHandleDb[id] = newH
+		md.updateManager.setHandle(id, newH)
+	}
+
 	if mStatus == Merged &&
 		// Don't send notifies if it's just a rekey (the real mdserver
 		// sends a "folder needs rekey" notification in this case).
@@ -465,6 +693,26 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned) err
 	return nil
 }
 
+// TrialPut implements the MDServer interface for MDServerMemory.
+func (md *MDServerMemory) TrialPut(
+	ctx context.Context, rmds *RootMetadataSigned) error {
+	_, _, err := md.checkPut(ctx, rmds, false)
+	if err != nil {
+		return err
+	}
+
+	encodedMd, err := md.config.Codec().Encode(rmds)
+	if err != nil {
+		return MDServerError{err}
+	}
+
+	_, currentUID, err := md.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return MDServerError{err}
+	}
+	return md.quotaManager.check(currentUID, uint64(len(encodedMd)))
+}
+
 // PruneBranch implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) PruneBranch(ctx context.Context, id TlfID, bid BranchID) error {
 	if bid == NullBranchID {
@@ -493,7 +741,32 @@ func (md *MDServerMemory) PruneBranch(ctx context.Context, id TlfID, bid BranchI
 	}
 
 	delete(md.branchDb, branchKey)
-	return nil
+	// The branch no longer counts against anyone's quota, though.
+	return md.quotaManager.pruneBranch(bid)
+}
+
+// GetBranches implements the MDServer interface for MDServerMemory.
+func (md *MDServerMemory) GetBranches(ctx context.Context, id TlfID) (
+	[]BranchID, error) {
+	_, err := md.checkGetParams(ctx, id, NullBranchID, Merged)
+	if err != nil {
+		return nil, err
+	}
+
+	md.lock.RLock()
+	defer md.lock.RUnlock()
+	if md.branchDb == nil {
+		return nil, errMDServerMemoryShutdown
+	}
+
+	var bids []BranchID
+	for key, bid := range md.branchDb {
+		if key.tlfID == id {
+			bids = append(bids, bid)
+		}
+	}
+	sortBranchIDs(bids)
+	return bids, nil
 }
 
 func (md *MDServerMemory) getBranchID(ctx context.Context, id TlfID) (BranchID, error) {
@@ -528,6 +801,66 @@ func (md *MDServerMemory) RegisterForUpdate(ctx context.Context, id TlfID,
 	return c, nil
 }
 
+// RegisterForHandleChange implements the MDServer interface for
+// MDServerMemory.
+func (md *MDServerMemory) RegisterForHandleChange(ctx context.Context,
+	id TlfID) (<-chan BareTlfHandle, error) {
+	// GetLatestHandleForTLF checks that the caller is a reader.
+	_, err := md.GetLatestHandleForTLF(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return md.updateManager.registerForHandleChange(id, md), nil
+}
+
+// PauseNotifications holds back update notifications to observers
+// registered with RegisterForUpdate, for any instance sharing this
+// in-memory server's data, until ResumeNotifications is called. This
+// models a server undergoing maintenance.
+func (md *MDServerMemory) PauseNotifications() {
+	md.updateManager.pause()
+}
+
+// ResumeNotifications delivers the update notifications held back
+// since PauseNotifications was called. Each waiting observer gets a
+// single notification, no matter how many revisions were put to its
+// TLF while paused.
+func (md *MDServerMemory) ResumeNotifications() {
+	md.updateManager.resume()
+}
+
+// GetQuotaInfo implements the MDServer interface for MDServerMemory.
+func (md *MDServerMemory) GetQuotaInfo(ctx context.Context) (
+	used, limit uint64, err error) {
+	_, currentUID, err := md.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return 0, 0, MDServerError{err}
+	}
+	used, limit = md.quotaManager.getQuotaInfo(currentUID)
+	return used, limit, nil
+}
+
+// SetQuotaLimit sets the number of bytes of metadata each user may
+// put to any instance sharing this in-memory server's data. Puts
+// that would take a user over the limit fail with
+// MDServerErrorQuotaExceeded. A limit of 0, the default, means there
+// is none.
+func (md *MDServerMemory) SetQuotaLimit(limit uint64) {
+	md.quotaManager.setLimit(limit)
+}
+
+// SetMaxBranchRevisions sets the maximum number of revisions an
+// unmerged branch may have on any instance sharing this in-memory
+// server's data. Puts that would make a branch longer fail with
+// MDServerErrorTooManyRevisions. A maximum of 0, the default, means
+// there is none.
+func (md *MDServerMemory) SetMaxBranchRevisions(max uint64) {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	md.maxBranchRevisions = max
+}
+
 func (md *MDServerMemory) getCurrentDeviceKIDBytes(ctx context.Context) (
 	[]byte, error) {
 	buf := &bytes.Buffer{}
@@ -584,6 +917,132 @@ func (md *MDServerMemory) Shutdown() {
 	md.latestHandleDb = nil
 	md.branchDb = nil
 	md.truncateLockManager = nil
+	md.updateManager.shutdownHandleObservers(md)
+}
+
+// mdServerMemorySnapshot is the serialized form of the state of an
+// MDServerMemory, as returned by Snapshot.
+type mdServerMemorySnapshot struct {
+	Handles       []mdServerMemorySnapshotHandle
+	LatestHandles []mdServerMemorySnapshotLatestHandle
+	MDs           []mdServerMemorySnapshotMDs
+	Branches      []mdServerMemorySnapshotBranch
+}
+
+type mdServerMemorySnapshotHandle struct {
+	EncodedHandle []byte
+	ID            TlfID
+}
+
+type mdServerMemorySnapshotLatestHandle struct {
+	ID     TlfID
+	Handle BareTlfHandle
+}
+
+type mdServerMemorySnapshotMD struct {
+	EncodedMD []byte
+	// Stored as nanoseconds since the epoch, to avoid depending
+	// on how the codec handles time.Time.
+	Timestamp int64
+}
+
+type mdServerMemorySnapshotMDs struct {
+	ID              TlfID
+	BID             BranchID
+	InitialRevision MetadataRevision
+	MDs             []mdServerMemorySnapshotMD
+}
+
+type mdServerMemorySnapshotBranch struct {
+	ID        TlfID
+	DeviceKID keybase1.KID
+	BID       BranchID
+}
+
+// Snapshot serializes the entire state of this server, i.e. the
+// merged and unmerged revision history of every TLF along with the
+// handle and branch mappings, so that it can later be passed to
+// Restore. Truncate locks, quotas, and registered observers aren't
+// included. This is meant for tests that need to simulate a server
+// losing or rolling back its state.
+func (md *MDServerMemory) Snapshot() ([]byte, error) {
+	md.lock.RLock()
+	defer md.lock.RUnlock()
+	if md.handleDb == nil {
+		return nil, errMDServerMemoryShutdown
+	}
+
+	var snapshot mdServerMemorySnapshot
+	for handleKey, id := range md.handleDb {
+		snapshot.Handles = append(snapshot.Handles,
+			mdServerMemorySnapshotHandle{[]byte(handleKey), id})
+	}
+	for id, handle := range md.latestHandleDb {
+		snapshot.LatestHandles = append(snapshot.LatestHandles,
+			mdServerMemorySnapshotLatestHandle{id, handle})
+	}
+	for key, blockList := range md.mdDb {
+		mds := mdServerMemorySnapshotMDs{
+			ID:              key.tlfID,
+			BID:             key.branchID,
+			InitialRevision: blockList.initialRevision,
+		}
+		for _, block := range blockList.blocks {
+			mds.MDs = append(mds.MDs, mdServerMemorySnapshotMD{
+				block.encodedMd, block.timestamp.UnixNano()})
+		}
+		snapshot.MDs = append(snapshot.MDs, mds)
+	}
+	for key, bid := range md.branchDb {
+		snapshot.Branches = append(snapshot.Branches,
+			mdServerMemorySnapshotBranch{key.tlfID, key.deviceKID, bid})
+	}
+
+	return md.config.Codec().Encode(snapshot)
+}
+
+// Restore replaces the entire state of this server, and of all the
+// copies that share it, with one previously returned by Snapshot.
+// Registered observers aren't notified of any changes.
+func (md *MDServerMemory) Restore(buf []byte) error {
+	var snapshot mdServerMemorySnapshot
+	err := md.config.Codec().Decode(buf, &snapshot)
+	if err != nil {
+		return err
+	}
+
+	handleDb := make(map[mdHandleKey]TlfID)
+	for _, h := range snapshot.Handles {
+		handleDb[mdHandleKey(h.EncodedHandle)] = h.ID
+	}
+	latestHandleDb := make(map[TlfID]BareTlfHandle)
+	for _, h := range snapshot.LatestHandles {
+		latestHandleDb[h.ID] = h.Handle
+	}
+	mdDb := make(map[mdBlockKey]mdBlockMemList)
+	for _, mds := range snapshot.MDs {
+		blockList := mdBlockMemList{initialRevision: mds.InitialRevision}
+		for _, m := range mds.MDs {
+			blockList.blocks = append(blockList.blocks, mdBlockMem{
+				m.EncodedMD, time.Unix(0, m.Timestamp)})
+		}
+		mdDb[mdBlockKey{mds.ID, mds.BID}] = blockList
+	}
+	branchDb := make(map[mdBranchKey]BranchID)
+	for _, b := range snapshot.Branches {
+		branchDb[mdBranchKey{b.ID, b.DeviceKID}] = b.BID
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if md.handleDb == nil {
+		return errMDServerMemoryShutdown
+	}
+	md.handleDb = handleDb
+	md.latestHandleDb = latestHandleDb
+	md.mdDb = mdDb
+	md.branchDb = branchDb
+	return nil
 }
 
 // IsConnected implements the MDServer interface for MDServerMemory.
@@ -652,6 +1111,8 @@ func (md *MDServerMemory) addNewAssertionForTest(uid keybase1.UID,
 			return err
 		}
 		md.handleDb[mdHandleKey(newHBytes)] = id
+		md.latestHandleDb[id] = newH
+		md.updateManager.setHandle(id, newH)
 	}
 	return nil
 }
@@ -669,17 +1130,234 @@ func (md *MDServerMemory) getCurrentMergedHeadRevision(
 }
 
 // GetLatestHandleForTLF implements the MDServer interface for MDServerMemory.
-func (md *MDServerMemory) GetLatestHandleForTLF(_ context.Context, id TlfID) (
+func (md *MDServerMemory) GetLatestHandleForTLF(ctx context.Context, id TlfID) (
 	BareTlfHandle, error) {
+	_, uid, err := md.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return BareTlfHandle{}, MDServerError{err}
+	}
+
 	md.lock.RLock()
 	defer md.lock.RUnlock()
 	if md.latestHandleDb == nil {
 		return BareTlfHandle{}, errMDServerMemoryShutdown
 	}
 
-	return md.latestHandleDb[id], nil
+	handle, ok := md.latestHandleDb[id]
+	if ok && !handle.IsReader(uid) {
+		return BareTlfHandle{}, MDServerErrorUnauthorized{}
+	}
+	return handle, nil
+}
+
+// mdServerMemoryReadOnlyReplica is a read-only view of an
+// MDServerMemory. It shares the underlying store with the primary,
+// so reads always reflect the primary's current state, but it
+// rejects all writes with MDServerErrorWriteAccess.
+type mdServerMemoryReadOnlyReplica struct {
+	// primary isn't embedded, so that none of its write methods
+	// (e.g., putImported or Restore) are exposed by accident.
+	primary *MDServerMemory
+}
+
+var _ MDServer = mdServerMemoryReadOnlyReplica{}
+
+// ReadOnlyReplica returns a read-only MDServer that shares its
+// underlying store with md. This should only be used for testing.
+func (md *MDServerMemory) ReadOnlyReplica() MDServer {
+	return mdServerMemoryReadOnlyReplica{primary: md}
+}
+
+// GetForHandle implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica. Unlike the primary, it never
+// creates a new TLF for an unknown handle.
+func (md mdServerMemoryReadOnlyReplica) GetForHandle(ctx context.Context,
+	handle BareTlfHandle, mStatus MergeStatus) (
+	TlfID, *RootMetadataSigned, error) {
+	handleBytes, err := md.primary.config.Codec().Encode(handle)
+	if err != nil {
+		return NullTlfID, nil, MDServerError{err}
+	}
+
+	id, err := func() (TlfID, error) {
+		md.primary.lock.RLock()
+		defer md.primary.lock.RUnlock()
+		if md.primary.handleDb == nil {
+			return NullTlfID, errMDServerMemoryShutdown
+		}
+
+		id, ok := md.primary.handleDb[mdHandleKey(handleBytes)]
+		if !ok {
+			// Creating a new TLF is a write.
+			return NullTlfID, MDServerErrorWriteAccess{}
+		}
+		return id, nil
+	}()
+	if err != nil {
+		return NullTlfID, nil, err
+	}
+
+	rmds, err := md.primary.GetForTLF(ctx, id, NullBranchID, mStatus)
+	if err != nil {
+		return NullTlfID, nil, err
+	}
+	return id, rmds, nil
+}
+
+// GetForTLF implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) GetForTLF(ctx context.Context,
+	id TlfID, bid BranchID, mStatus MergeStatus) (
+	*RootMetadataSigned, error) {
+	return md.primary.GetForTLF(ctx, id, bid, mStatus)
+}
+
+// GetRange implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) GetRange(ctx context.Context,
+	id TlfID, bid BranchID, mStatus MergeStatus,
+	start, stop MetadataRevision) ([]*RootMetadataSigned, error) {
+	return md.primary.GetRange(ctx, id, bid, mStatus, start, stop)
+}
+
+// GetRangeByWriter implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) GetRangeByWriter(
+	ctx context.Context, id TlfID, bid BranchID, mStatus MergeStatus,
+	start, stop MetadataRevision, writer keybase1.UID) (
+	[]*RootMetadataSigned, error) {
+	return md.primary.GetRangeByWriter(
+		ctx, id, bid, mStatus, start, stop, writer)
+}
+
+// HasRevision implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) HasRevision(ctx context.Context,
+	id TlfID, bid BranchID, mStatus MergeStatus, rev MetadataRevision) (
+	bool, MdID, error) {
+	return md.primary.HasRevision(ctx, id, bid, mStatus, rev)
+}
+
+// GetBranches implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) GetBranches(
+	ctx context.Context, id TlfID) ([]BranchID, error) {
+	return md.primary.GetBranches(ctx, id)
+}
+
+// GetQuotaInfo implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) GetQuotaInfo(
+	ctx context.Context) (used, limit uint64, err error) {
+	return md.primary.GetQuotaInfo(ctx)
+}
+
+// RegisterForUpdate implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) RegisterForUpdate(
+	ctx context.Context, id TlfID, currHead MetadataRevision) (
+	<-chan error, error) {
+	return md.primary.RegisterForUpdate(ctx, id, currHead)
+}
+
+// RegisterForHandleChange implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) RegisterForHandleChange(
+	ctx context.Context, id TlfID) (<-chan BareTlfHandle, error) {
+	return md.primary.RegisterForHandleChange(ctx, id)
+}
+
+// CheckForRekeys implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) CheckForRekeys(
+	ctx context.Context) <-chan error {
+	return md.primary.CheckForRekeys(ctx)
+}
+
+// GetLatestHandleForTLF implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) GetLatestHandleForTLF(
+	ctx context.Context, id TlfID) (BareTlfHandle, error) {
+	return md.primary.GetLatestHandleForTLF(ctx, id)
+}
+
+// RefreshAuthToken implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) RefreshAuthToken(
+	ctx context.Context) {
+	md.primary.RefreshAuthToken(ctx)
+}
+
+// DisableRekeyUpdatesForTesting implements the MDServer interface
+// for mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) DisableRekeyUpdatesForTesting() {
+	md.primary.DisableRekeyUpdatesForTesting()
+}
+
+// IsConnected implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) IsConnected() bool {
+	return md.primary.IsConnected()
 }
 
+// OffsetFromServerTime implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) OffsetFromServerTime() (
+	time.Duration, bool) {
+	return md.primary.OffsetFromServerTime()
+}
+
+// Snapshot is like MDServerMemory.Snapshot, for the shared store.
+func (md mdServerMemoryReadOnlyReplica) Snapshot() ([]byte, error) {
+	return md.primary.Snapshot()
+}
+
+// Restore always fails with MDServerErrorWriteAccess, since it
+// would overwrite the shared store.
+func (md mdServerMemoryReadOnlyReplica) Restore(buf []byte) error {
+	return MDServerErrorWriteAccess{}
+}
+
+// Put implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) Put(
+	ctx context.Context, rmds *RootMetadataSigned) error {
+	return MDServerErrorWriteAccess{}
+}
+
+// TrialPut implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) TrialPut(
+	ctx context.Context, rmds *RootMetadataSigned) error {
+	return MDServerErrorWriteAccess{}
+}
+
+// PruneBranch implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) PruneBranch(
+	ctx context.Context, id TlfID, bid BranchID) error {
+	return MDServerErrorWriteAccess{}
+}
+
+// TruncateLock implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) TruncateLock(
+	ctx context.Context, id TlfID) (bool, error) {
+	return false, MDServerErrorWriteAccess{}
+}
+
+// TruncateUnlock implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica.
+func (md mdServerMemoryReadOnlyReplica) TruncateUnlock(
+	ctx context.Context, id TlfID) (bool, error) {
+	return false, MDServerErrorWriteAccess{}
+}
+
+// Shutdown implements the MDServer interface for
+// mdServerMemoryReadOnlyReplica. The shared store is owned by the
+// primary, so this does nothing.
+func (md mdServerMemoryReadOnlyReplica) Shutdown() {}
+
 // OffsetFromServerTime implements the MDServer interface for
 // MDServerMemory.
 func (md *MDServerMemory) OffsetFromServerTime() (time.Duration, bool) {
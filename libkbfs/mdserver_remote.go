@@ -454,10 +454,51 @@ func (md *MDServerRemote) GetForTLF(ctx context.Context, id TlfID,
 func (md *MDServerRemote) GetRange(ctx context.Context, id TlfID,
 	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
 	[]*RootMetadataSigned, error) {
+	err := validateRevisionRange(start, stop)
+	if err != nil {
+		return nil, err
+	}
 	_, rmds, err := md.get(ctx, id, nil, bid, mStatus, start, stop)
 	return rmds, err
 }
 
+// GetRangeByWriter implements the MDServer interface for
+// MDServerRemote.
+//
+// The mdserver protocol can't filter by writer, so the whole range
+// is fetched and filtered on the client. The result is the same,
+// but it doesn't save any bandwidth.
+func (md *MDServerRemote) GetRangeByWriter(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision,
+	writer keybase1.UID) ([]*RootMetadataSigned, error) {
+	rmdses, err := md.GetRange(ctx, id, bid, mStatus, start, stop)
+	if err != nil {
+		return nil, err
+	}
+	return filterRMDSesByWriter(rmdses, writer), nil
+}
+
+// HasRevision implements the MDServer interface for MDServerRemote.
+//
+// TODO: Add an RPC for this. For now, it fetches the whole MD with
+// GetRange and computes its ID locally.
+func (md *MDServerRemote) HasRevision(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus, rev MetadataRevision) (
+	bool, MdID, error) {
+	rmdses, err := md.GetRange(ctx, id, bid, mStatus, rev, rev)
+	if err != nil {
+		return false, MdID{}, err
+	}
+	if len(rmdses) == 0 {
+		return false, MdID{}, nil
+	}
+	mdID, err := md.config.Crypto().MakeMdID(rmdses[0].MD)
+	if err != nil {
+		return false, MdID{}, err
+	}
+	return true, mdID, nil
+}
+
 // Put implements the MDServer interface for MDServerRemote.
 func (md *MDServerRemote) Put(ctx context.Context, rmds *RootMetadataSigned) error {
 	// encode MD block
@@ -477,6 +518,115 @@ func (md *MDServerRemote) Put(ctx context.Context, rmds *RootMetadataSigned) err
 	return md.client.PutMetadata(ctx, arg)
 }
 
+// GetBranches implements the MDServer interface for MDServerRemote.
+//
+// TODO: Add an RPC for this. For now, the remote server doesn't
+// expose branches other than the current device's, so this returns
+// MDServerUnsupportedError, and callers fall back to just that
+// branch; see getBranchesOrCurrent.
+func (md *MDServerRemote) GetBranches(ctx context.Context, id TlfID) (
+	[]BranchID, error) {
+	return nil, MDServerUnsupportedError{"GetBranches"}
+}
+
+// GetQuotaInfo implements the MDServer interface for MDServerRemote.
+//
+// TODO: Add an RPC for this to the keybase1 protocol. Until then,
+// the remote server doesn't report metadata usage, so this returns
+// MDServerUnsupportedError.
+func (md *MDServerRemote) GetQuotaInfo(ctx context.Context) (
+	used, limit uint64, err error) {
+	return 0, 0, MDServerUnsupportedError{"GetQuotaInfo"}
+}
+
+// TrialPut implements the MDServer interface for MDServerRemote.
+//
+// TODO: Add an RPC for this. For now, it runs the same checks as the
+// local servers' Put against the heads fetched from the server, so a
+// trial put can still pass when the real put would fail because of
+// a limit only the server knows about, e.g. on the length of a
+// branch.
+func (md *MDServerRemote) TrialPut(
+	ctx context.Context, rmds *RootMetadataSigned) error {
+	_, currentUID, err := md.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	currentVerifyingKey, err := md.config.KBPKI().GetCurrentVerifyingKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = rmds.IsValidAndSigned(md.config.Codec(), md.config.Crypto())
+	if err != nil {
+		return MDServerErrorBadRequest{Reason: err.Error()}
+	}
+
+	err = checkMDSize(md.config.Codec(), md.config.MaxMDBytes(), rmds)
+	if err != nil {
+		return err
+	}
+
+	err = rmds.IsLastModifiedBy(currentUID, currentVerifyingKey)
+	if err != nil {
+		return MDServerErrorBadRequest{Reason: err.Error()}
+	}
+
+	id := rmds.MD.TlfID()
+
+	// Check permissions
+	mergedMasterHead, err := md.GetForTLF(ctx, id, NullBranchID, Merged)
+	if err != nil {
+		return err
+	}
+	if mergedMasterHead != nil {
+		ok, err := isWriterOrValidRekey(md.config.Codec(), currentUID,
+			mergedMasterHead.MD, rmds.MD)
+		if err != nil {
+			return MDServerError{err}
+		}
+		if !ok {
+			return MDServerErrorUnauthorized{}
+		}
+	}
+
+	head := mergedMasterHead
+	if rmds.MD.MergedStatus() == Unmerged {
+		head, err = md.GetForTLF(ctx, id, rmds.MD.BID(), Unmerged)
+		if err != nil {
+			return err
+		}
+		if head == nil {
+			// currHead for unmerged history might be on the
+			// main branch
+			prevRev := rmds.MD.RevisionNumber() - 1
+			rmdses, err := md.GetRange(
+				ctx, id, NullBranchID, Merged, prevRev, prevRev)
+			if err != nil {
+				return err
+			}
+			if len(rmdses) != 1 {
+				return MDServerError{
+					Err: fmt.Errorf("Expected 1 MD block got %d",
+						len(rmdses)),
+				}
+			}
+			head = rmdses[0]
+		}
+	}
+
+	// Consistency checks
+	if head == nil {
+		return nil
+	}
+	headID, err := md.config.Crypto().MakeMdID(head.MD)
+	if err != nil {
+		return err
+	}
+	return head.MD.CheckValidSuccessorForServer(headID, rmds.MD)
+}
+
 // PruneBranch implements the MDServer interface for MDServerRemote.
 func (md *MDServerRemote) PruneBranch(ctx context.Context, id TlfID, bid BranchID) error {
 	arg := keybase1.PruneBranchArg{
@@ -593,6 +743,14 @@ func (md *MDServerRemote) RegisterForUpdate(ctx context.Context, id TlfID,
 	return c, err
 }
 
+// RegisterForHandleChange implements the MDServer interface for
+// MDServerRemote. The mdserver protocol has no handle change
+// notifications, so this always returns MDServerUnsupportedError.
+func (md *MDServerRemote) RegisterForHandleChange(ctx context.Context,
+	id TlfID) (<-chan BareTlfHandle, error) {
+	return nil, MDServerUnsupportedError{"RegisterForHandleChange"}
+}
+
 // TruncateLock implements the MDServer interface for MDServerRemote.
 func (md *MDServerRemote) TruncateLock(ctx context.Context, id TlfID) (
 	bool, error) {
@@ -723,6 +881,40 @@ func (md *MDServerRemote) GetTLFCryptKeyServerHalf(ctx context.Context,
 	return
 }
 
+// GetKeyHalves is an implementation of the KeyServer interface.
+func (md *MDServerRemote) GetKeyHalves(ctx context.Context,
+	requests []KeyHalfRequest) ([]KeyHalfResult, error) {
+	// The mdserver protocol has no bulk get, so issue all the
+	// gets at once, which takes about as long as a single round
+	// trip.
+	results := make([]KeyHalfResult, len(requests))
+	errs := make([]error, len(requests))
+	var wg sync.WaitGroup
+	for i, req := range requests {
+		wg.Add(1)
+		go func(i int, req KeyHalfRequest) {
+			defer wg.Done()
+			serverHalf, err := md.GetTLFCryptKeyServerHalf(
+				ctx, req.ServerHalfID, req.CryptPublicKey)
+			switch err.(type) {
+			case nil:
+				results[i].ServerHalf = serverHalf
+			case MDServerErrorUnauthorized:
+				results[i].Err = err
+			default:
+				errs[i] = err
+			}
+		}(i, req)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
 // PutTLFCryptKeyServerHalves is an implementation of the KeyServer interface.
 func (md *MDServerRemote) PutTLFCryptKeyServerHalves(ctx context.Context,
 	serverKeyHalves map[keybase1.UID]map[keybase1.KID]TLFCryptKeyServerHalf) error {
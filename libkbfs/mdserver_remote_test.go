@@ -0,0 +1,157 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"testing"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/keybase/go-framed-msgpack-rpc"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// fakeMDServerClient serves the mdserver RPCs that MDServerRemote
+// makes from a local MD server.
+type fakeMDServerClient struct {
+	codec    Codec
+	mdServer MDServer
+}
+
+var _ rpc.GenericClient = (*fakeMDServerClient)(nil)
+
+func (c *fakeMDServerClient) Call(ctx context.Context, s string,
+	args interface{}, res interface{}) error {
+	switch s {
+	case "keybase.1.metadata.getMetadata":
+		arg := args.([]interface{})[0].(keybase1.GetMetadataArg)
+		id, err := ParseTlfID(arg.FolderID)
+		if err != nil {
+			return err
+		}
+		bid, err := ParseBranchID(arg.BranchID)
+		if err != nil {
+			return err
+		}
+		mStatus := Merged
+		if arg.Unmerged {
+			mStatus = Unmerged
+		}
+
+		var rmdses []*RootMetadataSigned
+		if arg.StartRevision == MetadataRevisionUninitialized.Number() {
+			head, err := c.mdServer.GetForTLF(ctx, id, bid, mStatus)
+			if err != nil {
+				return err
+			}
+			if head != nil {
+				rmdses = append(rmdses, head)
+			}
+		} else {
+			rmdses, err = c.mdServer.GetRange(ctx, id, bid, mStatus,
+				MetadataRevision(arg.StartRevision),
+				MetadataRevision(arg.StopRevision))
+			if err != nil {
+				return err
+			}
+		}
+
+		response := keybase1.MetadataResponse{FolderID: arg.FolderID}
+		for _, rmds := range rmdses {
+			buf, err := c.codec.Encode(rmds)
+			if err != nil {
+				return err
+			}
+			response.MdBlocks = append(response.MdBlocks,
+				keybase1.MDBlock{
+					Version: int(rmds.Version()),
+					Block:   buf,
+				})
+		}
+		*res.(*keybase1.MetadataResponse) = response
+		return nil
+
+	default:
+		return fmt.Errorf("Unknown call: %s %v %v", s, args, res)
+	}
+}
+
+func (c *fakeMDServerClient) Notify(_ context.Context, s string,
+	args interface{}) error {
+	return fmt.Errorf("Unknown notify: %s %v", s, args)
+}
+
+func TestMDServerRemoteTrialPut(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "u1", "u2")
+	defer config.Shutdown()
+	mdServer, err := NewMDServerMemory(config)
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+
+	ctx := context.Background()
+
+	_, uid1, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config, "u2")
+	defer config2.Shutdown()
+	_, uid2, err := config2.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle(
+		[]keybase1.UID{uid1}, []keybase1.UID{uid2}, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	rmds := makeRMDSForTest(t, id, h, MetadataRevisionInitial, uid1, MdID{})
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+	prevRoot, err := config.Crypto().MakeMdID(rmds.MD)
+	require.NoError(t, err)
+
+	client := &fakeMDServerClient{config.Codec(), mdServer}
+	remote := &MDServerRemote{
+		config: config,
+		client: keybase1.MetadataClient{Cli: client},
+	}
+
+	// A valid successor should pass, without being stored.
+	rmds2 := makeRMDSForTest(
+		t, id, h, MetadataRevisionInitial+1, uid1, prevRoot)
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds2)
+	err = remote.TrialPut(ctx, rmds2)
+	require.NoError(t, err)
+	head, err := mdServer.GetForTLF(ctx, id, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevisionInitial, head.MD.RevisionNumber())
+
+	// A revision conflict should be predicted.
+	rmds3 := makeRMDSForTest(t, id, h, MetadataRevisionInitial, uid1, MdID{})
+	rmds3.MD.SetRefBytes(1)
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds3)
+	trialErr := remote.TrialPut(ctx, rmds3)
+	require.IsType(t, MDServerErrorConflictRevision{}, trialErr)
+	err = mdServer.Put(ctx, rmds3)
+	require.Equal(t, trialErr, err)
+
+	// So should a put by a reader that isn't a valid rekey.
+	remote2 := &MDServerRemote{
+		config: config2,
+		client: keybase1.MetadataClient{Cli: client},
+	}
+	rmds4 := makeRMDSForTest(
+		t, id, h, MetadataRevisionInitial+1, uid2, prevRoot)
+	rmds4.MD.SetLastModifyingWriter(uid1)
+	rmds4.MD.SetWriterMetadataCopiedBit()
+	rmds4.MD.SetRefBytes(1)
+	signRMDSForTest(t, config2.Codec(), config2.Crypto(), rmds4)
+	trialErr = remote2.TrialPut(ctx, rmds4)
+	require.IsType(t, MDServerErrorUnauthorized{}, trialErr)
+	err = mdServer.copy(config2).Put(ctx, rmds4)
+	require.Equal(t, trialErr, err)
+}
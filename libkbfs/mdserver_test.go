@@ -5,8 +5,13 @@
 package libkbfs
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol"
 	"github.com/stretchr/testify/require"
 
@@ -190,3 +195,1122 @@ func TestMDServerRegisterForUpdate(t *testing.T) {
 	_, err = mdServer.RegisterForUpdate(ctx, id2, MetadataRevisionInitial)
 	require.NoError(t, err)
 }
+
+func TestMDServerGetRangePaged(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	mdServer := config.MDServer()
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	// Put some merged MDs, and an unmerged branch off of
+	// revision 5 that starts after the first page.
+	prevRoot := MdID{}
+	middleRoot := MdID{}
+	for i := MetadataRevision(1); i <= 10; i++ {
+		rmds := makeRMDSForTest(t, id, h, i, uid, prevRoot)
+		signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+		err = mdServer.Put(ctx, rmds)
+		require.NoError(t, err)
+		prevRoot, err = config.Crypto().MakeMdID(rmds.MD)
+		require.NoError(t, err)
+		if i == 5 {
+			middleRoot = prevRoot
+		}
+	}
+
+	prevRoot = middleRoot
+	bid, err := config.Crypto().MakeRandomBranchID()
+	require.NoError(t, err)
+	for i := MetadataRevision(6); i < 41; i++ {
+		rmds := makeRMDSForTest(t, id, h, i, uid, prevRoot)
+		rmds.MD.SetUnmerged()
+		rmds.MD.SetBranchID(bid)
+		signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+		err = mdServer.Put(ctx, rmds)
+		require.NoError(t, err)
+		prevRoot, err = config.Crypto().MakeMdID(rmds.MD)
+		require.NoError(t, err)
+	}
+
+	// Page through the whole unmerged range, with the bounds only
+	// given for the first page.
+	const limit = 4
+	rmdses, token, err := GetRangePaged(
+		ctx, mdServer, id, bid, Unmerged, 1, 100, limit)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 0)
+	require.NotEqual(t, MDRangeToken(""), token)
+
+	var all []*RootMetadataSigned
+	pages := 1
+	for token != "" {
+		rmdses, token, err = GetRangePagedFromToken(
+			ctx, mdServer, id, bid, Unmerged, token, limit)
+		require.NoError(t, err)
+		require.True(t, len(rmdses) <= limit, "len=%d", len(rmdses))
+		all = append(all, rmdses...)
+		pages++
+	}
+	// The first empty page is before the branch starts, and the
+	// last one is past its head.
+	require.Equal(t, 11, pages)
+	require.Equal(t, 35, len(all))
+	for i := MetadataRevision(6); i < 41; i++ {
+		require.Equal(t, i, all[i-6].MD.RevisionNumber())
+	}
+
+	// A page that reaches stop is the last one.
+	rmdses, token, err = GetRangePaged(
+		ctx, mdServer, id, NullBranchID, Merged, 7, 10, limit)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 4)
+	require.Equal(t, MDRangeToken(""), token)
+
+	// A large stop doesn't page all the way to it.
+	rmdses, token, err = GetRangePaged(
+		ctx, mdServer, id, NullBranchID, Merged, 9,
+		MetadataRevision(1<<40), limit)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 2)
+	require.Equal(t, MDRangeToken(""), token)
+
+	_, _, err = GetRangePagedFromToken(
+		ctx, mdServer, id, NullBranchID, Merged, "bogus", limit)
+	require.IsType(t, InvalidMDRangeTokenError{}, err)
+}
+
+func TestMDServerMemorySnapshotRestore(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	mdServer, err := NewMDServerMemory(config)
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	prevRoot := MdID{}
+	putRange := func(start, stop MetadataRevision, bid BranchID) {
+		for i := start; i <= stop; i++ {
+			rmds := makeRMDSForTest(t, id, h, i, uid, prevRoot)
+			if bid != NullBranchID {
+				rmds.MD.SetUnmerged()
+				rmds.MD.SetBranchID(bid)
+			}
+			signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+			err := mdServer.Put(ctx, rmds)
+			require.NoError(t, err)
+			prevRoot, err = config.Crypto().MakeMdID(rmds.MD)
+			require.NoError(t, err)
+		}
+	}
+
+	// Put some merged MDs and an unmerged branch off of them.
+	putRange(1, 5, NullBranchID)
+	mergedRoot := prevRoot
+	bid, err := config.Crypto().MakeRandomBranchID()
+	require.NoError(t, err)
+	putRange(6, 8, bid)
+
+	snapshot, err := mdServer.Snapshot()
+	require.NoError(t, err)
+
+	// Put more merged MDs, and prune the branch.
+	prevRoot = mergedRoot
+	putRange(6, 10, NullBranchID)
+	err = mdServer.PruneBranch(ctx, id, bid)
+	require.NoError(t, err)
+
+	head, err := mdServer.GetForTLF(ctx, id, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(10), head.MD.RevisionNumber())
+
+	// Restoring should bring back the older merged head and the
+	// branch.
+	err = mdServer.Restore(snapshot)
+	require.NoError(t, err)
+
+	head, err = mdServer.GetForTLF(ctx, id, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(5), head.MD.RevisionNumber())
+	rmdses, err := mdServer.GetRange(ctx, id, NullBranchID, Merged, 1, 100)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(rmdses))
+
+	head, err = mdServer.GetForTLF(ctx, id, NullBranchID, Unmerged)
+	require.NoError(t, err)
+	require.NotNil(t, head)
+	require.Equal(t, bid, head.MD.BID())
+	require.Equal(t, MetadataRevision(8), head.MD.RevisionNumber())
+
+	// The handle mapping should have survived too.
+	id2, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+	require.Equal(t, id, id2)
+
+	// A garbage snapshot shouldn't change anything.
+	err = mdServer.Restore([]byte("garbage"))
+	require.Error(t, err)
+	head, err = mdServer.GetForTLF(ctx, id, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(5), head.MD.RevisionNumber())
+}
+
+// Make sure that the memory server never records a revision
+// timestamp earlier than the previous head's.
+func TestMDServerMemoryClampsRevisionTime(t *testing.T) {
+	// setup
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	clock, t0 := newTestClockAndTimeNow()
+	config.SetClock(clock)
+	mdServer, err := NewMDServerMemory(config)
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	rmds := makeRMDSForTest(t, id, h, MetadataRevisionInitial, uid, MdID{})
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+	prevRoot, err := config.Crypto().MakeMdID(rmds.MD)
+	require.NoError(t, err)
+
+	// Put the next revision with a clock that has gone backwards.
+	clock.Set(t0.Add(-time.Hour))
+	rmds = makeRMDSForTest(
+		t, id, h, MetadataRevisionInitial+1, uid, prevRoot)
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+
+	ts, err := mdServer.GetRevisionTime(
+		ctx, id, NullBranchID, Merged, MetadataRevisionInitial+1)
+	require.NoError(t, err)
+	require.True(t, ts.Equal(t0))
+
+	head, err := mdServer.GetForTLF(ctx, id, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.True(t, head.untrustedServerTimestamp.Equal(t0))
+}
+
+// Make sure that the disk server never records a revision
+// timestamp earlier than the previous head's.
+func TestMDServerDiskClampsRevisionTime(t *testing.T) {
+	// setup
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	mdServer, err := NewMDServerTempDir(config)
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	rmds := makeRMDSForTest(t, id, h, MetadataRevisionInitial, uid, MdID{})
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+	prevRoot, err := config.Crypto().MakeMdID(rmds.MD)
+	require.NoError(t, err)
+
+	// Record the first revision as written in the future, as if
+	// the clock has since gone backwards.
+	tlfStorage, err := mdServer.getStorage(id)
+	require.NoError(t, err)
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+	err = os.Chtimes(tlfStorage.mdPath(prevRoot), future, future)
+	require.NoError(t, err)
+
+	rmds = makeRMDSForTest(
+		t, id, h, MetadataRevisionInitial+1, uid, prevRoot)
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+
+	ts, err := mdServer.GetRevisionTime(
+		ctx, id, NullBranchID, Merged, MetadataRevisionInitial+1)
+	require.NoError(t, err)
+	require.True(t, ts.Equal(future))
+
+	head, err := mdServer.GetForTLF(ctx, id, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevisionInitial+1, head.MD.RevisionNumber())
+	require.True(t, head.untrustedServerTimestamp.Equal(future))
+}
+
+// Make sure that a read-only replica of the memory server sees
+// writes to the primary, but rejects writes of its own.
+func TestMDServerMemoryReadOnlyReplica(t *testing.T) {
+	// setup
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	mdServer, err := NewMDServerMemory(config)
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+	replica := mdServer.ReadOnlyReplica()
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	// The replica can't create a TLF.
+	_, _, err = replica.GetForHandle(ctx, h, Merged)
+	require.IsType(t, MDServerErrorWriteAccess{}, err)
+
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	replicaID, rmds, err := replica.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+	require.Equal(t, id, replicaID)
+	require.Nil(t, rmds)
+
+	// Write to the primary, and make sure the replica sees it.
+	rmds = makeRMDSForTest(t, id, h, MetadataRevisionInitial, uid, MdID{})
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+	prevRoot, err := config.Crypto().MakeMdID(rmds.MD)
+	require.NoError(t, err)
+
+	head, err := replica.GetForTLF(ctx, id, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.NotNil(t, head)
+	require.Equal(t, MetadataRevisionInitial, head.MD.RevisionNumber())
+
+	// Writes to the replica should be rejected.
+	rmds = makeRMDSForTest(
+		t, id, h, MetadataRevisionInitial+1, uid, prevRoot)
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+	err = replica.Put(ctx, rmds)
+	require.IsType(t, MDServerErrorWriteAccess{}, err)
+
+	rmdses, err := replica.GetRange(ctx, id, NullBranchID, Merged, 1, 100)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(rmdses))
+
+	_, err = replica.TruncateLock(ctx, id)
+	require.IsType(t, MDServerErrorWriteAccess{}, err)
+
+	// Importing history into the replica shouldn't be able to get
+	// around the write check.
+	var buf bytes.Buffer
+	err = ExportTLFHistory(ctx, mdServer, id, NullBranchID, Merged, &buf)
+	require.NoError(t, err)
+	err = ImportTLFHistory(ctx, replica, &buf)
+	require.IsType(t, MDServerErrorWriteAccess{}, err)
+
+	// Neither should restoring a snapshot.
+	snapshot, err := mdServer.Snapshot()
+	require.NoError(t, err)
+	restorer, ok := replica.(interface {
+		Restore(buf []byte) error
+	})
+	require.True(t, ok)
+	err = restorer.Restore(snapshot)
+	require.IsType(t, MDServerErrorWriteAccess{}, err)
+}
+
+// testMDServerLocal is what the shared local MD server tests need
+// from the server under test.
+type testMDServerLocal interface {
+	mdServerLocal
+	PauseNotifications()
+	ResumeNotifications()
+	SetQuotaLimit(limit uint64)
+	SetMaxBranchRevisions(max uint64)
+}
+
+// mdServerLocalConstructors has a constructor for each local MD
+// server implementation, each of which runMDServerLocalTest runs a
+// shared test against.
+var mdServerLocalConstructors = []struct {
+	name        string
+	newMDServer func(config Config) (testMDServerLocal, error)
+}{
+	{"Memory", func(config Config) (testMDServerLocal, error) {
+		return NewMDServerMemory(config)
+	}},
+	{"Disk", func(config Config) (testMDServerLocal, error) {
+		return NewMDServerTempDir(config)
+	}},
+}
+
+// runMDServerLocalTest runs test as a subtest against a fresh
+// instance of each local MD server implementation, using a test
+// config for the given users (or just "test_user" if none are given).
+func runMDServerLocalTest(t *testing.T, test func(
+	t *testing.T, config *ConfigLocal, mdServer testMDServerLocal),
+	users ...libkb.NormalizedUsername) {
+	if len(users) == 0 {
+		users = []libkb.NormalizedUsername{"test_user"}
+	}
+	for _, c := range mdServerLocalConstructors {
+		t.Run(c.name, func(t *testing.T) {
+			config := MakeTestConfigOrBust(t, users...)
+			defer config.Shutdown()
+			mdServer, err := c.newMDServer(config)
+			require.NoError(t, err)
+			defer mdServer.Shutdown()
+
+			test(t, config, mdServer)
+		})
+	}
+}
+
+func testMDServerTrialPut(
+	t *testing.T, config *ConfigLocal, mdServer testMDServerLocal) {
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	rmds := makeRMDSForTest(t, id, h, MetadataRevisionInitial, uid, MdID{})
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+
+	// A successful trial put shouldn't store anything.
+	err = mdServer.TrialPut(ctx, rmds)
+	require.NoError(t, err)
+	head, err := mdServer.GetForTLF(ctx, id, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.Nil(t, head)
+
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+	prevRoot, err := config.Crypto().MakeMdID(rmds.MD)
+	require.NoError(t, err)
+
+	rmds2 := makeRMDSForTest(
+		t, id, h, MetadataRevisionInitial+1, uid, prevRoot)
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds2)
+	err = mdServer.Put(ctx, rmds2)
+	require.NoError(t, err)
+
+	// A conflicting put should be predicted by a trial put.
+	rmds3 := makeRMDSForTest(
+		t, id, h, MetadataRevisionInitial+1, uid, prevRoot)
+	rmds3.MD.SetRefBytes(1)
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds3)
+	trialErr := mdServer.TrialPut(ctx, rmds3)
+	require.IsType(t, MDServerErrorConflictRevision{}, trialErr)
+	err = mdServer.Put(ctx, rmds3)
+	require.Equal(t, trialErr, err)
+}
+
+func TestMDServerTrialPut(t *testing.T) {
+	runMDServerLocalTest(t, testMDServerTrialPut)
+}
+
+func testMDServerGetForHandleUnmerged(
+	t *testing.T, config *ConfigLocal, mdServer testMDServerLocal) {
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	rmds := makeRMDSForTest(t, id, h, MetadataRevisionInitial, uid, MdID{})
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+	prevRoot, err := config.Crypto().MakeMdID(rmds.MD)
+	require.NoError(t, err)
+
+	// No unmerged branch yet.
+	id2, head, err := mdServer.GetForHandle(ctx, h, Unmerged)
+	require.NoError(t, err)
+	require.Equal(t, id, id2)
+	require.Nil(t, head)
+
+	bid, err := config.Crypto().MakeRandomBranchID()
+	require.NoError(t, err)
+	for i := MetadataRevisionInitial + 1; i <= MetadataRevisionInitial+3; i++ {
+		rmds := makeRMDSForTest(t, id, h, i, uid, prevRoot)
+		rmds.MD.SetUnmerged()
+		rmds.MD.SetBranchID(bid)
+		signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+		err = mdServer.Put(ctx, rmds)
+		require.NoError(t, err)
+		prevRoot, err = config.Crypto().MakeMdID(rmds.MD)
+		require.NoError(t, err)
+	}
+
+	id2, head, err = mdServer.GetForHandle(ctx, h, Unmerged)
+	require.NoError(t, err)
+	require.Equal(t, id, id2)
+	require.NotNil(t, head)
+	require.Equal(t, MetadataRevisionInitial+3, head.MD.RevisionNumber())
+	require.Equal(t, bid, head.MD.BID())
+
+	// The merged head is unaffected.
+	_, head, err = mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+	require.NotNil(t, head)
+	require.Equal(t, MetadataRevisionInitial, head.MD.RevisionNumber())
+
+	err = mdServer.PruneBranch(ctx, id, bid)
+	require.NoError(t, err)
+
+	_, head, err = mdServer.GetForHandle(ctx, h, Unmerged)
+	require.NoError(t, err)
+	require.Nil(t, head)
+}
+
+func TestMDServerGetForHandleUnmerged(t *testing.T) {
+	runMDServerLocalTest(t, testMDServerGetForHandleUnmerged)
+}
+
+func testMDServerGetRangeInvalid(
+	t *testing.T, config *ConfigLocal, mdServer testMDServerLocal) {
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	rmds := makeRMDSForTest(t, id, h, MetadataRevisionInitial, uid, MdID{})
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+
+	for _, r := range []struct {
+		start, stop MetadataRevision
+	}{
+		{MetadataRevisionUninitialized, 1},
+		{1, MetadataRevisionUninitialized},
+		{-1, 1},
+		{2, 1},
+	} {
+		_, err := mdServer.GetRange(
+			ctx, id, NullBranchID, Merged, r.start, r.stop)
+		require.IsType(t, MDServerErrorBadRequest{}, err,
+			"range [%s, %s]", r.start, r.stop)
+	}
+
+	// A single revision, and a range past the head, are fine.
+	rmdses, err := mdServer.GetRange(ctx, id, NullBranchID, Merged, 1, 1)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 1)
+	rmdses, err = mdServer.GetRange(ctx, id, NullBranchID, Merged, 2, 100)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 0)
+}
+
+func TestMDServerGetRangeInvalid(t *testing.T) {
+	runMDServerLocalTest(t, testMDServerGetRangeInvalid)
+}
+
+func testMDServerGetRangeByWriter(
+	t *testing.T, config *ConfigLocal, mdServer testMDServerLocal) {
+	ctx := context.Background()
+
+	_, uid1, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config, "u2")
+	defer config2.Shutdown()
+	mdServer2 := mdServer.copy(config2)
+	_, uid2, err := config2.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle(
+		[]keybase1.UID{uid1, uid2}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	// Alternate writers, starting with u1.
+	prevRoot := MdID{}
+	for i := MetadataRevisionInitial; i <= 6; i++ {
+		c, s, uid := config, MDServer(mdServer), uid1
+		if i%2 == 0 {
+			c, s, uid = config2, mdServer2, uid2
+		}
+		rmds := makeRMDSForTest(t, id, h, i, uid, prevRoot)
+		signRMDSForTest(t, c.Codec(), c.Crypto(), rmds)
+		err = s.Put(ctx, rmds)
+		require.NoError(t, err)
+		prevRoot, err = c.Crypto().MakeMdID(rmds.MD)
+		require.NoError(t, err)
+	}
+
+	getRevisions := func(start, stop MetadataRevision,
+		writer keybase1.UID) []MetadataRevision {
+		rmdses, err := mdServer.GetRangeByWriter(
+			ctx, id, NullBranchID, Merged, start, stop, writer)
+		require.NoError(t, err)
+		var revs []MetadataRevision
+		for _, rmds := range rmdses {
+			require.Equal(t, writer, rmds.MD.LastModifyingWriter())
+			revs = append(revs, rmds.MD.RevisionNumber())
+		}
+		return revs
+	}
+
+	require.Equal(t, []MetadataRevision{1, 3, 5}, getRevisions(1, 100, uid1))
+	require.Equal(t, []MetadataRevision{2, 4, 6}, getRevisions(1, 100, uid2))
+	require.Equal(t, []MetadataRevision{4}, getRevisions(3, 4, uid2))
+	require.Nil(t, getRevisions(1, 100, keybase1.MakeTestUID(100)))
+
+	_, err = mdServer.GetRangeByWriter(
+		ctx, id, NullBranchID, Merged, 2, 1, uid1)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+}
+
+func TestMDServerGetRangeByWriter(t *testing.T) {
+	runMDServerLocalTest(t, testMDServerGetRangeByWriter, "u1", "u2")
+}
+
+func testMDServerHasRevision(
+	t *testing.T, config *ConfigLocal, mdServer testMDServerLocal) {
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	ok, _, err := mdServer.HasRevision(
+		ctx, id, NullBranchID, Merged, MetadataRevisionInitial)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	var mdIDs []MdID
+	prevRoot := MdID{}
+	for i := MetadataRevisionInitial; i <= MetadataRevisionInitial+1; i++ {
+		rmds := makeRMDSForTest(t, id, h, i, uid, prevRoot)
+		signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+		err = mdServer.Put(ctx, rmds)
+		require.NoError(t, err)
+		prevRoot, err = config.Crypto().MakeMdID(rmds.MD)
+		require.NoError(t, err)
+		mdIDs = append(mdIDs, prevRoot)
+	}
+
+	bid, err := config.Crypto().MakeRandomBranchID()
+	require.NoError(t, err)
+	rmds := makeRMDSForTest(
+		t, id, h, MetadataRevisionInitial+2, uid, prevRoot)
+	rmds.MD.SetUnmerged()
+	rmds.MD.SetBranchID(bid)
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+	unmergedID, err := config.Crypto().MakeMdID(rmds.MD)
+	require.NoError(t, err)
+
+	for i, expectedID := range mdIDs {
+		ok, mdID, err := mdServer.HasRevision(ctx, id, NullBranchID,
+			Merged, MetadataRevisionInitial+MetadataRevision(i))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, expectedID, mdID)
+	}
+
+	// The unmerged revision isn't on the merged branch.
+	ok, _, err = mdServer.HasRevision(
+		ctx, id, NullBranchID, Merged, MetadataRevisionInitial+2)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// It can be found with or without the branch ID.
+	for _, b := range []BranchID{bid, NullBranchID} {
+		ok, mdID, err := mdServer.HasRevision(
+			ctx, id, b, Unmerged, MetadataRevisionInitial+2)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, unmergedID, mdID)
+	}
+
+	_, _, err = mdServer.HasRevision(
+		ctx, id, NullBranchID, Merged, MetadataRevisionUninitialized)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+}
+
+func TestMDServerHasRevision(t *testing.T) {
+	runMDServerLocalTest(t, testMDServerHasRevision)
+}
+
+func testMDServerGetLatestHandleForTLF(
+	t *testing.T, config *ConfigLocal, mdServer testMDServerLocal) {
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	// Make a TLF with an unresolved reader.
+	assertion := keybase1.SocialAssertion{User: "u2", Service: "twitter"}
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil,
+		[]keybase1.SocialAssertion{assertion}, nil)
+	require.NoError(t, err)
+
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	latest, err := mdServer.GetLatestHandleForTLF(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, h, latest)
+
+	// Once the assertion is resolved, the latest handle should
+	// reflect it.
+	daemon := config.KeybaseService().(*KeybaseDaemonLocal)
+	uid2 := daemon.addNewAssertionForTestOrBust("u2", "u2@twitter")
+	err = mdServer.addNewAssertionForTest(uid2, assertion)
+	require.NoError(t, err)
+
+	latest, err = mdServer.GetLatestHandleForTLF(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, []keybase1.UID{uid2}, latest.Readers)
+	require.Nil(t, latest.UnresolvedReaders)
+
+	// Someone who isn't a reader can't look it up.
+	config3 := ConfigAsUser(config, "u3")
+	defer config3.Shutdown()
+	mdServer3 := mdServer.copy(config3)
+	_, err = mdServer3.GetLatestHandleForTLF(ctx, id)
+	require.IsType(t, MDServerErrorUnauthorized{}, err)
+
+	// Looking up an unknown TLF returns an empty handle.
+	latest, err = mdServer.GetLatestHandleForTLF(ctx, FakeTlfID(1, false))
+	require.NoError(t, err)
+	require.Equal(t, BareTlfHandle{}, latest)
+}
+
+func TestMDServerGetLatestHandleForTLF(t *testing.T) {
+	runMDServerLocalTest(
+		t, testMDServerGetLatestHandleForTLF, "u1", "u2", "u3")
+}
+
+func testMDServerRegisterForHandleChange(
+	t *testing.T, config *ConfigLocal, mdServer testMDServerLocal) {
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	// Make a TLF with an unresolved reader.
+	assertion := keybase1.SocialAssertion{User: "u2", Service: "twitter"}
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil,
+		[]keybase1.SocialAssertion{assertion}, nil)
+	require.NoError(t, err)
+
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	c, err := mdServer.RegisterForHandleChange(ctx, id)
+	require.NoError(t, err)
+
+	// Someone who isn't a reader can't register.
+	config3 := ConfigAsUser(config, "u3")
+	defer config3.Shutdown()
+	mdServer3 := mdServer.copy(config3)
+	_, err = mdServer3.RegisterForHandleChange(ctx, id)
+	require.IsType(t, MDServerErrorUnauthorized{}, err)
+
+	select {
+	case <-c:
+		t.Fatal("Got a handle change before the assertion resolved")
+	default:
+	}
+
+	// Resolving the assertion should send the new handle, and
+	// then close the channel.
+	daemon := config.KeybaseService().(*KeybaseDaemonLocal)
+	uid2 := daemon.addNewAssertionForTestOrBust("u2", "u2@twitter")
+	err = mdServer.addNewAssertionForTest(uid2, assertion)
+	require.NoError(t, err)
+
+	newH, ok := <-c
+	require.True(t, ok)
+	require.Equal(t, []keybase1.UID{uid2}, newH.Readers)
+	require.Nil(t, newH.UnresolvedReaders)
+
+	_, ok = <-c
+	require.False(t, ok)
+
+	// Putting an MD whose handle resolves an assertion should
+	// also send the new handle.
+	assertion2 := keybase1.SocialAssertion{User: "u2", Service: "github"}
+	h2, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil,
+		[]keybase1.SocialAssertion{assertion2}, nil)
+	require.NoError(t, err)
+	id2, _, err := mdServer.GetForHandle(ctx, h2, Merged)
+	require.NoError(t, err)
+	c, err = mdServer.RegisterForHandleChange(ctx, id2)
+	require.NoError(t, err)
+
+	resolvedH2 := h2.ResolveAssertions(
+		map[keybase1.SocialAssertion]keybase1.UID{assertion2: uid2})
+	rmds := makeRMDSForTest(
+		t, id2, resolvedH2, MetadataRevisionInitial, uid, MdID{})
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+
+	newH, ok = <-c
+	require.True(t, ok)
+	require.Equal(t, []keybase1.UID{uid2}, newH.Readers)
+	require.Nil(t, newH.UnresolvedReaders)
+	latestH, err := mdServer.GetLatestHandleForTLF(ctx, id2)
+	require.NoError(t, err)
+	require.Equal(t, newH, latestH)
+
+	_, ok = <-c
+	require.False(t, ok)
+
+	// Shutting down should close any remaining channels.
+	c, err = mdServer.RegisterForHandleChange(ctx, id2)
+	require.NoError(t, err)
+	mdServer.Shutdown()
+	_, ok = <-c
+	require.False(t, ok)
+}
+
+func TestMDServerRegisterForHandleChange(t *testing.T) {
+	runMDServerLocalTest(
+		t, testMDServerRegisterForHandleChange, "u1", "u2", "u3")
+}
+
+func testMDServerMDTooLarge(
+	t *testing.T, config *ConfigLocal, mdServer testMDServerLocal) {
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	config.maxMDBytes = 100
+	rmds := makeRMDSForTest(t, id, h, MetadataRevisionInitial, uid, MdID{})
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+
+	err = mdServer.TrialPut(ctx, rmds)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+	err = mdServer.Put(ctx, rmds)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+	head, err := mdServer.GetForTLF(ctx, id, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.Nil(t, head)
+
+	// A max of 0 means there's no limit.
+	config.maxMDBytes = 0
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+}
+
+func TestMDServerMDTooLarge(t *testing.T) {
+	runMDServerLocalTest(t, testMDServerMDTooLarge)
+}
+
+func testMDServerPauseNotifications(
+	t *testing.T, config *ConfigLocal, mdServer testMDServerLocal) {
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h1, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id1, _, err := mdServer.GetForHandle(ctx, h1, Merged)
+	require.NoError(t, err)
+
+	h2, err := MakeBareTlfHandle([]keybase1.UID{uid},
+		[]keybase1.UID{keybase1.MakeTestUID(2)}, nil, nil, nil)
+	require.NoError(t, err)
+	id2, _, err := mdServer.GetForHandle(ctx, h2, Merged)
+	require.NoError(t, err)
+
+	// Observers must come from a different session than the
+	// writer to get notified.
+	observer := mdServer.copy(config)
+	c1, err := observer.RegisterForUpdate(ctx, id1, MetadataRevisionUninitialized)
+	require.NoError(t, err)
+	c2, err := observer.RegisterForUpdate(ctx, id2, MetadataRevisionUninitialized)
+	require.NoError(t, err)
+
+	mdServer.PauseNotifications()
+
+	ids := []TlfID{id1, id2}
+	handles := []BareTlfHandle{h1, h2}
+	for i, id := range ids {
+		prevRoot := MdID{}
+		for rev := MetadataRevisionInitial; rev < 5; rev++ {
+			rmds := makeRMDSForTest(t, id, handles[i], rev, uid, prevRoot)
+			signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+			err = mdServer.Put(ctx, rmds)
+			require.NoError(t, err)
+			prevRoot, err = config.Crypto().MakeMdID(rmds.MD)
+			require.NoError(t, err)
+		}
+	}
+
+	for _, c := range []<-chan error{c1, c2} {
+		select {
+		case <-c:
+			t.Fatal("Got notification while paused")
+		default:
+		}
+	}
+
+	mdServer.ResumeNotifications()
+
+	// Each observer should get exactly one notification, after
+	// which its channel is closed.
+	for _, c := range []<-chan error{c1, c2} {
+		select {
+		case err, ok := <-c:
+			require.True(t, ok)
+			require.NoError(t, err)
+		default:
+			t.Fatal("No notification after resume")
+		}
+		_, ok := <-c
+		require.False(t, ok)
+	}
+}
+
+func TestMDServerPauseNotifications(t *testing.T) {
+	runMDServerLocalTest(t, testMDServerPauseNotifications)
+}
+
+func testMDServerQuota(
+	t *testing.T, config *ConfigLocal, mdServer testMDServerLocal) {
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	used, limit, err := mdServer.GetQuotaInfo(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), used)
+	require.Equal(t, uint64(0), limit)
+
+	prevRoot := MdID{}
+	for rev := MetadataRevisionInitial; rev < 5; rev++ {
+		rmds := makeRMDSForTest(t, id, h, rev, uid, prevRoot)
+		signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+		err = mdServer.Put(ctx, rmds)
+		require.NoError(t, err)
+		prevRoot, err = config.Crypto().MakeMdID(rmds.MD)
+		require.NoError(t, err)
+
+		newUsed, _, err := mdServer.GetQuotaInfo(ctx)
+		require.NoError(t, err)
+		require.True(t, newUsed > used)
+		used = newUsed
+	}
+
+	// Usage on a branch is released when the branch is pruned.
+	bid, err := config.Crypto().MakeRandomBranchID()
+	require.NoError(t, err)
+	rmds := makeRMDSForTest(t, id, h, 5, uid, prevRoot)
+	rmds.MD.SetUnmerged()
+	rmds.MD.SetBranchID(bid)
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+	branchUsed, _, err := mdServer.GetQuotaInfo(ctx)
+	require.NoError(t, err)
+	require.True(t, branchUsed > used)
+	err = mdServer.PruneBranch(ctx, id, bid)
+	require.NoError(t, err)
+	newUsed, _, err := mdServer.GetQuotaInfo(ctx)
+	require.NoError(t, err)
+	require.Equal(t, used, newUsed)
+
+	mdServer.SetQuotaLimit(used + 1)
+	_, limit, err = mdServer.GetQuotaInfo(ctx)
+	require.NoError(t, err)
+	require.Equal(t, used+1, limit)
+
+	rmds = makeRMDSForTest(t, id, h, 5, uid, prevRoot)
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+	err = mdServer.TrialPut(ctx, rmds)
+	require.IsType(t, MDServerErrorQuotaExceeded{}, err)
+	err = mdServer.Put(ctx, rmds)
+	require.IsType(t, MDServerErrorQuotaExceeded{}, err)
+
+	// A failed put doesn't count against the quota.
+	newUsed, _, err = mdServer.GetQuotaInfo(ctx)
+	require.NoError(t, err)
+	require.Equal(t, used, newUsed)
+
+	mdServer.SetQuotaLimit(0)
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+}
+
+func TestMDServerQuota(t *testing.T) {
+	runMDServerLocalTest(t, testMDServerQuota)
+}
+
+func TestMDServerDiskQuotaPersisted(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	tempdir, err := ioutil.TempDir(os.TempDir(), "mdserver_disk_quota")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	mdServer, err := NewMDServerDir(config, tempdir)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	rmds := makeRMDSForTest(t, id, h, MetadataRevisionInitial, uid, MdID{})
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+	used, _, err := mdServer.GetQuotaInfo(ctx)
+	require.NoError(t, err)
+	require.NotEqual(t, uint64(0), used)
+	mdServer.Shutdown()
+
+	// The usage should survive a restart.
+	mdServer, err = NewMDServerDir(config, tempdir)
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+	newUsed, _, err := mdServer.GetQuotaInfo(ctx)
+	require.NoError(t, err)
+	require.Equal(t, used, newUsed)
+}
+
+func testMDServerTooManyRevisions(
+	t *testing.T, config *ConfigLocal, mdServer testMDServerLocal) {
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+
+	const maxBranchRevisions = 3
+	mdServer.SetMaxBranchRevisions(maxBranchRevisions)
+
+	// The cap doesn't apply to the merged branch.
+	prevRoot := MdID{}
+	for rev := MetadataRevisionInitial; rev <= 5; rev++ {
+		rmds := makeRMDSForTest(t, id, h, rev, uid, prevRoot)
+		signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+		err = mdServer.Put(ctx, rmds)
+		require.NoError(t, err)
+		prevRoot, err = config.Crypto().MakeMdID(rmds.MD)
+		require.NoError(t, err)
+	}
+
+	bid, err := config.Crypto().MakeRandomBranchID()
+	require.NoError(t, err)
+	makeUnmerged := func(rev MetadataRevision) *RootMetadataSigned {
+		rmds := makeRMDSForTest(t, id, h, rev, uid, prevRoot)
+		rmds.MD.SetUnmerged()
+		rmds.MD.SetBranchID(bid)
+		signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+		return rmds
+	}
+	for rev := MetadataRevision(6); rev < 6+maxBranchRevisions; rev++ {
+		rmds := makeUnmerged(rev)
+		err = mdServer.Put(ctx, rmds)
+		require.NoError(t, err)
+		prevRoot, err = config.Crypto().MakeMdID(rmds.MD)
+		require.NoError(t, err)
+	}
+
+	rmds := makeUnmerged(6 + maxBranchRevisions)
+	expectedErr := MDServerErrorTooManyRevisions{
+		Max: maxBranchRevisions, Actual: maxBranchRevisions + 1}
+	err = mdServer.TrialPut(ctx, rmds)
+	require.Equal(t, expectedErr, err)
+	err = mdServer.Put(ctx, rmds)
+	require.Equal(t, expectedErr, err)
+	require.True(t, isRevisionConflict(err))
+
+	// Nothing should have been stored.
+	head, err := mdServer.GetForTLF(ctx, id, bid, Unmerged)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevision(5+maxBranchRevisions),
+		head.MD.RevisionNumber())
+
+	mdServer.SetMaxBranchRevisions(0)
+	err = mdServer.Put(ctx, rmds)
+	require.NoError(t, err)
+}
+
+func TestMDServerTooManyRevisions(t *testing.T) {
+	runMDServerLocalTest(t, testMDServerTooManyRevisions)
+}
@@ -12,7 +12,9 @@ import (
 	"path/filepath"
 	"sync"
 
+	"github.com/keybase/client/go/logger"
 	keybase1 "github.com/keybase/client/go/protocol"
+	"golang.org/x/net/context"
 )
 
 // mdServerTlfStorage stores an ordered list of metadata IDs for each
@@ -50,6 +52,7 @@ import (
 type mdServerTlfStorage struct {
 	codec  Codec
 	crypto cryptoPure
+	log    logger.Logger
 	dir    string
 
 	// Protects any IO operations in dir or any of its children,
@@ -58,11 +61,12 @@ type mdServerTlfStorage struct {
 	branchJournals map[BranchID]mdIDJournal
 }
 
-func makeMDServerTlfStorage(
-	codec Codec, crypto cryptoPure, dir string) *mdServerTlfStorage {
+func makeMDServerTlfStorage(codec Codec, crypto cryptoPure,
+	log logger.Logger, dir string) *mdServerTlfStorage {
 	journal := &mdServerTlfStorage{
 		codec:          codec,
 		crypto:         crypto,
+		log:            log,
 		dir:            dir,
 		branchJournals: make(map[BranchID]mdIDJournal),
 	}
@@ -308,32 +312,68 @@ func (s *mdServerTlfStorage) getRange(
 	return s.getRangeReadLocked(currentUID, bid, start, stop)
 }
 
-func (s *mdServerTlfStorage) put(
-	currentUID keybase1.UID, currentVerifyingKey VerifyingKey,
-	rmds *RootMetadataSigned) (
-	recordBranchID bool, err error) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
+func (s *mdServerTlfStorage) hasRevision(
+	currentUID keybase1.UID, bid BranchID, rev MetadataRevision) (
+	bool, MdID, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 
 	if s.isShutdownReadLocked() {
-		return false, errMDServerTlfStorageShutdown
+		return false, MdID{}, errMDServerTlfStorageShutdown
 	}
 
-	err = rmds.IsValidAndSigned(s.codec, s.crypto)
+	err := s.checkGetParamsReadLocked(currentUID, bid)
 	if err != nil {
-		return false, MDServerErrorBadRequest{Reason: err.Error()}
+		return false, MdID{}, err
 	}
 
-	err = rmds.IsLastModifiedBy(currentUID, currentVerifyingKey)
+	j, ok := s.branchJournals[bid]
+	if !ok {
+		return false, MdID{}, nil
+	}
+
+	// The journal has the MD IDs, so there's no need to read the
+	// MD itself.
+	_, mdIDs, err := j.getRange(rev, rev)
+	if err != nil {
+		return false, MdID{}, MDServerError{err}
+	}
+	if len(mdIDs) == 0 {
+		return false, MdID{}, nil
+	}
+	return true, mdIDs[0], nil
+}
+
+// checkPutReadLocked performs all the validation that put does on
+// rmds, without storing anything. It returns the head that rmds
+// would be the successor of, if any, and whether rmds would start a
+// new branch whose ID needs to be recorded. If
+// maxBranchRevisions is non-zero, it's the maximum number of
+// revisions an unmerged branch may have. If imported is set, rmds
+// may have been last modified by any writer and device, and
+// currentVerifyingKey is ignored.
+func (s *mdServerTlfStorage) checkPutReadLocked(
+	currentUID keybase1.UID, currentVerifyingKey VerifyingKey,
+	maxBranchRevisions uint64, imported bool,
+	rmds *RootMetadataSigned) (
+	head *RootMetadataSigned, recordBranchID bool, err error) {
+	err = rmds.IsValidAndSigned(s.codec, s.crypto)
 	if err != nil {
-		return false, MDServerErrorBadRequest{Reason: err.Error()}
+		return nil, false, MDServerErrorBadRequest{Reason: err.Error()}
+	}
+
+	if !imported {
+		err = rmds.IsLastModifiedBy(currentUID, currentVerifyingKey)
+		if err != nil {
+			return nil, false, MDServerErrorBadRequest{Reason: err.Error()}
+		}
 	}
 
 	// Check permissions
 
 	mergedMasterHead, err := s.getHeadForTLFReadLocked(NullBranchID)
 	if err != nil {
-		return false, MDServerError{err}
+		return nil, false, MDServerError{err}
 	}
 
 	// TODO: Figure out nil case.
@@ -341,19 +381,19 @@ func (s *mdServerTlfStorage) put(
 		ok, err := isWriterOrValidRekey(
 			s.codec, currentUID, mergedMasterHead.MD, rmds.MD)
 		if err != nil {
-			return false, MDServerError{err}
+			return nil, false, MDServerError{err}
 		}
 		if !ok {
-			return false, MDServerErrorUnauthorized{}
+			return nil, false, MDServerErrorUnauthorized{}
 		}
 	}
 
 	bid := rmds.MD.BID()
 	mStatus := rmds.MD.MergedStatus()
 
-	head, err := s.getHeadForTLFReadLocked(bid)
+	head, err = s.getHeadForTLFReadLocked(bid)
 	if err != nil {
-		return false, MDServerError{err}
+		return nil, false, MDServerError{err}
 	}
 
 	if mStatus == Unmerged && head == nil {
@@ -362,10 +402,10 @@ func (s *mdServerTlfStorage) put(
 		rmdses, err := s.getRangeReadLocked(
 			currentUID, NullBranchID, prevRev, prevRev)
 		if err != nil {
-			return false, MDServerError{err}
+			return nil, false, MDServerError{err}
 		}
 		if len(rmdses) != 1 {
-			return false, MDServerError{
+			return nil, false, MDServerError{
 				Err: fmt.Errorf("Expected 1 MD block got %d", len(rmdses)),
 			}
 		}
@@ -377,26 +417,119 @@ func (s *mdServerTlfStorage) put(
 	if head != nil {
 		headID, err := s.crypto.MakeMdID(head.MD)
 		if err != nil {
-			return false, MDServerError{err}
+			return nil, false, MDServerError{err}
 		}
 
 		err = head.MD.CheckValidSuccessorForServer(headID, rmds.MD)
 		if err != nil {
-			return false, err
+			return nil, false, err
 		}
 	}
 
+	if mStatus == Unmerged && maxBranchRevisions != 0 {
+		actual := uint64(1)
+		if j, ok := s.branchJournals[bid]; ok && !recordBranchID {
+			length, err := j.length()
+			if err != nil {
+				return nil, false, MDServerError{err}
+			}
+			actual += length
+		}
+		if actual > maxBranchRevisions {
+			return nil, false, MDServerErrorTooManyRevisions{
+				Max: maxBranchRevisions, Actual: actual}
+		}
+	}
+
+	return head, recordBranchID, nil
+}
+
+func (s *mdServerTlfStorage) trialPut(
+	currentUID keybase1.UID, currentVerifyingKey VerifyingKey,
+	maxBranchRevisions uint64, rmds *RootMetadataSigned) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.isShutdownReadLocked() {
+		return errMDServerTlfStorageShutdown
+	}
+
+	_, _, err := s.checkPutReadLocked(
+		currentUID, currentVerifyingKey, maxBranchRevisions, false, rmds)
+	return err
+}
+
+func (s *mdServerTlfStorage) put(ctx context.Context,
+	currentUID keybase1.UID, currentVerifyingKey VerifyingKey,
+	maxBranchRevisions uint64, rmds *RootMetadataSigned) (
+	recordBranchID bool, err error) {
+	return s.putHelper(ctx,
+		currentUID, currentVerifyingKey, maxBranchRevisions, false, rmds)
+}
+
+// putImported is like put, but rmds may have been last modified by
+// any writer and device, as for an MD imported by
+// ImportTLFHistory.
+func (s *mdServerTlfStorage) putImported(ctx context.Context,
+	currentUID keybase1.UID, maxBranchRevisions uint64,
+	rmds *RootMetadataSigned) (recordBranchID bool, err error) {
+	return s.putHelper(ctx,
+		currentUID, VerifyingKey{}, maxBranchRevisions, true, rmds)
+}
+
+func (s *mdServerTlfStorage) putHelper(ctx context.Context,
+	currentUID keybase1.UID, currentVerifyingKey VerifyingKey,
+	maxBranchRevisions uint64, imported bool, rmds *RootMetadataSigned) (
+	recordBranchID bool, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.isShutdownReadLocked() {
+		return false, errMDServerTlfStorageShutdown
+	}
+
+	head, recordBranchID, err := s.checkPutReadLocked(currentUID,
+		currentVerifyingKey, maxBranchRevisions, imported, rmds)
+	if err != nil {
+		return false, err
+	}
+
+	bid := rmds.MD.BID()
+
 	id, err := s.putMDLocked(rmds)
 	if err != nil {
 		return false, MDServerError{err}
 	}
 
+	// Don't let revision timestamps go backwards, e.g. due to
+	// clock skew; instead, clamp the new timestamp to the previous
+	// head's, as MDServerMemory does.
+	if head != nil {
+		path := s.mdPath(id)
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			return false, MDServerError{err}
+		}
+		if fileInfo.ModTime().Before(head.untrustedServerTimestamp) {
+			s.log.CWarningf(ctx,
+				"Clamping timestamp for rev=%s from %s to "+
+					"previous head's %s",
+				rmds.MD.RevisionNumber(), fileInfo.ModTime(),
+				head.untrustedServerTimestamp)
+			err = os.Chtimes(path, head.untrustedServerTimestamp,
+				head.untrustedServerTimestamp)
+			if err != nil {
+				return false, MDServerError{err}
+			}
+		}
+	}
+
 	j, err := s.getOrCreateBranchJournalLocked(bid)
 	if err != nil {
 		return false, err
 	}
 
-	err = j.append(rmds.MD.RevisionNumber(), id)
+	err = j.append(rmds.MD.RevisionNumber(), mdIDJournalEntry{ID: id})
 	if err != nil {
 		return false, MDServerError{err}
 	}
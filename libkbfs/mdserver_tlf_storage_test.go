@@ -9,8 +9,10 @@ import (
 	"os"
 	"testing"
 
+	"github.com/keybase/client/go/logger"
 	keybase1 "github.com/keybase/client/go/protocol"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 )
 
 func getMDJournalLength(t *testing.T, s *mdServerTlfStorage, bid BranchID) int {
@@ -35,9 +37,12 @@ func TestMDServerTlfStorageBasic(t *testing.T) {
 		require.NoError(t, err)
 	}()
 
-	s := makeMDServerTlfStorage(codec, crypto, tempdir)
+	log := logger.NewTestLogger(t)
+	s := makeMDServerTlfStorage(codec, crypto, log, tempdir)
 	defer s.shutdown()
 
+	ctx := context.Background()
+
 	require.Equal(t, 0, getMDJournalLength(t, s, NullBranchID))
 
 	uid := keybase1.MakeTestUID(1)
@@ -60,7 +65,7 @@ func TestMDServerTlfStorageBasic(t *testing.T) {
 	for i := MetadataRevision(1); i <= 10; i++ {
 		rmds := makeRMDSForTest(t, id, h, i, uid, prevRoot)
 		signRMDSForTest(t, codec, signer, rmds)
-		recordBranchID, err := s.put(uid, verifyingKey, rmds)
+		recordBranchID, err := s.put(ctx, uid, verifyingKey, 0, rmds)
 		require.NoError(t, err)
 		require.False(t, recordBranchID)
 		prevRoot, err = crypto.MakeMdID(rmds.MD)
@@ -76,7 +81,7 @@ func TestMDServerTlfStorageBasic(t *testing.T) {
 
 	rmds := makeRMDSForTest(t, id, h, 10, uid, prevRoot)
 	signRMDSForTest(t, codec, signer, rmds)
-	_, err = s.put(uid, verifyingKey, rmds)
+	_, err = s.put(ctx, uid, verifyingKey, 0, rmds)
 	require.IsType(t, MDServerErrorConflictRevision{}, err)
 
 	require.Equal(t, 10, getMDJournalLength(t, s, NullBranchID))
@@ -91,7 +96,7 @@ func TestMDServerTlfStorageBasic(t *testing.T) {
 		rmds.MD.SetUnmerged()
 		rmds.MD.SetBranchID(bid)
 		signRMDSForTest(t, codec, signer, rmds)
-		recordBranchID, err := s.put(uid, verifyingKey, rmds)
+		recordBranchID, err := s.put(ctx, uid, verifyingKey, 0, rmds)
 		require.NoError(t, err)
 		require.Equal(t, i == MetadataRevision(6), recordBranchID)
 		prevRoot, err = crypto.MakeMdID(rmds.MD)
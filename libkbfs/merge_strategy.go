@@ -0,0 +1,58 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+// MergeDecision says how a MergeStrategy wants a conflict between an
+// unmerged and a merged change to be resolved.
+type MergeDecision int
+
+const (
+	// MergeKeepBoth keeps both versions, renaming the unmerged one
+	// using the configured ConflictRenamer. This is the default
+	// behavior.
+	MergeKeepBoth MergeDecision = iota
+	// MergeKeepMerged keeps the merged version and discards the
+	// unmerged change.
+	MergeKeepMerged
+)
+
+func (d MergeDecision) String() string {
+	switch d {
+	case MergeKeepBoth:
+		return "keep both"
+	case MergeKeepMerged:
+		return "keep merged"
+	default:
+		return "unknown merge decision"
+	}
+}
+
+// RenameMergeStrategy is the default MergeStrategy, which always
+// keeps both versions of a conflicting file.
+type RenameMergeStrategy struct{}
+
+// ResolveFileConflict implements the MergeStrategy interface for
+// RenameMergeStrategy.
+func (RenameMergeStrategy) ResolveFileConflict(
+	unmergedOp, mergedOp op) MergeDecision {
+	return MergeKeepBoth
+}
+
+// PreferNewestMergeStrategy discards the unmerged change to a
+// conflicting file if the merged change was made more recently,
+// according to the local timestamps of the MDs that carried them.
+// Since conflict resolution can't yet replace a merged file with the
+// unmerged version, both versions are kept otherwise.
+type PreferNewestMergeStrategy struct{}
+
+// ResolveFileConflict implements the MergeStrategy interface for
+// PreferNewestMergeStrategy.
+func (PreferNewestMergeStrategy) ResolveFileConflict(
+	unmergedOp, mergedOp op) MergeDecision {
+	if mergedOp.getLocalTimestamp().After(unmergedOp.getLocalTimestamp()) {
+		return MergeKeepMerged
+	}
+	return MergeKeepBoth
+}
@@ -11,6 +11,7 @@ import (
 	go_metrics "github.com/rcrowley/go-metrics"
 	context "golang.org/x/net/context"
 	reflect "reflect"
+	regexp "regexp"
 	time "time"
 )
 
@@ -506,6 +507,17 @@ func (_mr *_MockKBFSOpsRecorder) GetEditHistory(arg0, arg1 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetEditHistory", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) ListAllConflicts(ctx context.Context) ([]ConflictInfo, error) {
+	ret := _m.ctrl.Call(_m, "ListAllConflicts", ctx)
+	ret0, _ := ret[0].([]ConflictInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) ListAllConflicts(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ListAllConflicts", arg0)
+}
+
 func (_m *MockKBFSOps) Shutdown() error {
 	ret := _m.ctrl.Call(_m, "Shutdown")
 	ret0, _ := ret[0].(error)
@@ -2545,6 +2557,29 @@ func (_mr *_MockMDServerRecorder) GetRange(arg0, arg1, arg2, arg3, arg4, arg5 in
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRange", arg0, arg1, arg2, arg3, arg4, arg5)
 }
 
+func (_m *MockMDServer) GetRangeByWriter(ctx context.Context, id TlfID, bid BranchID, mStatus MergeStatus, start MetadataRevision, stop MetadataRevision, writer protocol.UID) ([]*RootMetadataSigned, error) {
+	ret := _m.ctrl.Call(_m, "GetRangeByWriter", ctx, id, bid, mStatus, start, stop, writer)
+	ret0, _ := ret[0].([]*RootMetadataSigned)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMDServerRecorder) GetRangeByWriter(arg0, arg1, arg2, arg3, arg4, arg5, arg6 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRangeByWriter", arg0, arg1, arg2, arg3, arg4, arg5, arg6)
+}
+
+func (_m *MockMDServer) HasRevision(ctx context.Context, id TlfID, bid BranchID, mStatus MergeStatus, rev MetadataRevision) (bool, MdID, error) {
+	ret := _m.ctrl.Call(_m, "HasRevision", ctx, id, bid, mStatus, rev)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(MdID)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockMDServerRecorder) HasRevision(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "HasRevision", arg0, arg1, arg2, arg3, arg4)
+}
+
 func (_m *MockMDServer) Put(ctx context.Context, rmds *RootMetadataSigned) error {
 	ret := _m.ctrl.Call(_m, "Put", ctx, rmds)
 	ret0, _ := ret[0].(error)
@@ -2555,6 +2590,39 @@ func (_mr *_MockMDServerRecorder) Put(arg0, arg1 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Put", arg0, arg1)
 }
 
+func (_m *MockMDServer) TrialPut(ctx context.Context, rmds *RootMetadataSigned) error {
+	ret := _m.ctrl.Call(_m, "TrialPut", ctx, rmds)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockMDServerRecorder) TrialPut(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "TrialPut", arg0, arg1)
+}
+
+func (_m *MockMDServer) GetBranches(ctx context.Context, id TlfID) ([]BranchID, error) {
+	ret := _m.ctrl.Call(_m, "GetBranches", ctx, id)
+	ret0, _ := ret[0].([]BranchID)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMDServerRecorder) GetBranches(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetBranches", arg0, arg1)
+}
+
+func (_m *MockMDServer) GetQuotaInfo(ctx context.Context) (uint64, uint64, error) {
+	ret := _m.ctrl.Call(_m, "GetQuotaInfo", ctx)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(uint64)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockMDServerRecorder) GetQuotaInfo(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetQuotaInfo", arg0)
+}
+
 func (_m *MockMDServer) PruneBranch(ctx context.Context, id TlfID, bid BranchID) error {
 	ret := _m.ctrl.Call(_m, "PruneBranch", ctx, id, bid)
 	ret0, _ := ret[0].(error)
@@ -2576,6 +2644,17 @@ func (_mr *_MockMDServerRecorder) RegisterForUpdate(arg0, arg1, arg2 interface{}
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "RegisterForUpdate", arg0, arg1, arg2)
 }
 
+func (_m *MockMDServer) RegisterForHandleChange(ctx context.Context, id TlfID) (<-chan BareTlfHandle, error) {
+	ret := _m.ctrl.Call(_m, "RegisterForHandleChange", ctx, id)
+	ret0, _ := ret[0].(<-chan BareTlfHandle)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMDServerRecorder) RegisterForHandleChange(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RegisterForHandleChange", arg0, arg1)
+}
+
 func (_m *MockMDServer) CheckForRekeys(ctx context.Context) <-chan error {
 	ret := _m.ctrl.Call(_m, "CheckForRekeys", ctx)
 	ret0, _ := ret[0].(<-chan error)
@@ -2719,6 +2798,29 @@ func (_mr *_MockmdServerLocalRecorder) GetRange(arg0, arg1, arg2, arg3, arg4, ar
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRange", arg0, arg1, arg2, arg3, arg4, arg5)
 }
 
+func (_m *MockmdServerLocal) GetRangeByWriter(ctx context.Context, id TlfID, bid BranchID, mStatus MergeStatus, start MetadataRevision, stop MetadataRevision, writer protocol.UID) ([]*RootMetadataSigned, error) {
+	ret := _m.ctrl.Call(_m, "GetRangeByWriter", ctx, id, bid, mStatus, start, stop, writer)
+	ret0, _ := ret[0].([]*RootMetadataSigned)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockmdServerLocalRecorder) GetRangeByWriter(arg0, arg1, arg2, arg3, arg4, arg5, arg6 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRangeByWriter", arg0, arg1, arg2, arg3, arg4, arg5, arg6)
+}
+
+func (_m *MockmdServerLocal) HasRevision(ctx context.Context, id TlfID, bid BranchID, mStatus MergeStatus, rev MetadataRevision) (bool, MdID, error) {
+	ret := _m.ctrl.Call(_m, "HasRevision", ctx, id, bid, mStatus, rev)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(MdID)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockmdServerLocalRecorder) HasRevision(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "HasRevision", arg0, arg1, arg2, arg3, arg4)
+}
+
 func (_m *MockmdServerLocal) Put(ctx context.Context, rmds *RootMetadataSigned) error {
 	ret := _m.ctrl.Call(_m, "Put", ctx, rmds)
 	ret0, _ := ret[0].(error)
@@ -2729,6 +2831,39 @@ func (_mr *_MockmdServerLocalRecorder) Put(arg0, arg1 interface{}) *gomock.Call
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Put", arg0, arg1)
 }
 
+func (_m *MockmdServerLocal) TrialPut(ctx context.Context, rmds *RootMetadataSigned) error {
+	ret := _m.ctrl.Call(_m, "TrialPut", ctx, rmds)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockmdServerLocalRecorder) TrialPut(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "TrialPut", arg0, arg1)
+}
+
+func (_m *MockmdServerLocal) GetBranches(ctx context.Context, id TlfID) ([]BranchID, error) {
+	ret := _m.ctrl.Call(_m, "GetBranches", ctx, id)
+	ret0, _ := ret[0].([]BranchID)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockmdServerLocalRecorder) GetBranches(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetBranches", arg0, arg1)
+}
+
+func (_m *MockmdServerLocal) GetQuotaInfo(ctx context.Context) (uint64, uint64, error) {
+	ret := _m.ctrl.Call(_m, "GetQuotaInfo", ctx)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(uint64)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockmdServerLocalRecorder) GetQuotaInfo(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetQuotaInfo", arg0)
+}
+
 func (_m *MockmdServerLocal) PruneBranch(ctx context.Context, id TlfID, bid BranchID) error {
 	ret := _m.ctrl.Call(_m, "PruneBranch", ctx, id, bid)
 	ret0, _ := ret[0].(error)
@@ -2750,6 +2885,17 @@ func (_mr *_MockmdServerLocalRecorder) RegisterForUpdate(arg0, arg1, arg2 interf
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "RegisterForUpdate", arg0, arg1, arg2)
 }
 
+func (_m *MockmdServerLocal) RegisterForHandleChange(ctx context.Context, id TlfID) (<-chan BareTlfHandle, error) {
+	ret := _m.ctrl.Call(_m, "RegisterForHandleChange", ctx, id)
+	ret0, _ := ret[0].(<-chan BareTlfHandle)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockmdServerLocalRecorder) RegisterForHandleChange(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RegisterForHandleChange", arg0, arg1)
+}
+
 func (_m *MockmdServerLocal) CheckForRekeys(ctx context.Context) <-chan error {
 	ret := _m.ctrl.Call(_m, "CheckForRekeys", ctx)
 	ret0, _ := ret[0].(<-chan error)
@@ -3167,6 +3313,17 @@ func (_mr *_MockKeyServerRecorder) GetTLFCryptKeyServerHalf(arg0, arg1, arg2 int
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetTLFCryptKeyServerHalf", arg0, arg1, arg2)
 }
 
+func (_m *MockKeyServer) GetKeyHalves(ctx context.Context, requests []KeyHalfRequest) ([]KeyHalfResult, error) {
+	ret := _m.ctrl.Call(_m, "GetKeyHalves", ctx, requests)
+	ret0, _ := ret[0].([]KeyHalfResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKeyServerRecorder) GetKeyHalves(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetKeyHalves", arg0, arg1)
+}
+
 func (_m *MockKeyServer) PutTLFCryptKeyServerHalves(ctx context.Context, serverKeyHalves map[protocol.UID]map[protocol.KID]TLFCryptKeyServerHalf) error {
 	ret := _m.ctrl.Call(_m, "PutTLFCryptKeyServerHalves", ctx, serverKeyHalves)
 	ret0, _ := ret[0].(error)
@@ -3333,14 +3490,55 @@ func (_m *MockConflictRenamer) EXPECT() *_MockConflictRenamerRecorder {
 	return _m.recorder
 }
 
-func (_m *MockConflictRenamer) ConflictRename(op op, original string) string {
-	ret := _m.ctrl.Call(_m, "ConflictRename", op, original)
+func (_m *MockConflictRenamer) ConflictRename(op op, original string, involvedWriters []libkb.NormalizedUsername, exists func(string) bool) string {
+	ret := _m.ctrl.Call(_m, "ConflictRename", op, original, involvedWriters, exists)
 	ret0, _ := ret[0].(string)
 	return ret0
 }
 
-func (_mr *_MockConflictRenamerRecorder) ConflictRename(arg0, arg1 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "ConflictRename", arg0, arg1)
+func (_mr *_MockConflictRenamerRecorder) ConflictRename(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ConflictRename", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockConflictRenamer) Pattern() *regexp.Regexp {
+	ret := _m.ctrl.Call(_m, "Pattern")
+	ret0, _ := ret[0].(*regexp.Regexp)
+	return ret0
+}
+
+func (_mr *_MockConflictRenamerRecorder) Pattern() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Pattern")
+}
+
+// Mock of MergeStrategy interface
+type MockMergeStrategy struct {
+	ctrl     *gomock.Controller
+	recorder *_MockMergeStrategyRecorder
+}
+
+// Recorder for MockMergeStrategy (not exported)
+type _MockMergeStrategyRecorder struct {
+	mock *MockMergeStrategy
+}
+
+func NewMockMergeStrategy(ctrl *gomock.Controller) *MockMergeStrategy {
+	mock := &MockMergeStrategy{ctrl: ctrl}
+	mock.recorder = &_MockMergeStrategyRecorder{mock}
+	return mock
+}
+
+func (_m *MockMergeStrategy) EXPECT() *_MockMergeStrategyRecorder {
+	return _m.recorder
+}
+
+func (_m *MockMergeStrategy) ResolveFileConflict(unmergedOp op, mergedOp op) MergeDecision {
+	ret := _m.ctrl.Call(_m, "ResolveFileConflict", unmergedOp, mergedOp)
+	ret0, _ := ret[0].(MergeDecision)
+	return ret0
+}
+
+func (_mr *_MockMergeStrategyRecorder) ResolveFileConflict(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ResolveFileConflict", arg0, arg1)
 }
 
 // Mock of Config interface
@@ -3734,6 +3932,24 @@ func (_mr *_MockConfigRecorder) ConflictRenamer() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "ConflictRenamer")
 }
 
+func (_m *MockConfig) MergeStrategy() MergeStrategy {
+	ret := _m.ctrl.Call(_m, "MergeStrategy")
+	ret0, _ := ret[0].(MergeStrategy)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MergeStrategy() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MergeStrategy")
+}
+
+func (_m *MockConfig) SetMergeStrategy(_param0 MergeStrategy) {
+	_m.ctrl.Call(_m, "SetMergeStrategy", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetMergeStrategy(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMergeStrategy", arg0)
+}
+
 func (_m *MockConfig) SetConflictRenamer(_param0 ConflictRenamer) {
 	_m.ctrl.Call(_m, "SetConflictRenamer", _param0)
 }
@@ -3820,6 +4036,16 @@ func (_mr *_MockConfigRecorder) MaxDirBytes() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxDirBytes")
 }
 
+func (_m *MockConfig) MaxMDBytes() uint64 {
+	ret := _m.ctrl.Call(_m, "MaxMDBytes")
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MaxMDBytes() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxMDBytes")
+}
+
 func (_m *MockConfig) DoBackgroundFlushes() bool {
 	ret := _m.ctrl.Call(_m, "DoBackgroundFlushes")
 	ret0, _ := ret[0].(bool)
@@ -3838,6 +4064,24 @@ func (_mr *_MockConfigRecorder) SetDoBackgroundFlushes(arg0 interface{}) *gomock
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDoBackgroundFlushes", arg0)
 }
 
+func (_m *MockConfig) AllowUnverifiedKeys() bool {
+	ret := _m.ctrl.Call(_m, "AllowUnverifiedKeys")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) AllowUnverifiedKeys() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "AllowUnverifiedKeys")
+}
+
+func (_m *MockConfig) SetAllowUnverifiedKeys(_param0 bool) {
+	_m.ctrl.Call(_m, "SetAllowUnverifiedKeys", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetAllowUnverifiedKeys(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetAllowUnverifiedKeys", arg0)
+}
+
 func (_m *MockConfig) RekeyWithPromptWaitTime() time.Duration {
 	ret := _m.ctrl.Call(_m, "RekeyWithPromptWaitTime")
 	ret0, _ := ret[0].(time.Duration)
@@ -3868,6 +4112,24 @@ func (_mr *_MockConfigRecorder) QuotaReclamationMinUnrefAge() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "QuotaReclamationMinUnrefAge")
 }
 
+func (_m *MockConfig) WriterInfoCacheTTL() time.Duration {
+	ret := _m.ctrl.Call(_m, "WriterInfoCacheTTL")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) WriterInfoCacheTTL() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "WriterInfoCacheTTL")
+}
+
+func (_m *MockConfig) SetWriterInfoCacheTTL(_param0 time.Duration) {
+	_m.ctrl.Call(_m, "SetWriterInfoCacheTTL", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetWriterInfoCacheTTL(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetWriterInfoCacheTTL", arg0)
+}
+
 func (_m *MockConfig) ResetCaches() {
 	_m.ctrl.Call(_m, "ResetCaches")
 }
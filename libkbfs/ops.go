@@ -37,8 +37,8 @@ type op interface {
 	// otherwise).  The resulting action (if any) assumes that this
 	// method's target op is the unmerged op, and the given op is the
 	// merged op.
-	CheckConflict(renamer ConflictRenamer, mergedOp op, isFile bool) (
-		crAction, error)
+	CheckConflict(renamer ConflictRenamer, mergedOp op, isFile bool,
+		mergedNames crMergedNames) (crAction, error)
 	// GetDefaultAction should be called on an unmerged op only after
 	// all conflicts with the corresponding change have been checked,
 	// and it returns the action to take against the merged branch
@@ -303,7 +303,7 @@ func (co *createOp) String() string {
 }
 
 func (co *createOp) CheckConflict(renamer ConflictRenamer, mergedOp op,
-	isFile bool) (crAction, error) {
+	isFile bool, mergedNames crMergedNames) (crAction, error) {
 	switch realMergedOp := mergedOp.(type) {
 	case *createOp:
 		// Conflicts if this creates the same name and one of them
@@ -317,15 +317,17 @@ func (co *createOp) CheckConflict(renamer ConflictRenamer, mergedOp op,
 				// merged one is not.
 				return &renameMergedAction{
 					fromName: co.NewName,
-					toName:   renamer.ConflictRename(mergedOp, co.NewName),
-					symPath:  co.crSymPath,
+					toName: renamer.ConflictRename(mergedOp, co.NewName,
+						involvedWriters(mergedOp, co), mergedNames.dir),
+					symPath: co.crSymPath,
 				}, nil
 			}
 			// Otherwise rename the unmerged entry (guaranteed to be a file).
 			return &renameUnmergedAction{
 				fromName: co.NewName,
-				toName:   renamer.ConflictRename(co, co.NewName),
-				symPath:  co.crSymPath,
+				toName: renamer.ConflictRename(co, co.NewName,
+					involvedWriters(co, mergedOp), mergedNames.dir),
+				symPath: co.crSymPath,
 			}, nil
 		}
 
@@ -340,9 +342,10 @@ func (co *createOp) CheckConflict(renamer ConflictRenamer, mergedOp op,
 			// Always rename the unmerged one
 			return &copyUnmergedEntryAction{
 				fromName: co.NewName,
-				toName:   renamer.ConflictRename(co, co.NewName),
-				symPath:  co.crSymPath,
-				unique:   true,
+				toName: renamer.ConflictRename(co, co.NewName,
+					involvedWriters(co, mergedOp), mergedNames.dir),
+				symPath: co.crSymPath,
+				unique:  true,
 			}, nil
 		}
 	}
@@ -422,7 +425,7 @@ func (ro *rmOp) String() string {
 }
 
 func (ro *rmOp) CheckConflict(renamer ConflictRenamer, mergedOp op,
-	isFile bool) (crAction, error) {
+	isFile bool, mergedNames crMergedNames) (crAction, error) {
 	switch realMergedOp := mergedOp.(type) {
 	case *createOp:
 		if realMergedOp.NewName == ro.OldName {
@@ -540,7 +543,7 @@ func (ro *renameOp) String() string {
 }
 
 func (ro *renameOp) CheckConflict(renamer ConflictRenamer, mergedOp op,
-	isFile bool) (crAction, error) {
+	isFile bool, mergedNames crMergedNames) (crAction, error) {
 	return nil, fmt.Errorf("Unexpected conflict check on a rename op: %s", ro)
 }
 
@@ -665,7 +668,7 @@ func (so *syncOp) String() string {
 }
 
 func (so *syncOp) CheckConflict(renamer ConflictRenamer, mergedOp op,
-	isFile bool) (crAction, error) {
+	isFile bool, mergedNames crMergedNames) (crAction, error) {
 	switch mergedOp.(type) {
 	case *syncOp:
 		// Any sync on the same file is a conflict.  (TODO: add
@@ -674,7 +677,8 @@ func (so *syncOp) CheckConflict(renamer ConflictRenamer, mergedOp op,
 		return &renameUnmergedAction{
 			fromName: so.getFinalPath().tailName(),
 			toName: renamer.ConflictRename(so, mergedOp.getFinalPath().
-				tailName()),
+				tailName(), involvedWriters(so, mergedOp),
+				mergedNames.parent),
 			unmergedParentMostRecent: so.getFinalPath().parentPath().
 				tailPointer(),
 			mergedParentMostRecent: mergedOp.getFinalPath().parentPath().
@@ -890,7 +894,7 @@ func (sao *setAttrOp) String() string {
 }
 
 func (sao *setAttrOp) CheckConflict(renamer ConflictRenamer, mergedOp op,
-	isFile bool) (crAction, error) {
+	isFile bool, mergedNames crMergedNames) (crAction, error) {
 	switch realMergedOp := mergedOp.(type) {
 	case *setAttrOp:
 		if realMergedOp.Attr == sao.Attr {
@@ -909,7 +913,9 @@ func (sao *setAttrOp) CheckConflict(renamer ConflictRenamer, mergedOp op,
 			return &renameUnmergedAction{
 				fromName: sao.getFinalPath().tailName(),
 				toName: renamer.ConflictRename(
-					sao, mergedOp.getFinalPath().tailName()),
+					sao, mergedOp.getFinalPath().tailName(),
+					involvedWriters(sao, mergedOp),
+					mergedNames.parent),
 				symPath:      symPath,
 				causedByAttr: causedByAttr,
 				unmergedParentMostRecent: sao.getFinalPath().parentPath().
@@ -958,7 +964,7 @@ func (ro *resolutionOp) String() string {
 }
 
 func (ro *resolutionOp) CheckConflict(renamer ConflictRenamer, mergedOp op,
-	isFile bool) (crAction, error) {
+	isFile bool, mergedNames crMergedNames) (crAction, error) {
 	return nil, nil
 }
 
@@ -993,7 +999,7 @@ func (ro *rekeyOp) String() string {
 }
 
 func (ro *rekeyOp) CheckConflict(renamer ConflictRenamer, mergedOp op,
-	isFile bool) (crAction, error) {
+	isFile bool, mergedNames crMergedNames) (crAction, error) {
 	return nil, nil
 }
 
@@ -1040,7 +1046,7 @@ func (gco *gcOp) String() string {
 }
 
 func (gco *gcOp) CheckConflict(renamer ConflictRenamer, mergedOp op,
-	isFile bool) (crAction, error) {
+	isFile bool, mergedNames crMergedNames) (crAction, error) {
 	return nil, nil
 }
 
@@ -13,6 +13,7 @@ import (
 
 	keybase1 "github.com/keybase/client/go/protocol"
 	"github.com/keybase/go-codec/codec"
+	"golang.org/x/net/context"
 )
 
 // MetadataFlags bitfield.
@@ -717,6 +718,53 @@ func (rmds *RootMetadataSigned) MakeFinalCopy(config Config) (
 	return &newRmds, nil
 }
 
+// rootSigningInput returns the bytes covered by rmds.SigInfo.
+func (rmds *RootMetadataSigned) rootSigningInput(codec Codec) (
+	[]byte, error) {
+	md := rmds.MD
+	if rmds.MD.IsFinal() {
+		mdCopy, err := md.DeepCopy(codec)
+		if err != nil {
+			return nil, err
+		}
+		mutableMdCopy, ok := mdCopy.(MutableBareRootMetadata)
+		if !ok {
+			return nil, MutableBareRootMetadataNoImplError{}
+		}
+		// Mask out finalized additions.  These are the only
+		// things allowed to change in the finalized metadata
+		// block.
+		mutableMdCopy.ClearFinalBit()
+		mutableMdCopy.SetRevision(md.RevisionNumber() - 1)
+		mutableMdCopy.SetFinalizedInfo(nil)
+		md = mutableMdCopy
+	}
+	// Re-marshal the whole RootMetadata. This is not avoidable
+	// without support from ugorji/codec.
+	return codec.Encode(md)
+}
+
+// SigningInputs returns the bytes that must be signed to produce the
+// writer metadata signature (to be set with
+// SetWriterMetadataSigInfo) and the root metadata signature (to be
+// set as SigInfo), so that an external signer doesn't have to
+// reimplement their encoding. Note that the root metadata covers the
+// writer metadata signature, so if the writer metadata is being
+// signed too, its signature must be set first and SigningInputs
+// called again to get the final rootMD.
+func (rmds *RootMetadataSigned) SigningInputs(codec Codec) (
+	writerMD []byte, rootMD []byte, err error) {
+	writerMD, err = rmds.MD.GetSerializedWriterMetadata(codec)
+	if err != nil {
+		return nil, nil, err
+	}
+	rootMD, err = rmds.rootSigningInput(codec)
+	if err != nil {
+		return nil, nil, err
+	}
+	return writerMD, rootMD, nil
+}
+
 // IsValidAndSigned verifies the RootMetadataSigned, checks the root
 // signature, and returns an error if a problem was found.  This
 // should be the first thing checked on an RMDS retrieved from an
@@ -736,27 +784,7 @@ func (rmds *RootMetadataSigned) IsValidAndSigned(
 		return err
 	}
 
-	md := rmds.MD
-	if rmds.MD.IsFinal() {
-		mdCopy, err := md.DeepCopy(codec)
-		if err != nil {
-			return err
-		}
-		mutableMdCopy, ok := mdCopy.(MutableBareRootMetadata)
-		if !ok {
-			return MutableBareRootMetadataNoImplError{}
-		}
-		// Mask out finalized additions.  These are the only
-		// things allowed to change in the finalized metadata
-		// block.
-		mutableMdCopy.ClearFinalBit()
-		mutableMdCopy.SetRevision(md.RevisionNumber() - 1)
-		mutableMdCopy.SetFinalizedInfo(nil)
-		md = mutableMdCopy
-	}
-	// Re-marshal the whole RootMetadata. This is not avoidable
-	// without support from ugorji/codec.
-	buf, err := codec.Encode(md)
+	buf, err := rmds.rootSigningInput(codec)
 	if err != nil {
 		return err
 	}
@@ -787,6 +815,60 @@ func (rmds *RootMetadataSigned) IsLastModifiedBy(
 	return nil
 }
 
+// VerifyRMDSChain checks that every RootMetadataSigned in rmdses is
+// valid and signed, and that each one is a valid successor of the
+// one before it, as for a range returned by MDServer.GetRange. If
+// verifyingKey is non-zero, every MD must also have been signed by
+// it. On failure, it returns an RMDSChainBrokenError with the index
+// of the first MD that failed.
+func VerifyRMDSChain(codec Codec, crypto cryptoPure,
+	rmdses []*RootMetadataSigned, verifyingKey VerifyingKey) error {
+	var prevID MdID
+	for i, rmds := range rmdses {
+		err := rmds.IsValidAndSigned(codec, crypto)
+		if err != nil {
+			return RMDSChainBrokenError{i, err}
+		}
+		if verifyingKey != (VerifyingKey{}) &&
+			rmds.SigInfo.VerifyingKey != verifyingKey {
+			return RMDSChainBrokenError{i, fmt.Errorf(
+				"Verifying key %v != %v",
+				rmds.SigInfo.VerifyingKey, verifyingKey)}
+		}
+		if i > 0 {
+			err := rmdses[i-1].MD.CheckValidSuccessor(prevID, rmds.MD)
+			if err != nil {
+				return RMDSChainBrokenError{i, err}
+			}
+		}
+		prevID, err = crypto.MakeMdID(rmds.MD)
+		if err != nil {
+			return RMDSChainBrokenError{i, err}
+		}
+	}
+	return nil
+}
+
+// VerifyRMDSSignedWhileKeyValid checks that the keys that signed
+// rmds belonged to its last-modifying writer and user, and hadn't yet
+// been revoked at serverTime, the time the server recorded the
+// revision. This catches signatures backdated to before a key's
+// revocation. If the writer metadata was copied from an earlier
+// revision, its signature wasn't made at serverTime, so only the
+// root signature is checked.
+func VerifyRMDSSignedWhileKeyValid(ctx context.Context, kbpki KBPKI,
+	rmds *RootMetadataSigned, serverTime time.Time) error {
+	if !rmds.MD.IsWriterMetadataCopiedSet() {
+		err := kbpki.HasVerifyingKey(ctx, rmds.MD.LastModifyingWriter(),
+			rmds.MD.GetWriterMetadataSigInfo().VerifyingKey, serverTime)
+		if err != nil {
+			return err
+		}
+	}
+	return kbpki.HasVerifyingKey(ctx, rmds.MD.GetLastModifyingUser(),
+		rmds.SigInfo.VerifyingKey, serverTime)
+}
+
 // DecodeRootMetadataSigned deserializes a metaddata block into the specified versioned structure.
 func DecodeRootMetadataSigned(codec Codec, tlf TlfID, ver, max MetadataVer, buf []byte) (
 	*RootMetadataSigned, error) {
@@ -804,6 +886,13 @@ func DecodeRootMetadataSigned(codec Codec, tlf TlfID, ver, max MetadataVer, buf
 	if err := codec.Decode(buf, &brmds); err != nil {
 		return nil, err
 	}
+	// Reject a malformed PrevRoot here, rather than when it fails
+	// to match the ID of the previous revision.
+	if brmds.MD.PrevRoot != (MdID{}) {
+		if err := brmds.MD.PrevRoot.IsValid(); err != nil {
+			return nil, err
+		}
+	}
 	return &RootMetadataSigned{
 		MD:      &brmds.MD,
 		SigInfo: brmds.SigInfo,
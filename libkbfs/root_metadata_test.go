@@ -8,6 +8,7 @@ import (
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/keybase/client/go/externals"
 	"github.com/keybase/client/go/libkb"
@@ -702,3 +703,187 @@ func TestRootMetadataFinalVerify(t *testing.T) {
 		t.Fatalf("expected error")
 	}
 }
+
+func TestRootMetadataSignedSigningInputs(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice")
+	defer config.Shutdown()
+	codec := config.Codec()
+	ctx := context.Background()
+
+	id := FakeTlfID(1, false)
+	handle := parseTlfHandleOrBust(t, config, "alice", false)
+	h, err := handle.ToBareHandle()
+	require.NoError(t, err)
+	rmds, err := NewRootMetadataSignedForTest(id, h)
+	require.NoError(t, err)
+	rmds.MD.FakeInitialRekey(h)
+	rmds.MD.SetLastModifyingWriter(h.Writers[0])
+	rmds.MD.SetLastModifyingUser(h.Writers[0])
+	rmds.MD.SetSerializedPrivateMetadata([]byte{42})
+
+	// Sign the writer metadata as an external signer would.
+	writerMD, _, err := rmds.SigningInputs(codec)
+	require.NoError(t, err)
+	expectedWriterMD, err := rmds.MD.GetSerializedWriterMetadata(codec)
+	require.NoError(t, err)
+	require.Equal(t, expectedWriterMD, writerMD)
+	sigInfo, err := config.Crypto().Sign(ctx, writerMD)
+	require.NoError(t, err)
+	rmds.MD.SetWriterMetadataSigInfo(sigInfo)
+
+	// Then sign the root metadata, which covers the writer
+	// signature.
+	_, rootMD, err := rmds.SigningInputs(codec)
+	require.NoError(t, err)
+	expectedRootMD, err := codec.Encode(rmds.MD)
+	require.NoError(t, err)
+	require.Equal(t, expectedRootMD, rootMD)
+	rmds.SigInfo, err = config.Crypto().Sign(ctx, rootMD)
+	require.NoError(t, err)
+
+	err = rmds.IsValidAndSigned(codec, config.Crypto())
+	require.NoError(t, err)
+
+	// The inputs of a finalized copy should still verify against
+	// the original signature.
+	rmds2, err := rmds.MakeFinalCopy(config)
+	require.NoError(t, err)
+	_, rootMD2, err := rmds2.SigningInputs(codec)
+	require.NoError(t, err)
+	require.Equal(t, rootMD, rootMD2)
+	err = rmds2.IsValidAndSigned(codec, config.Crypto())
+	require.NoError(t, err)
+}
+
+func TestVerifyRMDSChain(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	codec := config.Codec()
+	crypto := config.Crypto()
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	verifyingKey, err := config.KBPKI().GetCurrentVerifyingKey(ctx)
+	require.NoError(t, err)
+	h, err := MakeBareTlfHandle([]keybase1.UID{uid}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id := FakeTlfID(1, false)
+
+	var rmdses []*RootMetadataSigned
+	prevRoot := MdID{}
+	for i := MetadataRevisionInitial; i <= 5; i++ {
+		rmds := makeRMDSForTest(t, id, h, i, uid, prevRoot)
+		signRMDSForTest(t, codec, crypto, rmds)
+		rmdses = append(rmdses, rmds)
+		prevRoot, err = crypto.MakeMdID(rmds.MD)
+		require.NoError(t, err)
+	}
+
+	err = VerifyRMDSChain(codec, crypto, rmdses, verifyingKey)
+	require.NoError(t, err)
+	err = VerifyRMDSChain(codec, crypto, rmdses, VerifyingKey{})
+	require.NoError(t, err)
+
+	// A wrong verifying key should fail on the first MD.
+	otherKey := MakeFakeVerifyingKeyOrBust("other key")
+	err = VerifyRMDSChain(codec, crypto, rmdses, otherKey)
+	require.IsType(t, RMDSChainBrokenError{}, err)
+	require.Equal(t, 0, err.(RMDSChainBrokenError).Index)
+
+	// Replace the fourth MD with one that has the wrong prev root.
+	broken := makeRMDSForTest(t, id, h, 4, uid, fakeMdID(1))
+	signRMDSForTest(t, codec, crypto, broken)
+	brokenChain := append([]*RootMetadataSigned(nil), rmdses[:3]...)
+	brokenChain = append(brokenChain, broken)
+	err = VerifyRMDSChain(codec, crypto, brokenChain, verifyingKey)
+	require.IsType(t, RMDSChainBrokenError{}, err)
+	require.Equal(t, 3, err.(RMDSChainBrokenError).Index)
+	require.IsType(t, MDPrevRootMismatch{}, err.(RMDSChainBrokenError).Err)
+}
+
+func TestRootMetadataSignedLastModifyingUser(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	codec := config.Codec()
+	crypto := config.Crypto()
+	ctx := context.Background()
+
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	reader := keybase1.MakeTestUID(2)
+	outsider := keybase1.MakeTestUID(3)
+	h, err := MakeBareTlfHandle(
+		[]keybase1.UID{uid}, []keybase1.UID{reader}, nil, nil, nil)
+	require.NoError(t, err)
+	id := FakeTlfID(1, false)
+
+	makeRMDS := func(writer, user keybase1.UID) *RootMetadataSigned {
+		rmds := makeRMDSForTest(
+			t, id, h, MetadataRevisionInitial, uid, MdID{})
+		rmds.MD.SetLastModifyingWriter(writer)
+		rmds.MD.SetLastModifyingUser(user)
+		signRMDSForTest(t, codec, crypto, rmds)
+		return rmds
+	}
+
+	// Both writers and readers may be the last modifying user.
+	err = makeRMDS(uid, uid).IsValidAndSigned(codec, crypto)
+	require.NoError(t, err)
+	err = makeRMDS(uid, reader).IsValidAndSigned(codec, crypto)
+	require.NoError(t, err)
+
+	err = makeRMDS(uid, outsider).IsValidAndSigned(codec, crypto)
+	require.Equal(t, InvalidLastModifyingUserError{outsider}, err)
+
+	// Only writers may be the last modifying writer.
+	err = makeRMDS(reader, reader).IsValidAndSigned(codec, crypto)
+	require.Equal(t, InvalidLastModifyingWriterError{reader}, err)
+}
+
+func TestVerifyRMDSSignedWhileKeyValid(t *testing.T) {
+	revokeTime := time.Now()
+	kbpki, uid, localUsers := makeTestKBPKIClientWithRevokedKey(
+		t, revokeTime)
+	ctx := context.Background()
+
+	var revokedKey VerifyingKey
+	for k := range localUsers[0].RevokedVerifyingKeys {
+		revokedKey = k
+		break
+	}
+	validKey := localUsers[0].VerifyingKeys[0]
+
+	md := &BareRootMetadataV2{}
+	md.SetLastModifyingWriter(uid)
+	md.SetLastModifyingUser(uid)
+	md.SetWriterMetadataSigInfo(SignatureInfo{VerifyingKey: revokedKey})
+	rmds := &RootMetadataSigned{
+		MD:      md,
+		SigInfo: SignatureInfo{VerifyingKey: revokedKey},
+	}
+
+	// Recorded by the server before the key was revoked.
+	err := VerifyRMDSSignedWhileKeyValid(
+		ctx, kbpki, rmds, revokeTime.Add(-10*time.Second))
+	require.NoError(t, err)
+
+	// Recorded by the server after the key was revoked.
+	err = VerifyRMDSSignedWhileKeyValid(
+		ctx, kbpki, rmds, revokeTime.Add(10*time.Second))
+	require.IsType(t, KeyNotFoundError{}, err)
+
+	// Even if only the writer metadata was signed with the
+	// revoked key.
+	rmds.SigInfo.VerifyingKey = validKey
+	err = VerifyRMDSSignedWhileKeyValid(
+		ctx, kbpki, rmds, revokeTime.Add(10*time.Second))
+	require.IsType(t, KeyNotFoundError{}, err)
+
+	// Unless the writer metadata was copied from an earlier
+	// revision.
+	md.SetWriterMetadataCopiedBit()
+	err = VerifyRMDSSignedWhileKeyValid(
+		ctx, kbpki, rmds, revokeTime.Add(10*time.Second))
+	require.NoError(t, err)
+}
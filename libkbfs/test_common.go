@@ -5,6 +5,8 @@
 package libkbfs
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
@@ -49,6 +51,91 @@ func RandomBlockID() BlockID {
 	return BlockID{h}
 }
 
+// deterministicBlockIDCrypto wraps a Crypto, replacing the hashing
+// used for permanent block IDs with a deterministic sequence, so that
+// tests can predict which blocks get new IDs. The first distinct
+// buffer passed to MakePermanentBlockID gets the first ID in the
+// sequence, the next distinct buffer gets the next one, and so on;
+// the same buffer always gets the same ID.
+type deterministicBlockIDCrypto struct {
+	Crypto
+
+	lock sync.Mutex
+	ids  map[RawDefaultHash]BlockID
+	next uint64
+}
+
+func newDeterministicBlockIDCrypto(crypto Crypto) *deterministicBlockIDCrypto {
+	return &deterministicBlockIDCrypto{
+		Crypto: crypto,
+		ids:    make(map[RawDefaultHash]BlockID),
+	}
+}
+
+// blockIDForTesting returns the i-th block ID in the deterministic
+// sequence, starting from 1.
+func (c *deterministicBlockIDCrypto) blockIDForTesting(i uint64) BlockID {
+	var dh RawDefaultHash
+	binary.BigEndian.PutUint64(dh[:8], i)
+	h, err := HashFromRaw(DefaultHashType, dh[:])
+	if err != nil {
+		panic(err)
+	}
+	return BlockID{h}
+}
+
+// assignedCount returns how many block IDs have been assigned so far.
+func (c *deterministicBlockIDCrypto) assignedCount() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.next
+}
+
+// MakePermanentBlockID implements the Crypto interface for
+// deterministicBlockIDCrypto.
+func (c *deterministicBlockIDCrypto) MakePermanentBlockID(
+	encodedEncryptedData []byte) (BlockID, error) {
+	key := RawDefaultHash(sha256.Sum256(encodedEncryptedData))
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if id, ok := c.ids[key]; ok {
+		return id, nil
+	}
+	c.next++
+	id := c.blockIDForTesting(c.next)
+	c.ids[key] = id
+	return id, nil
+}
+
+// VerifyBlockID implements the Crypto interface for
+// deterministicBlockIDCrypto.
+func (c *deterministicBlockIDCrypto) VerifyBlockID(
+	encodedEncryptedData []byte, id BlockID) error {
+	expectedID, err := c.MakePermanentBlockID(encodedEncryptedData)
+	if err != nil {
+		return err
+	}
+	if id != expectedID {
+		return fmt.Errorf(
+			"Block ID mismatch: expected %s, got %s", expectedID, id)
+	}
+	return nil
+}
+
+// installDeterministicBlockIDsForTesting makes the given config use
+// deterministic permanent block IDs (see deterministicBlockIDCrypto),
+// and replaces its block server with an in-memory one that validates
+// block IDs the same way. It must be called before any blocks are
+// put.
+func installDeterministicBlockIDsForTesting(
+	config *ConfigLocal) *deterministicBlockIDCrypto {
+	crypto := newDeterministicBlockIDCrypto(config.Crypto())
+	config.SetCrypto(crypto)
+	config.BlockServer().Shutdown()
+	config.SetBlockServer(NewBlockServerMemory(config))
+	return crypto
+}
+
 func fakeMdID(b byte) MdID {
 	dh := RawDefaultHash{b}
 	h, err := HashFromRaw(DefaultHashType, dh[:])
@@ -68,10 +155,54 @@ func setTestLogger(config Config, t logger.TestLogBackend) {
 	config.SetLoggerMaker(testLoggerMaker(t))
 }
 
+// TestConfigOption customizes a config made by
+// MakeTestConfigOrBustWithOpts. It's applied after all the defaults
+// are set up.
+type TestConfigOption func(config *ConfigLocal)
+
+// TestConfigBGFlush returns a TestConfigOption that turns background
+// flushing back on.
+func TestConfigBGFlush() TestConfigOption {
+	return func(config *ConfigLocal) {
+		config.SetDoBackgroundFlushes(true)
+	}
+}
+
+// TestConfigQRPeriod returns a TestConfigOption that sets the quota
+// reclamation period, which is 0 (i.e., no automatic reclamation) by
+// default.
+func TestConfigQRPeriod(period time.Duration) TestConfigOption {
+	return func(config *ConfigLocal) {
+		config.qrPeriod = period
+	}
+}
+
+// TestConfigClock returns a TestConfigOption that sets the clock.
+func TestConfigClock(clock Clock) TestConfigOption {
+	return func(config *ConfigLocal) {
+		config.SetClock(clock)
+	}
+}
+
+// TestConfigBlockSplitter returns a TestConfigOption that sets the
+// block splitter.
+func TestConfigBlockSplitter(bsplit BlockSplitter) TestConfigOption {
+	return func(config *ConfigLocal) {
+		config.SetBlockSplitter(bsplit)
+	}
+}
+
 // MakeTestConfigOrBust creates and returns a config suitable for
 // unit-testing with the given list of users.
 func MakeTestConfigOrBust(t logger.TestLogBackend,
 	users ...libkb.NormalizedUsername) *ConfigLocal {
+	return MakeTestConfigOrBustWithOpts(t, nil, users...)
+}
+
+// MakeTestConfigOrBustWithOpts is like MakeTestConfigOrBust, but
+// applies the given options to the config before returning it.
+func MakeTestConfigOrBustWithOpts(t logger.TestLogBackend,
+	opts []TestConfigOption, users ...libkb.NormalizedUsername) *ConfigLocal {
 	config := NewConfigLocal()
 	setTestLogger(config, t)
 
@@ -79,7 +210,11 @@ func MakeTestConfigOrBust(t logger.TestLogBackend,
 	config.SetKBFSOps(kbfsOps)
 	config.SetNotifier(kbfsOps)
 
-	config.SetBlockSplitter(&BlockSplitterSimple{64 * 1024, 8 * 1024})
+	bsplit, err := NewBlockSplitterSimpleExact(64*1024, 8*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.SetBlockSplitter(bsplit)
 	config.SetKeyManager(NewKeyManagerStandard(config))
 	config.SetMDOps(NewMDOpsStandard(config))
 
@@ -178,6 +313,10 @@ func MakeTestConfigOrBust(t logger.TestLogBackend,
 	configs := []Config{config}
 	config.allKnownConfigsForTesting = &configs
 
+	for _, opt := range opts {
+		opt(config)
+	}
+
 	return config
 }
 
@@ -215,6 +354,7 @@ func ConfigAsUser(config *ConfigLocal, loggedInUser libkb.NormalizedUsername) *C
 	crypto := NewCryptoLocal(config, signingKey, cryptPrivateKey)
 	c.SetCrypto(crypto)
 	c.noBGFlush = config.noBGFlush
+	c.allowUnverifiedKeys = config.allowUnverifiedKeys
 
 	if s, ok := config.BlockServer().(*BlockServerRemote); ok {
 		blockServer := NewBlockServerRemote(c, s.RemoteAddress(), env.NewContext())
@@ -295,6 +435,55 @@ func AddNewKeysOrBust(t logger.TestLogBackend, rmd *RootMetadata, wkb TLFWriterK
 	}
 }
 
+// MakeTestHandleWithReaders makes a private BareTlfHandle with the
+// given writers and readers. It returns an error if a UID is both a
+// writer and a reader.
+func MakeTestHandleWithReaders(writers, readers []keybase1.UID) (
+	BareTlfHandle, error) {
+	isWriter := make(map[keybase1.UID]bool, len(writers))
+	for _, w := range writers {
+		isWriter[w] = true
+	}
+	for _, r := range readers {
+		if isWriter[r] {
+			return BareTlfHandle{}, fmt.Errorf(
+				"%s is both a writer and a reader", r)
+		}
+	}
+	return MakeBareTlfHandle(writers, readers, nil, nil, nil)
+}
+
+// FakeReaderCryptPublicKey returns the fake crypt public key that
+// AddReaderKeysOrBust adds for the given reader.
+func FakeReaderCryptPublicKey(reader keybase1.UID) CryptPublicKey {
+	return MakeFakeCryptPublicKeyOrBust("reader " + reader.String())
+}
+
+// AddReaderKeysOrBust adds a device key to rkb for each of the given
+// readers, namely FakeReaderCryptPublicKey(reader), along with a fake
+// ephemeral public key for them to share. It blows up if a reader
+// already has keys in rkb.
+func AddReaderKeysOrBust(t logger.TestLogBackend,
+	rkb *TLFReaderKeyBundle, readers ...keybase1.UID) {
+	if rkb.RKeys == nil {
+		rkb.RKeys = make(UserDeviceKeyInfoMap)
+	}
+	ePubKeyIndex := -1 - len(rkb.TLFReaderEphemeralPublicKeys)
+	rkb.TLFReaderEphemeralPublicKeys = append(
+		rkb.TLFReaderEphemeralPublicKeys,
+		MakeTLFEphemeralPublicKey([32]byte{byte(-ePubKeyIndex)}))
+	for _, r := range readers {
+		if _, ok := rkb.RKeys[r]; ok {
+			t.Fatalf("Reader %s already has keys", r)
+		}
+		rkb.RKeys[r] = DeviceKeyInfoMap{
+			FakeReaderCryptPublicKey(r).kid: TLFCryptKeyInfo{
+				EPubKeyIndex: ePubKeyIndex,
+			},
+		}
+	}
+}
+
 func keySaltForUserDevice(name libkb.NormalizedUsername,
 	index int) libkb.NormalizedUsername {
 	if index > 0 {
@@ -483,6 +672,20 @@ func RestartCRForTesting(baseCtx context.Context, config Config,
 	return nil
 }
 
+// CRCompletionChanForTesting returns a channel that will receive the
+// resolved revision the next time conflict resolution completes
+// successfully for the given folder-branch.
+func CRCompletionChanForTesting(config Config,
+	folderBranch FolderBranch) (<-chan MetadataRevision, error) {
+	kbfsOps, ok := config.KBFSOps().(*KBFSOpsStandard)
+	if !ok {
+		return nil, errors.New("Unexpected KBFSOps type")
+	}
+
+	ops := kbfsOps.getOpsNoAdd(folderBranch)
+	return ops.cr.notifyOnCompletion(), nil
+}
+
 // ForceQuotaReclamationForTesting kicks off quota reclamation under
 // the given config, for the given folder-branch.
 func ForceQuotaReclamationForTesting(config Config,
@@ -512,6 +715,14 @@ func newTestClockAndTimeNow() (*TestClock, time.Time) {
 	return &TestClock{t: t0}, t0
 }
 
+// NewTestClockAtUnix returns a TestClock set to the given number of
+// seconds since the Unix epoch, in UTC, for tests that depend on
+// exactly what time it is, e.g. to check dates formatted into
+// conflict names.
+func NewTestClockAtUnix(sec int64) *TestClock {
+	return &TestClock{t: time.Unix(sec, 0).UTC()}
+}
+
 // Now implements the Clock interface for TestClock.
 func (tc *TestClock) Now() time.Time {
 	tc.l.Lock()
@@ -533,6 +744,50 @@ func (tc *TestClock) Add(d time.Duration) {
 	tc.t = tc.t.Add(d)
 }
 
+// AdvanceUntil moves the test clock forward to t. If the clock is
+// already at or past t, it's left alone, so it never goes backwards.
+func (tc *TestClock) AdvanceUntil(t time.Time) {
+	tc.l.Lock()
+	defer tc.l.Unlock()
+	if tc.t.Before(t) {
+		tc.t = t
+	}
+}
+
+// WaitForJournalLength polls the length of the MD journal for the
+// given TLF in jServer, backing off between polls, until it's equal
+// to target. It returns an error if ctx is done first. Errors reading
+// the length are treated as transient, but the last one is included
+// in the returned error.
+func WaitForJournalLength(ctx context.Context, jServer *JournalServer,
+	tlfID TlfID, target int) error {
+	const maxBackoff = 100 * time.Millisecond
+	backoff := time.Millisecond
+	for {
+		length, err := jServer.mdJournalLength(tlfID)
+		if err == nil && length == uint64(target) {
+			return nil
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			if err != nil {
+				return fmt.Errorf("Timed out waiting for journal "+
+					"length %d: %v (last error: %v)",
+					target, ctx.Err(), err)
+			}
+			return fmt.Errorf("Timed out waiting for journal "+
+				"length %d, at %d: %v", target, length, ctx.Err())
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
 // CheckConfigAndShutdown shuts down the given config, but fails the
 // test if there's an error.
 func CheckConfigAndShutdown(t logger.TestLogBackend, config Config) {
@@ -0,0 +1,91 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakeTestConfigOrBustWithOpts(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown()
+	require.False(t, config.DoBackgroundFlushes())
+	require.Equal(t, time.Duration(0), config.QuotaReclamationPeriod())
+
+	clock := newTestClockNow()
+	bsplit, err := NewBlockSplitterSimpleExact(1024, 512)
+	require.NoError(t, err)
+	config2 := MakeTestConfigOrBustWithOpts(t, []TestConfigOption{
+		TestConfigBGFlush(),
+		TestConfigQRPeriod(time.Hour),
+		TestConfigClock(clock),
+		TestConfigBlockSplitter(bsplit),
+	}, "test_user")
+	defer config2.Shutdown()
+	require.True(t, config2.DoBackgroundFlushes())
+	require.Equal(t, time.Hour, config2.QuotaReclamationPeriod())
+	require.Equal(t, clock, config2.Clock())
+	require.Equal(t, bsplit, config2.BlockSplitter())
+}
+
+func TestTestClockAtUnix(t *testing.T) {
+	// Noon on 2016-01-02, UTC.
+	clock := NewTestClockAtUnix(1451736000)
+	require.Equal(t, "2016-01-02 12:00:00",
+		clock.Now().Format("2006-01-02 15:04:05"))
+
+	// Advancing moves the clock forward, but never backwards.
+	target := clock.Now().Add(36 * time.Hour)
+	clock.AdvanceUntil(target)
+	require.Equal(t, target, clock.Now())
+	clock.AdvanceUntil(target.Add(-time.Hour))
+	require.Equal(t, target, clock.Now())
+
+	cr := WriterDeviceDateConflictRenamer{}
+	require.Equal(t, "x.conflicted (alice's laptop copy 2016-01-04).txt",
+		cr.ConflictRenameHelper(clock.Now(), "alice", "laptop", "x.txt"))
+}
+
+func TestMakeTestHandleWithReaders(t *testing.T) {
+	w1, w2 := keybase1.MakeTestUID(1), keybase1.MakeTestUID(2)
+	r1, r2 := keybase1.MakeTestUID(3), keybase1.MakeTestUID(4)
+
+	h, err := MakeTestHandleWithReaders(
+		[]keybase1.UID{w2, w1}, []keybase1.UID{r2, r1})
+	require.NoError(t, err)
+	require.Equal(t, []keybase1.UID{w1, w2}, h.Writers)
+	require.Equal(t, []keybase1.UID{r1, r2}, h.Readers)
+	require.True(t, h.IsReader(r1))
+	require.False(t, h.IsWriter(r1))
+
+	_, err = MakeTestHandleWithReaders(
+		[]keybase1.UID{w1, w2}, []keybase1.UID{r1, w2})
+	require.Error(t, err)
+
+	// Give the readers keys, in two batches.
+	rmd := NewRootMetadata()
+	err = rmd.Update(FakeTlfID(1, false), h)
+	require.NoError(t, err)
+	rkb := NewEmptyTLFReaderKeyBundle()
+	AddReaderKeysOrBust(t, &rkb, r1)
+	AddReaderKeysOrBust(t, &rkb, r2)
+	AddNewKeysOrBust(t, rmd, NewEmptyTLFWriterKeyBundle(), rkb)
+
+	for i, r := range []keybase1.UID{r1, r2} {
+		ePubKey, _, _, ok, err := rmd.bareMd.GetTLFCryptKeyParams(
+			rmd.LatestKeyGeneration(), r, FakeReaderCryptPublicKey(r))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, rkb.TLFReaderEphemeralPublicKeys[i], ePubKey)
+	}
+	_, _, _, ok, err := rmd.bareMd.GetTLFCryptKeyParams(
+		rmd.LatestKeyGeneration(), w1, FakeReaderCryptPublicKey(w1))
+	require.NoError(t, err)
+	require.False(t, ok)
+}
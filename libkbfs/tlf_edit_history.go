@@ -230,7 +230,10 @@ func (teh *TlfEditHistory) updateRmds(rmds []ImmutableRootMetadata,
 
 func (teh *TlfEditHistory) calculateEditCounts(ctx context.Context,
 	rmds []ImmutableRootMetadata) (TlfWriterEdits, *crChains, error) {
-	chains, err := newCRChains(ctx, teh.config, rmds, &teh.fbo.blocks, false)
+	winfos := newWriterInfoCache(teh.config,
+		writerInfoCacheCapacityDefault, teh.config.WriterInfoCacheTTL())
+	chains, err := newCRChains(
+		ctx, teh.config, rmds, &teh.fbo.blocks, false, winfos)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -0,0 +1,77 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	keybase1 "github.com/keybase/client/go/protocol"
+	"golang.org/x/net/context"
+)
+
+const (
+	// writerInfoCacheCapacityDefault is the default number of
+	// writer infos a writerInfoCache holds.
+	writerInfoCacheCapacityDefault = 100
+	// writerInfoCacheTTLDefault is the default time after which a
+	// writerInfoCache looks a writer info up again, e.g. to pick up
+	// a changed device name.
+	writerInfoCacheTTLDefault = 10 * time.Minute
+)
+
+type writerInfoCacheKey struct {
+	uid keybase1.UID
+	kid keybase1.KID
+}
+
+type writerInfoCacheEntry struct {
+	winfo     writerInfo
+	fetchedAt time.Time
+}
+
+// writerInfoCache is an LRU cache of writer infos, keyed by UID and
+// KID, so that conflict resolution doesn't have to load the same
+// user for every op they wrote. Entries expire after a TTL, measured
+// with the config's clock. It is goroutine-safe.
+type writerInfoCache struct {
+	config Config
+	ttl    time.Duration
+	lru    *lru.Cache
+}
+
+// newWriterInfoCache constructs a new writerInfoCache holding at
+// most capacity writer infos, each for at most ttl.
+func newWriterInfoCache(
+	config Config, capacity int, ttl time.Duration) *writerInfoCache {
+	cache, err := lru.New(capacity)
+	if err != nil {
+		panic(err.Error())
+	}
+	return &writerInfoCache{config, ttl, cache}
+}
+
+// get returns the writer info for the given UID and KID, from the
+// cache if it has an unexpired entry for them.
+func (c *writerInfoCache) get(ctx context.Context, uid keybase1.UID,
+	kid keybase1.KID) (writerInfo, error) {
+	key := writerInfoCacheKey{uid, kid}
+	now := c.config.Clock().Now()
+	if entry, ok := c.lru.Get(key); ok {
+		if entry, ok := entry.(writerInfoCacheEntry); ok &&
+			now.Sub(entry.fetchedAt) < c.ttl {
+			return entry.winfo, nil
+		}
+	}
+
+	// Concurrent misses for the same key may both do the lookup,
+	// which is harmless.
+	winfo, err := newWriterInfo(ctx, c.config, uid, kid)
+	if err != nil {
+		return writerInfo{}, err
+	}
+	c.lru.Add(key, writerInfoCacheEntry{winfo, now})
+	return winfo, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// countingKeybaseService counts the calls to LoadUserPlusKeys.
+type countingKeybaseService struct {
+	KeybaseService
+
+	lock  sync.Mutex
+	loads int
+}
+
+func (k *countingKeybaseService) LoadUserPlusKeys(
+	ctx context.Context, uid keybase1.UID) (UserInfo, error) {
+	func() {
+		k.lock.Lock()
+		defer k.lock.Unlock()
+		k.loads++
+	}()
+	return k.KeybaseService.LoadUserPlusKeys(ctx, uid)
+}
+
+func (k *countingKeybaseService) getLoads() int {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.loads
+}
+
+func TestWriterInfoCache(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "u1", "u2")
+	defer config.Shutdown()
+	config2 := ConfigAsUser(config, "u2")
+	defer config2.Shutdown()
+	clock := NewTestClockAtUnix(1451736000)
+	config.SetClock(clock)
+	kbs := &countingKeybaseService{KeybaseService: config.KeybaseService()}
+	config.SetKeybaseService(kbs)
+
+	ctx := context.Background()
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	_, uid2, err := config2.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	kid, err := config.KBPKI().GetCurrentVerifyingKey(ctx)
+	require.NoError(t, err)
+	expected, err := newWriterInfo(ctx, config, uid, kid.KID())
+	require.NoError(t, err)
+	require.Equal(t, 1, kbs.getLoads())
+
+	cache := newWriterInfoCache(config, 1, time.Minute)
+
+	// Concurrent lookups are fine, and later ones are served
+	// from the cache.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			winfo, err := cache.get(ctx, uid, kid.KID())
+			require.NoError(t, err)
+			require.Equal(t, expected, winfo)
+		}()
+	}
+	wg.Wait()
+	loads := kbs.getLoads()
+	require.True(t, loads > 1)
+	winfo, err := cache.get(ctx, uid, kid.KID())
+	require.NoError(t, err)
+	require.Equal(t, expected, winfo)
+	require.Equal(t, loads, kbs.getLoads())
+
+	// An expired entry is looked up again.
+	clock.Add(time.Minute)
+	_, err = cache.get(ctx, uid, kid.KID())
+	require.NoError(t, err)
+	require.Equal(t, loads+1, kbs.getLoads())
+
+	// Only one entry fits, so looking up another writer evicts
+	// the first one.
+	_, err = cache.get(ctx, uid2, kid.KID())
+	require.NoError(t, err)
+	_, err = cache.get(ctx, uid, kid.KID())
+	require.NoError(t, err)
+	require.Equal(t, loads+3, kbs.getLoads())
+}
@@ -842,15 +842,15 @@ func TestCrConflictUnmergedRenamedDirDouble(t *testing.T) {
 			write("a/b/f", "uh oh"),
 			rename("a/b", "a/d"),
 			reenableUpdates(),
-			lsdir("a/", m{"d$": "DIR", crnameEsc("d", bob) + "$": "DIR", crnameEsc("d", bob) + ` \(1\)`: "DIR"}),
+			lsdir("a/", m{"d$": "DIR", crnameEsc("d", bob) + "$": "DIR", crnameNEsc("d", bob, 2): "DIR"}),
 			lsdir("a/d", m{"e": "FILE"}),
-			lsdir(crname("a/d", bob)+" (1)", m{"c": "FILE", "f": "FILE"}),
+			lsdir(crnameN("a/d", bob, 2), m{"c": "FILE", "f": "FILE"}),
 			read("a/d/e", "world"),
 		),
 		as(alice,
-			lsdir("a/", m{"d$": "DIR", crnameEsc("d", bob) + "$": "DIR", crnameEsc("d", bob) + ` \(1\)`: "DIR"}),
+			lsdir("a/", m{"d$": "DIR", crnameEsc("d", bob) + "$": "DIR", crnameNEsc("d", bob, 2): "DIR"}),
 			lsdir("a/d", m{"e": "FILE"}),
-			lsdir(crname("a/d", bob)+" (1)", m{"c": "FILE", "f": "FILE"}),
+			lsdir(crnameN("a/d", bob, 2), m{"c": "FILE", "f": "FILE"}),
 			read("a/d/e", "world"),
 		),
 	)
@@ -890,16 +890,16 @@ func TestCrConflictWriteFileDouble(t *testing.T) {
 		as(bob, noSync(),
 			write("a/b", "uh oh again!"),
 			reenableUpdates(),
-			lsdir("a/", m{"b$": "FILE", crnameEsc("b", bob) + "$": "FILE", crnameEsc("b", bob) + ` \(1\)`: "FILE"}),
+			lsdir("a/", m{"b$": "FILE", crnameEsc("b", bob) + "$": "FILE", crnameNEsc("b", bob, 2): "FILE"}),
 			read("a/b", "another write"),
 			read(crname("a/b", bob), "uh oh"),
-			read(crname("a/b", bob)+" (1)", "uh oh again!"),
+			read(crnameN("a/b", bob, 2), "uh oh again!"),
 		),
 		as(alice,
-			lsdir("a/", m{"b$": "FILE", crnameEsc("b", bob) + "$": "FILE", crnameEsc("b", bob) + ` \(1\)`: "FILE"}),
+			lsdir("a/", m{"b$": "FILE", crnameEsc("b", bob) + "$": "FILE", crnameNEsc("b", bob, 2): "FILE"}),
 			read("a/b", "another write"),
 			read(crname("a/b", bob), "uh oh"),
-			read(crname("a/b", bob)+" (1)", "uh oh again!"),
+			read(crnameN("a/b", bob, 2), "uh oh again!"),
 		),
 	)
 }
@@ -938,16 +938,16 @@ func TestCrConflictWriteFileDoubleWithExtensions(t *testing.T) {
 		as(bob, noSync(),
 			write("a/file.tar.gz", "uh oh again!"),
 			reenableUpdates(),
-			lsdir("a/", m{"file.tar.gz$": "FILE", crnameEsc("file.tar.gz", bob) + "$": "FILE", crnameEsc("file", bob) + ` \(1\).tar.gz`: "FILE"}),
+			lsdir("a/", m{"file.tar.gz$": "FILE", crnameEsc("file.tar.gz", bob) + "$": "FILE", crnameNEsc("file.tar.gz", bob, 2): "FILE"}),
 			read("a/file.tar.gz", "another write"),
 			read(crname("a/file.tar.gz", bob), "uh oh"),
-			read(crname("a/file", bob)+" (1).tar.gz", "uh oh again!"),
+			read(crnameN("a/file.tar.gz", bob, 2), "uh oh again!"),
 		),
 		as(alice,
-			lsdir("a/", m{"file.tar.gz$": "FILE", crnameEsc("file.tar.gz", bob) + "$": "FILE", crnameEsc("file", bob) + ` \(1\).tar.gz`: "FILE"}),
+			lsdir("a/", m{"file.tar.gz$": "FILE", crnameEsc("file.tar.gz", bob) + "$": "FILE", crnameNEsc("file.tar.gz", bob, 2): "FILE"}),
 			read("a/file.tar.gz", "another write"),
 			read(crname("a/file.tar.gz", bob), "uh oh"),
-			read(crname("a/file", bob)+" (1).tar.gz", "uh oh again!"),
+			read(crnameN("a/file.tar.gz", bob, 2), "uh oh again!"),
 		),
 	)
 }
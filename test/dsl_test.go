@@ -774,6 +774,20 @@ func crnameEsc(path string, user username) string {
 	return crnameAtTimeEsc(path, user, 0)
 }
 
+// crnameN returns the name of the nth conflict file for the same path
+// and user, which gets a counter since the earlier names are taken.
+func crnameN(path string, user username, n int) string {
+	name := crname(path, user)
+	i := strings.LastIndex(name, ")")
+	return name[:i] + fmt.Sprintf(" #%d", n) + name[i:]
+}
+
+// crnameNEsc returns the name of the nth conflict file for the same
+// path and user with regular expression escapes.
+func crnameNEsc(path string, user username, n int) string {
+	return regexp.QuoteMeta(crnameN(path, user, n))
+}
+
 type silentBenchmark struct{ testing.TB }
 
 func (silentBenchmark) Log(args ...interface{})                 {}